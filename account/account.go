@@ -18,96 +18,343 @@ package account
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	pb "github.com/conseweb/common/protos"
-	"github.com/conseweb/common/semaphore"
 	"github.com/conseweb/supervisor/account/store"
 	"github.com/conseweb/supervisor/challenge"
-	"github.com/looplab/fsm"
+	"github.com/conseweb/supervisor/clock"
 	"github.com/op/go-logging"
-	"github.com/spf13/viper"
 )
 
 const (
-	default_storage_backend = "rocksdb"
+	persist_queue_size = 1024
 )
 
 var (
-	logger     *logging.Logger
-	once       *sync.Once
-	controller *FarmerAccountController
+	logger = logging.MustGetLogger("supervisor")
 )
 
-func init() {
-	logger = logging.MustGetLogger("supervisor")
-	once = &sync.Once{}
+type FarmerAccountController struct {
+	accountStorage store.Storage
+	accountTree    *AccountTree
+	// deadlines of handlers in account tree, ping, conquer and suspension ones
+	timer      *deadlineTimer
+	challenger *challenge.Challenger
+	reward     RewardPolicy
+	fsm        *FarmerFSMDef
+	hooks      *Hooks
+	journal    *Journal
+	clock      clock.Clock
+	cfg        *Config
+	l          *sync.RWMutex
+	stop       chan struct{}
+	stopOnce   *sync.Once
+	// a standby controller keeps and checks no handlers, another supervisor of the cluster serves farmers
+	standby bool
+	// farmer accounts waiting to be persisted, in the order they changed
+	persistQueue chan persistItem
+	persisted    chan struct{}
+	// latest bytes of accounts still in persist queue, by key, so that a farmer taken out of account tree
+	// isn't loaded from storage before its last change makes it there
+	unpersisted  map[string]*unpersistedFarmer
+	unpersistedL *sync.Mutex
+	// updates writing handlers' runtime state out of the lock, storage isn't closed until they are done
+	writing *sync.WaitGroup
+}
+
+type unpersistedFarmer struct {
+	value  []byte
+	queued int
 }
 
-// read config file and init a storage backend
-func getBackendStorage() (storage store.Storage) {
-	backend := default_storage_backend
-	if viper.GetString("account.store.backend") != "" {
-		backend = viper.GetString("account.store.backend")
+// an item with snapshot set is not persisted, a snapshot is taken once every account queued before it is
+type persistItem struct {
+	key      []byte
+	value    []byte
+	snapshot chan<- snapshotTaken
+	// told the error of persisting, if not nil
+	done chan<- error
+}
+
+type snapshotTaken struct {
+	snap store.Snapshot
+	err  error
+}
+
+// NewFarmerAccountController creates a controller upon the storage,
+// challenges are issued and verified by challenger,
+// balances are decided by cfg's reward policy, states by cfg's state machine,
+// handlers which were online before supervisor stopped are restored into account tree
+func NewFarmerAccountController(storage store.Storage, challenger *challenge.Challenger, cfg *Config) *FarmerAccountController {
+	reward := cfg.RewardPolicy
+	if reward == nil {
+		reward = NewRewardPolicy(cfg.Reward)
+	}
+	fsmDef, err := NewFarmerFSMDef(cfg.FSM)
+	if err != nil {
+		logger.Errorf("%v, use built-in farmer state machine instead", err)
+		fsmDef, _ = NewFarmerFSMDef(nil)
 	}
 
-	// use rocksdb as backend
-	if backend == "rocksdb" {
-		dbpath := viper.GetString("account.store.rocksdb.dbpath")
-		if dbpath == "" {
-			logger.Panic("using rocksdb as backend, but not specified dbpath")
-		}
+	ctr := &FarmerAccountController{
+		accountStorage: storage,
+		accountTree:    NewAccountTree(),
+		challenger:     challenger,
+		reward:         reward,
+		fsm:            fsmDef,
+		hooks:          NewHooks(),
+		journal:        NewJournal(storage),
+		clock:          clock.OrReal(cfg.Clock),
+		cfg:            cfg,
+		l:              &sync.RWMutex{},
+		stop:           make(chan struct{}),
+		stopOnce:       &sync.Once{},
+		persistQueue:   make(chan persistItem, persist_queue_size),
+		persisted:      make(chan struct{}),
+		unpersisted:    make(map[string]*unpersistedFarmer),
+		unpersistedL:   &sync.Mutex{},
+		writing:        &sync.WaitGroup{},
+	}
+	ctr.journal.clock = ctr.clock
+	ctr.timer = newDeadlineTimer(ctr.clock, cfg.CheckWorkers, ctr.checkHandler)
+	ctr.restoreHandlers(nil)
+	go ctr.persistFarmers()
 
-		var err error
-		storage, err = store.NewStore(backend, dbpath)
-		if err != nil {
-			logger.Panic(err)
-		}
+	return ctr
+}
+
+// farmer account state machine, shared by all handlers
+func (ctr *FarmerAccountController) FSM() *FarmerFSMDef {
+	return ctr.fsm
+}
+
+// registry of hooks on farmer's transitions and balance changes
+func (ctr *FarmerAccountController) Hooks() *Hooks {
+	return ctr.hooks
+}
+
+// balance journal, farmer's balance is the fold of its journal
+func (ctr *FarmerAccountController) Journal() *Journal {
+	return ctr.journal
+}
+
+// journal is ahead of a persisted account if supervisor stopped before the account persisted
+func (ctr *FarmerAccountController) loadBalance(account *pb.FarmerAccount) {
+	balance, ok, err := ctr.journal.Balance(account.FarmerID)
+	if err != nil {
+		logger.Errorf("load farmer(%s) balance journal err: %v", account.FarmerID, err)
+		return
+	}
+	if ok && balance != account.Balance {
+		logger.Warningf("farmer(%s) balance %d, journal ends with %d, take the journal one", account.FarmerID, account.Balance, balance)
+		account.Balance = balance
+	}
+}
+
+// AdjustBalance sets farmer's balance by hand, memo tells why, recorded in farmer's journal
+func (ctr *FarmerAccountController) AdjustBalance(farmerId string, balance uint32, memo string) error {
+	h, err := ctr.NewFarmerHandler(farmerId)
+	if err != nil {
+		return err
 	}
 
-	return storage
+	if err := h.postBalance(pb.BalanceReason_ADMIN_ADJUSTMENT, balance, nil, memo); err != nil {
+		return err
+	}
+
+	return ctr.UpdateFarmerHandler(h)
 }
 
-type FarmerAccountController struct {
-	accountStorage store.Storage
-	accountTree    *AccountTree
-	l              *sync.RWMutex
+// SuspendFarmer takes farmer out of service for d by hand, reason tells why
+func (ctr *FarmerAccountController) SuspendFarmer(farmerId string, d time.Duration, reason string) error {
+	h, err := ctr.NewFarmerHandler(farmerId)
+	if err != nil {
+		return err
+	}
+
+	return h.Suspend(d, reason)
 }
 
-func getController() *FarmerAccountController {
-	once.Do(func() {
-		if controller != nil {
-			return
-		}
+// BanFarmer takes farmer out of service by hand, until LiftFarmer
+func (ctr *FarmerAccountController) BanFarmer(farmerId string, reason string) error {
+	h, err := ctr.NewFarmerHandler(farmerId)
+	if err != nil {
+		return err
+	}
 
-		controller = &FarmerAccountController{
-			accountStorage: getBackendStorage(),
-			accountTree:    NewAccountTree(),
-			l:              &sync.RWMutex{},
-		}
+	return h.Ban(reason)
+}
 
-		go controller.checkHandlers()
-	})
+// LiftFarmer puts a suspended or banned farmer back to OFFLINE
+func (ctr *FarmerAccountController) LiftFarmer(farmerId string) error {
+	h, err := ctr.NewFarmerHandler(farmerId)
+	if err != nil {
+		return err
+	}
+
+	return h.Lift()
+}
+
+// ForceOffline takes farmer offline by hand, as if it went offline itself
+func (ctr *FarmerAccountController) ForceOffline(farmerId string) error {
+	h, err := ctr.servedHandler(farmerId)
+	if err != nil {
+		return err
+	}
+
+	return h.OffLine()
+}
+
+// ClearChallenge drops farmer's pending challenge by hand, false if there is none
+func (ctr *FarmerAccountController) ClearChallenge(farmerId string) (bool, error) {
+	h, err := ctr.servedHandler(farmerId)
+	if err != nil {
+		return false, err
+	}
+
+	if !h.clearChallenge() {
+		return false, nil
+	}
+	return true, ctr.UpdateFarmerHandler(h)
+}
+
+// FarmerEvent fires event on farmer's state machine by hand, for transitions added by config
+func (ctr *FarmerAccountController) FarmerEvent(farmerId, event string) error {
+	h, err := ctr.NewFarmerHandler(farmerId)
+	if err != nil {
+		return err
+	}
 
-	return controller
+	return h.Event(event)
+}
+
+// Start fires handlers' deadlines in background as they lapse, until controller closed
+func (ctr *FarmerAccountController) Start() {
+	ctr.timer.start(ctr.stop)
+}
+
+// SetStandby puts controller on standby, or back into service,
+// challenges of the handlers dropped on standby are left to whichever supervisor serves the farmers next,
+// handlers are restored from storage once back into service
+func (ctr *FarmerAccountController) SetStandby(standby bool) {
+	ctr.l.Lock()
+	ctr.standby = standby
+	ctr.l.Unlock()
+	ctr.DropHandlers(nil)
+	logger.Infof("farmer account controller standby: %v", standby)
+
+	if !standby {
+		ctr.restoreHandlers(nil)
+	}
 }
 
 // NewFarmer doesn't mean the farmer is already online
 // just stands for there is a farmer want to connect 2 supervisor
-func NewFarmerHandler(farmerId string) (*FarmerAccountHandler, error) {
-	return getController().NewFarmerHandler(farmerId)
-}
 func (ctr *FarmerAccountController) NewFarmerHandler(farmerId string) (handler *FarmerAccountHandler, err error) {
 	if farmerId == "" {
 		err = errors.New("farmerId is empty")
 		return
 	}
 
+	// 1. looking farmer from account tree, then from storage
+	if handler, err = ctr.FarmerHandler(farmerId); err == nil {
+		return
+	}
+
+	// 2 if can not load farmer account info from tree & storage, new a farmer account info
+	{
+		key := farmerId2Key(farmerId)
+		handler = &FarmerAccountHandler{ctr: ctr}
+		ctr.l.Lock()
+		handler.account = &pb.FarmerAccount{
+			FarmerID:         farmerId,
+			Balance:          0,
+			State:            pb.FarmerState_OFFLINE,
+			LastModifiedTime: clock.Stamp(ctr.clock.Now()),
+		}
+		handler.fsm = ctr.fsm.newFSM(handler, ctr.fsm.initial)
+		// put into account tree
+		ctr.accountTree.Put(key, handler)
+		ctr.scheduleHandler(key, handler)
+		if farmerBytes, err := farmerAccount2Bytes(handler.account); err == nil {
+			ctr.asyncPersistFarmerBytes([]byte(key), farmerBytes)
+		}
+		ctr.l.Unlock()
+
+		return handler, nil
+	}
+}
+
+// handler of a farmer in service, a farmer out of it isn't brought in
+func (ctr *FarmerAccountController) servedHandler(farmerId string) (*FarmerAccountHandler, error) {
+	ctr.l.RLock()
+	handler, err := ctr.accountTree.Get(farmerId2Key(farmerId))
+	ctr.l.RUnlock()
+	if err != nil {
+		if _, _, err := ctr.LoadFarmer(farmerId); err != nil {
+			return nil, err
+		}
+		return nil, ErrFarmerNotInService
+	}
+
+	return handler, nil
+}
+
+// LoadFarmer looks farmer up without bringing it into service, handler is nil if the farmer isn't in service,
+// ErrFarmerNotFound if supervisor never met the farmer
+func (ctr *FarmerAccountController) LoadFarmer(farmerId string) (account *pb.FarmerAccount, handler *FarmerAccountHandler, err error) {
+	if farmerId == "" {
+		return nil, nil, errors.New("farmerId is empty")
+	}
+
+	key := farmerId2Key(farmerId)
+	ctr.l.RLock()
+	handler, err = ctr.accountTree.Get(key)
+	var farmerBytes []byte
+	if err != nil {
+		farmerBytes, err = ctr.loadFarmerBytes(key)
+	}
+	ctr.l.RUnlock()
+	if handler != nil {
+		return handler.Account(), handler, nil
+	}
+	if err != nil || farmerBytes == nil {
+		return nil, nil, ErrFarmerNotFound
+	}
+
+	account, err = ctr.loadedAccount(farmerBytes)
+	return account, nil, err
+}
+
+// account as loaded from storage, in the state its farmer is brought into service in
+func (ctr *FarmerAccountController) loadedAccount(farmerBytes []byte) (*pb.FarmerAccount, error) {
+	account, err := bytes2FarmerAccount(farmerBytes)
+	if err != nil {
+		return nil, err
+	}
+	ctr.loadBalance(account)
+	account.FsmState = ctr.fsm.loadedState(account)
+	account.State = ctr.fsm.ReportAs(account.FsmState)
+
+	return account, nil
+}
+
+// FarmerHandler loads farmer's handler, bringing the farmer into service if it isn't,
+// ErrFarmerNotFound if supervisor never met the farmer
+func (ctr *FarmerAccountController) FarmerHandler(farmerId string) (handler *FarmerAccountHandler, err error) {
+	if farmerId == "" {
+		err = errors.New("farmerId is empty")
+		return
+	}
+
 	key := farmerId2Key(farmerId)
 	// 1. looking farmer from account tree
 	{
-		handler = &FarmerAccountHandler{}
 		ctr.l.RLock()
 		handler, err = ctr.accountTree.Get(key)
 		ctr.l.RUnlock()
@@ -116,161 +363,361 @@ func (ctr *FarmerAccountController) NewFarmerHandler(farmerId string) (handler *
 		}
 	}
 
-	tmpFsm := fsm.NewFSM(pb.FarmerState_OFFLINE.String(), fsm.Events{
-		{Name: "offline", Src: []string{pb.FarmerState_ONLINE.String(), pb.FarmerState_LOST.String()}, Dst: pb.FarmerState_OFFLINE.String()},
-		{Name: "online", Src: []string{pb.FarmerState_OFFLINE.String(), pb.FarmerState_LOST.String()}, Dst: pb.FarmerState_ONLINE.String()},
-		{Name: "lost", Src: []string{pb.FarmerState_ONLINE.String()}, Dst: pb.FarmerState_LOST.String()},
-	}, fsm.Callbacks{
-		"before_event": func(e *fsm.Event) {
-			handler.beforeEvent(e)
-		},
-	})
+	// 2. looking farmer from persist queue, then from storage, if found, put into account tree, and create fsm
+	var farmerBytes []byte
+	ctr.l.RLock()
+	farmerBytes, err = ctr.loadFarmerBytes(key)
+	ctr.l.RUnlock()
+	if err != nil || farmerBytes == nil {
+		return nil, ErrFarmerNotFound
+	}
 
-	// 2. looking farmer from storage, if found, put into account tree, and create fsm
-	{
-		handler = &FarmerAccountHandler{}
-		var farmerBytes []byte
+	handler = &FarmerAccountHandler{ctr: ctr}
+	if handler.account, err = ctr.loadedAccount(farmerBytes); err != nil {
+		return nil, err
+	}
+	handler.fsm = ctr.fsm.newFSM(handler, handler.account.FsmState)
+
+	ctr.l.Lock()
+	// put into account tree
+	ctr.accountTree.Put(key, handler)
+	ctr.scheduleHandler(key, handler)
+	ctr.l.Unlock()
+
+	return handler, nil
+}
+
+// InServiceFarmers returns handlers of farmers in service, whose id starts with prefix and is after after,
+// in one of states if any given, in order of id, up to limit, next is after of the next page, empty if no more
+func (ctr *FarmerAccountController) InServiceFarmers(prefix, after string, states []pb.FarmerState, limit int) (handlers []*FarmerAccountHandler, next string) {
+	ctr.l.RLock()
+	keys := ctr.accountTree.PrefixSearch(farmerId2Key(prefix))
+	ctr.l.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if key <= after {
+			continue
+		}
 		ctr.l.RLock()
-		farmerBytes, err = ctr.accountStorage.Get([]byte(key))
+		h, err := ctr.accountTree.Get(key)
 		ctr.l.RUnlock()
-		if err == nil {
-			handler.account, err = bytes2FarmerAccount(farmerBytes)
-			if err == nil {
-				handler.fsm = tmpFsm
-				handler.account.State = pb.FarmerState(pb.FarmerState_value[handler.fsm.Current()])
-
-				ctr.l.Lock()
-				// put into account tree
-				ctr.accountTree.Put(key, handler)
-				ctr.l.Unlock()
+		if err != nil || !h.inStates(states) {
+			continue
+		}
 
-				return
-			}
+		if len(handlers) == limit {
+			return handlers, handlers[limit-1].account.FarmerID
 		}
+		handlers = append(handlers, h)
 	}
 
-	// 3 if can not load farmer account info from tree & storage, new a farmer account info
-	{
-		handler = &FarmerAccountHandler{}
-		ctr.l.Lock()
-		handler.account = &pb.FarmerAccount{
-			FarmerID:         farmerId,
-			Balance:          0,
-			State:            pb.FarmerState_OFFLINE,
-			LastModifiedTime: time.Now().UnixNano(),
+	return handlers, ""
+}
+
+// StoredFarmers is like InServiceFarmers, but pages through every farmer account in storage,
+// accounts of farmers in service are taken from their handlers
+func (ctr *FarmerAccountController) StoredFarmers(prefix, after string, states []pb.FarmerState, limit int) (accounts []*pb.FarmerAccount, next string, err error) {
+	start := farmerId2Key(prefix)
+	if after != "" && after >= start {
+		start = after + "\x00"
+	}
+
+	var loadErr error
+	err = ctr.accountStorage.SeekCF(store.DefaultColumnFamily, []byte(start), func(key, value []byte) bool {
+		if !strings.HasPrefix(string(key), prefix) {
+			return false
 		}
-		handler.fsm = tmpFsm
-		// put into account tree
-		ctr.accountTree.Put(key, handler)
-		if farmerBytes, err := farmerAccount2Bytes(handler.account); err == nil {
-			ctr.asyncPersistFarmerBytes([]byte(key), farmerBytes)
+
+		ctr.l.RLock()
+		h, treeErr := ctr.accountTree.Get(string(key))
+		ctr.l.RUnlock()
+		var account *pb.FarmerAccount
+		if treeErr == nil {
+			account = h.Account()
+		} else {
+			if account, loadErr = ctr.loadedAccount(value); loadErr != nil {
+				return false
+			}
+		}
+		if !accountInStates(account, states) {
+			return true
 		}
-		ctr.l.Unlock()
 
-		return
+		if len(accounts) == limit {
+			next = accounts[limit-1].FarmerID
+			return false
+		}
+		accounts = append(accounts, account)
+		return true
+	})
+	if err == nil {
+		err = loadErr
 	}
-}
 
-func UpdateFarmerHandler(handler *FarmerAccountHandler) {
-	getController().UpdateFarmerHandler(handler)
+	return
 }
 
-func (ctr *FarmerAccountController) UpdateFarmerHandler(handler *FarmerAccountHandler) {
+// UpdateFarmerHandler puts handler's change into account tree and storage, an account is persisted in background,
+// unless cfg.SyncPersist, then the call returns once it is, failing if it isn't
+func (ctr *FarmerAccountController) UpdateFarmerHandler(handler *FarmerAccountHandler) error {
 	key := farmerId2Key(handler.account.FarmerID)
 
 	ctr.l.Lock()
-	if farmerBytes, err := farmerAccount2Bytes(handler.account); err == nil {
-		// save back 2 memory
-		if handler.account.State != pb.FarmerState_OFFLINE {
-			ctr.accountTree.Put(key, handler)
-		} else {
-			ctr.accountTree.Delete(key)
+	if handler.dropped {
+		// such as of a session, another supervisor may serve the farmer by now
+		ctr.l.Unlock()
+		logger.Debugf("farmer(%s) handler dropped, its update is ignored", handler.account.FarmerID)
+		return ctr.ignoredUpdate(errors.New("supervisor/account: farmer handler dropped"))
+	}
+	select {
+	case <-ctr.persisted:
+		// such as of a session dropped as supervisor stops, storage is closed by now
+		ctr.l.Unlock()
+		logger.Debugf("farmer(%s) updated after controller closed, the update is ignored", handler.account.FarmerID)
+		return ctr.ignoredUpdate(errors.New("supervisor/account: controller is closed"))
+	default:
+	}
+	farmerBytes, err := farmerAccount2Bytes(handler.account)
+	if err != nil {
+		ctr.l.Unlock()
+		return err
+	}
+	// save back 2 memory, a suspended handler stays in tree till its suspension lapses,
+	// a handler out of it has no runtime state to persist
+	var stateBytes []byte
+	if InService(handler.account.State) {
+		ctr.accountTree.Put(key, handler)
+		ctr.scheduleHandler(key, handler)
+		if stateBytes, err = handlerStateBytes(handler); err != nil {
+			ctr.l.Unlock()
+			return err
 		}
-
-		ctr.asyncPersistFarmerBytes([]byte(key), farmerBytes)
+	} else {
+		ctr.accountTree.Delete(key)
+		ctr.timer.CancelAll(key)
+		ctr.endSession(handler)
 	}
+	done := ctr.asyncPersistFarmerBytes([]byte(key), farmerBytes)
+	ctr.writing.Add(1)
 	ctr.l.Unlock()
+
+	// storage of a cluster takes a round trip to peers to write, nobody waits on the lock for it
+	err = ctr.persistHandlerState([]byte(key), stateBytes)
+	ctr.writing.Done()
+	if done == nil {
+		return nil
+	}
+	if persistErr := <-done; persistErr != nil {
+		return fmt.Errorf("supervisor/account: farmer account not persisted: %v", persistErr)
+	}
+	if err != nil {
+		return fmt.Errorf("supervisor/account: farmer handler state not persisted: %v", err)
+	}
+	return nil
 }
 
-// close the backend storage
-func Close() error {
-	return getController().Close()
+// an update ignored fails only the caller waiting for it to be persisted
+func (ctr *FarmerAccountController) ignoredUpdate(err error) error {
+	if ctr.cfg.SyncPersist {
+		return err
+	}
+	return nil
 }
+
+// stop the checker and hooks, close the backend storage
 func (ctr *FarmerAccountController) Close() error {
-	ctr.accountTree = nil
+	ctr.stopOnce.Do(func() {
+		close(ctr.stop)
+	})
+	// handlers being checked may still update and persist
+	ctr.timer.wait()
+	ctr.hooks.Close()
+
+	ctr.l.Lock()
+	// accounts queued make it to storage before it closes
+	select {
+	case <-ctr.persisted:
+	default:
+		close(ctr.persistQueue)
+		<-ctr.persisted
+	}
+	ctr.l.Unlock()
+	// nothing is updated once the queue closed, the ones updated before finish writing
+	ctr.writing.Wait()
 	return ctr.accountStorage.Close()
 }
 
-// save back 2 storage, async
-func (ctr *FarmerAccountController) asyncPersistFarmerBytes(farmerKey, farmerBytes []byte) {
-	go ctr.accountStorage.Set(farmerKey, farmerBytes)
+// save back 2 storage, async, callers hold ctr.l, so that nothing is queued once Close drained the queue,
+// with cfg.SyncPersist the error of persisting is told by the channel returned, nil otherwise
+func (ctr *FarmerAccountController) asyncPersistFarmerBytes(farmerKey, farmerBytes []byte) <-chan error {
+	ctr.unpersistedL.Lock()
+	farmer, ok := ctr.unpersisted[string(farmerKey)]
+	if !ok {
+		farmer = &unpersistedFarmer{}
+		ctr.unpersisted[string(farmerKey)] = farmer
+	}
+	farmer.value = farmerBytes
+	farmer.queued++
+	ctr.unpersistedL.Unlock()
+
+	item := persistItem{key: farmerKey, value: farmerBytes}
+	var done chan error
+	if ctr.cfg.SyncPersist {
+		done = make(chan error, 1)
+		item.done = done
+	}
+	ctr.persistQueue <- item
+	return done
 }
 
-// check handlers
-func (ctr *FarmerAccountController) checkHandlers() {
-	ticker := time.NewTicker(getControllerCheckInterval())
-	sema := semaphore.NewSemaphore(getControllerCheckWorkers())
+// farmer's account, the last one queued if it isn't persisted yet, caller must hold the lock
+func (ctr *FarmerAccountController) loadFarmerBytes(key string) ([]byte, error) {
+	ctr.unpersistedL.Lock()
+	farmer, ok := ctr.unpersisted[key]
+	ctr.unpersistedL.Unlock()
+	if ok {
+		return farmer.value, nil
+	}
 
-	for {
-		select {
-		case <-ticker.C:
-			logger.Infof("current farmer handler count: %d", ctr.accountTree.Len())
+	return ctr.accountStorage.Get([]byte(key))
+}
 
-			for _, key := range ctr.accountTree.Keys() {
-				sema.Acquire()
-				go func(key string) {
-					defer sema.Release()
+// persist queued accounts one by one, so that a later change of a farmer is never overwritten by an earlier one
+func (ctr *FarmerAccountController) persistFarmers() {
+	defer close(ctr.persisted)
 
-					h, err := ctr.accountTree.Get(key)
-					if err != nil {
-						logger.Errorf("get farmer handler err: %v", err)
-						return
-					}
+	for item := range ctr.persistQueue {
+		if item.snapshot != nil {
+			snap, err := ctr.accountStorage.(store.Snapshotter).Snapshot()
+			item.snapshot <- snapshotTaken{snap: snap, err: err}
+			continue
+		}
+		err := ctr.accountStorage.Set(item.key, item.value)
+		if err != nil {
+			logger.Errorf("persist farmer(%s) account err: %v", item.key, err)
+		}
 
-					// if handler's nextPingTime is before now, lostcount ++
-					if time.Unix(h.nextPingTime, 0).Before(time.Now()) {
-						h.lostCount++
-						h.Lost()
+		ctr.unpersistedL.Lock()
+		if farmer := ctr.unpersisted[string(item.key)]; farmer != nil {
+			if farmer.queued--; farmer.queued == 0 {
+				delete(ctr.unpersisted, string(item.key))
+			}
+		}
+		ctr.unpersistedL.Unlock()
+		if item.done != nil {
+			item.done <- err
+		}
+	}
+}
 
-						if h.lostCount >= viper.GetInt("farmer.ping.lostcount") {
-							h.OffLine()
-						}
+// Snapshot of the storage, which sees every farmer account changed before the call, and nothing written after it,
+// so that it can be backed up while supervisor keeps serving, it must be released once read
+func (ctr *FarmerAccountController) Snapshot() (store.Snapshot, error) {
+	if _, ok := ctr.accountStorage.(store.Snapshotter); !ok {
+		return nil, errors.New("supervisor/account: storage can't be snapshotted")
+	}
 
-						ctr.UpdateFarmerHandler(h)
-					}
+	taken := make(chan snapshotTaken, 1)
+	ctr.l.Lock()
+	select {
+	case <-ctr.persisted:
+		ctr.l.Unlock()
+		return nil, errors.New("supervisor/account: controller is closed")
+	default:
+		ctr.persistQueue <- persistItem{snapshot: taken}
+	}
+	ctr.l.Unlock()
 
-					// if handler's nextConquerTime > 0, nextChallengeReq isn't nil, and is before now, punlish
-					if h.nextConquerTime > 0 && h.nextFarmerChallengeReq != nil && time.Unix(h.nextConquerTime, 0).Before(time.Now()) {
-						blocksRange := h.nextFarmerChallengeReq.BlocksRange()
-						challenge.GetFarmerChallengeReqCache().DelFarmerChallengeReq(h.nextFarmerChallengeReq.FarmerID(), blocksRange.HighBlockNumber, blocksRange.LowBlockNumber, h.nextFarmerChallengeReq.HashAlgo())
+	t := <-taken
+	return t.snap, t.err
+}
 
-						h.nextConquerTime = 0
-						h.nextFarmerChallengeReq = nil
-						h.punishBalance()
+// schedule deadlines of a handler in account tree, the ones it has no more are dropped, caller must hold the lock
+func (ctr *FarmerAccountController) scheduleHandler(key string, h *FarmerAccountHandler) {
+	if h.account.State != pb.FarmerState_ONLINE {
+		ctr.endSession(h)
+	}
 
-						ctr.UpdateFarmerHandler(h)
-					}
-				}(key)
-			}
-		}
+	switch h.account.State {
+	case pb.FarmerState_OFFLINE, pb.FarmerState_BANNED:
+		ctr.timer.CancelAll(key)
+		return
+	case pb.FarmerState_SUSPENDED:
+		ctr.timer.Cancel(key, deadline_ping)
+		ctr.timer.Cancel(key, deadline_conquer)
+		ctr.timer.Schedule(key, deadline_suspension, h.account.SuspendedUntil)
+		return
+	}
+
+	ctr.timer.Cancel(key, deadline_suspension)
+	// farmer in session answers supervisor's pings instead of pinging
+	if h.session != nil && h.session.answerBy > 0 {
+		ctr.timer.Schedule(key, deadline_ping, h.session.answerBy)
+	} else if h.nextPingTime > 0 && h.session == nil {
+		ctr.timer.Schedule(key, deadline_ping, h.nextPingTime)
+	} else {
+		ctr.timer.Cancel(key, deadline_ping)
+	}
+	if h.nextFarmerChallengeReq != nil && h.nextConquerTime > 0 {
+		ctr.timer.Schedule(key, deadline_conquer, h.nextConquerTime)
+	} else {
+		ctr.timer.Cancel(key, deadline_conquer)
 	}
 }
 
-func getControllerCheckInterval() time.Duration {
-	if interval, err := time.ParseDuration(viper.GetString("account.check.interval")); err == nil {
-		return interval
+// check one handler's ping, conquer and suspension deadlines, fired by the timer once one of them lapses
+func (ctr *FarmerAccountController) checkHandler(key string) {
+	ctr.l.RLock()
+	h, err := ctr.accountTree.Get(key)
+	ctr.l.RUnlock()
+	if err != nil {
+		logger.Debugf("farmer(%s) handler gone before its deadline", key)
+		return
 	}
 
-	viper.Set("account.check.interval", "60s")
-	return time.Duration(60) * time.Second
-}
+	// farmer out of service is neither pinging nor conquering
+	switch h.account.State {
+	case pb.FarmerState_SUSPENDED:
+		h.lapseSuspension()
+		return
+	case pb.FarmerState_BANNED:
+		return
+	}
+
+	// if handler's nextPingTime is before now, lostcount ++, and farmer has another interval before the next lost
+	now := ctr.clock.Now()
+	ctr.l.Lock()
+	session := h.session
+	expired := session != nil && session.expire(key, now)
+	ctr.l.Unlock()
+	if expired {
+		logger.Infof("farmer(%s) didn't answer pings down its session in time", key)
+	} else if session == nil && h.nextPingTime > 0 && !clock.Time(h.nextPingTime).After(now) {
+		h.lostCount++
+		h.nextPingTime = clock.Stamp(now.Add(ctr.cfg.PingInterval))
+		h.Lost()
+
+		if h.lostCount >= ctr.cfg.LostCount {
+			h.OffLine()
+		}
 
-func getControllerCheckWorkers() int {
-	workers := viper.GetInt("account.check.workers")
-	if workers <= 0 {
-		viper.Set("account.check.workers", 8)
-		workers = 8
+		ctr.UpdateFarmerHandler(h)
 	}
 
-	return workers
+	// if handler's nextConquerTime > 0, nextChallengeReq isn't nil, and is before now, punlish
+	if h.nextConquerTime > 0 && h.nextFarmerChallengeReq != nil && !clock.Time(h.nextConquerTime).After(now) {
+		blocksRange := h.nextFarmerChallengeReq.BlocksRange()
+		ctr.challenger.FarmerChallengeReqCache().DelFarmerChallengeReq(h.nextFarmerChallengeReq.FarmerID(), blocksRange.HighBlockNumber, blocksRange.LowBlockNumber, h.nextFarmerChallengeReq.HashAlgo())
+
+		missed := h.nextFarmerChallengeReq
+		h.nextConquerTime = 0
+		h.nextFarmerChallengeReq = nil
+		h.publishChallenge(HookVerdict, missed, &challenge.Verdict{Kind: missed.Kind(), Reason: "conquer deadline passed"})
+		if err := h.punishBalance(missed); err != nil {
+			logger.Warningf("farmer(%s) missed a challenge, but isn't penalized: %v", h.account.FarmerID, err)
+		}
+
+		ctr.UpdateFarmerHandler(h)
+	}
 }
@@ -103,21 +103,20 @@ func (t *AccountTree) Get(key string) (*FarmerAccountHandler, error) {
 	return node.value, nil
 }
 
+// delete the key, and the nodes no other key goes through
 func (t *AccountTree) Delete(key string) {
-	i := int(0)
-	bkeys := []byte(key)
-	node, exist := getNode(t.root, bkeys)
+	node, exist := getNode(t.root, []byte(key))
 	if !exist {
 		return
 	}
+	if term, ok := node.children[null]; !ok || !term.term {
+		return
+	}
 
 	t.size--
-	for n := node.parent; n != nil; n = n.parent {
-		i++
-		if len(n.children) > 1 {
-			n.DeleteChild(bkeys[len(bkeys)-i])
-			break
-		}
+	node.DeleteChild(null)
+	for n := node; n.parent != nil && len(n.children) == 0; n = n.parent {
+		n.parent.DeleteChild(n.key)
 	}
 }
 
@@ -55,6 +55,22 @@ func (s *TestAccountTree) TestTrieTree_Delete(c *check.C) {
 
 	keys := trie.Keys()
 	c.Assert(len(keys), check.Equals, 2)
+
+	// the only key, and a key others start with
+	trie = NewAccountTree()
+	c.Check(trie.Put("foo", nil), check.IsNil)
+	trie.Delete("foo")
+	_, err := trie.Get("foo")
+	c.Check(err, check.Equals, errKeyNotFound)
+	c.Check(trie.Keys(), check.HasLen, 0)
+	c.Check(trie.Len(), check.Equals, 0)
+
+	c.Check(trie.Put("foo", nil), check.IsNil)
+	c.Check(trie.Put("foobar", nil), check.IsNil)
+	trie.Delete("foo")
+	c.Check(trie.Keys(), check.DeepEquals, []string{"foobar"})
+	trie.Delete("foo")
+	c.Check(trie.Len(), check.Equals, 1)
 }
 
 func (s *TestAccountTree) TestTrieTree_HasKeysWithPrefix(c *check.C) {
@@ -21,25 +21,131 @@ import (
 	"path/filepath"
 	"time"
 
-	"github.com/spf13/viper"
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/challenge"
 	"gopkg.in/check.v1"
 )
 
 type TestFarmerAccount struct {
+	dbpath string
+	ctr    *FarmerAccountController
 }
 
 var _ = check.Suite(&TestFarmerAccount{})
 
+// challenger without block source, enough for tests never conquering a challenge
+func newTestChallenger() *challenge.Challenger {
+	cfg := &challenge.Config{
+		HashAlgo: pb.HashAlgo_SHA256,
+		Delay:    time.Second * 10,
+	}
+
+	return challenge.NewChallenger(cfg, nil, challenge.NewDefaultFarmerChallengeReqCache(cfg.Delay, 0), challenge.NewDefaultBlocksHashCache(0, 0))
+}
+
+func newTestConfig() *Config {
+	return &Config{
+		CheckWorkers: 8,
+		PingInterval: time.Second * 900,
+		LostCount:    2,
+	}
+}
+
 func (t *TestFarmerAccount) SetUpSuite(c *check.C) {
-	viper.Set("account.store.backend", "rocksdb")
-	viper.Set("account.store.rocksdb.dbpath", filepath.Join(os.TempDir(), "testAccount"))
-	viper.Set("farmer.ping.interval", 900)
-	viper.Set("farmer.ping.lostcount", 2)
-	viper.Set("farmer.challenge.hashalgo", "SHA256")
+	t.dbpath = filepath.Join(os.TempDir(), "testAccount")
+	storage, err := store.NewStore("rocksdb", t.dbpath)
+	c.Assert(err, check.IsNil)
+
+	t.ctr = NewFarmerAccountController(storage, newTestChallenger(), newTestConfig())
 }
 
 func (t *TestFarmerAccount) TearDownSuite(c *check.C) {
 	time.Sleep(time.Second)
-	Close()
-	os.Remove(filepath.Join(os.TempDir(), "testAccount"))
+	t.ctr.Close()
+	t.ctr.challenger.Close()
+	os.RemoveAll(t.dbpath)
+}
+
+func (t *TestFarmerAccount) TestStoredFarmers(c *check.C) {
+	for _, id := range []string{"TestStoredFarmers1", "TestStoredFarmers2", "TestStoredFarmers3"} {
+		handler, err := t.ctr.NewFarmerHandler(id)
+		c.Assert(err, check.IsNil)
+		c.Assert(handler.OnLine(), check.IsNil)
+	}
+	offline, _ := t.ctr.NewFarmerHandler("TestStoredFarmers2")
+	c.Assert(offline.OffLine(), check.IsNil)
+	time.Sleep(time.Millisecond * 100)
+
+	// offline farmer has left account tree, but is still stored
+	handlers, _ := t.ctr.InServiceFarmers("TestStoredFarmers", "", nil, 10)
+	c.Check(handlers, check.HasLen, 2)
+
+	accounts, next, err := t.ctr.StoredFarmers("TestStoredFarmers", "", nil, 2)
+	c.Assert(err, check.IsNil)
+	c.Assert(accounts, check.HasLen, 2)
+	c.Check(accounts[1].FarmerID, check.Equals, "TestStoredFarmers2")
+	c.Check(accounts[1].State, check.Equals, pb.FarmerState_OFFLINE)
+	c.Check(next, check.Equals, "TestStoredFarmers2")
+
+	accounts, next, err = t.ctr.StoredFarmers("TestStoredFarmers", next, nil, 2)
+	c.Assert(err, check.IsNil)
+	c.Assert(accounts, check.HasLen, 1)
+	c.Check(accounts[0].FarmerID, check.Equals, "TestStoredFarmers3")
+	c.Check(next, check.Equals, "")
+
+	accounts, _, err = t.ctr.StoredFarmers("TestStoredFarmers", "", []pb.FarmerState{pb.FarmerState_OFFLINE}, 10)
+	c.Assert(err, check.IsNil)
+	c.Assert(accounts, check.HasLen, 1)
+	c.Check(accounts[0].FarmerID, check.Equals, "TestStoredFarmers2")
+}
+
+func (t *TestFarmerAccount) TestLoadFarmer(c *check.C) {
+	_, _, err := t.ctr.LoadFarmer("TestLoadFarmer")
+	c.Check(err, check.Equals, ErrFarmerNotFound)
+
+	handler, err := t.ctr.NewFarmerHandler("TestLoadFarmer")
+	c.Assert(err, check.IsNil)
+	c.Assert(handler.OnLine(), check.IsNil)
+	account, loaded, err := t.ctr.LoadFarmer("TestLoadFarmer")
+	c.Assert(err, check.IsNil)
+	c.Check(loaded, check.Equals, handler)
+	c.Check(account.State, check.Equals, pb.FarmerState_ONLINE)
+
+	// an offline farmer is looked up, but not brought into service
+	c.Assert(handler.OffLine(), check.IsNil)
+	account, loaded, err = t.ctr.LoadFarmer("TestLoadFarmer")
+	c.Assert(err, check.IsNil)
+	c.Check(loaded, check.IsNil)
+	c.Check(account.State, check.Equals, pb.FarmerState_OFFLINE)
+	handlers, _ := t.ctr.InServiceFarmers("TestLoadFarmer", "", nil, 10)
+	c.Check(handlers, check.HasLen, 0)
+
+	c.Check(t.ctr.ForceOffline("TestLoadFarmer"), check.Equals, ErrFarmerNotInService)
+	_, err = t.ctr.ClearChallenge("TestLoadFarmer")
+	c.Check(err, check.Equals, ErrFarmerNotInService)
+	handlers, _ = t.ctr.InServiceFarmers("TestLoadFarmer", "", nil, 10)
+	c.Check(handlers, check.HasLen, 0)
+}
+
+func (t *TestFarmerAccount) TestSnapshot(c *check.C) {
+	handler, err := t.ctr.NewFarmerHandler("TestSnapshot")
+	c.Assert(err, check.IsNil)
+	c.Assert(handler.OnLine(), check.IsNil)
+
+	// taken right after the change, before it would have been persisted on its own
+	snap, err := t.ctr.Snapshot()
+	c.Assert(err, check.IsNil)
+	defer snap.Release()
+	c.Assert(handler.OffLine(), check.IsNil)
+	time.Sleep(time.Millisecond * 100)
+
+	states := map[string]pb.FarmerState{}
+	c.Assert(snap.SeekCF(store.DefaultColumnFamily, []byte(farmerId2Key("TestSnapshot")), func(key, value []byte) bool {
+		account, err := bytes2FarmerAccount(value)
+		c.Assert(err, check.IsNil)
+		states[account.FarmerID] = account.State
+		return false
+	}), check.IsNil)
+	c.Check(states, check.DeepEquals, map[string]pb.FarmerState{"TestSnapshot": pb.FarmerState_ONLINE})
 }
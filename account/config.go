@@ -0,0 +1,206 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"time"
+
+	"github.com/conseweb/supervisor/clock"
+	"github.com/spf13/viper"
+)
+
+var (
+	default_penalties = []string{"10%", "50%", penalty_step_zero, penalty_step_suspend}
+)
+
+// Config of account controller, account.check and farmer.ping sections of supervisor.yaml
+type Config struct {
+	// how many handlers' lapsed deadlines can be checked at once
+	CheckWorkers int
+	// interval of time, farmer call for heartbeat
+	PingInterval time.Duration
+	// after certain times of lost, farmer is put OFFLINE
+	LostCount int
+
+	// farmer.reward section, nil means defaults
+	Reward *RewardConfig
+	// if set, used instead of the policy Reward describes
+	RewardPolicy RewardPolicy
+
+	// account.fsm section, states and transitions added to the built-in ones, nil means none
+	FSM *FSMConfig
+
+	// handlers' deadlines, uptime and timestamps are told by it, nil is the system clock
+	Clock clock.Clock
+
+	// if set, a call changing farmer's account returns once the change is persisted, rather than leaving it to background,
+	// so that a supervisor of a cluster going away has committed whatever farmers were told
+	SyncPersist bool
+}
+
+// RewardConfig of the default reward policy, farmer.reward section of supervisor.yaml
+type RewardConfig struct {
+	Policy string
+	// balance a plain ping earns
+	Base uint32
+	// every BlocksUnit blocks farmer proved keeping adds another Base, up to MaxBlocksFactor times
+	BlocksUnit      uint64
+	MaxBlocksFactor uint64
+	// UptimeBonus percent more for every UptimeUnit online, up to MaxUptimeBonus percent
+	UptimeUnit     time.Duration
+	UptimeBonus    uint64
+	MaxUptimeBonus uint64
+	// reward multipliers of a plain ping and of each challenge kind conquered
+	PingWeight   uint64
+	HashWeight   uint64
+	SampleWeight uint64
+	RootWeight   uint64
+	// escalating penalties of consecutive missed challenges, the last one repeats
+	Penalties []PenaltyStep
+	// how long a suspend step takes farmer out of service
+	Suspension time.Duration
+}
+
+// DefaultRewardConfig is what a missing farmer.reward section means
+func DefaultRewardConfig() *RewardConfig {
+	penalties := make([]PenaltyStep, 0, len(default_penalties))
+	for _, step := range default_penalties {
+		penalty, _ := ParsePenaltyStep(step)
+		penalties = append(penalties, penalty)
+	}
+
+	return &RewardConfig{
+		Policy:          RewardPolicyDefault,
+		Base:            100,
+		BlocksUnit:      1000,
+		MaxBlocksFactor: 10,
+		UptimeUnit:      time.Duration(24) * time.Hour,
+		UptimeBonus:     10,
+		MaxUptimeBonus:  100,
+		PingWeight:      1,
+		HashWeight:      2,
+		SampleWeight:    3,
+		RootWeight:      2,
+		Penalties:       penalties,
+		Suspension:      time.Duration(24) * time.Hour,
+	}
+}
+
+// ConfigFromViper reads account config, missing values fall back to defaults
+func ConfigFromViper() *Config {
+	return &Config{
+		CheckWorkers: getControllerCheckWorkers(),
+		PingInterval: getPingInterval(),
+		LostCount:    viper.GetInt("farmer.ping.lostcount"),
+		Reward:       RewardConfigFromViper(),
+		FSM:          FSMConfigFromViper(),
+	}
+}
+
+// RewardConfigFromViper reads farmer.reward section, missing values fall back to defaults
+func RewardConfigFromViper() *RewardConfig {
+	def := DefaultRewardConfig()
+	cfg := &RewardConfig{
+		Policy:          viper.GetString("farmer.reward.policy"),
+		Base:            uint32(getRewardUint("farmer.reward.base", uint64(def.Base))),
+		BlocksUnit:      getRewardUint("farmer.reward.blocks.unit", def.BlocksUnit),
+		MaxBlocksFactor: getRewardUint("farmer.reward.blocks.maxfactor", def.MaxBlocksFactor),
+		UptimeUnit:      getRewardUptimeUnit(def.UptimeUnit),
+		UptimeBonus:     getRewardUint("farmer.reward.uptime.bonus", def.UptimeBonus),
+		MaxUptimeBonus:  getRewardUint("farmer.reward.uptime.maxbonus", def.MaxUptimeBonus),
+		PingWeight:      getRewardUint("farmer.reward.weight.ping", def.PingWeight),
+		HashWeight:      getRewardUint("farmer.reward.weight.hash", def.HashWeight),
+		SampleWeight:    getRewardUint("farmer.reward.weight.sample", def.SampleWeight),
+		RootWeight:      getRewardUint("farmer.reward.weight.root", def.RootWeight),
+		Penalties:       getRewardPenalties(def.Penalties),
+		Suspension:      getRewardSuspension(def.Suspension),
+	}
+	if cfg.Policy == "" {
+		viper.Set("farmer.reward.policy", RewardPolicyDefault)
+		cfg.Policy = RewardPolicyDefault
+	}
+
+	return cfg
+}
+
+func getRewardUint(key string, def uint64) uint64 {
+	if value := viper.GetInt(key); value > 0 {
+		return uint64(value)
+	}
+
+	viper.Set(key, def)
+	return def
+}
+
+func getRewardUptimeUnit(def time.Duration) time.Duration {
+	if unit, err := time.ParseDuration(viper.GetString("farmer.reward.uptime.unit")); err == nil && unit > 0 {
+		return unit
+	}
+
+	viper.Set("farmer.reward.uptime.unit", def.String())
+	return def
+}
+
+func getRewardSuspension(def time.Duration) time.Duration {
+	if suspension, err := time.ParseDuration(viper.GetString("farmer.reward.suspension")); err == nil && suspension > 0 {
+		return suspension
+	}
+
+	viper.Set("farmer.reward.suspension", def.String())
+	return def
+}
+
+// an invalid step drops the whole list back to defaults
+func getRewardPenalties(def []PenaltyStep) []PenaltyStep {
+	steps := viper.GetStringSlice("farmer.reward.penalties")
+	if len(steps) == 0 {
+		viper.Set("farmer.reward.penalties", default_penalties)
+		return def
+	}
+
+	penalties := make([]PenaltyStep, 0, len(steps))
+	for _, step := range steps {
+		penalty, err := ParsePenaltyStep(step)
+		if err != nil {
+			logger.Warningf("%v, use default penalties %v instead", err, default_penalties)
+			viper.Set("farmer.reward.penalties", default_penalties)
+			return def
+		}
+		penalties = append(penalties, penalty)
+	}
+
+	return penalties
+}
+
+func getControllerCheckWorkers() int {
+	workers := viper.GetInt("account.check.workers")
+	if workers <= 0 {
+		viper.Set("account.check.workers", 8)
+		workers = 8
+	}
+
+	return workers
+}
+
+func getPingInterval() time.Duration {
+	if interval, err := time.ParseDuration(viper.GetString("farmer.ping.interval")); err == nil {
+		return interval
+	}
+
+	viper.Set("farmer.ping.interval", "900s")
+	return time.Duration(900) * time.Second
+}
@@ -0,0 +1,176 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account/store"
+)
+
+const (
+	// memo of the journal entry an import moving farmer's balance posts
+	import_memo = "import"
+
+	max_record_line = 1 << 20
+)
+
+// AccountRecord is the portable form of a farmer account, one json object per line in an export,
+// enums are written by name, so that an export doesn't depend on their numbers
+type AccountRecord struct {
+	FarmerID          string `json:"farmerID"`
+	Balance           uint32 `json:"balance"`
+	State             string `json:"state"`
+	FsmState          string `json:"fsmState,omitempty"`
+	StateReason       string `json:"stateReason,omitempty"`
+	SuspendedUntil    int64  `json:"suspendedUntil,omitempty"`
+	LastModifiedTime  int64  `json:"lastModifiedTime,omitempty"`
+	LastChallengeTime int64  `json:"lastChallengeTime,omitempty"`
+}
+
+func NewAccountRecord(account *pb.FarmerAccount) *AccountRecord {
+	return &AccountRecord{
+		FarmerID:          account.FarmerID,
+		Balance:           account.Balance,
+		State:             account.State.String(),
+		FsmState:          account.FsmState,
+		StateReason:       account.StateReason,
+		SuspendedUntil:    account.SuspendedUntil,
+		LastModifiedTime:  account.LastModifiedTime,
+		LastChallengeTime: account.LastChallengeTime,
+	}
+}
+
+// FarmerAccount checks the record against fsm, and converts it back
+func (r *AccountRecord) FarmerAccount(fsm *FarmerFSMDef) (*pb.FarmerAccount, error) {
+	if r.FarmerID == "" {
+		return nil, fmt.Errorf("supervisor/account: record has no farmerID")
+	}
+	state, ok := pb.FarmerState_value[r.State]
+	if !ok {
+		return nil, fmt.Errorf("supervisor/account: farmer(%s) has unknown state %q", r.FarmerID, r.State)
+	}
+	if r.FsmState != "" {
+		if _, ok := fsm.reportAs[r.FsmState]; !ok {
+			return nil, fmt.Errorf("supervisor/account: farmer(%s) has fsm state %q unknown to the state machine", r.FarmerID, r.FsmState)
+		}
+		if fsm.ReportAs(r.FsmState) != pb.FarmerState(state) {
+			return nil, fmt.Errorf("supervisor/account: farmer(%s) fsm state %s doesn't report as %s", r.FarmerID, r.FsmState, r.State)
+		}
+	}
+	if r.SuspendedUntil != 0 && pb.FarmerState(state) != pb.FarmerState_SUSPENDED {
+		return nil, fmt.Errorf("supervisor/account: farmer(%s) is %s, but has suspendedUntil", r.FarmerID, r.State)
+	}
+
+	return &pb.FarmerAccount{
+		FarmerID:          r.FarmerID,
+		Balance:           r.Balance,
+		State:             pb.FarmerState(state),
+		FsmState:          r.FsmState,
+		StateReason:       r.StateReason,
+		SuspendedUntil:    r.SuspendedUntil,
+		LastModifiedTime:  r.LastModifiedTime,
+		LastChallengeTime: r.LastChallengeTime,
+	}, nil
+}
+
+// ExportAccounts writes every farmer account in src to w, as it is stored, in order of farmer id,
+// src is a storage, or a snapshot of it if it's being written. returns how many are written
+func ExportAccounts(src store.Iterable, w io.Writer) (int, error) {
+	count := 0
+	enc := json.NewEncoder(w)
+	var exportErr error
+	err := src.IterateCF(store.DefaultColumnFamily, func(key, value []byte) bool {
+		account, err := bytes2FarmerAccount(value)
+		if err != nil {
+			exportErr = fmt.Errorf("supervisor/account: farmer(%s) account broken: %v", key, err)
+			return false
+		}
+		if exportErr = enc.Encode(NewAccountRecord(account)); exportErr != nil {
+			return false
+		}
+
+		count++
+		return true
+	})
+	if err != nil {
+		return count, err
+	}
+
+	return count, exportErr
+}
+
+// ImportAccounts reads farmer accounts written by ExportAccounts from r into storage.
+// every record is checked against fsm before any is written, so a broken export imports nothing.
+// an imported account replaces the stored one, and if farmer has a balance journal,
+// a balance differing from it is posted to the journal, so importing twice is the same as once
+func ImportAccounts(storage store.Storage, fsm *FarmerFSMDef, r io.Reader) (int, error) {
+	var accounts []*pb.FarmerAccount
+	seen := make(map[string]int)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), max_record_line)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		record := &AccountRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return 0, fmt.Errorf("supervisor/account: line %d: %v", lineno, err)
+		}
+		account, err := record.FarmerAccount(fsm)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		if first, ok := seen[account.FarmerID]; ok {
+			return 0, fmt.Errorf("supervisor/account: line %d: farmer(%s) already on line %d", lineno, account.FarmerID, first)
+		}
+		seen[account.FarmerID] = lineno
+		accounts = append(accounts, account)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	journal := NewJournal(storage)
+	for i, account := range accounts {
+		balance, ok, err := journal.Balance(account.FarmerID)
+		if err != nil {
+			return i, err
+		}
+		if ok && balance != account.Balance {
+			if _, err := journal.Post(account.FarmerID, pb.BalanceReason_ADMIN_ADJUSTMENT, balance, account.Balance, nil, import_memo); err != nil {
+				return i, err
+			}
+		}
+
+		farmerBytes, err := farmerAccount2Bytes(account)
+		if err != nil {
+			return i, err
+		}
+		if err := storage.Set([]byte(farmerId2Key(account.FarmerID)), farmerBytes); err != nil {
+			return i, err
+		}
+	}
+
+	return len(accounts), nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account/store"
+	"gopkg.in/check.v1"
+)
+
+type TestAccountExport struct {
+	src store.Storage
+	dst store.Storage
+	fsm *FarmerFSMDef
+}
+
+var _ = check.Suite(&TestAccountExport{})
+
+func (t *TestAccountExport) SetUpTest(c *check.C) {
+	os.RemoveAll(filepath.Join(os.TempDir(), "testAccountExport"))
+	var err error
+	t.src, err = store.NewStore("rocksdb", filepath.Join(os.TempDir(), "testAccountExport", "src"))
+	c.Assert(err, check.IsNil)
+	t.dst, err = store.NewStore("rocksdb", filepath.Join(os.TempDir(), "testAccountExport", "dst"))
+	c.Assert(err, check.IsNil)
+	t.fsm, err = NewFarmerFSMDef(nil)
+	c.Assert(err, check.IsNil)
+}
+
+func (t *TestAccountExport) TearDownTest(c *check.C) {
+	t.src.Close()
+	t.dst.Close()
+	os.RemoveAll(filepath.Join(os.TempDir(), "testAccountExport"))
+}
+
+func (t *TestAccountExport) put(c *check.C, storage store.Storage, account *pb.FarmerAccount) {
+	farmerBytes, err := farmerAccount2Bytes(account)
+	c.Assert(err, check.IsNil)
+	c.Assert(storage.Set([]byte(farmerId2Key(account.FarmerID)), farmerBytes), check.IsNil)
+}
+
+func (t *TestAccountExport) TestRoundTrip(c *check.C) {
+	accounts := []*pb.FarmerAccount{
+		{FarmerID: "A", Balance: 100, State: pb.FarmerState_OFFLINE, FsmState: "OFFLINE", LastModifiedTime: 1},
+		{FarmerID: "B", Balance: 200, State: pb.FarmerState_SUSPENDED, FsmState: "SUSPENDED", SuspendedUntil: 2, StateReason: "missed"},
+		{FarmerID: "C", State: pb.FarmerState_BANNED, StateReason: "cheating", LastChallengeTime: 3},
+	}
+	for _, account := range accounts {
+		t.put(c, t.src, account)
+	}
+
+	exported := &bytes.Buffer{}
+	count, err := ExportAccounts(t.src, exported)
+	c.Assert(err, check.IsNil)
+	c.Check(count, check.Equals, 3)
+	c.Check(strings.Count(exported.String(), "\n"), check.Equals, 3)
+
+	count, err = ImportAccounts(t.dst, t.fsm, bytes.NewReader(exported.Bytes()))
+	c.Assert(err, check.IsNil)
+	c.Check(count, check.Equals, 3)
+
+	// stored the same, byte for byte, and exported the same
+	for _, account := range accounts {
+		srcBytes, err := t.src.Get([]byte(account.FarmerID))
+		c.Assert(err, check.IsNil)
+		dstBytes, err := t.dst.Get([]byte(account.FarmerID))
+		c.Assert(err, check.IsNil)
+		c.Check(dstBytes, check.DeepEquals, srcBytes)
+	}
+	again := &bytes.Buffer{}
+	_, err = ExportAccounts(t.dst, again)
+	c.Assert(err, check.IsNil)
+	c.Check(again.String(), check.Equals, exported.String())
+}
+
+func (t *TestAccountExport) TestImportIdempotent(c *check.C) {
+	journal := NewJournal(t.dst)
+	_, err := journal.Post("A", pb.BalanceReason_PING_REWARD, 0, 50, nil, "")
+	c.Assert(err, check.IsNil)
+
+	export := `{"farmerID":"A","balance":80,"state":"OFFLINE"}` + "\n"
+	for i := 0; i < 2; i++ {
+		count, err := ImportAccounts(t.dst, t.fsm, strings.NewReader(export))
+		c.Assert(err, check.IsNil)
+		c.Check(count, check.Equals, 1)
+	}
+
+	// the journal is moved to imported balance once
+	entries, _, balance, err := journal.History("A", 0, 10)
+	c.Assert(err, check.IsNil)
+	c.Check(balance, check.Equals, uint32(80))
+	c.Assert(entries, check.HasLen, 2)
+	c.Check(entries[1].Reason, check.Equals, pb.BalanceReason_ADMIN_ADJUSTMENT)
+	c.Check(entries[1].Memo, check.Equals, import_memo)
+}
+
+func (t *TestAccountExport) TestImportInvalid(c *check.C) {
+	valid := `{"farmerID":"A","balance":80,"state":"OFFLINE"}`
+	for _, invalid := range []string{
+		`{"balance":80,"state":"OFFLINE"}`,
+		`{"farmerID":"B","state":"AWAY"}`,
+		`{"farmerID":"B","state":"OFFLINE","fsmState":"PROBATION"}`,
+		`{"farmerID":"B","state":"OFFLINE","fsmState":"BANNED"}`,
+		`{"farmerID":"B","state":"ONLINE","suspendedUntil":1}`,
+		`{"farmerID":"B","balance":-1,"state":"OFFLINE"}`,
+		`{"farmerID":"B"`,
+		valid,
+	} {
+		count, err := ImportAccounts(t.dst, t.fsm, strings.NewReader(valid+"\n"+invalid+"\n"))
+		c.Check(err, check.ErrorMatches, ".*line 2: .*", check.Commentf(invalid))
+		c.Check(count, check.Equals, 0)
+	}
+
+	// nothing is written by a broken import
+	_, err := t.dst.Get([]byte("A"))
+	c.Check(err, check.NotNil)
+}
@@ -0,0 +1,377 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/clock"
+	"github.com/looplab/fsm"
+	"github.com/spf13/viper"
+)
+
+const (
+	// events handlers fire themselves, always defined
+	farmer_event_offline = "offline"
+	farmer_event_online  = "online"
+	farmer_event_lost    = "lost"
+	farmer_event_suspend = "suspend"
+	farmer_event_ban     = "ban"
+	farmer_event_lift    = "lift"
+	farmer_event_lapse   = "lapse"
+
+	fsm_guard_suspension_lapsed = "suspension_lapsed"
+
+	fsm_action_start_uptime     = "start_uptime"
+	fsm_action_stop_uptime      = "stop_uptime"
+	fsm_action_leave_service    = "leave_service"
+	fsm_action_clear_suspension = "clear_suspension"
+)
+
+// a guard refuses a transition by returning an error
+type fsmGuard func(h *FarmerAccountHandler, e *fsm.Event) error
+
+// an action is a side effect of a transition, run after farmer entered the new state
+type fsmAction func(h *FarmerAccountHandler, e *fsm.Event)
+
+var (
+	// guards and actions a transition can refer to by name
+	fsmGuards = map[string]fsmGuard{
+		fsm_guard_suspension_lapsed: func(h *FarmerAccountHandler, e *fsm.Event) error {
+			if clock.Stamp(h.ctr.clock.Now()) < h.account.SuspendedUntil {
+				return fmt.Errorf("suspended until %v", clock.Time(h.account.SuspendedUntil))
+			}
+			return nil
+		},
+	}
+	fsmActions = map[string]fsmAction{
+		fsm_action_start_uptime: func(h *FarmerAccountHandler, e *fsm.Event) {
+			h.lostCount = 0
+			h.onlineSince = clock.Stamp(h.ctr.clock.Now())
+		},
+		fsm_action_stop_uptime: func(h *FarmerAccountHandler, e *fsm.Event) {
+			h.onlineSince = 0
+		},
+		fsm_action_leave_service: func(h *FarmerAccountHandler, e *fsm.Event) {
+			h.leaveService()
+		},
+		fsm_action_clear_suspension: func(h *FarmerAccountHandler, e *fsm.Event) {
+			h.account.SuspendedUntil = 0
+			h.account.StateReason = ""
+		},
+	}
+
+	// built-in states report as themselves
+	builtinFarmerStates = []pb.FarmerState{
+		pb.FarmerState_OFFLINE,
+		pb.FarmerState_ONLINE,
+		pb.FarmerState_LOST,
+		pb.FarmerState_SUSPENDED,
+		pb.FarmerState_BANNED,
+	}
+)
+
+func builtinFarmerTransitions() []FSMTransitionConfig {
+	offline, online, lost := pb.FarmerState_OFFLINE.String(), pb.FarmerState_ONLINE.String(), pb.FarmerState_LOST.String()
+	suspended, banned := pb.FarmerState_SUSPENDED.String(), pb.FarmerState_BANNED.String()
+
+	return []FSMTransitionConfig{
+		{Event: farmer_event_offline, Src: []string{online, lost}, Dst: offline, Actions: []string{fsm_action_stop_uptime}},
+		{Event: farmer_event_online, Src: []string{offline, lost}, Dst: online, Actions: []string{fsm_action_start_uptime}},
+		{Event: farmer_event_lost, Src: []string{online}, Dst: lost},
+		{Event: farmer_event_suspend, Src: []string{offline, online, lost}, Dst: suspended, Actions: []string{fsm_action_leave_service}},
+		{Event: farmer_event_ban, Src: []string{offline, online, lost, suspended}, Dst: banned, Actions: []string{fsm_action_leave_service}},
+		{Event: farmer_event_lift, Src: []string{suspended, banned}, Dst: offline, Actions: []string{fsm_action_clear_suspension}},
+		{Event: farmer_event_lapse, Src: []string{suspended}, Dst: offline, Guard: fsm_guard_suspension_lapsed, Actions: []string{fsm_action_clear_suspension}},
+	}
+}
+
+// FSMConfig is account.fsm section of supervisor.yaml,
+// states and transitions in it are added to the built-in ones
+type FSMConfig struct {
+	States      []FSMStateConfig      `mapstructure:"states"`
+	Transitions []FSMTransitionConfig `mapstructure:"transitions"`
+	// decoding err, reported by NewFarmerFSMDef
+	err error
+}
+
+// FSMStateConfig is a state added by config, As is the built-in state it reports as
+type FSMStateConfig struct {
+	Name string `mapstructure:"name"`
+	As   string `mapstructure:"as"`
+}
+
+// FSMTransitionConfig moves farmer from any of Src to Dst on Event, unless Guard refuses,
+// Actions run after the transition
+type FSMTransitionConfig struct {
+	Event   string   `mapstructure:"event"`
+	Src     []string `mapstructure:"src"`
+	Dst     string   `mapstructure:"dst"`
+	Guard   string   `mapstructure:"guard"`
+	Actions []string `mapstructure:"actions"`
+}
+
+func (t FSMTransitionConfig) String() string {
+	return fmt.Sprintf("%s: %v -> %s", t.Event, t.Src, t.Dst)
+}
+
+// FSMConfigFromViper reads account.fsm section, a missing one means built-in states and transitions only
+func FSMConfigFromViper() *FSMConfig {
+	cfg := &FSMConfig{}
+	if err := viper.UnmarshalKey("account.fsm", cfg); err != nil {
+		cfg.err = fmt.Errorf("supervisor/account: invalid account.fsm section: %v", err)
+	}
+
+	return cfg
+}
+
+type fsmTransition struct {
+	event string
+	src   string
+}
+
+// FarmerFSMDef is farmer account state machine, built and validated once, shared by all handlers
+type FarmerFSMDef struct {
+	initial     string
+	states      []string
+	reportAs    map[string]pb.FarmerState
+	transitions []FSMTransitionConfig
+	events      fsm.Events
+	dsts        map[fsmTransition]string
+	guards      map[fsmTransition]fsmGuard
+	actions     map[fsmTransition][]fsmAction
+}
+
+// NewFarmerFSMDef adds cfg's states and transitions to the built-in ones, nil cfg means none,
+// every state must be reachable from OFFLINE, and every transition must be between known states
+func NewFarmerFSMDef(cfg *FSMConfig) (*FarmerFSMDef, error) {
+	if cfg == nil {
+		cfg = &FSMConfig{}
+	}
+	if cfg.err != nil {
+		return nil, cfg.err
+	}
+
+	def := &FarmerFSMDef{
+		initial:  pb.FarmerState_OFFLINE.String(),
+		reportAs: make(map[string]pb.FarmerState),
+		dsts:     make(map[fsmTransition]string),
+		guards:   make(map[fsmTransition]fsmGuard),
+		actions:  make(map[fsmTransition][]fsmAction),
+	}
+	for _, state := range builtinFarmerStates {
+		def.states = append(def.states, state.String())
+		def.reportAs[state.String()] = state
+	}
+	for _, state := range cfg.States {
+		if err := def.addState(state); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range append(builtinFarmerTransitions(), cfg.Transitions...) {
+		if err := def.addTransition(t); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := def.checkReachable(); err != nil {
+		return nil, err
+	}
+
+	return def, nil
+}
+
+func (def *FarmerFSMDef) addState(state FSMStateConfig) error {
+	if state.Name == "" {
+		return fmt.Errorf("supervisor/account: fsm state without name")
+	}
+	if _, ok := def.reportAs[state.Name]; ok {
+		return fmt.Errorf("supervisor/account: fsm state %s defined twice", state.Name)
+	}
+	as, ok := pb.FarmerState_value[state.As]
+	if !ok {
+		return fmt.Errorf("supervisor/account: fsm state %s reports as unknown state %q", state.Name, state.As)
+	}
+
+	def.states = append(def.states, state.Name)
+	def.reportAs[state.Name] = pb.FarmerState(as)
+	return nil
+}
+
+// a transition referring to an unknown state, guard or action is dangling
+func (def *FarmerFSMDef) addTransition(t FSMTransitionConfig) error {
+	if t.Event == "" || len(t.Src) == 0 {
+		return fmt.Errorf("supervisor/account: fsm transition %v needs an event and src states", t)
+	}
+	if _, ok := def.reportAs[t.Dst]; !ok {
+		return fmt.Errorf("supervisor/account: fsm transition %v goes to unknown state %q", t, t.Dst)
+	}
+
+	var guard fsmGuard
+	if t.Guard != "" {
+		var ok bool
+		if guard, ok = fsmGuards[t.Guard]; !ok {
+			return fmt.Errorf("supervisor/account: fsm transition %v has unknown guard %q", t, t.Guard)
+		}
+	}
+	actions := make([]fsmAction, 0, len(t.Actions))
+	for _, name := range t.Actions {
+		action, ok := fsmActions[name]
+		if !ok {
+			return fmt.Errorf("supervisor/account: fsm transition %v has unknown action %q", t, name)
+		}
+		actions = append(actions, action)
+	}
+
+	for _, src := range t.Src {
+		if _, ok := def.reportAs[src]; !ok {
+			return fmt.Errorf("supervisor/account: fsm transition %v comes from unknown state %q", t, src)
+		}
+		if src == t.Dst {
+			return fmt.Errorf("supervisor/account: fsm transition %v goes from %s to itself", t, src)
+		}
+
+		key := fsmTransition{event: t.Event, src: src}
+		if dst, ok := def.dsts[key]; ok {
+			return fmt.Errorf("supervisor/account: fsm event %s from %s defined twice, to %s and %s", t.Event, src, dst, t.Dst)
+		}
+		def.dsts[key] = t.Dst
+		if guard != nil {
+			def.guards[key] = guard
+		}
+		if len(actions) > 0 {
+			def.actions[key] = actions
+		}
+	}
+
+	def.transitions = append(def.transitions, t)
+	def.events = append(def.events, fsm.EventDesc{Name: t.Event, Src: t.Src, Dst: t.Dst})
+	return nil
+}
+
+func (def *FarmerFSMDef) checkReachable() error {
+	reached := map[string]bool{def.initial: true}
+	queue := []string{def.initial}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+
+		for key, dst := range def.dsts {
+			if key.src == state && !reached[dst] {
+				reached[dst] = true
+				queue = append(queue, dst)
+			}
+		}
+	}
+
+	for _, state := range def.states {
+		if !reached[state] {
+			return fmt.Errorf("supervisor/account: fsm state %s is unreachable from %s", state, def.initial)
+		}
+	}
+
+	return nil
+}
+
+// ReportAs returns the built-in state a state reports as
+func (def *FarmerFSMDef) ReportAs(state string) pb.FarmerState {
+	return def.reportAs[state]
+}
+
+// the exact state account was persisted in, or the one it reported as if config no longer has it
+func (def *FarmerFSMDef) restoredState(account *pb.FarmerAccount) string {
+	if _, ok := def.reportAs[account.FsmState]; ok {
+		return account.FsmState
+	}
+
+	return account.State.String()
+}
+
+// a farmer loaded from storage starts from OFFLINE, unless it was suspended or banned
+func (def *FarmerFSMDef) loadedState(account *pb.FarmerAccount) string {
+	state := def.restoredState(account)
+	switch def.reportAs[state] {
+	case pb.FarmerState_SUSPENDED, pb.FarmerState_BANNED:
+		return state
+	}
+
+	return def.initial
+}
+
+// handler's own fsm, starts from state, guards and actions are looked up in def
+func (def *FarmerFSMDef) newFSM(handler *FarmerAccountHandler, state string) *fsm.FSM {
+	return fsm.NewFSM(state, def.events, fsm.Callbacks{
+		"before_event": func(e *fsm.Event) {
+			handler.beforeEvent(e)
+			if guard := def.guards[fsmTransition{event: e.Event, src: e.Src}]; guard != nil {
+				if err := guard(handler, e); err != nil {
+					e.Cancel(err)
+				}
+			}
+		},
+		"after_event": func(e *fsm.Event) {
+			for _, action := range def.actions[fsmTransition{event: e.Event, src: e.Src}] {
+				action(handler, e)
+			}
+			handler.afterTransition(e)
+		},
+	})
+}
+
+// Dot renders the state machine in graphviz dot,
+// a state reporting as another shows both, a transition shows its guard and actions
+func (def *FarmerFSMDef) Dot() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "digraph farmer {")
+	fmt.Fprintln(buf, "\trankdir=LR;")
+
+	for _, state := range def.states {
+		attrs := []string{}
+		if state == def.initial {
+			attrs = append(attrs, "shape=doublecircle")
+		}
+		if as := def.reportAs[state].String(); as != state {
+			attrs = append(attrs, fmt.Sprintf("label=%q", state+"\n("+as+")"))
+		}
+
+		if len(attrs) > 0 {
+			fmt.Fprintf(buf, "\t%q [%s];\n", state, strings.Join(attrs, ", "))
+		} else {
+			fmt.Fprintf(buf, "\t%q;\n", state)
+		}
+	}
+
+	for _, t := range def.transitions {
+		label := t.Event
+		if t.Guard != "" {
+			label += " [" + t.Guard + "]"
+		}
+		if len(t.Actions) > 0 {
+			label += " / " + strings.Join(t.Actions, ", ")
+		}
+
+		for _, src := range t.Src {
+			fmt.Fprintf(buf, "\t%q -> %q [label=%q];\n", src, t.Dst, label)
+		}
+	}
+
+	fmt.Fprintln(buf, "}")
+	return buf.String()
+}
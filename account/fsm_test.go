@@ -0,0 +1,152 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"strings"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/spf13/viper"
+	"gopkg.in/check.v1"
+)
+
+type TestFarmerFSM struct{}
+
+var _ = check.Suite(&TestFarmerFSM{})
+
+// PROBATION reports as ONLINE, entered and left by events of its own
+func newProbationFSMConfig() *FSMConfig {
+	return &FSMConfig{
+		States: []FSMStateConfig{{Name: "PROBATION", As: "ONLINE"}},
+		Transitions: []FSMTransitionConfig{
+			{Event: "probation", Src: []string{"ONLINE", "LOST"}, Dst: "PROBATION"},
+			{Event: "release", Src: []string{"PROBATION"}, Dst: "ONLINE"},
+			{Event: "offline", Src: []string{"PROBATION"}, Dst: "OFFLINE", Actions: []string{fsm_action_stop_uptime}},
+		},
+	}
+}
+
+func (t *TestFarmerFSM) TestBuiltin(c *check.C) {
+	def, err := NewFarmerFSMDef(nil)
+	c.Assert(err, check.IsNil)
+
+	for _, state := range builtinFarmerStates {
+		c.Check(def.ReportAs(state.String()), check.Equals, state)
+	}
+
+	dot := def.Dot()
+	c.Check(strings.HasPrefix(dot, "digraph farmer {"), check.Equals, true)
+	c.Check(strings.Contains(dot, `"OFFLINE" [shape=doublecircle];`), check.Equals, true)
+	c.Check(strings.Contains(dot, `"OFFLINE" -> "ONLINE" [label="online / start_uptime"];`), check.Equals, true)
+	c.Check(strings.Contains(dot, `"SUSPENDED" -> "OFFLINE" [label="lapse [suspension_lapsed] / clear_suspension"];`), check.Equals, true)
+}
+
+func (t *TestFarmerFSM) TestAddedState(c *check.C) {
+	def, err := NewFarmerFSMDef(newProbationFSMConfig())
+	c.Assert(err, check.IsNil)
+	c.Check(def.ReportAs("PROBATION"), check.Equals, pb.FarmerState_ONLINE)
+
+	// a farmer on probation is loaded as OFFLINE, but restored as it was
+	account := &pb.FarmerAccount{State: pb.FarmerState_ONLINE, FsmState: "PROBATION"}
+	c.Check(def.loadedState(account), check.Equals, "OFFLINE")
+	c.Check(def.restoredState(account), check.Equals, "PROBATION")
+
+	// without the state in config, it is restored as the one it reported as
+	builtin, _ := NewFarmerFSMDef(nil)
+	c.Check(builtin.restoredState(account), check.Equals, "ONLINE")
+
+	dot := def.Dot()
+	c.Check(strings.Contains(dot, `"PROBATION" [label="PROBATION\n(ONLINE)"];`), check.Equals, true)
+	c.Check(strings.Contains(dot, `"LOST" -> "PROBATION" [label="probation"];`), check.Equals, true)
+}
+
+func (t *TestFarmerFSM) TestInvalid(c *check.C) {
+	cases := []struct {
+		name string
+		cfg  *FSMConfig
+		err  string
+	}{
+		{"unreachable state", &FSMConfig{
+			States:      []FSMStateConfig{{Name: "PROBATION", As: "ONLINE"}},
+			Transitions: []FSMTransitionConfig{{Event: "release", Src: []string{"PROBATION"}, Dst: "ONLINE"}},
+		}, "unreachable"},
+		{"dangling dst", &FSMConfig{
+			Transitions: []FSMTransitionConfig{{Event: "probation", Src: []string{"ONLINE"}, Dst: "PROBATION"}},
+		}, "unknown state"},
+		{"dangling src", &FSMConfig{
+			Transitions: []FSMTransitionConfig{{Event: "release", Src: []string{"PROBATION"}, Dst: "ONLINE"}},
+		}, "unknown state"},
+		{"unknown guard", &FSMConfig{
+			Transitions: []FSMTransitionConfig{{Event: "rest", Src: []string{"ONLINE"}, Dst: "OFFLINE", Guard: "tired"}},
+		}, "unknown guard"},
+		{"unknown action", &FSMConfig{
+			Transitions: []FSMTransitionConfig{{Event: "rest", Src: []string{"ONLINE"}, Dst: "OFFLINE", Actions: []string{"sleep"}}},
+		}, "unknown action"},
+		{"event defined twice", &FSMConfig{
+			Transitions: []FSMTransitionConfig{{Event: "online", Src: []string{"OFFLINE"}, Dst: "LOST"}},
+		}, "defined twice"},
+		{"to itself", &FSMConfig{
+			Transitions: []FSMTransitionConfig{{Event: "stay", Src: []string{"ONLINE"}, Dst: "ONLINE"}},
+		}, "to itself"},
+		{"no event", &FSMConfig{
+			Transitions: []FSMTransitionConfig{{Src: []string{"ONLINE"}, Dst: "OFFLINE"}},
+		}, "needs an event"},
+		{"state defined twice", &FSMConfig{
+			States: []FSMStateConfig{{Name: "ONLINE", As: "ONLINE"}},
+		}, "defined twice"},
+		{"state reports as unknown state", &FSMConfig{
+			States: []FSMStateConfig{{Name: "PROBATION", As: "WATCHED"}},
+		}, "unknown state"},
+	}
+
+	for _, cs := range cases {
+		_, err := NewFarmerFSMDef(cs.cfg)
+		if c.Check(err, check.NotNil, check.Commentf(cs.name)) {
+			c.Check(strings.Contains(err.Error(), cs.err), check.Equals, true, check.Commentf("%s: %v", cs.name, err))
+		}
+	}
+}
+
+func (t *TestFarmerFSM) TestFSMConfigFromViper(c *check.C) {
+	defer viper.Set("account.fsm", nil)
+
+	def, err := NewFarmerFSMDef(FSMConfigFromViper())
+	c.Assert(err, check.IsNil)
+	c.Check(def.states, check.HasLen, len(builtinFarmerStates))
+
+	viper.Set("account.fsm", map[string]interface{}{
+		"states": []interface{}{
+			map[interface{}]interface{}{"name": "PROBATION", "as": "ONLINE"},
+		},
+		"transitions": []interface{}{
+			map[interface{}]interface{}{"event": "probation", "src": []interface{}{"ONLINE"}, "dst": "PROBATION"},
+			map[interface{}]interface{}{"event": "release", "src": []interface{}{"PROBATION"}, "dst": "ONLINE"},
+		},
+	})
+	def, err = NewFarmerFSMDef(FSMConfigFromViper())
+	c.Assert(err, check.IsNil)
+	c.Check(def.ReportAs("PROBATION"), check.Equals, pb.FarmerState_ONLINE)
+
+	// src must be a list
+	viper.Set("account.fsm", map[string]interface{}{
+		"transitions": []interface{}{
+			map[interface{}]interface{}{"event": "release", "src": "PROBATION", "dst": "ONLINE"},
+		},
+	})
+	_, err = NewFarmerFSMDef(FSMConfigFromViper())
+	c.Check(err, check.ErrorMatches, "(?s)supervisor/account: invalid account.fsm section.*")
+}
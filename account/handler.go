@@ -18,23 +18,56 @@ package account
 
 import (
 	"errors"
+	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 
-	"github.com/conseweb/supervisor/challenge"
 	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/challenge"
+	"github.com/conseweb/supervisor/clock"
 	"github.com/golang/protobuf/proto"
 	"github.com/looplab/fsm"
-	"github.com/spf13/viper"
+)
+
+var (
+	ErrFarmerSuspended    = errors.New("supervisor/account: farmer is suspended")
+	ErrFarmerBanned       = errors.New("supervisor/account: farmer is banned")
+	ErrFarmerNotFound     = errors.New("supervisor/account: farmer not found")
+	ErrFarmerNotInService = errors.New("supervisor/account: farmer isn't in service")
 )
 
 type FarmerAccountHandler struct {
+	ctr                    *FarmerAccountController
 	account                *pb.FarmerAccount
 	fsm                    *fsm.FSM
 	lostCount              int
 	nextPingTime           int64
 	nextConquerTime        int64
 	nextFarmerChallengeReq *challenge.FarmerChallengeReq
+	// when farmer went online, in UnixNano
+	onlineSince int64
+	// width of blocks range farmer declared in its last ping
+	declaredBlocks uint64
+	// width of blocks range of the last challenge farmer conquered, 0 once it fails or misses one
+	provenBlocks uint64
+	// consecutive challenges missed
+	misses int
+	// transition made by the event in progress, published to hooks once account updated
+	transition *HookEvent
+	// session farmer keeps open, guarded by ctr.l
+	session *Session
+	// opening and closing farmer's sessions, so that farmer reconnecting doesn't race its session dropped
+	sessionL sync.Mutex
+	// taken out of account tree by DropHandlers, its updates are ignored, guarded by ctr.l
+	dropped bool
+}
+
+// ChallengeSupport is what kind of challenges farmer can answer, declared on every ping
+type ChallengeSupport struct {
+	Nonce  bool
+	Sample bool
+	Root   bool
 }
 
 // whether or not need challenge blocks hash
@@ -46,6 +79,17 @@ func (h *FarmerAccountHandler) needChallengeBlocks(highBlockNumber, lowBlockBumb
 		if highBlockNumber < lowBlockBumber {
 			return
 		}
+		// ranges hash cache warmed up are checked without reading blocks
+		if warmed, ok := h.ctr.challenger.WarmedRange(highBlockNumber, lowBlockBumber); ok {
+			brange = warmed
+			return
+		}
+		// a single block is the only range there is to pick
+		if highBlockNumber == lowBlockBumber {
+			brange.HighBlockNumber = highBlockNumber
+			brange.LowBlockNumber = lowBlockBumber
+			return
+		}
 
 		brange.HighBlockNumber = highBlockNumber - uint64(rand.Int63n(int64(highBlockNumber-lowBlockBumber)))
 		brange.LowBlockNumber = lowBlockBumber + uint64(rand.Int63n(int64(brange.HighBlockNumber-lowBlockBumber)))
@@ -54,19 +98,15 @@ func (h *FarmerAccountHandler) needChallengeBlocks(highBlockNumber, lowBlockBumb
 	return
 }
 
-// choose challenge hash type from viper
+// challenge hash type challenger issues
 func (h *FarmerAccountHandler) challengeHashAlgo() pb.HashAlgo {
-	hashAlgo := viper.GetString("farmer.challenge.hashalgo")
-	if hashAlgo == "" {
-		hashAlgo = pb.HashAlgo_SHA256.String()
-	}
-	return pb.HashAlgo(pb.HashAlgo_value[hashAlgo])
+	return h.ctr.challenger.HashAlgo()
 }
 
 // randomly return next ping time
 func (h *FarmerAccountHandler) NextPingTime() int64 {
 	if h.nextPingTime <= 0 {
-		h.nextPingTime = time.Now().Add(nextPingInterval()).UnixNano()
+		h.nextPingTime = clock.Stamp(h.ctr.clock.Now().Add(h.ctr.cfg.PingInterval))
 	}
 
 	return h.nextPingTime
@@ -79,17 +119,78 @@ func (h *FarmerAccountHandler) Account() *pb.FarmerAccount {
 	return h.account
 }
 
-// after online, we set farmer's lost count 0
-func (h *FarmerAccountHandler) afterEvent() {
-	h.account.LastModifiedTime = time.Now().UnixNano()
-	h.account.State = pb.FarmerState(pb.FarmerState_value[h.fsm.Current()])
+// built-in state farmer reports as
+func (h *FarmerAccountHandler) state() pb.FarmerState {
+	return h.ctr.fsm.ReportAs(h.fsm.Current())
+}
+
+// whether or not farmer is in one of states, true if none given
+func (h *FarmerAccountHandler) inStates(states []pb.FarmerState) bool {
+	return accountInStates(h.account, states)
+}
 
-	UpdateFarmerHandler(h)
+// InService tells whether or not a farmer in state is served, with a handler in account tree
+func InService(state pb.FarmerState) bool {
+	return state != pb.FarmerState_OFFLINE && state != pb.FarmerState_BANNED
+}
+
+func accountInStates(account *pb.FarmerAccount, states []pb.FarmerState) bool {
+	if len(states) == 0 {
+		return true
+	}
+	for _, state := range states {
+		if account.State == state {
+			return true
+		}
+	}
+	return false
+}
+
+// times in a row farmer didn't ping in time
+func (h *FarmerAccountHandler) LostCount() int {
+	return h.lostCount
+}
+
+// challenge farmer hasn't conquered yet and when it's due in UnixNano, nil if none
+func (h *FarmerAccountHandler) PendingChallenge() (*challenge.FarmerChallengeReq, int64) {
+	return h.nextFarmerChallengeReq, h.nextConquerTime
+}
+
+// after online, we set farmer's lost count 0, the error is of persisting the change
+func (h *FarmerAccountHandler) afterEvent() error {
+	h.account.LastModifiedTime = clock.Stamp(h.ctr.clock.Now())
+	h.account.FsmState = h.fsm.Current()
+	h.account.State = h.state()
+
+	err := h.ctr.UpdateFarmerHandler(h)
+
+	if transition := h.transition; transition != nil {
+		h.transition = nil
+		h.ctr.hooks.Publish(transition)
+	}
+	return err
+}
+
+// remember the transition fsm just made
+func (h *FarmerAccountHandler) afterTransition(e *fsm.Event) {
+	h.transition = &HookEvent{
+		Kind:     HookTransition,
+		FarmerID: h.account.FarmerID,
+		Time:     h.ctr.clock.Now(),
+		Event:    e.Event,
+		Src:      e.Src,
+		Dst:      e.Dst,
+		State:    h.ctr.fsm.ReportAs(e.Dst),
+	}
 }
 
 func (h *FarmerAccountHandler) OnLine() error {
-	if h.fsm.Can("online") {
-		if err := h.fsm.Event("online"); err != nil {
+	if err := h.checkInService(); err != nil {
+		return err
+	}
+
+	if h.fsm.Can(farmer_event_online) {
+		if err := h.fsm.Event(farmer_event_online); err != nil {
 			logger.Errorf("farmer online return err: %v", err)
 			return err
 		}
@@ -97,64 +198,309 @@ func (h *FarmerAccountHandler) OnLine() error {
 		return errors.New("already online, can not override.")
 	}
 
-	h.lostCount = 0
-	h.afterEvent()
-
-	return nil
+	h.nextPingTime = clock.Stamp(h.ctr.clock.Now().Add(h.ctr.cfg.PingInterval))
+	return h.afterEvent()
 }
 
-func (h *FarmerAccountHandler) Ping(highBlockNumber, lowBlockNumber uint64) (need bool, brange *pb.BlocksRange, hashAlgo pb.HashAlgo, err error) {
-	if h.fsm.Current() == pb.FarmerState_OFFLINE.String() {
+// returns the pending challenge if farmer need to conquer one, nil otherwise
+func (h *FarmerAccountHandler) Ping(highBlockNumber, lowBlockNumber uint64, support ChallengeSupport) (challengeReq *challenge.FarmerChallengeReq, err error) {
+	if err = h.checkInService(); err != nil {
+		return
+	}
+	if h.state() == pb.FarmerState_OFFLINE {
 		err = errors.New("farmer is offline")
 		return
 	}
 
-	need, brange = h.needChallengeBlocks(highBlockNumber, lowBlockNumber)
+	if highBlockNumber >= lowBlockNumber {
+		h.declaredBlocks = highBlockNumber - lowBlockNumber
+	}
+
+	need, brange := h.needChallengeBlocks(highBlockNumber, lowBlockNumber)
 	if need {
-		hashAlgo = h.challengeHashAlgo()
+		if challengeReq, err = h.newChallengeReq(brange, support); err != nil {
+			return
+		}
 
 		// sv cache challenge req
-		req, set := challenge.GetFarmerChallengeReqCache().SetFarmerChallengeReq(h.account.FarmerID, brange.HighBlockNumber, brange.LowBlockNumber, hashAlgo)
-		if set {
+		reqCache := h.ctr.challenger.FarmerChallengeReqCache()
+		if reqCache.AddFarmerChallengeReq(challengeReq) {
 			// set handler's nextConquerTime and nextChallengeReq
-			h.nextConquerTime = time.Now().Add(nextChallengeDelay()).UnixNano()
-			h.nextFarmerChallengeReq = req
+			h.nextConquerTime = clock.Stamp(h.ctr.clock.Now().Add(h.ctr.challenger.Delay()))
+			h.nextFarmerChallengeReq = challengeReq
+			h.publishChallenge(HookChallenge, challengeReq, nil)
+		} else if pending, get := reqCache.GetFarmerChallengeReq(h.account.FarmerID, brange.HighBlockNumber, brange.LowBlockNumber, challengeReq.HashAlgo()); get {
+			// the same challenge is still pending, farmer answers that one
+			challengeReq = pending
+		} else {
+			// the cache is full of others' challenges, farmer is challenged on a later ping instead
+			logger.Warningf("challenge cache is full, farmer(%s) isn't challenged this time", h.account.FarmerID)
+			challengeReq = nil
 		}
 	} else {
-		// if no need to challenge, just add balance h time
-		h.calcBalance()
+		// if no need to challenge, just add balance h time,
+		// a reward not recorded fails the ping, which counts all the same
+		err = h.calcBalance(nil)
 	}
 
+	// the ping deadline moves on
 	h.lostCount = 0
-	h.afterEvent()
+	h.nextPingTime = clock.Stamp(h.ctr.clock.Now().Add(h.ctr.cfg.PingInterval))
+	if updateErr := h.afterEvent(); err == nil {
+		err = updateErr
+	}
 
 	return
 }
 
-func (h *FarmerAccountHandler) ConquerChallenge(highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo, blocksHash string) error {
-	if challenge.ConquerChallenge(h.account.FarmerID, highBlockNumber, lowBlockNumber, hashAlgo, blocksHash) {
-		h.calcBalance()
-	} else {
-		h.punishBalance()
+// challenge kind is chosen by challenger's policy
+func (h *FarmerAccountHandler) newChallengeReq(brange *pb.BlocksRange, support ChallengeSupport) (*challenge.FarmerChallengeReq, error) {
+	kind := h.ctr.challenger.ChallengeKind(support.Sample, support.Root)
+	if kind == pb.ChallengeKind_BLOCKS_SAMPLE {
+		samples, err := h.ctr.challenger.NewSamples(brange.HighBlockNumber, brange.LowBlockNumber)
+		if err == nil {
+			return challenge.NewFarmerSampleChallengeReq(h.account.FarmerID, brange.HighBlockNumber, brange.LowBlockNumber, samples), nil
+		}
+		logger.Warningf("sample blocks[%d, %d] for farmer(%s) err: %v, challenge with blocks hash instead", brange.HighBlockNumber, brange.LowBlockNumber, h.account.FarmerID, err)
+	}
+
+	var nonce []byte
+	if support.Nonce {
+		var err error
+		if nonce, err = h.ctr.challenger.NewNonce(); err != nil {
+			return nil, err
+		}
+	}
+
+	// accumulator may not catch up with the range yet
+	if kind == pb.ChallengeKind_BLOCKS_ROOT && h.ctr.challenger.Committed(brange.HighBlockNumber) {
+		return challenge.NewFarmerRootChallengeReq(h.account.FarmerID, brange.HighBlockNumber, brange.LowBlockNumber, nonce), nil
+	}
+	return challenge.NewFarmerChallengeReq(h.account.FarmerID, brange.HighBlockNumber, brange.LowBlockNumber, h.challengeHashAlgo(), nonce), nil
+}
+
+// blocksHash answers BLOCKS_HASH and BLOCKS_ROOT challenge, proofs answer BLOCKS_SAMPLE one
+func (h *FarmerAccountHandler) ConquerChallenge(highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo, blocksHash string, proofs []*pb.ChunkProof) error {
+	if err := h.checkInService(); err != nil {
+		return err
+	}
+
+	// conquering deletes the request, take it first for rewarding
+	req, _ := h.ctr.challenger.FarmerChallengeReqCache().GetFarmerChallengeReq(h.account.FarmerID, highBlockNumber, lowBlockNumber, hashAlgo)
+	verdict := h.ctr.challenger.Conquer(h.account.FarmerID, highBlockNumber, lowBlockNumber, hashAlgo, blocksHash, proofs)
+	h.publishChallenge(HookVerdict, req, verdict)
+	// the challenge is over either way, its deadline mustn't punish farmer once more
+	h.clearChallenge()
+	if !verdict.OK {
+		err := h.punishBalance(req)
+		// a penalty taking farmer out of service persisted it already
+		if h.state() != pb.FarmerState_SUSPENDED && h.state() != pb.FarmerState_BANNED {
+			if updateErr := h.afterEvent(); err == nil {
+				err = updateErr
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("farmer conquer challenge fail, %v", err)
+		}
 		return errors.New("farmer conquer challenge fail")
 	}
 
+	h.misses = 0
+	h.provenBlocks = highBlockNumber - lowBlockNumber
+	rewardErr := h.calcBalance(req)
 	h.lostCount = 0
-	h.account.LastChallengeTime = time.Now().UnixNano()
-	h.nextConquerTime = 0
-	h.nextFarmerChallengeReq = nil
-	h.afterEvent()
+	h.account.LastChallengeTime = clock.Stamp(h.ctr.clock.Now())
+	updateErr := h.afterEvent()
+
+	// the challenge is over, farmer isn't told it conquered it as long as the reward isn't recorded
+	if rewardErr != nil {
+		return fmt.Errorf("farmer conquered challenge, but %v", rewardErr)
+	}
+	if updateErr != nil {
+		return fmt.Errorf("farmer conquered challenge, but %v", updateErr)
+	}
+	return nil
+}
+
+// tell hooks a challenge issued, or the verdict on it
+func (h *FarmerAccountHandler) publishChallenge(kind HookKind, req *challenge.FarmerChallengeReq, verdict *challenge.Verdict) {
+	h.ctr.hooks.Publish(&HookEvent{
+		Kind:      kind,
+		FarmerID:  h.account.FarmerID,
+		Time:      h.ctr.clock.Now(),
+		Challenge: req,
+		Verdict:   verdict,
+	})
+}
+
+func (h *FarmerAccountHandler) rewardContext(req *challenge.FarmerChallengeReq) *RewardContext {
+	ctx := &RewardContext{
+		Balance:      h.account.Balance,
+		ProvenBlocks: h.provenBlocks,
+		Challenge:    req,
+		Misses:       h.misses,
+	}
+	// blocks farmer no longer declares aren't rewarded, however it proved them before
+	if ctx.ProvenBlocks > h.declaredBlocks {
+		ctx.ProvenBlocks = h.declaredBlocks
+	}
+	if h.onlineSince > 0 {
+		ctx.Uptime = h.ctr.clock.Now().Sub(clock.Time(h.onlineSince))
+	}
+
+	return ctx
+}
+
+// balance only changes along with an entry posted to farmer's journal
+func (h *FarmerAccountHandler) postBalance(reason pb.BalanceReason, balance uint32, req *challenge.FarmerChallengeReq, memo string) error {
+	entry, err := h.ctr.journal.Post(h.account.FarmerID, reason, h.account.Balance, balance, req, memo)
+	if err != nil {
+		logger.Errorf("post farmer(%s) balance %d -> %d (%v) err: %v", h.account.FarmerID, h.account.Balance, balance, reason, err)
+		return fmt.Errorf("supervisor/account: balance change not recorded: %v", err)
+	}
+	h.account.Balance = balance
+
+	h.ctr.hooks.Publish(&HookEvent{
+		Kind:     HookBalance,
+		FarmerID: h.account.FarmerID,
+		Time:     clock.Time(entry.Timestamp),
+		Entry:    entry,
+	})
 
 	return nil
 }
 
-// TODO calc farmer balance
-func (h *FarmerAccountHandler) calcBalance() {
-	h.account.Balance += 100
+// reward a ping, or a conquered challenge if req isn't nil, balance is left as it is if the reward isn't recorded
+func (h *FarmerAccountHandler) calcBalance(req *challenge.FarmerChallengeReq) error {
+	reason := pb.BalanceReason_PING_REWARD
+	if req != nil {
+		reason = pb.BalanceReason_CHALLENGE_SUCCESS
+	}
+	return h.postBalance(reason, addBalance(h.account.Balance, h.ctr.reward.Reward(h.rewardContext(req))), req, "")
+}
+
+// penalize a missed challenge, penalties escalate with consecutive misses,
+// the miss counts towards suspension and ban even if its penalty isn't recorded
+func (h *FarmerAccountHandler) punishBalance(req *challenge.FarmerChallengeReq) error {
+	h.misses++
+	h.provenBlocks = 0
+	penalty := h.ctr.reward.Penalize(h.rewardContext(req))
+	postErr := h.postBalance(pb.BalanceReason_CHALLENGE_MISSED, penalty.Balance, req, "")
+
+	reason := fmt.Sprintf("%d challenges missed in a row", h.misses)
+	switch {
+	case penalty.Ban:
+		logger.Warningf("farmer(%s) banned after %s", h.account.FarmerID, reason)
+		h.Ban(reason)
+	case penalty.Suspend:
+		logger.Warningf("farmer(%s) suspended for %v after %s", h.account.FarmerID, penalty.SuspendFor, reason)
+		h.Suspend(penalty.SuspendFor, reason)
+	}
+
+	return postErr
+}
+
+// a suspended or banned farmer is refused, a suspension past its expiry lapses first
+func (h *FarmerAccountHandler) checkInService() error {
+	h.lapseSuspension()
+
+	switch h.state() {
+	case pb.FarmerState_SUSPENDED:
+		return ErrFarmerSuspended
+	case pb.FarmerState_BANNED:
+		return ErrFarmerBanned
+	}
+
+	return nil
+}
+
+// returns true if farmer's suspension lapsed, the guard of lapse refuses until it expires
+func (h *FarmerAccountHandler) lapseSuspension() bool {
+	if h.state() != pb.FarmerState_SUSPENDED || !h.fsm.Can(farmer_event_lapse) {
+		return false
+	}
+	if err := h.fsm.Event(farmer_event_lapse); err != nil {
+		return false
+	}
+
+	logger.Infof("farmer(%s) suspension lapsed", h.account.FarmerID)
+	h.afterEvent()
+	return true
+}
+
+// Suspend takes farmer out of service for d, suspending a suspended farmer again restarts its suspension
+func (h *FarmerAccountHandler) Suspend(d time.Duration, reason string) error {
+	if h.state() == pb.FarmerState_BANNED {
+		return ErrFarmerBanned
+	}
+
+	if h.fsm.Can(farmer_event_suspend) {
+		if err := h.fsm.Event(farmer_event_suspend); err != nil {
+			logger.Errorf("farmer suspend return err: %v", err)
+			return err
+		}
+	}
+
+	h.account.SuspendedUntil = clock.Stamp(h.ctr.clock.Now().Add(d))
+	h.account.StateReason = reason
+	return h.afterEvent()
+}
+
+// Ban takes farmer out of service until Lift
+func (h *FarmerAccountHandler) Ban(reason string) error {
+	if h.fsm.Can(farmer_event_ban) {
+		if err := h.fsm.Event(farmer_event_ban); err != nil {
+			logger.Errorf("farmer ban return err: %v", err)
+			return err
+		}
+	}
+
+	h.account.SuspendedUntil = 0
+	h.account.StateReason = reason
+	return h.afterEvent()
+}
+
+// Lift puts a suspended or banned farmer back to OFFLINE
+func (h *FarmerAccountHandler) Lift() error {
+	if !h.fsm.Can(farmer_event_lift) {
+		return errors.New("farmer is neither suspended nor banned")
+	}
+	if err := h.fsm.Event(farmer_event_lift); err != nil {
+		logger.Errorf("farmer lift return err: %v", err)
+		return err
+	}
+
+	return h.afterEvent()
+}
+
+// Event fires any event of farmer's state machine, for transitions added by config
+func (h *FarmerAccountHandler) Event(event string) error {
+	if err := h.fsm.Event(event); err != nil {
+		return err
+	}
+
+	return h.afterEvent()
 }
 
-func (h *FarmerAccountHandler) punishBalance() {
-	h.account.Balance = 0
+// farmer out of service has no pending challenge, and its uptime starts over
+func (h *FarmerAccountHandler) leaveService() {
+	h.clearChallenge()
+	h.lostCount = 0
+	h.onlineSince = 0
+}
+
+// drop pending challenge, false if there is none
+func (h *FarmerAccountHandler) clearChallenge() bool {
+	req := h.nextFarmerChallengeReq
+	if req == nil {
+		return false
+	}
+
+	blocksRange := req.BlocksRange()
+	h.ctr.challenger.FarmerChallengeReqCache().DelFarmerChallengeReq(req.FarmerID(), blocksRange.HighBlockNumber, blocksRange.LowBlockNumber, req.HashAlgo())
+	h.nextConquerTime = 0
+	h.nextFarmerChallengeReq = nil
+	return true
 }
 
 func (h *FarmerAccountHandler) Lost() error {
@@ -162,29 +508,25 @@ func (h *FarmerAccountHandler) Lost() error {
 		return errors.New("current lost count <= 0")
 	}
 
-	if h.fsm.Can("lost") {
-		if err := h.fsm.Event("lost"); err != nil {
+	if h.fsm.Can(farmer_event_lost) {
+		if err := h.fsm.Event(farmer_event_lost); err != nil {
 			logger.Errorf("farmer lost return err: %v", err)
 			return err
 		}
 	}
 
-	h.afterEvent()
-
-	return nil
+	return h.afterEvent()
 }
 
 func (h *FarmerAccountHandler) OffLine() error {
-	if h.fsm.Can("offline") {
-		if err := h.fsm.Event("offline"); err != nil {
+	if h.fsm.Can(farmer_event_offline) {
+		if err := h.fsm.Event(farmer_event_offline); err != nil {
 			logger.Errorf("farmer offline return err: %v", err)
 			return err
 		}
 	}
 
-	h.afterEvent()
-
-	return nil
+	return h.afterEvent()
 }
 
 func (h *FarmerAccountHandler) beforeEvent(e *fsm.Event) {
@@ -220,21 +562,3 @@ func bytes2FarmerAccount(fBytes []byte) (*pb.FarmerAccount, error) {
 
 	return account, nil
 }
-
-func nextPingInterval() time.Duration {
-	if interval, err := time.ParseDuration(viper.GetString("farmer.ping.interval")); err == nil {
-		return interval
-	}
-
-	viper.Set("farmer.ping.interval", "900s")
-	return time.Duration(900) * time.Second
-}
-
-func nextChallengeDelay() time.Duration {
-	if delay, err := time.ParseDuration(viper.GetString("farmer.challenge.delay")); err == nil {
-		return delay
-	}
-
-	viper.Set("farmer.challenge.delay", "10s")
-	return time.Duration(10) * time.Second
-}
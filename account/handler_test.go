@@ -17,18 +17,24 @@ limitations under the License.
 package account
 
 import (
+	"errors"
+	"sync"
+	"time"
+
 	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/challenge"
 	"gopkg.in/check.v1"
 )
 
 func (t *TestFarmerAccount) TestOnLine(c *check.C) {
-	handler, _ := NewFarmerHandler("TestOnLine")
+	handler, _ := t.ctr.NewFarmerHandler("TestOnLine")
 	c.Check(handler.OnLine(), check.IsNil)
 	c.Assert(handler.Account().State, check.Equals, pb.FarmerState_ONLINE)
 }
 
 func (t *TestFarmerAccount) TestLost(c *check.C) {
-	handler, _ := NewFarmerHandler("TestLost")
+	handler, _ := t.ctr.NewFarmerHandler("TestLost")
 	c.Check(handler.OnLine(), check.IsNil)
 	c.Assert(handler.Account().State, check.Equals, pb.FarmerState_ONLINE)
 
@@ -38,7 +44,7 @@ func (t *TestFarmerAccount) TestLost(c *check.C) {
 }
 
 func (t *TestFarmerAccount) TestOffLine(c *check.C) {
-	handler, _ := NewFarmerHandler("TestOffLine")
+	handler, _ := t.ctr.NewFarmerHandler("TestOffLine")
 	c.Check(handler.OnLine(), check.IsNil)
 	c.Assert(handler.Account().State, check.Equals, pb.FarmerState_ONLINE)
 
@@ -49,3 +55,249 @@ func (t *TestFarmerAccount) TestOffLine(c *check.C) {
 	c.Check(handler.OffLine(), check.IsNil)
 	c.Assert(handler.Account().State, check.Equals, pb.FarmerState_OFFLINE)
 }
+
+func (t *TestFarmerAccount) TestSuspend(c *check.C) {
+	handler, _ := t.ctr.NewFarmerHandler("TestSuspend")
+	c.Check(handler.OnLine(), check.IsNil)
+
+	c.Check(t.ctr.SuspendFarmer("TestSuspend", time.Hour, "cheating"), check.IsNil)
+	c.Assert(handler.Account().State, check.Equals, pb.FarmerState_SUSPENDED)
+	c.Check(handler.Account().StateReason, check.Equals, "cheating")
+
+	// refused on every call while suspended
+	c.Check(handler.OnLine(), check.Equals, ErrFarmerSuspended)
+	_, err := handler.Ping(100, 20, ChallengeSupport{})
+	c.Check(err, check.Equals, ErrFarmerSuspended)
+	c.Check(handler.ConquerChallenge(100, 20, pb.HashAlgo_SHA256, "", nil), check.Equals, ErrFarmerSuspended)
+
+	// suspended handler is kept in tree, so that checker lapses it
+	_, err = t.ctr.accountTree.Get("TestSuspend")
+	c.Check(err, check.IsNil)
+
+	handler.account.SuspendedUntil = time.Now().Add(-time.Second).UnixNano()
+	t.ctr.checkHandler("TestSuspend")
+	c.Check(handler.Account().State, check.Equals, pb.FarmerState_OFFLINE)
+	c.Check(handler.Account().SuspendedUntil, check.Equals, int64(0))
+	c.Check(handler.OnLine(), check.IsNil)
+}
+
+func (t *TestFarmerAccount) TestSuspensionLapsesOnCall(c *check.C) {
+	handler, _ := t.ctr.NewFarmerHandler("TestSuspensionLapsesOnCall")
+	c.Check(handler.Suspend(-time.Second, "expired"), check.IsNil)
+	c.Assert(handler.Account().State, check.Equals, pb.FarmerState_SUSPENDED)
+
+	c.Check(handler.OnLine(), check.IsNil)
+	c.Check(handler.Account().State, check.Equals, pb.FarmerState_ONLINE)
+}
+
+func (t *TestFarmerAccount) TestBan(c *check.C) {
+	handler, _ := t.ctr.NewFarmerHandler("TestBan")
+	c.Check(handler.Suspend(time.Hour, "first"), check.IsNil)
+	c.Check(t.ctr.BanFarmer("TestBan", "again"), check.IsNil)
+	c.Assert(handler.Account().State, check.Equals, pb.FarmerState_BANNED)
+	c.Check(handler.Account().SuspendedUntil, check.Equals, int64(0))
+
+	c.Check(handler.OnLine(), check.Equals, ErrFarmerBanned)
+	c.Check(handler.Suspend(time.Hour, "milder"), check.Equals, ErrFarmerBanned)
+
+	// banned farmer leaves tree, but stays banned when loaded from storage
+	time.Sleep(time.Millisecond * 100)
+	loaded, err := t.ctr.NewFarmerHandler("TestBan")
+	c.Assert(err, check.IsNil)
+	c.Check(loaded.Account().State, check.Equals, pb.FarmerState_BANNED)
+	c.Check(loaded.OnLine(), check.Equals, ErrFarmerBanned)
+
+	c.Check(t.ctr.LiftFarmer("TestBan"), check.IsNil)
+	c.Check(loaded.Account().State, check.Equals, pb.FarmerState_OFFLINE)
+	c.Check(loaded.Account().StateReason, check.Equals, "")
+	c.Check(loaded.Lift(), check.NotNil)
+	c.Check(loaded.OnLine(), check.IsNil)
+}
+
+func (t *TestFarmerAccount) TestPenaltySuspends(c *check.C) {
+	handler, _ := t.ctr.NewFarmerHandler("TestPenaltySuspends")
+	c.Check(handler.OnLine(), check.IsNil)
+
+	req := challenge.NewFarmerChallengeReq("TestPenaltySuspends", 100, 20, pb.HashAlgo_SHA256, nil)
+	handler.nextConquerTime = time.Now().Add(time.Minute).UnixNano()
+	handler.nextFarmerChallengeReq = req
+	t.ctr.challenger.FarmerChallengeReqCache().AddFarmerChallengeReq(req)
+
+	// the default penalties suspend on the fourth miss in a row
+	handler.misses = 3
+	c.Check(handler.punishBalance(req), check.IsNil)
+	c.Assert(handler.Account().State, check.Equals, pb.FarmerState_SUSPENDED)
+	c.Check(time.Unix(0, handler.Account().SuspendedUntil).After(time.Now().Add(23*time.Hour)), check.Equals, true)
+	c.Check(handler.nextFarmerChallengeReq, check.IsNil)
+
+	_, pending := t.ctr.challenger.FarmerChallengeReqCache().GetFarmerChallengeReq("TestPenaltySuspends", 100, 20, pb.HashAlgo_SHA256)
+	c.Check(pending, check.Equals, false)
+}
+
+// farmer declaring a single block is challenged on that very block
+func (t *TestFarmerAccount) TestChallengeSingleBlock(c *check.C) {
+	handler, _ := t.ctr.NewFarmerHandler("TestChallengeSingleBlock")
+	for i := 0; i < 100; i++ {
+		need, brange := handler.needChallengeBlocks(42, 42)
+		if need {
+			c.Check(brange.HighBlockNumber, check.Equals, uint64(42))
+			c.Check(brange.LowBlockNumber, check.Equals, uint64(42))
+		}
+	}
+}
+
+// a challenge the full cache refused isn't issued, farmer could never conquer it
+func (t *TestFarmerAccount) TestChallengeCacheFull(c *check.C) {
+	cfg := &challenge.Config{
+		HashAlgo: pb.HashAlgo_SHA256,
+		Delay:    time.Second * 10,
+	}
+	reqCache := challenge.NewDefaultFarmerChallengeReqCache(cfg.Delay, 1)
+	_, set := reqCache.SetFarmerChallengeReq("TestChallengeCacheFullOther", 100, 20, pb.HashAlgo_SHA256, nil)
+	c.Assert(set, check.Equals, true)
+	ctr := NewFarmerAccountController(t.ctr.accountStorage, challenge.NewChallenger(cfg, nil, reqCache, challenge.NewDefaultBlocksHashCache(0, 0)), newTestConfig())
+
+	handler, _ := ctr.NewFarmerHandler("TestChallengeCacheFull")
+	c.Check(handler.OnLine(), check.IsNil)
+	for i := 0; i < 20; i++ {
+		req, _ := handler.Ping(100, 20, ChallengeSupport{})
+		c.Check(req, check.IsNil)
+		c.Check(handler.nextFarmerChallengeReq, check.IsNil)
+	}
+
+	_, pending := reqCache.GetFarmerChallengeReq("TestChallengeCacheFullOther", 100, 20, pb.HashAlgo_SHA256)
+	c.Check(pending, check.Equals, true)
+}
+
+// a challenge farmer failed is over, its deadline passing doesn't count another miss
+func (t *TestFarmerAccount) TestFailedConquerPunishedOnce(c *check.C) {
+	handler, _ := t.ctr.NewFarmerHandler("TestFailedConquerPunishedOnce")
+	c.Check(handler.OnLine(), check.IsNil)
+
+	req := challenge.NewFarmerChallengeReq("TestFailedConquerPunishedOnce", 100, 20, pb.HashAlgo_SHA256, nil)
+	handler.nextConquerTime = time.Now().Add(time.Second).UnixNano()
+	handler.nextFarmerChallengeReq = req
+	t.ctr.challenger.BlocksHashCache().SetBlocksHashToCache(100, 20, pb.HashAlgo_SHA256, "blocks hash")
+	t.ctr.challenger.FarmerChallengeReqCache().AddFarmerChallengeReq(req)
+	c.Check(handler.ConquerChallenge(100, 20, pb.HashAlgo_SHA256, "wrong", nil), check.NotNil)
+	c.Check(handler.misses, check.Equals, 1)
+	c.Check(handler.nextFarmerChallengeReq, check.IsNil)
+	balance := handler.Account().Balance
+
+	time.Sleep(time.Second)
+	t.ctr.checkHandler("TestFailedConquerPunishedOnce")
+	c.Check(handler.misses, check.Equals, 1)
+	c.Check(handler.Account().Balance, check.Equals, balance)
+}
+
+// failingStorage fails every write
+type failingStorage struct {
+	store.Storage
+}
+
+func (s *failingStorage) Set(key, value []byte) error {
+	return errors.New("storage is broken")
+}
+
+func (s *failingStorage) SetCF(cf string, key, value []byte) error {
+	return errors.New("storage is broken")
+}
+
+// a balance change the journal can't record isn't made, and whoever made it is told so
+func (t *TestFarmerAccount) TestBalanceNotRecorded(c *check.C) {
+	handler, _ := t.ctr.NewFarmerHandler("TestBalanceNotRecorded")
+	c.Check(handler.OnLine(), check.IsNil)
+	balance := handler.Account().Balance
+
+	journal := t.ctr.journal
+	t.ctr.journal = &Journal{l: &sync.Mutex{}, storage: &failingStorage{Storage: journal.storage}, clock: journal.clock}
+	defer func() { t.ctr.journal = journal }()
+
+	c.Check(handler.calcBalance(nil), check.NotNil)
+	c.Check(handler.Account().Balance, check.Equals, balance)
+
+	// the miss counts all the same
+	req := challenge.NewFarmerChallengeReq("TestBalanceNotRecorded", 100, 20, pb.HashAlgo_SHA256, nil)
+	c.Check(handler.punishBalance(req), check.NotNil)
+	c.Check(handler.Account().Balance, check.Equals, balance)
+	c.Check(handler.misses, check.Equals, 1)
+}
+
+func (t *TestFarmerAccount) TestFarmerEvent(c *check.C) {
+	def, err := NewFarmerFSMDef(newProbationFSMConfig())
+	c.Assert(err, check.IsNil)
+	builtin := t.ctr.fsm
+	t.ctr.fsm = def
+	defer func() { t.ctr.fsm = builtin }()
+
+	handler, _ := t.ctr.NewFarmerHandler("TestFarmerEvent")
+	c.Check(handler.OnLine(), check.IsNil)
+
+	// farmer on probation still reports as online
+	c.Check(t.ctr.FarmerEvent("TestFarmerEvent", "probation"), check.IsNil)
+	c.Check(handler.Account().State, check.Equals, pb.FarmerState_ONLINE)
+	c.Check(handler.Account().FsmState, check.Equals, "PROBATION")
+	c.Check(handler.checkInService(), check.IsNil)
+
+	c.Check(handler.Event("release"), check.IsNil)
+	c.Check(handler.Account().FsmState, check.Equals, "ONLINE")
+	c.Check(handler.Event("release"), check.NotNil)
+
+	c.Check(handler.Event("probation"), check.IsNil)
+	c.Check(handler.OffLine(), check.IsNil)
+	c.Check(handler.Account().State, check.Equals, pb.FarmerState_OFFLINE)
+	c.Check(handler.onlineSince, check.Equals, int64(0))
+}
+
+func (t *TestFarmerAccount) TestHooks(c *check.C) {
+	var transitions []string
+	var reasons []pb.BalanceReason
+	mine := func(e *HookEvent) bool { return e.FarmerID == "TestHooks" }
+	c.Assert(t.ctr.Hooks().Subscribe(HookSubscription{Name: "TestHooks.transitions", Filter: mine}, func(e *HookEvent) error {
+		switch e.Kind {
+		case HookTransition:
+			transitions = append(transitions, e.Src+"->"+e.Dst)
+		case HookBalance:
+			reasons = append(reasons, e.Entry.Reason)
+		}
+		return nil
+	}), check.IsNil)
+	defer t.ctr.Hooks().Unsubscribe("TestHooks.transitions")
+
+	handler, _ := t.ctr.NewFarmerHandler("TestHooks")
+	c.Check(handler.OnLine(), check.IsNil)
+	handler.lostCount++
+	c.Check(handler.Lost(), check.IsNil)
+	c.Check(handler.OffLine(), check.IsNil)
+	c.Check(t.ctr.AdjustBalance("TestHooks", 100, "opening"), check.IsNil)
+
+	c.Check(transitions, check.DeepEquals, []string{"OFFLINE->ONLINE", "ONLINE->LOST", "LOST->OFFLINE"})
+	c.Check(reasons, check.DeepEquals, []pb.BalanceReason{pb.BalanceReason_ADMIN_ADJUSTMENT})
+}
+
+func (t *TestFarmerAccount) TestVerdictHook(c *check.C) {
+	var kinds []HookKind
+	var verdict *challenge.Verdict
+	c.Assert(t.ctr.Hooks().Subscribe(HookSubscription{Name: "TestVerdictHook", Filter: func(e *HookEvent) bool { return e.FarmerID == "TestVerdictHook" }}, func(e *HookEvent) error {
+		kinds = append(kinds, e.Kind)
+		if e.Kind == HookVerdict {
+			verdict = e.Verdict
+		}
+		return nil
+	}), check.IsNil)
+	defer t.ctr.Hooks().Unsubscribe("TestVerdictHook")
+
+	handler, _ := t.ctr.NewFarmerHandler("TestVerdictHook")
+	c.Check(handler.OnLine(), check.IsNil)
+	// test challenger has no block source, blocks hash comes from cache
+	t.ctr.challenger.BlocksHashCache().SetBlocksHashToCache(100, 20, pb.HashAlgo_SHA256, "blocks hash")
+	t.ctr.challenger.FarmerChallengeReqCache().AddFarmerChallengeReq(challenge.NewFarmerChallengeReq("TestVerdictHook", 100, 20, pb.HashAlgo_SHA256, nil))
+	c.Check(handler.ConquerChallenge(100, 20, pb.HashAlgo_SHA256, "wrong", nil), check.NotNil)
+
+	// verdict comes before the penalty it leads to
+	c.Check(kinds, check.DeepEquals, []HookKind{HookTransition, HookVerdict, HookBalance})
+	c.Assert(verdict, check.NotNil)
+	c.Check(verdict.OK, check.Equals, false)
+	c.Check(verdict.FarmerHash, check.Equals, "wrong")
+	c.Check(verdict.ServerHash, check.Equals, challenge.FarmerBindConquerHash("TestVerdictHook", pb.HashAlgo_SHA256, "blocks hash"))
+}
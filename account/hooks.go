@@ -0,0 +1,357 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/challenge"
+)
+
+const (
+	default_hook_timeout    = time.Second * 5
+	default_hook_queue_size = 1024
+)
+
+var (
+	ErrHooksClosed = errors.New("supervisor/account: hooks closed")
+)
+
+// HookKind is what a hook event is about
+type HookKind int
+
+const (
+	// farmer's state machine made a transition
+	HookTransition HookKind = iota
+	// farmer's balance changed, a missed challenge is one with CHALLENGE_MISSED reason
+	HookBalance
+	// a challenge issued to farmer
+	HookChallenge
+	// supervisor decided on farmer's answer to a challenge, or on a challenge missed
+	HookVerdict
+)
+
+func (k HookKind) String() string {
+	switch k {
+	case HookTransition:
+		return "transition"
+	case HookBalance:
+		return "balance"
+	case HookChallenge:
+		return "challenge"
+	case HookVerdict:
+		return "verdict"
+	default:
+		return fmt.Sprintf("HookKind(%d)", int(k))
+	}
+}
+
+// HookEvent is what hooks are notified of, shared by all hooks, so read only
+type HookEvent struct {
+	Kind     HookKind
+	FarmerID string
+	Time     time.Time
+
+	// transition, Src and Dst are states of the state machine, State is the one Dst reports as
+	Event string
+	Src   string
+	Dst   string
+	State pb.FarmerState
+
+	// balance change, the entry posted to farmer's journal
+	Entry *pb.BalanceEntry
+
+	// challenge issued or decided on, nil for verdict on a challenge not found
+	Challenge *challenge.FarmerChallengeReq
+	Verdict   *challenge.Verdict
+}
+
+func (e *HookEvent) String() string {
+	switch {
+	case e.Kind == HookBalance && e.Entry != nil:
+		return fmt.Sprintf("farmer(%s) %v of %d, balance %d", e.FarmerID, e.Entry.Reason, e.Entry.Amount, e.Entry.Balance)
+	case e.Kind == HookChallenge && e.Challenge != nil:
+		brange := e.Challenge.BlocksRange()
+		return fmt.Sprintf("farmer(%s) challenged %v of blocks[%d, %d]", e.FarmerID, e.Challenge.Kind(), brange.HighBlockNumber, brange.LowBlockNumber)
+	case e.Kind == HookVerdict && e.Verdict != nil:
+		return fmt.Sprintf("farmer(%s) conquer ok: %v %s", e.FarmerID, e.Verdict.OK, e.Verdict.Reason)
+	}
+	return fmt.Sprintf("farmer(%s) %s: %s -> %s", e.FarmerID, e.Event, e.Src, e.Dst)
+}
+
+// Hook reacts to a farmer event, an error is logged and counted, never stops others
+type Hook func(e *HookEvent) error
+
+// HookSubscription tells what a hook receives and how
+type HookSubscription struct {
+	// unique among subscriptions
+	Name string
+	// events hook receives, nil means all
+	Filter func(e *HookEvent) bool
+	// async hook gets events from its own queue, sync one is called before publisher goes on
+	Async bool
+	// how long a hook can take on one event, publisher stops waiting on a sync hook after it,
+	// 0 means default
+	Timeout time.Duration
+	// async hook's queue, events are dropped when it is full, 0 means default
+	QueueSize int
+}
+
+// OnTransitionTo filters transitions into states reporting as one of states, all transitions if none given
+func OnTransitionTo(states ...pb.FarmerState) func(e *HookEvent) bool {
+	return func(e *HookEvent) bool {
+		if e.Kind != HookTransition {
+			return false
+		}
+		if len(states) == 0 {
+			return true
+		}
+		for _, state := range states {
+			if e.State == state {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// OnBalanceChange filters balance changes of one of reasons, all balance changes if none given
+func OnBalanceChange(reasons ...pb.BalanceReason) func(e *HookEvent) bool {
+	return func(e *HookEvent) bool {
+		if e.Kind != HookBalance || e.Entry == nil {
+			return false
+		}
+		if len(reasons) == 0 {
+			return true
+		}
+		for _, reason := range reasons {
+			if e.Entry.Reason == reason {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// HookStats counts how a hook's deliveries went
+type HookStats struct {
+	Delivered uint64
+	Failed    uint64
+	TimedOut  uint64
+	// async only, queue was full
+	Dropped uint64
+}
+
+type hookSub struct {
+	HookSubscription
+	hook  Hook
+	queue chan *HookEvent
+
+	delivered uint64
+	failed    uint64
+	timedOut  uint64
+	dropped   uint64
+}
+
+// Hooks is the registry of hooks on farmer events,
+// a hook failing, panicking or hanging affects nothing but its own stats
+type Hooks struct {
+	l      *sync.RWMutex
+	subs   []*hookSub
+	closed bool
+	wg     *sync.WaitGroup
+}
+
+func NewHooks() *Hooks {
+	return &Hooks{
+		l:  &sync.RWMutex{},
+		wg: &sync.WaitGroup{},
+	}
+}
+
+// Subscribe adds hook to registry, an async one starts working on its queue at once
+func (hs *Hooks) Subscribe(sub HookSubscription, hook Hook) error {
+	if sub.Name == "" || hook == nil {
+		return errors.New("supervisor/account: hook needs a name and a func")
+	}
+	if sub.Timeout <= 0 {
+		sub.Timeout = default_hook_timeout
+	}
+	if sub.QueueSize <= 0 {
+		sub.QueueSize = default_hook_queue_size
+	}
+
+	hs.l.Lock()
+	defer hs.l.Unlock()
+
+	if hs.closed {
+		return ErrHooksClosed
+	}
+	for _, s := range hs.subs {
+		if s.Name == sub.Name {
+			return fmt.Errorf("supervisor/account: hook %s subscribed twice", sub.Name)
+		}
+	}
+
+	s := &hookSub{
+		HookSubscription: sub,
+		hook:             hook,
+	}
+	if sub.Async {
+		s.queue = make(chan *HookEvent, sub.QueueSize)
+		hs.wg.Add(1)
+		go hs.work(s)
+	}
+	hs.subs = append(hs.subs, s)
+
+	return nil
+}
+
+// Unsubscribe removes hook, an async one still works off events already queued
+func (hs *Hooks) Unsubscribe(name string) error {
+	hs.l.Lock()
+	defer hs.l.Unlock()
+
+	for i, s := range hs.subs {
+		if s.Name == name {
+			hs.subs = append(hs.subs[:i], hs.subs[i+1:]...)
+			if s.queue != nil {
+				close(s.queue)
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("supervisor/account: hook %s not subscribed", name)
+}
+
+// Stats returns how hook's deliveries went, false if not subscribed
+func (hs *Hooks) Stats(name string) (HookStats, bool) {
+	hs.l.RLock()
+	defer hs.l.RUnlock()
+
+	for _, s := range hs.subs {
+		if s.Name == name {
+			return HookStats{
+				Delivered: atomic.LoadUint64(&s.delivered),
+				Failed:    atomic.LoadUint64(&s.failed),
+				TimedOut:  atomic.LoadUint64(&s.timedOut),
+				Dropped:   atomic.LoadUint64(&s.dropped),
+			}, true
+		}
+	}
+
+	return HookStats{}, false
+}
+
+// Publish queues e for async hooks, then calls sync ones in subscription order,
+// it never blocks on a full queue, nor waits on a sync hook more than its timeout
+func (hs *Hooks) Publish(e *HookEvent) {
+	if hs == nil {
+		return
+	}
+
+	var syncSubs []*hookSub
+	hs.l.RLock()
+	if hs.closed {
+		hs.l.RUnlock()
+		return
+	}
+	for _, s := range hs.subs {
+		if s.Filter != nil && !s.Filter(e) {
+			continue
+		}
+		if !s.Async {
+			syncSubs = append(syncSubs, s)
+			continue
+		}
+
+		select {
+		case s.queue <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			logger.Warningf("hook %s queue is full, drop %v", s.Name, e)
+		}
+	}
+	hs.l.RUnlock()
+
+	// sync hooks are called out of lock, so that they can subscribe or unsubscribe
+	for _, s := range syncSubs {
+		s.call(e)
+	}
+}
+
+// Close stops accepting events, and waits for async hooks working off their queues
+func (hs *Hooks) Close() {
+	hs.l.Lock()
+	if hs.closed {
+		hs.l.Unlock()
+		return
+	}
+	hs.closed = true
+	for _, s := range hs.subs {
+		if s.queue != nil {
+			close(s.queue)
+		}
+	}
+	hs.subs = nil
+	hs.l.Unlock()
+
+	hs.wg.Wait()
+}
+
+func (hs *Hooks) work(s *hookSub) {
+	defer hs.wg.Done()
+
+	for e := range s.queue {
+		s.call(e)
+	}
+}
+
+// call hook in its own goroutine, a hanging one is left behind after timeout
+func (s *hookSub) call(e *HookEvent) {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- s.hook(e)
+	}()
+
+	timer := time.NewTimer(s.Timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			atomic.AddUint64(&s.failed, 1)
+			logger.Warningf("hook %s on %v err: %v", s.Name, e, err)
+			return
+		}
+		atomic.AddUint64(&s.delivered, 1)
+	case <-timer.C:
+		atomic.AddUint64(&s.timedOut, 1)
+		logger.Warningf("hook %s on %v timed out after %v", s.Name, e, s.Timeout)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"gopkg.in/check.v1"
+)
+
+type TestHooks struct {
+	hooks *Hooks
+}
+
+var _ = check.Suite(&TestHooks{})
+
+func (t *TestHooks) SetUpTest(c *check.C) {
+	t.hooks = NewHooks()
+}
+
+func (t *TestHooks) TearDownTest(c *check.C) {
+	t.hooks.Close()
+}
+
+func newTestTransition(state pb.FarmerState) *HookEvent {
+	return &HookEvent{Kind: HookTransition, FarmerID: "farmer", Time: time.Now(), Event: "test", Dst: state.String(), State: state}
+}
+
+func newTestBalanceChange(reason pb.BalanceReason) *HookEvent {
+	return &HookEvent{Kind: HookBalance, FarmerID: "farmer", Time: time.Now(), Entry: &pb.BalanceEntry{FarmerID: "farmer", Reason: reason}}
+}
+
+// collects events a hook receives
+type hookRecorder struct {
+	l      sync.Mutex
+	events []*HookEvent
+}
+
+func (r *hookRecorder) hook(e *HookEvent) error {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.events = append(r.events, e)
+	return nil
+}
+
+func (r *hookRecorder) len() int {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return len(r.events)
+}
+
+func (t *TestHooks) TestSyncFilter(c *check.C) {
+	lost, missed := &hookRecorder{}, &hookRecorder{}
+	c.Assert(t.hooks.Subscribe(HookSubscription{Name: "lost", Filter: OnTransitionTo(pb.FarmerState_LOST, pb.FarmerState_OFFLINE)}, lost.hook), check.IsNil)
+	c.Assert(t.hooks.Subscribe(HookSubscription{Name: "missed", Filter: OnBalanceChange(pb.BalanceReason_CHALLENGE_MISSED)}, missed.hook), check.IsNil)
+
+	t.hooks.Publish(newTestTransition(pb.FarmerState_ONLINE))
+	t.hooks.Publish(newTestTransition(pb.FarmerState_LOST))
+	t.hooks.Publish(newTestTransition(pb.FarmerState_OFFLINE))
+	t.hooks.Publish(newTestBalanceChange(pb.BalanceReason_PING_REWARD))
+	t.hooks.Publish(newTestBalanceChange(pb.BalanceReason_CHALLENGE_MISSED))
+
+	// sync hooks are done when publish returns
+	c.Check(lost.len(), check.Equals, 2)
+	c.Check(missed.len(), check.Equals, 1)
+	c.Check(missed.events[0].Entry.Reason, check.Equals, pb.BalanceReason_CHALLENGE_MISSED)
+
+	stats, ok := t.hooks.Stats("lost")
+	c.Check(ok, check.Equals, true)
+	c.Check(stats, check.Equals, HookStats{Delivered: 2})
+}
+
+func (t *TestHooks) TestSubscribe(c *check.C) {
+	r := &hookRecorder{}
+	c.Check(t.hooks.Subscribe(HookSubscription{Name: "dup"}, r.hook), check.IsNil)
+	c.Check(t.hooks.Subscribe(HookSubscription{Name: "dup"}, r.hook), check.NotNil)
+	c.Check(t.hooks.Subscribe(HookSubscription{}, r.hook), check.NotNil)
+	c.Check(t.hooks.Subscribe(HookSubscription{Name: "nil"}, nil), check.NotNil)
+
+	c.Check(t.hooks.Unsubscribe("dup"), check.IsNil)
+	c.Check(t.hooks.Unsubscribe("dup"), check.NotNil)
+	t.hooks.Publish(newTestTransition(pb.FarmerState_ONLINE))
+	c.Check(r.len(), check.Equals, 0)
+
+	_, ok := t.hooks.Stats("dup")
+	c.Check(ok, check.Equals, false)
+}
+
+func (t *TestHooks) TestAsync(c *check.C) {
+	r := &hookRecorder{}
+	c.Assert(t.hooks.Subscribe(HookSubscription{Name: "async", Async: true}, r.hook), check.IsNil)
+
+	for i := 0; i < 10; i++ {
+		t.hooks.Publish(newTestTransition(pb.FarmerState_ONLINE))
+	}
+
+	// close works off the queue
+	t.hooks.Close()
+	c.Check(r.len(), check.Equals, 10)
+	c.Check(t.hooks.Subscribe(HookSubscription{Name: "late"}, r.hook), check.Equals, ErrHooksClosed)
+}
+
+func (t *TestHooks) TestAsyncQueueFull(c *check.C) {
+	release := make(chan struct{})
+	blocked := func(e *HookEvent) error {
+		<-release
+		return nil
+	}
+	c.Assert(t.hooks.Subscribe(HookSubscription{Name: "blocked", Async: true, QueueSize: 1}, blocked), check.IsNil)
+
+	// one being worked on, one queued, the rest dropped, none of them blocks publisher
+	t.hooks.Publish(newTestTransition(pb.FarmerState_ONLINE))
+	time.Sleep(time.Millisecond * 50)
+	for i := 0; i < 4; i++ {
+		t.hooks.Publish(newTestTransition(pb.FarmerState_ONLINE))
+	}
+	stats, _ := t.hooks.Stats("blocked")
+	c.Check(stats.Dropped, check.Equals, uint64(3))
+
+	close(release)
+	t.hooks.Close()
+}
+
+func (t *TestHooks) TestIsolation(c *check.C) {
+	hang := make(chan struct{})
+	defer close(hang)
+
+	r := &hookRecorder{}
+	c.Assert(t.hooks.Subscribe(HookSubscription{Name: "failing"}, func(e *HookEvent) error { return errors.New("dashboard down") }), check.IsNil)
+	c.Assert(t.hooks.Subscribe(HookSubscription{Name: "panicking"}, func(e *HookEvent) error { panic("teller gone") }), check.IsNil)
+	c.Assert(t.hooks.Subscribe(HookSubscription{Name: "hanging", Timeout: time.Millisecond * 50}, func(e *HookEvent) error {
+		<-hang
+		return nil
+	}), check.IsNil)
+	c.Assert(t.hooks.Subscribe(HookSubscription{Name: "recorder"}, r.hook), check.IsNil)
+
+	start := time.Now()
+	t.hooks.Publish(newTestTransition(pb.FarmerState_LOST))
+	c.Check(time.Since(start) < time.Second, check.Equals, true)
+	c.Check(r.len(), check.Equals, 1)
+
+	failing, _ := t.hooks.Stats("failing")
+	c.Check(failing, check.Equals, HookStats{Failed: 1})
+	panicking, _ := t.hooks.Stats("panicking")
+	c.Check(panicking, check.Equals, HookStats{Failed: 1})
+	hanging, _ := t.hooks.Stats("hanging")
+	c.Check(hanging, check.Equals, HookStats{TimedOut: 1})
+}
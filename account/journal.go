@@ -0,0 +1,313 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/challenge"
+	"github.com/conseweb/supervisor/clock"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	// counterpart accounts of farmers' balance entries
+	JournalAccountRewards   = "supervisor:rewards"
+	JournalAccountPenalties = "supervisor:penalties"
+	JournalAccountAdmin     = "supervisor:admin"
+	JournalAccountOpening   = "supervisor:opening"
+
+	journal_entry_key = byte(0)
+	journal_head_key  = byte(1)
+
+	default_journal_page_limit = 100
+	max_journal_page_limit     = 1000
+)
+
+// Journal keeps append only balance journals of farmers in journal column family,
+// farmer's balance is the fold of its journal, entries move balance between farmer and a supervisor account.
+// entry n is keyed by len(farmerKey), farmerKey, 0, n, head of the journal by len(farmerKey), farmerKey, 1,
+// an entry is committed once head moves onto it
+type Journal struct {
+	l       *sync.Mutex
+	storage store.Storage
+	// entries are timestamped by it
+	clock clock.Clock
+}
+
+// last committed entry of a journal
+type journalHead struct {
+	Seq     uint64 `json:"seq"`
+	Balance uint32 `json:"balance"`
+}
+
+func NewJournal(storage store.Storage) *Journal {
+	return &Journal{
+		l:       &sync.Mutex{},
+		storage: storage,
+		clock:   clock.Real(),
+	}
+}
+
+// account name of the farmer in entries
+func JournalFarmerAccount(farmerId string) string {
+	return "farmer:" + farmerId
+}
+
+func journalPrefix(farmerId string) []byte {
+	farmerKey := farmerId2Key(farmerId)
+	prefix := make([]byte, 2, 2+len(farmerKey))
+	binary.BigEndian.PutUint16(prefix, uint16(len(farmerKey)))
+	return append(prefix, farmerKey...)
+}
+
+func journalEntryKey(farmerId string, seq uint64) []byte {
+	key := append(journalPrefix(farmerId), journal_entry_key)
+	seqBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqBytes, seq)
+	return append(key, seqBytes...)
+}
+
+func journalHeadKey(farmerId string) []byte {
+	return append(journalPrefix(farmerId), journal_head_key)
+}
+
+// head of farmer's journal, nil if it has none
+func (j *Journal) head(farmerId string) (*journalHead, error) {
+	value, err := j.storage.GetCF(store.JournalColumnFamily, journalHeadKey(farmerId))
+	if err == store.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	head := &journalHead{}
+	if err := json.Unmarshal(value, head); err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
+// Balance is the balance farmer's journal ends with, false if farmer has no journal yet
+func (j *Journal) Balance(farmerId string) (uint32, bool, error) {
+	j.l.Lock()
+	defer j.l.Unlock()
+
+	head, err := j.head(farmerId)
+	if err != nil || head == nil {
+		return 0, false, err
+	}
+	return head.Balance, true, nil
+}
+
+// Post appends an entry moving farmer's balance from before to after, for reason.
+// a farmer starting its journal with a balance gets an OPENING_BALANCE entry first,
+// before must be what the journal ends with, or the balance has been changed behind the journal
+func (j *Journal) Post(farmerId string, reason pb.BalanceReason, before, after uint32, req *challenge.FarmerChallengeReq, memo string) (*pb.BalanceEntry, error) {
+	j.l.Lock()
+	defer j.l.Unlock()
+
+	head, err := j.head(farmerId)
+	if err != nil {
+		return nil, err
+	}
+	now := clock.Stamp(j.clock.Now())
+	if head == nil {
+		head = &journalHead{}
+		if before > 0 {
+			opening := newBalanceEntry(farmerId, pb.BalanceReason_OPENING_BALANCE, 0, before, now)
+			if head, err = j.append(head, opening); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if head.Balance != before {
+		return nil, fmt.Errorf("supervisor/account: farmer(%s) balance %d, but journal ends with %d", farmerId, before, head.Balance)
+	}
+
+	entry := newBalanceEntry(farmerId, reason, before, after, now)
+	entry.Memo = memo
+	if req != nil {
+		entry.BlocksRange = req.BlocksRange()
+		entry.ChallengeKind = req.Kind()
+	}
+	if _, err := j.append(head, entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// entry at timestamp, with debit and credit sides set by the direction of the change
+func newBalanceEntry(farmerId string, reason pb.BalanceReason, before, after uint32, timestamp int64) *pb.BalanceEntry {
+	counterpart := JournalAccountRewards
+	switch reason {
+	case pb.BalanceReason_OPENING_BALANCE:
+		counterpart = JournalAccountOpening
+	case pb.BalanceReason_CHALLENGE_MISSED:
+		counterpart = JournalAccountPenalties
+	case pb.BalanceReason_ADMIN_ADJUSTMENT:
+		counterpart = JournalAccountAdmin
+	}
+
+	entry := &pb.BalanceEntry{
+		FarmerID:  farmerId,
+		Reason:    reason,
+		Balance:   after,
+		Timestamp: timestamp,
+	}
+	if after >= before {
+		entry.Debit, entry.Credit, entry.Amount = counterpart, JournalFarmerAccount(farmerId), after-before
+	} else {
+		entry.Debit, entry.Credit, entry.Amount = JournalFarmerAccount(farmerId), counterpart, before-after
+	}
+
+	return entry
+}
+
+// caller must hold the lock, entry goes first and head last
+func (j *Journal) append(head *journalHead, entry *pb.BalanceEntry) (*journalHead, error) {
+	entry.Seq = head.Seq + 1
+	entryBytes, err := proto.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.storage.SetCF(store.JournalColumnFamily, journalEntryKey(entry.FarmerID, entry.Seq), entryBytes); err != nil {
+		return nil, err
+	}
+
+	next := &journalHead{Seq: entry.Seq, Balance: entry.Balance}
+	headBytes, err := json.Marshal(next)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.storage.SetCF(store.JournalColumnFamily, journalHeadKey(entry.FarmerID), headBytes); err != nil {
+		return nil, err
+	}
+
+	return next, nil
+}
+
+// walk committed entries of farmer's journal after seq afterSeq, until fn returns false
+func (j *Journal) walk(farmerId string, head *journalHead, afterSeq uint64, fn func(entry *pb.BalanceEntry) bool) error {
+	prefix := append(journalPrefix(farmerId), journal_entry_key)
+
+	var err error
+	seekErr := j.storage.SeekCF(store.JournalColumnFamily, journalEntryKey(farmerId, afterSeq+1), func(key, value []byte) bool {
+		if !bytes.HasPrefix(key, prefix) {
+			return false
+		}
+
+		entry := &pb.BalanceEntry{}
+		if err = proto.Unmarshal(value, entry); err != nil {
+			return false
+		}
+		// written, but head never moved onto it
+		if entry.Seq > head.Seq {
+			return false
+		}
+		return fn(entry)
+	})
+	if seekErr != nil {
+		return seekErr
+	}
+
+	return err
+}
+
+// History pages through farmer's journal, returns at most limit entries after seq afterSeq,
+// next is afterSeq of the next page, 0 if there is no more, balance is what the journal ends with
+func (j *Journal) History(farmerId string, afterSeq uint64, limit int) (entries []*pb.BalanceEntry, next uint64, balance uint32, err error) {
+	if limit <= 0 {
+		limit = default_journal_page_limit
+	}
+	if limit > max_journal_page_limit {
+		limit = max_journal_page_limit
+	}
+
+	j.l.Lock()
+	head, err := j.head(farmerId)
+	j.l.Unlock()
+	if err != nil || head == nil {
+		return
+	}
+
+	entries = []*pb.BalanceEntry{}
+	err = j.walk(farmerId, head, afterSeq, func(entry *pb.BalanceEntry) bool {
+		entries = append(entries, entry)
+		return len(entries) < limit
+	})
+	if err != nil {
+		return
+	}
+
+	if len(entries) > 0 && entries[len(entries)-1].Seq < head.Seq {
+		next = entries[len(entries)-1].Seq
+	}
+	balance = head.Balance
+	return
+}
+
+// Fold replays farmer's whole journal, checks every entry follows the one before it,
+// returns the balance it folds to
+func (j *Journal) Fold(farmerId string) (uint32, error) {
+	j.l.Lock()
+	head, err := j.head(farmerId)
+	j.l.Unlock()
+	if err != nil || head == nil {
+		return 0, err
+	}
+
+	farmerAccount := JournalFarmerAccount(farmerId)
+	seq, balance := uint64(0), uint32(0)
+	var broken error
+	err = j.walk(farmerId, head, 0, func(entry *pb.BalanceEntry) bool {
+		seq++
+		switch {
+		case entry.Seq != seq:
+			broken = fmt.Errorf("entry %d missing", seq)
+		case entry.Credit == farmerAccount && entry.Debit != farmerAccount && balance+entry.Amount >= balance:
+			balance += entry.Amount
+		case entry.Debit == farmerAccount && entry.Credit != farmerAccount && balance >= entry.Amount:
+			balance -= entry.Amount
+		default:
+			broken = fmt.Errorf("entry %d doesn't move farmer's balance %d", seq, balance)
+		}
+		if broken == nil && entry.Balance != balance {
+			broken = fmt.Errorf("entry %d ends with balance %d, folds to %d", seq, entry.Balance, balance)
+		}
+		return broken == nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if broken == nil && (seq != head.Seq || balance != head.Balance) {
+		broken = fmt.Errorf("journal folds to entry %d balance %d, head is entry %d balance %d", seq, balance, head.Seq, head.Balance)
+	}
+	if broken != nil {
+		return 0, fmt.Errorf("supervisor/account: farmer(%s) balance journal broken, %v", farmerId, broken)
+	}
+
+	return balance, nil
+}
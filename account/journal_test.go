@@ -0,0 +1,211 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/challenge"
+	"github.com/golang/protobuf/proto"
+	"gopkg.in/check.v1"
+)
+
+type TestBalanceJournal struct {
+	dbpath  string
+	storage store.Storage
+	journal *Journal
+}
+
+var _ = check.Suite(&TestBalanceJournal{})
+
+func (t *TestBalanceJournal) SetUpTest(c *check.C) {
+	t.dbpath = filepath.Join(os.TempDir(), "testBalanceJournal")
+	os.RemoveAll(t.dbpath)
+
+	var err error
+	t.storage, err = store.NewStore("rocksdb", t.dbpath)
+	c.Assert(err, check.IsNil)
+	t.journal = NewJournal(t.storage)
+}
+
+func (t *TestBalanceJournal) TearDownTest(c *check.C) {
+	t.storage.Close()
+	os.RemoveAll(t.dbpath)
+}
+
+func (t *TestBalanceJournal) TestPostAndFold(c *check.C) {
+	req := challenge.NewFarmerSampleChallengeReq("TestPostAndFold", 100, 20, nil)
+
+	entry, err := t.journal.Post("TestPostAndFold", pb.BalanceReason_PING_REWARD, 0, 100, nil, "")
+	c.Assert(err, check.IsNil)
+	c.Check(entry.Seq, check.Equals, uint64(1))
+	c.Check(entry.Debit, check.Equals, JournalAccountRewards)
+	c.Check(entry.Credit, check.Equals, JournalFarmerAccount("TestPostAndFold"))
+	c.Check(entry.Amount, check.Equals, uint32(100))
+
+	entry, err = t.journal.Post("TestPostAndFold", pb.BalanceReason_CHALLENGE_SUCCESS, 100, 400, req, "")
+	c.Assert(err, check.IsNil)
+	c.Check(entry.BlocksRange.HighBlockNumber, check.Equals, uint64(100))
+	c.Check(entry.ChallengeKind, check.Equals, pb.ChallengeKind_BLOCKS_SAMPLE)
+
+	entry, err = t.journal.Post("TestPostAndFold", pb.BalanceReason_CHALLENGE_MISSED, 400, 360, req, "")
+	c.Assert(err, check.IsNil)
+	c.Check(entry.Debit, check.Equals, JournalFarmerAccount("TestPostAndFold"))
+	c.Check(entry.Credit, check.Equals, JournalAccountPenalties)
+	c.Check(entry.Amount, check.Equals, uint32(40))
+
+	balance, err := t.journal.Fold("TestPostAndFold")
+	c.Assert(err, check.IsNil)
+	c.Check(balance, check.Equals, uint32(360))
+
+	balance, ok, err := t.journal.Balance("TestPostAndFold")
+	c.Assert(err, check.IsNil)
+	c.Check(ok, check.Equals, true)
+	c.Check(balance, check.Equals, uint32(360))
+}
+
+func (t *TestBalanceJournal) TestOpeningBalance(c *check.C) {
+	// a farmer earned its balance before journals existed
+	_, err := t.journal.Post("TestOpeningBalance", pb.BalanceReason_PING_REWARD, 500, 600, nil, "")
+	c.Assert(err, check.IsNil)
+
+	entries, next, balance, err := t.journal.History("TestOpeningBalance", 0, 0)
+	c.Assert(err, check.IsNil)
+	c.Check(next, check.Equals, uint64(0))
+	c.Check(balance, check.Equals, uint32(600))
+	c.Assert(entries, check.HasLen, 2)
+	c.Check(entries[0].Reason, check.Equals, pb.BalanceReason_OPENING_BALANCE)
+	c.Check(entries[0].Debit, check.Equals, JournalAccountOpening)
+	c.Check(entries[0].Balance, check.Equals, uint32(500))
+	c.Check(entries[1].Reason, check.Equals, pb.BalanceReason_PING_REWARD)
+
+	balance, err = t.journal.Fold("TestOpeningBalance")
+	c.Assert(err, check.IsNil)
+	c.Check(balance, check.Equals, uint32(600))
+}
+
+func (t *TestBalanceJournal) TestPostBehindJournal(c *check.C) {
+	_, err := t.journal.Post("TestPostBehindJournal", pb.BalanceReason_PING_REWARD, 0, 100, nil, "")
+	c.Assert(err, check.IsNil)
+
+	// balance changed without going through the journal
+	_, err = t.journal.Post("TestPostBehindJournal", pb.BalanceReason_PING_REWARD, 300, 400, nil, "")
+	c.Check(err, check.NotNil)
+
+	_, ok, err := t.journal.Balance("TestNoJournal")
+	c.Assert(err, check.IsNil)
+	c.Check(ok, check.Equals, false)
+}
+
+func (t *TestBalanceJournal) TestHistoryPaging(c *check.C) {
+	for i := uint32(0); i < 25; i++ {
+		_, err := t.journal.Post("TestHistoryPaging", pb.BalanceReason_PING_REWARD, i*10, (i+1)*10, nil, "")
+		c.Assert(err, check.IsNil)
+	}
+	// a farmer whose key extends the other one's
+	_, err := t.journal.Post("TestHistoryPagingToo", pb.BalanceReason_PING_REWARD, 0, 10, nil, "")
+	c.Assert(err, check.IsNil)
+
+	seqs := []uint64{}
+	pages := 0
+	for after := uint64(0); ; {
+		pages++
+		entries, next, balance, err := t.journal.History("TestHistoryPaging", after, 10)
+		c.Assert(err, check.IsNil)
+		c.Check(balance, check.Equals, uint32(250))
+		for _, entry := range entries {
+			c.Check(entry.FarmerID, check.Equals, "TestHistoryPaging")
+			seqs = append(seqs, entry.Seq)
+		}
+		if next == 0 {
+			break
+		}
+		after = next
+	}
+	c.Check(pages, check.Equals, 3)
+	c.Check(seqs, check.HasLen, 25)
+	for i, seq := range seqs {
+		c.Check(seq, check.Equals, uint64(i+1))
+	}
+
+	entries, next, _, err := t.journal.History("TestNoJournal", 0, 10)
+	c.Assert(err, check.IsNil)
+	c.Check(entries, check.HasLen, 0)
+	c.Check(next, check.Equals, uint64(0))
+}
+
+func (t *TestBalanceJournal) TestUncommittedEntry(c *check.C) {
+	_, err := t.journal.Post("TestUncommittedEntry", pb.BalanceReason_PING_REWARD, 0, 100, nil, "")
+	c.Assert(err, check.IsNil)
+
+	// supervisor stopped after writing entry 2, before moving head onto it
+	uncommitted := newBalanceEntry("TestUncommittedEntry", pb.BalanceReason_PING_REWARD, 100, 900, time.Now().UnixNano())
+	uncommitted.Seq = 2
+	entryBytes, err := proto.Marshal(uncommitted)
+	c.Assert(err, check.IsNil)
+	c.Assert(t.storage.SetCF(store.JournalColumnFamily, journalEntryKey("TestUncommittedEntry", 2), entryBytes), check.IsNil)
+
+	entries, _, balance, err := t.journal.History("TestUncommittedEntry", 0, 0)
+	c.Assert(err, check.IsNil)
+	c.Check(entries, check.HasLen, 1)
+	c.Check(balance, check.Equals, uint32(100))
+
+	// the next post takes its place
+	entry, err := t.journal.Post("TestUncommittedEntry", pb.BalanceReason_PING_REWARD, 100, 200, nil, "")
+	c.Assert(err, check.IsNil)
+	c.Check(entry.Seq, check.Equals, uint64(2))
+	fold, err := t.journal.Fold("TestUncommittedEntry")
+	c.Assert(err, check.IsNil)
+	c.Check(fold, check.Equals, uint32(200))
+}
+
+func (t *TestBalanceJournal) TestFoldTampered(c *check.C) {
+	for i := uint32(0); i < 3; i++ {
+		_, err := t.journal.Post("TestFoldTampered", pb.BalanceReason_PING_REWARD, i*100, (i+1)*100, nil, "")
+		c.Assert(err, check.IsNil)
+	}
+
+	entries, _, _, err := t.journal.History("TestFoldTampered", 0, 0)
+	c.Assert(err, check.IsNil)
+	entries[1].Amount = 1000
+	entryBytes, err := proto.Marshal(entries[1])
+	c.Assert(err, check.IsNil)
+	c.Assert(t.storage.SetCF(store.JournalColumnFamily, journalEntryKey("TestFoldTampered", 2), entryBytes), check.IsNil)
+
+	_, err = t.journal.Fold("TestFoldTampered")
+	c.Check(err, check.NotNil)
+}
+
+func (t *TestBalanceJournal) TestAdjustBalance(c *check.C) {
+	ctr := NewFarmerAccountController(t.storage, newTestChallenger(), newTestConfig())
+
+	c.Assert(ctr.AdjustBalance("TestAdjustBalance", 300, "compensation for downtime"), check.IsNil)
+	handler, err := ctr.NewFarmerHandler("TestAdjustBalance")
+	c.Assert(err, check.IsNil)
+	c.Check(handler.Account().Balance, check.Equals, uint32(300))
+
+	entries, _, _, err := ctr.Journal().History("TestAdjustBalance", 0, 0)
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 1)
+	c.Check(entries[0].Reason, check.Equals, pb.BalanceReason_ADMIN_ADJUSTMENT)
+	c.Check(entries[0].Debit, check.Equals, JournalAccountAdmin)
+	c.Check(entries[0].Memo, check.Equals, "compensation for downtime")
+}
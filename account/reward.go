@@ -0,0 +1,198 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/challenge"
+)
+
+const (
+	RewardPolicyDefault = "default"
+
+	penalty_step_zero    = "zero"
+	penalty_step_suspend = "suspend"
+	penalty_step_ban     = "ban"
+)
+
+// RewardContext is what a reward or a penalty is decided by
+type RewardContext struct {
+	// farmer's balance before
+	Balance uint32
+	// width of blocks range farmer proved keeping by the last challenge it conquered,
+	// no wider than the range it declares now, 0 until it conquers one, or once it fails one
+	ProvenBlocks uint64
+	// how long farmer has been online
+	Uptime time.Duration
+	// challenge conquered or missed, nil for a ping without challenge
+	Challenge *challenge.FarmerChallengeReq
+	// consecutive challenges missed, this one included, only for penalties
+	Misses int
+}
+
+// Penalty is what a missed challenge costs farmer
+type Penalty struct {
+	// farmer's balance after
+	Balance uint32
+	// farmer is taken out of service for SuspendFor
+	Suspend    bool
+	SuspendFor time.Duration
+	// farmer is taken out of service until an operator lifts the ban
+	Ban bool
+}
+
+// RewardPolicy decides how much farmer earns for a ping or a conquered challenge,
+// and what a missed challenge costs
+type RewardPolicy interface {
+	Reward(ctx *RewardContext) uint32
+	Penalize(ctx *RewardContext) Penalty
+}
+
+// PenaltyStep is one step of escalating penalties, a cut of Percent of balance, a suspension or a ban
+type PenaltyStep struct {
+	Percent uint32
+	Suspend bool
+	Ban     bool
+}
+
+// ParsePenaltyStep parses "N%", "zero", "suspend" or "ban"
+func ParsePenaltyStep(step string) (PenaltyStep, error) {
+	switch step = strings.TrimSpace(step); step {
+	case penalty_step_zero:
+		return PenaltyStep{Percent: 100}, nil
+	case penalty_step_suspend:
+		return PenaltyStep{Percent: 100, Suspend: true}, nil
+	case penalty_step_ban:
+		return PenaltyStep{Percent: 100, Ban: true}, nil
+	}
+
+	if strings.HasSuffix(step, "%") {
+		percent, err := strconv.ParseUint(strings.TrimSuffix(step, "%"), 10, 32)
+		if err == nil && percent <= 100 {
+			return PenaltyStep{Percent: uint32(percent)}, nil
+		}
+	}
+
+	return PenaltyStep{}, fmt.Errorf("supervisor/account: invalid penalty step %q", step)
+}
+
+// NewRewardPolicy returns the policy cfg describes, unknown policy falls back to default one
+func NewRewardPolicy(cfg *RewardConfig) RewardPolicy {
+	if cfg == nil {
+		cfg = DefaultRewardConfig()
+	}
+
+	switch cfg.Policy {
+	case "", RewardPolicyDefault:
+	default:
+		logger.Warningf("not supported reward policy: %v, use %v instead", cfg.Policy, RewardPolicyDefault)
+	}
+
+	return &defaultRewardPolicy{cfg: cfg}
+}
+
+// defaultRewardPolicy rewards Base, times blocks factor, uptime factor and challenge weight,
+// penalizes along Penalties, the last step repeats
+type defaultRewardPolicy struct {
+	cfg *RewardConfig
+}
+
+func (p *defaultRewardPolicy) Reward(ctx *RewardContext) uint32 {
+	reward := uint64(p.cfg.Base)
+
+	// every BlocksUnit blocks farmer proved keeping adds another Base, up to MaxBlocksFactor times
+	if p.cfg.BlocksUnit > 0 {
+		factor := 1 + ctx.ProvenBlocks/p.cfg.BlocksUnit
+		if p.cfg.MaxBlocksFactor > 0 && factor > p.cfg.MaxBlocksFactor {
+			factor = p.cfg.MaxBlocksFactor
+		}
+		reward *= factor
+	}
+
+	// UptimeBonus percent more for every UptimeUnit online, up to MaxUptimeBonus percent
+	if p.cfg.UptimeUnit > 0 && ctx.Uptime > 0 {
+		bonus := uint64(ctx.Uptime/p.cfg.UptimeUnit) * p.cfg.UptimeBonus
+		if bonus > p.cfg.MaxUptimeBonus {
+			bonus = p.cfg.MaxUptimeBonus
+		}
+		reward = reward * (100 + bonus) / 100
+	}
+
+	reward *= p.weight(ctx.Challenge)
+	if reward > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(reward)
+}
+
+// challenges harder to answer weigh more
+func (p *defaultRewardPolicy) weight(req *challenge.FarmerChallengeReq) uint64 {
+	if req == nil {
+		return p.cfg.PingWeight
+	}
+
+	switch req.Kind() {
+	case pb.ChallengeKind_BLOCKS_SAMPLE:
+		return p.cfg.SampleWeight
+	case pb.ChallengeKind_BLOCKS_ROOT:
+		return p.cfg.RootWeight
+	default:
+		return p.cfg.HashWeight
+	}
+}
+
+func (p *defaultRewardPolicy) Penalize(ctx *RewardContext) Penalty {
+	steps := p.cfg.Penalties
+	if len(steps) == 0 {
+		return Penalty{Balance: 0}
+	}
+
+	idx := ctx.Misses - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(steps) {
+		idx = len(steps) - 1
+	}
+	step := steps[idx]
+
+	cut := uint64(ctx.Balance) * uint64(step.Percent) / 100
+	penalty := Penalty{
+		Balance: ctx.Balance - uint32(cut),
+		Suspend: step.Suspend,
+		Ban:     step.Ban,
+	}
+	if penalty.Suspend {
+		penalty.SuspendFor = p.cfg.Suspension
+	}
+
+	return penalty
+}
+
+// add reward to balance, never overflows
+func addBalance(balance, reward uint32) uint32 {
+	if balance > math.MaxUint32-reward {
+		return math.MaxUint32
+	}
+	return balance + reward
+}
@@ -0,0 +1,176 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"math"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/challenge"
+	"github.com/spf13/viper"
+	"gopkg.in/check.v1"
+)
+
+type TestRewardPolicy struct {
+	policy RewardPolicy
+}
+
+var _ = check.Suite(&TestRewardPolicy{})
+
+func (t *TestRewardPolicy) SetUpSuite(c *check.C) {
+	t.policy = NewRewardPolicy(nil)
+}
+
+func (t *TestRewardPolicy) TestDefaultReward(c *check.C) {
+	hashReq := challenge.NewFarmerChallengeReq("TestDefaultReward", 100, 10, pb.HashAlgo_SHA256, nil)
+	sampleReq := challenge.NewFarmerSampleChallengeReq("TestDefaultReward", 100, 10, nil)
+	rootReq := challenge.NewFarmerRootChallengeReq("TestDefaultReward", 100, 10, nil)
+
+	cases := []struct {
+		name   string
+		ctx    *RewardContext
+		reward uint32
+	}{
+		{"plain ping", &RewardContext{}, 100},
+		{"less than a blocks unit", &RewardContext{ProvenBlocks: 999}, 100},
+		{"one blocks unit", &RewardContext{ProvenBlocks: 1000}, 200},
+		{"several blocks units", &RewardContext{ProvenBlocks: 5500}, 600},
+		{"blocks factor capped", &RewardContext{ProvenBlocks: 1000000000}, 1000},
+		{"less than an uptime unit", &RewardContext{Uptime: time.Hour * 23}, 100},
+		{"one uptime unit", &RewardContext{Uptime: time.Hour * 24}, 110},
+		{"several uptime units", &RewardContext{Uptime: time.Hour * 72}, 130},
+		{"uptime bonus capped", &RewardContext{Uptime: time.Hour * 24 * 30}, 200},
+		{"hash challenge", &RewardContext{Challenge: hashReq}, 200},
+		{"sample challenge", &RewardContext{Challenge: sampleReq}, 300},
+		{"root challenge", &RewardContext{Challenge: rootReq}, 200},
+		{"all together", &RewardContext{ProvenBlocks: 2500, Uptime: time.Hour * 48, Challenge: sampleReq}, 1080},
+		{"balance doesn't matter", &RewardContext{Balance: 12345}, 100},
+	}
+
+	for _, cs := range cases {
+		c.Check(t.policy.Reward(cs.ctx), check.Equals, cs.reward, check.Commentf(cs.name))
+	}
+}
+
+// blocks farmer only declares in pings count for nothing, proved ones count as long as farmer still declares them
+func (t *TestRewardPolicy) TestProvenBlocks(c *check.C) {
+	h := &FarmerAccountHandler{account: &pb.FarmerAccount{}, declaredBlocks: 1000000000}
+	c.Check(t.policy.Reward(h.rewardContext(nil)), check.Equals, uint32(100))
+
+	h.provenBlocks = 2000
+	c.Check(t.policy.Reward(h.rewardContext(nil)), check.Equals, uint32(300))
+
+	h.declaredBlocks = 1500
+	c.Check(t.policy.Reward(h.rewardContext(nil)), check.Equals, uint32(200))
+}
+
+func (t *TestRewardPolicy) TestDefaultRewardOverflow(c *check.C) {
+	cfg := DefaultRewardConfig()
+	cfg.Base = math.MaxUint32
+	policy := NewRewardPolicy(cfg)
+
+	c.Check(policy.Reward(&RewardContext{ProvenBlocks: 5000}), check.Equals, uint32(math.MaxUint32))
+	c.Check(addBalance(math.MaxUint32-1, 100), check.Equals, uint32(math.MaxUint32))
+}
+
+func (t *TestRewardPolicy) TestDefaultPenalize(c *check.C) {
+	cases := []struct {
+		name    string
+		ctx     *RewardContext
+		penalty Penalty
+	}{
+		{"first miss", &RewardContext{Balance: 1000, Misses: 1}, Penalty{Balance: 900}},
+		{"misses not counted yet", &RewardContext{Balance: 1000}, Penalty{Balance: 900}},
+		{"second miss", &RewardContext{Balance: 1000, Misses: 2}, Penalty{Balance: 500}},
+		{"third miss", &RewardContext{Balance: 1000, Misses: 3}, Penalty{Balance: 0}},
+		{"fourth miss", &RewardContext{Balance: 1000, Misses: 4}, Penalty{Balance: 0, Suspend: true, SuspendFor: 24 * time.Hour}},
+		{"the last step repeats", &RewardContext{Balance: 1000, Misses: 10}, Penalty{Balance: 0, Suspend: true, SuspendFor: 24 * time.Hour}},
+		{"rounds in farmer's favor", &RewardContext{Balance: 15, Misses: 1}, Penalty{Balance: 14}},
+		{"nothing to cut", &RewardContext{Balance: 0, Misses: 1}, Penalty{Balance: 0}},
+	}
+
+	for _, cs := range cases {
+		c.Check(t.policy.Penalize(cs.ctx), check.Equals, cs.penalty, check.Commentf(cs.name))
+	}
+}
+
+func (t *TestRewardPolicy) TestPenalizeWithoutSteps(c *check.C) {
+	cfg := DefaultRewardConfig()
+	cfg.Penalties = nil
+
+	c.Check(NewRewardPolicy(cfg).Penalize(&RewardContext{Balance: 1000, Misses: 1}), check.Equals, Penalty{Balance: 0})
+}
+
+func (t *TestRewardPolicy) TestPenalizeBan(c *check.C) {
+	cfg := DefaultRewardConfig()
+	cfg.Suspension = time.Hour
+	cfg.Penalties = []PenaltyStep{{Percent: 100, Suspend: true}, {Percent: 100, Ban: true}}
+	policy := NewRewardPolicy(cfg)
+
+	c.Check(policy.Penalize(&RewardContext{Balance: 1000, Misses: 1}), check.Equals, Penalty{Balance: 0, Suspend: true, SuspendFor: time.Hour})
+	c.Check(policy.Penalize(&RewardContext{Balance: 1000, Misses: 2}), check.Equals, Penalty{Balance: 0, Ban: true})
+}
+
+func (t *TestRewardPolicy) TestParsePenaltyStep(c *check.C) {
+	cases := []struct {
+		step    string
+		penalty PenaltyStep
+		valid   bool
+	}{
+		{"10%", PenaltyStep{Percent: 10}, true},
+		{" 50% ", PenaltyStep{Percent: 50}, true},
+		{"100%", PenaltyStep{Percent: 100}, true},
+		{"zero", PenaltyStep{Percent: 100}, true},
+		{"suspend", PenaltyStep{Percent: 100, Suspend: true}, true},
+		{"ban", PenaltyStep{Percent: 100, Ban: true}, true},
+		{"101%", PenaltyStep{}, false},
+		{"-5%", PenaltyStep{}, false},
+		{"10", PenaltyStep{}, false},
+		{"half", PenaltyStep{}, false},
+	}
+
+	for _, cs := range cases {
+		penalty, err := ParsePenaltyStep(cs.step)
+		c.Check(err == nil, check.Equals, cs.valid, check.Commentf("step %q", cs.step))
+		c.Check(penalty, check.Equals, cs.penalty, check.Commentf("step %q", cs.step))
+	}
+}
+
+func (t *TestRewardPolicy) TestRewardConfigFromViper(c *check.C) {
+	defer func() {
+		for _, key := range []string{"farmer.reward.base", "farmer.reward.uptime.unit", "farmer.reward.penalties", "farmer.reward.suspension"} {
+			viper.Set(key, nil)
+		}
+	}()
+
+	viper.Set("farmer.reward.base", 50)
+	viper.Set("farmer.reward.uptime.unit", "1h")
+	viper.Set("farmer.reward.penalties", []string{"20%", "suspend"})
+	viper.Set("farmer.reward.suspension", "2h")
+	cfg := RewardConfigFromViper()
+	c.Check(cfg.Policy, check.Equals, RewardPolicyDefault)
+	c.Check(cfg.Base, check.Equals, uint32(50))
+	c.Check(cfg.UptimeUnit, check.Equals, time.Hour)
+	c.Check(cfg.BlocksUnit, check.Equals, DefaultRewardConfig().BlocksUnit)
+	c.Check(cfg.Penalties, check.DeepEquals, []PenaltyStep{{Percent: 20}, {Percent: 100, Suspend: true}})
+	c.Check(cfg.Suspension, check.Equals, 2*time.Hour)
+
+	// one bad step and the whole list falls back
+	viper.Set("farmer.reward.penalties", []string{"20%", "twice"})
+	c.Check(RewardConfigFromViper().Penalties, check.DeepEquals, DefaultRewardConfig().Penalties)
+}
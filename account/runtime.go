@@ -0,0 +1,179 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"encoding/json"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/challenge"
+	"github.com/conseweb/supervisor/clock"
+)
+
+// farmerHandlerState is the part of a handler only lives in memory,
+// persisted into runtime column family, so that pending challenges survive supervisor restarts
+type farmerHandlerState struct {
+	LostCount       int                   `json:"lostCount"`
+	NextPingTime    int64                 `json:"nextPingTime"`
+	NextConquerTime int64                 `json:"nextConquerTime"`
+	OnlineSince     int64                 `json:"onlineSince,omitempty"`
+	DeclaredBlocks  uint64                `json:"declaredBlocks,omitempty"`
+	ProvenBlocks    uint64                `json:"provenBlocks,omitempty"`
+	Misses          int                   `json:"misses,omitempty"`
+	ChallengeReq    *farmerChallengeState `json:"challengeReq,omitempty"`
+}
+
+type farmerChallengeState struct {
+	HighBlockNumber uint64            `json:"highBlockNumber"`
+	LowBlockNumber  uint64            `json:"lowBlockNumber"`
+	HashAlgo        pb.HashAlgo       `json:"hashAlgo"`
+	Nonce           []byte            `json:"nonce,omitempty"`
+	Kind            pb.ChallengeKind  `json:"kind,omitempty"`
+	Samples         []*pb.BlockSample `json:"samples,omitempty"`
+}
+
+func (h *FarmerAccountHandler) runtimeState() *farmerHandlerState {
+	state := &farmerHandlerState{
+		LostCount:       h.lostCount,
+		NextPingTime:    h.nextPingTime,
+		NextConquerTime: h.nextConquerTime,
+		OnlineSince:     h.onlineSince,
+		DeclaredBlocks:  h.declaredBlocks,
+		ProvenBlocks:    h.provenBlocks,
+		Misses:          h.misses,
+	}
+	if h.nextFarmerChallengeReq != nil {
+		blocksRange := h.nextFarmerChallengeReq.BlocksRange()
+		state.ChallengeReq = &farmerChallengeState{
+			HighBlockNumber: blocksRange.HighBlockNumber,
+			LowBlockNumber:  blocksRange.LowBlockNumber,
+			HashAlgo:        h.nextFarmerChallengeReq.HashAlgo(),
+			Nonce:           h.nextFarmerChallengeReq.Nonce(),
+			Kind:            h.nextFarmerChallengeReq.Kind(),
+			Samples:         h.nextFarmerChallengeReq.Samples(),
+		}
+	}
+
+	return state
+}
+
+// restore runtime state, a pending challenge whose deadline hasn't passed is put back into challenge cache,
+// an overdue one is only kept in handler, waiting for checker to punish
+func (h *FarmerAccountHandler) restoreRuntimeState(state *farmerHandlerState) {
+	h.lostCount = state.LostCount
+	h.nextPingTime = state.NextPingTime
+	h.nextConquerTime = state.NextConquerTime
+	h.onlineSince = state.OnlineSince
+	h.declaredBlocks = state.DeclaredBlocks
+	h.provenBlocks = state.ProvenBlocks
+	h.misses = state.Misses
+
+	if state.ChallengeReq == nil {
+		return
+	}
+
+	farmerId := h.account.FarmerID
+	brange := state.ChallengeReq
+	req := challenge.NewFarmerChallengeReq(farmerId, brange.HighBlockNumber, brange.LowBlockNumber, brange.HashAlgo, brange.Nonce)
+	switch brange.Kind {
+	case pb.ChallengeKind_BLOCKS_SAMPLE:
+		req = challenge.NewFarmerSampleChallengeReq(farmerId, brange.HighBlockNumber, brange.LowBlockNumber, brange.Samples)
+	case pb.ChallengeKind_BLOCKS_ROOT:
+		req = challenge.NewFarmerRootChallengeReq(farmerId, brange.HighBlockNumber, brange.LowBlockNumber, brange.Nonce)
+	}
+	h.nextFarmerChallengeReq = req
+
+	if clock.Time(state.NextConquerTime).After(h.ctr.clock.Now()) {
+		h.ctr.challenger.FarmerChallengeReqCache().AddFarmerChallengeReq(req)
+	}
+}
+
+// handler's runtime state to persist, caller must hold the lock
+func handlerStateBytes(handler *FarmerAccountHandler) ([]byte, error) {
+	stateBytes, err := json.Marshal(handler.runtimeState())
+	if err != nil {
+		logger.Errorf("marshal farmer handler state err: %v", err)
+		return nil, err
+	}
+	return stateBytes, nil
+}
+
+// persist handler's runtime state, nil state deletes it, as farmer is out of service
+func (ctr *FarmerAccountController) persistHandlerState(farmerKey, stateBytes []byte) error {
+	if stateBytes == nil {
+		if err := ctr.accountStorage.DelCF(store.RuntimeColumnFamily, farmerKey); err != nil {
+			logger.Errorf("delete farmer handler state err: %v", err)
+		}
+		return nil
+	}
+
+	if err := ctr.accountStorage.SetCF(store.RuntimeColumnFamily, farmerKey, stateBytes); err != nil {
+		logger.Errorf("persist farmer handler state err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// rebuild account tree from handlers' runtime state persisted before supervisor stopped,
+// only handlers of farmers matched if match isn't nil
+func (ctr *FarmerAccountController) restoreHandlers(match func(farmerId string) bool) int {
+	ctr.l.Lock()
+	defer ctr.l.Unlock()
+
+	restored := 0
+	err := ctr.accountStorage.IterateCF(store.RuntimeColumnFamily, func(key, value []byte) bool {
+		if match != nil && !match(string(key)) {
+			return true
+		}
+		state := &farmerHandlerState{}
+		if err := json.Unmarshal(value, state); err != nil {
+			logger.Errorf("unmarshal farmer handler state err: %v", err)
+			return true
+		}
+
+		farmerBytes, err := ctr.loadFarmerBytes(string(key))
+		if err != nil {
+			logger.Warningf("farmer(%s) has runtime state, but no account: %v", key, err)
+			return true
+		}
+		account, err := bytes2FarmerAccount(farmerBytes)
+		if err != nil || account.State == pb.FarmerState_OFFLINE {
+			return true
+		}
+		ctr.loadBalance(account)
+
+		handler := &FarmerAccountHandler{
+			ctr:     ctr,
+			account: account,
+		}
+		handler.fsm = ctr.fsm.newFSM(handler, ctr.fsm.restoredState(account))
+		handler.restoreRuntimeState(state)
+		ctr.accountTree.Put(string(key), handler)
+		ctr.scheduleHandler(string(key), handler)
+		restored++
+
+		logger.Debugf("farmer(%s) handler restored, state: %v, lostCount: %d, pending challenge: %v", key, account.State, state.LostCount, state.ChallengeReq != nil)
+		return true
+	})
+	if err != nil {
+		logger.Errorf("restore farmer handlers err: %v", err)
+	}
+
+	logger.Infof("%d farmer handlers restored", restored)
+	return restored
+}
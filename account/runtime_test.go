@@ -0,0 +1,275 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/challenge"
+	"gopkg.in/check.v1"
+)
+
+type TestFarmerRuntime struct {
+	dbpath string
+}
+
+var _ = check.Suite(&TestFarmerRuntime{})
+
+func (t *TestFarmerRuntime) SetUpTest(c *check.C) {
+	t.dbpath = filepath.Join(os.TempDir(), "testAccountRuntime")
+	os.RemoveAll(t.dbpath)
+}
+
+func (t *TestFarmerRuntime) TearDownTest(c *check.C) {
+	os.RemoveAll(t.dbpath)
+}
+
+// stop supervisor after handler updated, and start a new one on the same storage
+func (t *TestFarmerRuntime) restart(c *check.C, storage store.Storage) (store.Storage, *FarmerAccountController) {
+	// farmer account is persisted async
+	time.Sleep(time.Millisecond * 100)
+	c.Assert(storage.Close(), check.IsNil)
+
+	storage, err := store.NewStore("rocksdb", t.dbpath)
+	c.Assert(err, check.IsNil)
+
+	return storage, NewFarmerAccountController(storage, newTestChallenger(), newTestConfig())
+}
+
+func (t *TestFarmerRuntime) TestRestoreOverdueChallenge(c *check.C) {
+	storage, err := store.NewStore("rocksdb", t.dbpath)
+	c.Assert(err, check.IsNil)
+	ctr := NewFarmerAccountController(storage, newTestChallenger(), newTestConfig())
+
+	handler, err := ctr.NewFarmerHandler("TestRestoreOverdueChallenge")
+	c.Assert(err, check.IsNil)
+	c.Check(handler.OnLine(), check.IsNil)
+
+	// a challenge issued before supervisor went down, its deadline passed long before supervisor comes back
+	handler.account.Balance = 500
+	handler.lostCount = 1
+	handler.nextPingTime = time.Now().Add(time.Hour).UnixNano()
+	handler.nextConquerTime = 1
+	handler.nextFarmerChallengeReq = challenge.NewFarmerChallengeReq("TestRestoreOverdueChallenge", 100, 20, pb.HashAlgo_SHA256, nil)
+	ctr.UpdateFarmerHandler(handler)
+
+	storage, ctr = t.restart(c, storage)
+	defer storage.Close()
+
+	restored, err := ctr.accountTree.Get("TestRestoreOverdueChallenge")
+	c.Assert(err, check.IsNil)
+	c.Check(restored.Account().State, check.Equals, pb.FarmerState_ONLINE)
+	c.Check(restored.Account().Balance, check.Equals, uint32(500))
+	c.Check(restored.lostCount, check.Equals, 1)
+	c.Assert(restored.nextFarmerChallengeReq, check.NotNil)
+	c.Check(restored.nextFarmerChallengeReq.BlocksRange().HighBlockNumber, check.Equals, uint64(100))
+
+	// the farmer doesn't escape the punishment, the first miss costs a cut of balance
+	ctr.checkHandler("TestRestoreOverdueChallenge")
+	c.Check(restored.Account().Balance, check.Equals, uint32(450))
+	c.Check(restored.misses, check.Equals, 1)
+	c.Check(restored.nextFarmerChallengeReq, check.IsNil)
+	time.Sleep(time.Millisecond * 100)
+}
+
+func (t *TestFarmerRuntime) TestRestorePendingChallenge(c *check.C) {
+	storage, err := store.NewStore("rocksdb", t.dbpath)
+	c.Assert(err, check.IsNil)
+	ctr := NewFarmerAccountController(storage, newTestChallenger(), newTestConfig())
+
+	handler, err := ctr.NewFarmerHandler("TestRestorePendingChallenge")
+	c.Assert(err, check.IsNil)
+	c.Check(handler.OnLine(), check.IsNil)
+
+	handler.nextPingTime = time.Now().Add(time.Hour).UnixNano()
+	handler.nextConquerTime = time.Now().Add(time.Minute).UnixNano()
+	handler.nextFarmerChallengeReq = challenge.NewFarmerChallengeReq("TestRestorePendingChallenge", 100, 20, pb.HashAlgo_SHA256, []byte("nonce"))
+	ctr.UpdateFarmerHandler(handler)
+
+	storage, ctr = t.restart(c, storage)
+	defer storage.Close()
+
+	restored, err := ctr.accountTree.Get("TestRestorePendingChallenge")
+	c.Assert(err, check.IsNil)
+	c.Check(restored.nextConquerTime, check.Equals, handler.nextConquerTime)
+	c.Assert(restored.nextFarmerChallengeReq, check.NotNil)
+
+	// farmer can still conquer it, with the nonce issued before restart
+	req, get := ctr.challenger.FarmerChallengeReqCache().GetFarmerChallengeReq("TestRestorePendingChallenge", 100, 20, pb.HashAlgo_SHA256)
+	c.Assert(get, check.Equals, true)
+	c.Check(req.Nonce(), check.DeepEquals, []byte("nonce"))
+}
+
+func (t *TestFarmerRuntime) TestRestorePendingSampleChallenge(c *check.C) {
+	storage, err := store.NewStore("rocksdb", t.dbpath)
+	c.Assert(err, check.IsNil)
+	ctr := NewFarmerAccountController(storage, newTestChallenger(), newTestConfig())
+
+	handler, err := ctr.NewFarmerHandler("TestRestorePendingSampleChallenge")
+	c.Assert(err, check.IsNil)
+	c.Check(handler.OnLine(), check.IsNil)
+
+	samples := []*pb.BlockSample{{BlockNumber: 30, ChunkIndex: 2}, {BlockNumber: 90, ChunkIndex: 0}}
+	handler.nextPingTime = time.Now().Add(time.Hour).UnixNano()
+	handler.nextConquerTime = time.Now().Add(time.Minute).UnixNano()
+	handler.nextFarmerChallengeReq = challenge.NewFarmerSampleChallengeReq("TestRestorePendingSampleChallenge", 100, 20, samples)
+	ctr.UpdateFarmerHandler(handler)
+
+	storage, ctr = t.restart(c, storage)
+	defer storage.Close()
+
+	req, get := ctr.challenger.FarmerChallengeReqCache().GetFarmerChallengeReq("TestRestorePendingSampleChallenge", 100, 20, pb.HashAlgo_SHA256)
+	c.Assert(get, check.Equals, true)
+	c.Check(req.Kind(), check.Equals, pb.ChallengeKind_BLOCKS_SAMPLE)
+	c.Check(req.Samples(), check.DeepEquals, samples)
+}
+
+func (t *TestFarmerRuntime) TestOfflineNotRestored(c *check.C) {
+	storage, err := store.NewStore("rocksdb", t.dbpath)
+	c.Assert(err, check.IsNil)
+	ctr := NewFarmerAccountController(storage, newTestChallenger(), newTestConfig())
+
+	handler, err := ctr.NewFarmerHandler("TestOfflineNotRestored")
+	c.Assert(err, check.IsNil)
+	c.Check(handler.OnLine(), check.IsNil)
+	c.Check(handler.OffLine(), check.IsNil)
+
+	storage, ctr = t.restart(c, storage)
+	defer storage.Close()
+
+	c.Check(ctr.accountTree.Len(), check.Equals, 0)
+}
+
+// a change is persisted by the time the call made it returns, a change not persisted fails the call
+func (t *TestFarmerRuntime) TestSyncPersist(c *check.C) {
+	storage, err := store.NewStore("rocksdb", t.dbpath)
+	c.Assert(err, check.IsNil)
+	defer storage.Close()
+	cfg := newTestConfig()
+	cfg.SyncPersist = true
+	ctr := NewFarmerAccountController(storage, newTestChallenger(), cfg)
+
+	handler, err := ctr.NewFarmerHandler("TestSyncPersist")
+	c.Assert(err, check.IsNil)
+	c.Assert(handler.OnLine(), check.IsNil)
+	farmerBytes, err := storage.Get([]byte("TestSyncPersist"))
+	c.Assert(err, check.IsNil)
+	account, err := bytes2FarmerAccount(farmerBytes)
+	c.Assert(err, check.IsNil)
+	c.Check(account.State, check.Equals, pb.FarmerState_ONLINE)
+
+	broken := &failingStorage{Storage: storage}
+	handler, err = NewFarmerAccountController(broken, newTestChallenger(), cfg).NewFarmerHandler("TestSyncPersistBroken")
+	c.Assert(err, check.IsNil)
+	c.Check(handler.OnLine(), check.NotNil)
+
+	// in background, the failure is left to the log
+	handler, err = NewFarmerAccountController(broken, newTestChallenger(), newTestConfig()).NewFarmerHandler("TestSyncPersistBroken")
+	c.Assert(err, check.IsNil)
+	c.Check(handler.OnLine(), check.IsNil)
+}
+
+// stallingStorage stalls writes of runtime state until released, as storage of a cluster without a quorum would
+type stallingStorage struct {
+	store.Storage
+	release chan struct{}
+}
+
+func (s *stallingStorage) SetCF(cf string, key, value []byte) error {
+	if cf == store.RuntimeColumnFamily {
+		<-s.release
+	}
+	return s.Storage.SetCF(cf, key, value)
+}
+
+// a farmer whose write stalls doesn't hold up the others
+func (t *TestFarmerRuntime) TestStalledWriteOutOfLock(c *check.C) {
+	storage, err := store.NewStore("rocksdb", t.dbpath)
+	c.Assert(err, check.IsNil)
+	stalling := &stallingStorage{Storage: storage, release: make(chan struct{})}
+	ctr := NewFarmerAccountController(stalling, newTestChallenger(), newTestConfig())
+	defer ctr.Close()
+
+	stalled, err := ctr.NewFarmerHandler("TestStalledWrite")
+	c.Assert(err, check.IsNil)
+	onLine := make(chan error, 1)
+	go func() {
+		onLine <- stalled.OnLine()
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	looked := make(chan error, 1)
+	go func() {
+		_, _, err := ctr.LoadFarmer("TestStalledWrite")
+		looked <- err
+	}()
+	select {
+	case err := <-looked:
+		c.Check(err, check.IsNil)
+	case <-time.After(time.Second):
+		c.Error("farmer lookup waits on a stalled write")
+	}
+
+	close(stalling.release)
+	c.Check(<-onLine, check.IsNil)
+}
+
+// handlers dropped when their farmers are handed over, restored from storage when taken over
+func (t *TestFarmerRuntime) TestDropRestoreHandlers(c *check.C) {
+	storage, err := store.NewStore("rocksdb", t.dbpath)
+	c.Assert(err, check.IsNil)
+	defer storage.Close()
+	ctr := NewFarmerAccountController(storage, newTestChallenger(), newTestConfig())
+
+	for _, farmerId := range []string{"TestDropA", "TestDropB"} {
+		handler, err := ctr.NewFarmerHandler(farmerId)
+		c.Assert(err, check.IsNil)
+		c.Check(handler.OnLine(), check.IsNil)
+	}
+	handler, err := ctr.FarmerHandler("TestDropA")
+	c.Assert(err, check.IsNil)
+	handler.nextConquerTime = time.Now().Add(time.Hour).UnixNano()
+	handler.nextFarmerChallengeReq = challenge.NewFarmerChallengeReq("TestDropA", 100, 20, pb.HashAlgo_SHA256, nil)
+	ctr.challenger.FarmerChallengeReqCache().AddFarmerChallengeReq(handler.nextFarmerChallengeReq)
+	ctr.UpdateFarmerHandler(handler)
+
+	isA := func(farmerId string) bool { return farmerId == "TestDropA" }
+	c.Check(ctr.DropHandlers(isA), check.Equals, 1)
+	_, err = ctr.accountTree.Get("TestDropA")
+	c.Check(err, check.NotNil)
+	_, err = ctr.accountTree.Get("TestDropB")
+	c.Check(err, check.IsNil)
+	_, pending := ctr.challenger.FarmerChallengeReqCache().GetFarmerChallengeReq("TestDropA", 100, 20, pb.HashAlgo_SHA256)
+	c.Check(pending, check.Equals, false)
+
+	c.Check(ctr.RestoreHandlers(isA), check.Equals, 1)
+	restored, err := ctr.accountTree.Get("TestDropA")
+	c.Assert(err, check.IsNil)
+	c.Check(restored.Account().State, check.Equals, pb.FarmerState_ONLINE)
+	_, pending = ctr.challenger.FarmerChallengeReqCache().GetFarmerChallengeReq("TestDropA", 100, 20, pb.HashAlgo_SHA256)
+	c.Check(pending, check.Equals, true)
+
+	farmerId, ok := RecordFarmer(store.JournalColumnFamily, journalHeadKey("TestDropA"))
+	c.Check(ok, check.Equals, true)
+	c.Check(farmerId, check.Equals, "TestDropA")
+	_, ok = RecordFarmer(store.WebhookColumnFamily, []byte("TestDropA"))
+	c.Check(ok, check.Equals, false)
+}
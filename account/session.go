@@ -0,0 +1,169 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/clock"
+)
+
+// Session is a stream online farmer keeps open with supervisor, farmer needn't ping while it is open,
+// supervisor pings farmer down the stream instead, and farmer is lost as soon as the stream drops,
+// or it doesn't answer supervisor's ping before the next one is due, a stream half open drops nothing
+type Session struct {
+	h *FarmerAccountHandler
+	// supervisor pings farmer every ping interval
+	pings clock.Ticker
+	// when farmer must have answered the pings it has been sent, 0 if it has, guarded by ctr.l
+	answerBy int64
+	// the session ended as farmer didn't answer in time, it is left to Close to lose farmer, guarded by ctr.l
+	expired bool
+	done    chan struct{}
+	once    *sync.Once
+}
+
+// OpenSession brings farmer online if it isn't, such as reconnecting once its last session dropped,
+// and opens its session, the one farmer already has is taken over by it
+func (h *FarmerAccountHandler) OpenSession() (*Session, error) {
+	h.sessionL.Lock()
+	defer h.sessionL.Unlock()
+
+	if err := h.checkInService(); err != nil {
+		return nil, err
+	}
+	if h.state() != pb.FarmerState_ONLINE {
+		if err := h.OnLine(); err != nil {
+			return nil, err
+		}
+	}
+	if h.state() != pb.FarmerState_ONLINE {
+		return nil, errors.New("supervisor/account: farmer isn't online")
+	}
+
+	s := &Session{
+		h:     h,
+		pings: h.ctr.clock.NewTicker(h.ctr.cfg.PingInterval),
+		done:  make(chan struct{}),
+		once:  &sync.Once{},
+	}
+	key := farmerId2Key(h.account.FarmerID)
+
+	h.ctr.l.Lock()
+	defer h.ctr.l.Unlock()
+
+	h.ctr.endSession(h)
+	h.session = s
+	// the stream keeps farmer alive, not its pings
+	h.ctr.scheduleHandler(key, h)
+	return s, nil
+}
+
+// Pings tells when supervisor pings farmer down the session
+func (s *Session) Pings() <-chan time.Time {
+	return s.pings.C()
+}
+
+// Done is closed once the session is over on supervisor's side, farmer is no longer online,
+// another session took over, or farmer's handler left this supervisor
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Pinged is told once supervisor pinged farmer down the session, farmer must answer before the next ping is due,
+// a ping while the ones before are unanswered leaves the deadline as it is
+func (s *Session) Pinged() {
+	h := s.h
+	h.ctr.l.Lock()
+	defer h.ctr.l.Unlock()
+
+	if h.session != s || s.answerBy > 0 {
+		return
+	}
+	s.answerBy = clock.Stamp(h.ctr.clock.Now().Add(h.ctr.cfg.PingInterval))
+	h.ctr.scheduleHandler(farmerId2Key(h.account.FarmerID), h)
+}
+
+// Answered is told once a request of farmer's came down the session, which answers every ping before it
+func (s *Session) Answered() {
+	h := s.h
+	h.ctr.l.Lock()
+	defer h.ctr.l.Unlock()
+
+	if h.session != s || s.answerBy == 0 {
+		return
+	}
+	s.answerBy = 0
+	h.ctr.scheduleHandler(farmerId2Key(h.account.FarmerID), h)
+}
+
+// Close closes the session as its stream is gone, farmer is lost right away, unless another session took over
+func (s *Session) Close() {
+	h := s.h
+	h.sessionL.Lock()
+	defer h.sessionL.Unlock()
+
+	h.ctr.l.Lock()
+	// an expired session is still farmer's to drop, till another one is open
+	if h.session != s && !(s.expired && h.session == nil) {
+		h.ctr.l.Unlock()
+		return
+	}
+	s.expired = false
+	h.ctr.endSession(h)
+	h.ctr.l.Unlock()
+
+	// farmer has another interval to come back, as if it missed a ping
+	h.lostCount++
+	h.nextPingTime = clock.Stamp(h.ctr.clock.Now().Add(h.ctr.cfg.PingInterval))
+	h.Lost()
+	if h.lostCount >= h.ctr.cfg.LostCount {
+		h.OffLine()
+	}
+}
+
+// end the session of farmer that hasn't answered supervisor's pings by now, false if it has,
+// farmer is lost by the session's own Close, and by its ping deadline an interval later,
+// should the session be stuck on a stream half open, caller must hold the lock
+func (s *Session) expire(key string, now time.Time) bool {
+	h := s.h
+	if h.session != s || s.answerBy == 0 || clock.Time(s.answerBy).After(now) {
+		return false
+	}
+	s.expired = true
+	h.ctr.endSession(h)
+	h.ctr.timer.Schedule(key, deadline_ping, clock.Stamp(now.Add(h.ctr.cfg.PingInterval)))
+	return true
+}
+
+func (s *Session) end() {
+	s.once.Do(func() {
+		s.pings.Stop()
+		close(s.done)
+	})
+}
+
+// end farmer's session if it has one, caller must hold the lock
+func (ctr *FarmerAccountController) endSession(h *FarmerAccountHandler) {
+	if h.session != nil {
+		h.session.end()
+		h.session = nil
+	}
+}
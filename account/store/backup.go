@@ -0,0 +1,159 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package store
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const (
+	backup_format  = "supervisor-backup"
+	backup_version = 1
+
+	max_backup_line = 64 << 20
+)
+
+// first line of a backup
+type backupHeader struct {
+	Format         string   `json:"format"`
+	Version        int      `json:"version"`
+	ColumnFamilies []string `json:"columnFamilies"`
+}
+
+// a key/value of a column family, one per line after the header,
+// the last line has end only, a backup without it is truncated
+type backupRecord struct {
+	CF    string         `json:"cf,omitempty"`
+	Key   []byte         `json:"key,omitempty"`
+	Value []byte         `json:"value,omitempty"`
+	End   *backupTrailer `json:"end,omitempty"`
+}
+
+type backupTrailer struct {
+	// how many records are in the backup
+	Records int `json:"records"`
+	// hex sha256 of record lines, as they are written
+	Digest string `json:"sha256"`
+}
+
+// WriteBackup writes every key/value of every column family of src to w, one json object per line,
+// in order of column family and key, so that a backup of a restored db is the same as the backup restored.
+// src is better a snapshot if storage is being written. returns how many records are written
+func WriteBackup(src Iterable, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&backupHeader{Format: backup_format, Version: backup_version, ColumnFamilies: ColumnFamilies}); err != nil {
+		return 0, err
+	}
+
+	digest := sha256.New()
+	recordEnc := json.NewEncoder(io.MultiWriter(w, digest))
+	count := 0
+	for _, cfName := range ColumnFamilies {
+		var writeErr error
+		err := src.IterateCF(cfName, func(key, value []byte) bool {
+			if writeErr = recordEnc.Encode(&backupRecord{CF: cfName, Key: key, Value: value}); writeErr != nil {
+				return false
+			}
+			count++
+			return true
+		})
+		if err == nil {
+			err = writeErr
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, enc.Encode(&backupRecord{End: &backupTrailer{Records: count, Digest: hex.EncodeToString(digest.Sum(nil))}})
+}
+
+// RestoreBackup writes a backup written by WriteBackup from r into storage, which must be empty.
+// records are written as they are read, so a broken backup leaves a part of it in storage,
+// the db restored into is better thrown away if restore fails. returns how many records are written
+func RestoreBackup(storage Storage, r io.Reader) (int, error) {
+	for _, cfName := range ColumnFamilies {
+		empty := true
+		if err := storage.IterateCF(cfName, func(key, value []byte) bool {
+			empty = false
+			return false
+		}); err != nil {
+			return 0, err
+		}
+		if !empty {
+			return 0, fmt.Errorf("supervisor/store: column family %s is not empty, backup is restored into an empty db only", cfName)
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), max_backup_line)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("supervisor/store: backup is empty")
+	}
+	header := &backupHeader{}
+	if err := json.Unmarshal(scanner.Bytes(), header); err != nil || header.Format != backup_format {
+		return 0, fmt.Errorf("supervisor/store: not a supervisor backup")
+	}
+	if header.Version > backup_version {
+		return 0, fmt.Errorf("supervisor/store: backup version %d is newer than %d", header.Version, backup_version)
+	}
+
+	digest := sha256.New()
+	count := 0
+	for lineno := 2; scanner.Scan(); lineno++ {
+		record := &backupRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return count, fmt.Errorf("supervisor/store: line %d: %v", lineno, err)
+		}
+
+		if record.End != nil {
+			if record.End.Records != count {
+				return count, fmt.Errorf("supervisor/store: backup has %d records, %d read", record.End.Records, count)
+			}
+			if sum := hex.EncodeToString(digest.Sum(nil)); record.End.Digest != sum {
+				return count, fmt.Errorf("supervisor/store: backup digest %s mismatch, records have %s", record.End.Digest, sum)
+			}
+			if scanner.Scan() {
+				return count, fmt.Errorf("supervisor/store: line %d: data after end of backup", lineno+1)
+			}
+			return count, scanner.Err()
+		}
+
+		if len(record.Key) == 0 {
+			return count, fmt.Errorf("supervisor/store: line %d: record has no key", lineno)
+		}
+		if err := storage.SetCF(record.CF, record.Key, record.Value); err != nil {
+			return count, fmt.Errorf("supervisor/store: line %d: %v", lineno, err)
+		}
+		digest.Write(scanner.Bytes())
+		digest.Write([]byte{'\n'})
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+
+	return count, fmt.Errorf("supervisor/store: backup is truncated after %d records", count)
+}
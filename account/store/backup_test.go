@@ -0,0 +1,115 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+type BackupTest struct {
+	dir string
+}
+
+var _ = check.Suite(&BackupTest{})
+
+func (t *BackupTest) SetUpTest(c *check.C) {
+	t.dir = c.MkDir()
+}
+
+func (t *BackupTest) open(c *check.C, name string) Storage {
+	storage, err := NewRocksdbStorage(filepath.Join(t.dir, name))
+	c.Assert(err, check.IsNil)
+	return storage
+}
+
+func (t *BackupTest) fill(c *check.C, storage Storage) {
+	for i, cfName := range ColumnFamilies {
+		for _, key := range []string{"b", "a", "c\x00\xff"} {
+			c.Assert(storage.SetCF(cfName, []byte(key), []byte{byte(i), 0, '\n', 0xfe}), check.IsNil)
+		}
+	}
+}
+
+func (t *BackupTest) TestRoundTrip(c *check.C) {
+	src := t.open(c, "src")
+	defer src.Close()
+	t.fill(c, src)
+
+	backup := &bytes.Buffer{}
+	count, err := WriteBackup(src, backup)
+	c.Assert(err, check.IsNil)
+	c.Check(count, check.Equals, 3*len(ColumnFamilies))
+
+	dst := t.open(c, "dst")
+	defer dst.Close()
+	restored, err := RestoreBackup(dst, bytes.NewReader(backup.Bytes()))
+	c.Assert(err, check.IsNil)
+	c.Check(restored, check.Equals, count)
+
+	for _, cfName := range ColumnFamilies {
+		c.Assert(src.IterateCF(cfName, func(key, value []byte) bool {
+			got, err := dst.GetCF(cfName, key)
+			c.Check(err, check.IsNil)
+			c.Check(got, check.DeepEquals, value)
+			return true
+		}), check.IsNil)
+	}
+
+	// backup of the restored db is the backup restored, byte for byte
+	again := &bytes.Buffer{}
+	_, err = WriteBackup(dst, again)
+	c.Assert(err, check.IsNil)
+	c.Check(again.Bytes(), check.DeepEquals, backup.Bytes())
+
+	// restored into an empty db only
+	_, err = RestoreBackup(dst, bytes.NewReader(backup.Bytes()))
+	c.Check(err, check.ErrorMatches, "supervisor/store: column family .* is not empty.*")
+}
+
+func (t *BackupTest) TestRestoreBroken(c *check.C) {
+	src := t.open(c, "src")
+	defer src.Close()
+	t.fill(c, src)
+
+	backup := &bytes.Buffer{}
+	_, err := WriteBackup(src, backup)
+	c.Assert(err, check.IsNil)
+	lines := strings.SplitAfter(backup.String(), "\n")
+
+	for i, broken := range []struct {
+		backup string
+		err    string
+	}{
+		{"", "supervisor/store: backup is empty"},
+		{strings.Join(lines[1:], ""), "supervisor/store: not a supervisor backup"},
+		{strings.Join(lines[:len(lines)-2], ""), "supervisor/store: backup is truncated after .*"},
+		{strings.Join(append(lines[:2:2], lines[3:]...), ""), "supervisor/store: backup has .* records, .* read"},
+		{strings.Replace(backup.String(), lines[1], strings.Replace(lines[1], `"key":"`, `"key":"AAAA`, 1), 1), "supervisor/store: backup digest .* mismatch.*"},
+		{strings.Replace(backup.String(), lines[2], strings.Replace(lines[2], `"cf":"default"`, `"cf":"nosuch"`, 1), 1), "supervisor/store: line 3: column family nosuch not found"},
+		{backup.String() + lines[1], "supervisor/store: line .*: data after end of backup"},
+	} {
+		dst := t.open(c, fmt.Sprintf("dst%d", i))
+		_, err := RestoreBackup(dst, strings.NewReader(broken.backup))
+		c.Check(err, check.ErrorMatches, broken.err)
+		dst.Close()
+	}
+}
@@ -17,7 +17,7 @@ limitations under the License.
 package store
 
 import (
-	"errors"
+	"fmt"
 	"os"
 	"path"
 
@@ -27,6 +27,7 @@ import (
 type RocksdbStorage struct {
 	db         *gorocksdb.DB
 	defaultCFH *gorocksdb.ColumnFamilyHandle
+	cfHandlers map[string]*gorocksdb.ColumnFamilyHandle
 }
 
 func NewRocksdbStorage(dbpath string) (*RocksdbStorage, error) {
@@ -48,7 +49,7 @@ func NewRocksdbStorage(dbpath string) (*RocksdbStorage, error) {
 	opts.SetCreateIfMissing(missing)
 	opts.SetCreateIfMissingColumnFamilies(true)
 
-	cfNames := []string{"default"}
+	cfNames := ColumnFamilies
 	var cfOpts []*gorocksdb.Options
 	for range cfNames {
 		cfOpts = append(cfOpts, opts)
@@ -64,24 +65,43 @@ func NewRocksdbStorage(dbpath string) (*RocksdbStorage, error) {
 	//	return nil, err
 	//}
 
-	return &RocksdbStorage{
+	rdb := &RocksdbStorage{
 		db:         db,
 		defaultCFH: cfHandlers[0],
-	}, nil
+		cfHandlers: make(map[string]*gorocksdb.ColumnFamilyHandle),
+	}
+	for i, cfName := range cfNames {
+		rdb.cfHandlers[cfName] = cfHandlers[i]
+	}
+
+	return rdb, nil
 }
 
 func (rdb *RocksdbStorage) Get(key []byte) ([]byte, error) {
+	return rdb.get(rdb.defaultCFH, key)
+}
+
+func (rdb *RocksdbStorage) GetCF(cfName string, key []byte) ([]byte, error) {
+	cfh, err := rdb.cfHandler(cfName)
+	if err != nil {
+		return nil, err
+	}
+
+	return rdb.get(cfh, key)
+}
+
+func (rdb *RocksdbStorage) get(cfh *gorocksdb.ColumnFamilyHandle, key []byte) ([]byte, error) {
 	opt := gorocksdb.NewDefaultReadOptions()
 	defer opt.Destroy()
 
-	slice, err := rdb.db.GetCF(opt, rdb.defaultCFH, key)
+	slice, err := rdb.db.GetCF(opt, cfh, key)
 	if err != nil {
 		return nil, err
 	}
 	defer slice.Free()
 
 	if slice.Data() == nil || len(slice.Data()) == 0 {
-		return nil, errors.New("no data found")
+		return nil, ErrNotFound
 	}
 
 	data := makeCopy(slice.Data())
@@ -105,6 +125,18 @@ func (rdb *RocksdbStorage) Set(key []byte, value []byte) error {
 	//return rdb.db.Put(opt, key, value)
 }
 
+func (rdb *RocksdbStorage) SetCF(cfName string, key []byte, value []byte) error {
+	cfh, err := rdb.cfHandler(cfName)
+	if err != nil {
+		return err
+	}
+
+	opt := gorocksdb.NewDefaultWriteOptions()
+	defer opt.Destroy()
+
+	return rdb.db.PutCF(opt, cfh, key, value)
+}
+
 func (rdb *RocksdbStorage) Del(key []byte) error {
 	opt := gorocksdb.NewDefaultWriteOptions()
 	defer opt.Destroy()
@@ -113,9 +145,109 @@ func (rdb *RocksdbStorage) Del(key []byte) error {
 	//return rdb.db.Delete(opt, key)
 }
 
+func (rdb *RocksdbStorage) DelCF(cfName string, key []byte) error {
+	cfh, err := rdb.cfHandler(cfName)
+	if err != nil {
+		return err
+	}
+
+	opt := gorocksdb.NewDefaultWriteOptions()
+	defer opt.Destroy()
+
+	return rdb.db.DeleteCF(opt, cfh, key)
+}
+
+func (rdb *RocksdbStorage) IterateCF(cfName string, fn func(key, value []byte) bool) error {
+	return rdb.SeekCF(cfName, nil, fn)
+}
+
+func (rdb *RocksdbStorage) SeekCF(cfName string, start []byte, fn func(key, value []byte) bool) error {
+	opt := gorocksdb.NewDefaultReadOptions()
+	defer opt.Destroy()
+
+	return rdb.seekCF(opt, cfName, start, fn)
+}
+
+func (rdb *RocksdbStorage) seekCF(opt *gorocksdb.ReadOptions, cfName string, start []byte, fn func(key, value []byte) bool) error {
+	cfh, err := rdb.cfHandler(cfName)
+	if err != nil {
+		return err
+	}
+
+	iter := rdb.db.NewIteratorCF(opt, cfh)
+	defer iter.Close()
+
+	if len(start) == 0 {
+		iter.SeekToFirst()
+	} else {
+		iter.Seek(start)
+	}
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		value := iter.Value()
+		goon := fn(makeCopy(key.Data()), makeCopy(value.Data()))
+		key.Free()
+		value.Free()
+
+		if !goon {
+			break
+		}
+	}
+
+	return iter.Err()
+}
+
+func (rdb *RocksdbStorage) Snapshot() (Snapshot, error) {
+	return &rocksdbSnapshot{
+		rdb:  rdb,
+		snap: rdb.db.NewSnapshot(),
+	}, nil
+}
+
+func (rdb *RocksdbStorage) Compact() error {
+	for _, cfName := range ColumnFamilies {
+		rdb.db.CompactRangeCF(rdb.cfHandlers[cfName], gorocksdb.Range{})
+	}
+
+	return nil
+}
+
 func (rdb *RocksdbStorage) Close() error {
-	rdb.defaultCFH.Destroy()
+	for _, cfh := range rdb.cfHandlers {
+		cfh.Destroy()
+	}
 	rdb.db.Close()
 
 	return nil
 }
+
+func (rdb *RocksdbStorage) cfHandler(cfName string) (*gorocksdb.ColumnFamilyHandle, error) {
+	cfh, ok := rdb.cfHandlers[cfName]
+	if !ok {
+		return nil, fmt.Errorf("column family %s not found", cfName)
+	}
+
+	return cfh, nil
+}
+
+// iterators of a rocksdb snapshot read the db as of the snapshot
+type rocksdbSnapshot struct {
+	rdb  *RocksdbStorage
+	snap *gorocksdb.Snapshot
+}
+
+func (s *rocksdbSnapshot) IterateCF(cfName string, fn func(key, value []byte) bool) error {
+	return s.SeekCF(cfName, nil, fn)
+}
+
+func (s *rocksdbSnapshot) SeekCF(cfName string, start []byte, fn func(key, value []byte) bool) error {
+	opt := gorocksdb.NewDefaultReadOptions()
+	defer opt.Destroy()
+	opt.SetSnapshot(s.snap)
+
+	return s.rdb.seekCF(opt, cfName, start, fn)
+}
+
+func (s *rocksdbSnapshot) Release() {
+	s.snap.Release()
+}
@@ -63,6 +63,65 @@ func (t *RocksdbStorageTest) TestRocksdbStorage_Del(c *check.C) {
 	c.Assert(string(get), check.Equals, "")
 }
 
+func (t *RocksdbStorageTest) TestRocksdbStorage_ColumnFamily(c *check.C) {
+	c.Assert(t.storage.SetCF(RuntimeColumnFamily, []byte("cf"), []byte("runtime")), check.IsNil)
+	get, err := t.storage.GetCF(RuntimeColumnFamily, []byte("cf"))
+	c.Assert(err, check.IsNil)
+	c.Check(string(get), check.Equals, "runtime")
+
+	// column families don't share keys
+	_, err = t.storage.Get([]byte("cf"))
+	c.Check(err, check.NotNil)
+
+	c.Assert(t.storage.DelCF(RuntimeColumnFamily, []byte("cf")), check.IsNil)
+	_, err = t.storage.GetCF(RuntimeColumnFamily, []byte("cf"))
+	c.Check(err, check.Equals, ErrNotFound)
+
+	c.Check(t.storage.SetCF("unknown", []byte("cf"), []byte("unknown")), check.NotNil)
+}
+
+func (t *RocksdbStorageTest) TestRocksdbStorage_IterateCF(c *check.C) {
+	for _, key := range []string{"iter2", "iter1", "iter3"} {
+		c.Assert(t.storage.SetCF(RuntimeColumnFamily, []byte(key), []byte(key)), check.IsNil)
+	}
+
+	keys := []string{}
+	c.Assert(t.storage.IterateCF(RuntimeColumnFamily, func(key, value []byte) bool {
+		c.Check(string(value), check.Equals, string(key))
+		keys = append(keys, string(key))
+		return true
+	}), check.IsNil)
+	c.Check(keys, check.DeepEquals, []string{"iter1", "iter2", "iter3"})
+
+	count := 0
+	c.Assert(t.storage.IterateCF(RuntimeColumnFamily, func(key, value []byte) bool {
+		count++
+		return false
+	}), check.IsNil)
+	c.Check(count, check.Equals, 1)
+
+	for _, key := range keys {
+		c.Assert(t.storage.DelCF(RuntimeColumnFamily, []byte(key)), check.IsNil)
+	}
+}
+
+func (t *RocksdbStorageTest) TestRocksdbStorage_SeekCF(c *check.C) {
+	for _, key := range []string{"seek1", "seek3", "seek5"} {
+		c.Assert(t.storage.SetCF(JournalColumnFamily, []byte(key), []byte(key)), check.IsNil)
+	}
+
+	keys := []string{}
+	c.Assert(t.storage.SeekCF(JournalColumnFamily, []byte("seek2"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}), check.IsNil)
+	c.Check(keys, check.DeepEquals, []string{"seek3", "seek5"})
+
+	for _, key := range []string{"seek1", "seek3", "seek5"} {
+		c.Assert(t.storage.DelCF(JournalColumnFamily, []byte(key)), check.IsNil)
+	}
+}
+
 func (t *RocksdbStorageTest) BenchmarkRocksdbStorage_Set(c *check.C) {
 	for i := 0; i < c.N; i++ {
 		val := []byte(fmt.Sprintf("benchmarkRocksdb_%v", i))
@@ -87,3 +146,37 @@ func (t *RocksdbStorageTest) BenchmarkRocksdbStorage_Del(c *check.C) {
 		t.storage.Del(val)
 	}
 }
+
+func (t *RocksdbStorageTest) TestRocksdbStorage_Compact(c *check.C) {
+	c.Assert(t.storage.SetCF(JournalColumnFamily, []byte("compact"), []byte("abc")), check.IsNil)
+	c.Assert(t.storage.DelCF(JournalColumnFamily, []byte("compact")), check.IsNil)
+
+	var storage Storage = t.storage
+	compacter, ok := storage.(Compacter)
+	c.Assert(ok, check.Equals, true)
+	c.Check(compacter.Compact(), check.IsNil)
+	_, err := t.storage.GetCF(JournalColumnFamily, []byte("compact"))
+	c.Check(err, check.Equals, ErrNotFound)
+}
+
+func (t *RocksdbStorageTest) TestRocksdbStorage_Snapshot(c *check.C) {
+	c.Assert(t.storage.SetCF(WebhookColumnFamily, []byte("snap1"), []byte("before")), check.IsNil)
+	snap, err := t.storage.Snapshot()
+	c.Assert(err, check.IsNil)
+	defer snap.Release()
+
+	// writes after the snapshot are not seen through it
+	c.Assert(t.storage.SetCF(WebhookColumnFamily, []byte("snap1"), []byte("after")), check.IsNil)
+	c.Assert(t.storage.SetCF(WebhookColumnFamily, []byte("snap2"), []byte("after")), check.IsNil)
+
+	values := map[string]string{}
+	c.Assert(snap.IterateCF(WebhookColumnFamily, func(key, value []byte) bool {
+		values[string(key)] = string(value)
+		return true
+	}), check.IsNil)
+	c.Check(values, check.DeepEquals, map[string]string{"snap1": "before"})
+
+	for _, key := range []string{"snap1", "snap2"} {
+		c.Assert(t.storage.DelCF(WebhookColumnFamily, []byte(key)), check.IsNil)
+	}
+}
@@ -17,18 +17,75 @@ limitations under the License.
 package store
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 )
 
+const (
+	// farmer accounts are stored in the default column family
+	DefaultColumnFamily = "default"
+	// farmer handlers' runtime state, such as lost count and pending challenge
+	RuntimeColumnFamily = "runtime"
+	// blocks accumulator of challenges, its nodes and block digests
+	AccumulatorColumnFamily = "accumulator"
+	// append only balance journals of farmers
+	JournalColumnFamily = "journal"
+	// webhook notifications waiting to be delivered
+	WebhookColumnFamily = "webhook"
+	// raft log and state of a supervisor in a cluster, never replicated itself
+	RaftColumnFamily = "raft"
+	// slots of the shard map this supervisor took part in moving, and who owns them since
+	ShardColumnFamily = "shard"
+)
+
+var (
+	// what Get/GetCF return for a missing key
+	ErrNotFound = errors.New("no data found")
+
+	ColumnFamilies = []string{DefaultColumnFamily, RuntimeColumnFamily, AccumulatorColumnFamily, JournalColumnFamily, WebhookColumnFamily, RaftColumnFamily, ShardColumnFamily}
+)
+
+// Get/Set/Del work on the default column family
 type Storage interface {
 	Get([]byte) ([]byte, error)
 	Set([]byte, []byte) error
 	Del([]byte) error
+	GetCF(string, []byte) ([]byte, error)
+	SetCF(string, []byte, []byte) error
+	DelCF(string, []byte) error
+	// iterate over all key/values of the column family in key order, stop once fn returns false
+	IterateCF(string, func(key, value []byte) bool) error
+	// like IterateCF, but starts from the first key >= start
+	SeekCF(string, []byte, func(key, value []byte) bool) error
 	Close() error
 }
 
+// Iterable reads column families in key order, both Storage and Snapshot are
+type Iterable interface {
+	IterateCF(string, func(key, value []byte) bool) error
+	SeekCF(string, []byte, func(key, value []byte) bool) error
+}
+
+// Snapshot is a read only view of storage as it was when the snapshot was taken,
+// writes after it are not seen, it must be released once read
+type Snapshot interface {
+	Iterable
+	Release()
+}
+
+// Snapshotter is a storage which can take snapshots of itself, while it's being written
+type Snapshotter interface {
+	Snapshot() (Snapshot, error)
+}
+
+// Compacter is a storage which can compact itself by hand, such as after a large import
+type Compacter interface {
+	// compact every column family over the whole key range
+	Compact() error
+}
+
 func NewStore(backend string, args ...interface{}) (storage Storage, err error) {
 	if backend == "" {
 		backend = "rocksdb"
@@ -0,0 +1,247 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/conseweb/common/semaphore"
+	"github.com/conseweb/supervisor/clock"
+)
+
+// what a deadline of a handler is for
+type deadlineKind int
+
+const (
+	deadline_ping deadlineKind = iota
+	deadline_conquer
+	deadline_suspension
+)
+
+// longest the timer sleeps without a deadline ahead
+const max_timer_wait = time.Hour
+
+// a deadline of a farmer, in UnixNano
+type deadline struct {
+	key   string
+	kind  deadlineKind
+	at    int64
+	index int
+}
+
+type deadlineKey struct {
+	key  string
+	kind deadlineKind
+}
+
+// min-heap of deadlines, the earliest on top
+type deadlineHeap []*deadline
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *deadlineHeap) Push(x interface{}) {
+	d := x.(*deadline)
+	d.index = len(*h)
+	*h = append(*h, d)
+}
+
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	d := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	d.index = -1
+	return d
+}
+
+// deadlineTimer fires farmers' deadlines the moment they lapse, instead of scanning every handler every interval,
+// a farmer has at most one deadline of each kind, scheduling it again moves it
+type deadlineTimer struct {
+	l       *sync.Mutex
+	heap    deadlineHeap
+	entries map[deadlineKey]*deadline
+	// woken once the earliest deadline changes
+	wake  chan struct{}
+	clock clock.Clock
+	// called with farmer's key when any of its deadlines lapses, by up to workers at once
+	fire    func(key string)
+	workers int
+	// run and the fires it started, waited for before the controller closes
+	running *sync.WaitGroup
+}
+
+func newDeadlineTimer(clk clock.Clock, workers int, fire func(key string)) *deadlineTimer {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &deadlineTimer{
+		l:       &sync.Mutex{},
+		entries: make(map[deadlineKey]*deadline),
+		clock:   clk,
+		wake:    make(chan struct{}, 1),
+		fire:    fire,
+		workers: workers,
+		running: &sync.WaitGroup{},
+	}
+}
+
+// Schedule sets farmer's deadline of kind at UnixNano at
+func (t *deadlineTimer) Schedule(key string, kind deadlineKind, at int64) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if d, ok := t.entries[deadlineKey{key, kind}]; ok {
+		if d.at == at {
+			return
+		}
+		d.at = at
+		heap.Fix(&t.heap, d.index)
+	} else {
+		d = &deadline{key: key, kind: kind, at: at}
+		t.entries[deadlineKey{key, kind}] = d
+		heap.Push(&t.heap, d)
+	}
+	if t.heap[0].at == at {
+		t.notify()
+	}
+}
+
+// Cancel drops farmer's deadline of kind, if any
+func (t *deadlineTimer) Cancel(key string, kind deadlineKind) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	t.cancel(key, kind)
+}
+
+// CancelAll drops every deadline of farmer
+func (t *deadlineTimer) CancelAll(key string) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	for _, kind := range []deadlineKind{deadline_ping, deadline_conquer, deadline_suspension} {
+		t.cancel(key, kind)
+	}
+}
+
+func (t *deadlineTimer) cancel(key string, kind deadlineKind) {
+	if d, ok := t.entries[deadlineKey{key, kind}]; ok {
+		delete(t.entries, deadlineKey{key, kind})
+		heap.Remove(&t.heap, d.index)
+	}
+}
+
+// Len is how many deadlines are ahead
+func (t *deadlineTimer) Len() int {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	return len(t.heap)
+}
+
+// Deadline of farmer of kind, false if there is none
+func (t *deadlineTimer) Deadline(key string, kind deadlineKind) (int64, bool) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if d, ok := t.entries[deadlineKey{key, kind}]; ok {
+		return d.at, true
+	}
+	return 0, false
+}
+
+// caller must hold the lock
+func (t *deadlineTimer) notify() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// farmers whose deadlines lapsed by now, taken off the timer, each farmer once
+func (t *deadlineTimer) lapsed(now int64) (keys []string, wait time.Duration) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	seen := make(map[string]bool)
+	for len(t.heap) > 0 && t.heap[0].at <= now {
+		d := heap.Pop(&t.heap).(*deadline)
+		delete(t.entries, deadlineKey{d.key, d.kind})
+		if !seen[d.key] {
+			seen[d.key] = true
+			keys = append(keys, d.key)
+		}
+	}
+
+	wait = max_timer_wait
+	if len(t.heap) > 0 && time.Duration(t.heap[0].at-now) < wait {
+		wait = time.Duration(t.heap[0].at - now)
+	}
+	return
+}
+
+// run fires deadlines as they lapse, until stop closed
+func (t *deadlineTimer) run(stop <-chan struct{}) {
+	sema := semaphore.NewSemaphore(t.workers)
+
+	for {
+		keys, wait := t.lapsed(clock.Stamp(t.clock.Now()))
+		for _, key := range keys {
+			sema.Acquire()
+			t.running.Add(1)
+			go func(key string) {
+				defer t.running.Done()
+				defer sema.Release()
+
+				t.fire(key)
+			}(key)
+		}
+
+		timer := t.clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-t.wake:
+			timer.Stop()
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// start runs the timer in background, until stop closed
+func (t *deadlineTimer) start(stop <-chan struct{}) {
+	t.running.Add(1)
+	go func() {
+		defer t.running.Done()
+
+		t.run(stop)
+	}()
+}
+
+// wait for the timer started to stop, and the fires it started to return
+func (t *deadlineTimer) wait() {
+	t.running.Wait()
+}
@@ -0,0 +1,228 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/common/semaphore"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/clock"
+	"gopkg.in/check.v1"
+)
+
+const (
+	benchmark_farmers = 1000000
+)
+
+type TestDeadlineTimer struct {
+	dbpath string
+}
+
+var _ = check.Suite(&TestDeadlineTimer{})
+
+func (t *TestDeadlineTimer) SetUpTest(c *check.C) {
+	t.dbpath = filepath.Join(os.TempDir(), "testDeadlineTimer")
+	os.RemoveAll(t.dbpath)
+}
+
+func (t *TestDeadlineTimer) TearDownTest(c *check.C) {
+	os.RemoveAll(t.dbpath)
+}
+
+// timer started waits for clk, no deadline lapses until it's advanced
+func waitTimer(c *check.C, clk *clock.Fake, timer *deadlineTimer) {
+	for i := 0; i < 1000; i++ {
+		if clk.Waiters() == 1 && len(timer.wake) == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Fatal("timer isn't waiting for the clock")
+}
+
+func (t *TestDeadlineTimer) TestFire(c *check.C) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	fired := make(chan string, 8)
+	timer := newDeadlineTimer(clk, 1, func(key string) { fired <- key })
+
+	now := clk.Now()
+	timer.Schedule("c", deadline_ping, clock.Stamp(now.Add(time.Second*3)))
+	timer.Schedule("a", deadline_ping, clock.Stamp(now.Add(time.Second)))
+	timer.Schedule("b", deadline_conquer, clock.Stamp(now.Add(time.Second*2)))
+	// farmer's deadlines lapsing together fire it once
+	timer.Schedule("a", deadline_conquer, clock.Stamp(now.Add(time.Second)))
+	// pinged, its deadline moves on
+	timer.Schedule("d", deadline_ping, clock.Stamp(now.Add(time.Second)))
+	timer.Schedule("d", deadline_ping, clock.Stamp(now.Add(time.Hour)))
+	// offline, its deadlines are gone
+	timer.Schedule("e", deadline_ping, clock.Stamp(now.Add(time.Second)))
+	timer.CancelAll("e")
+	c.Check(timer.Len(), check.Equals, 5)
+
+	stop := make(chan struct{})
+	timer.start(stop)
+	defer timer.wait()
+	defer close(stop)
+
+	for _, key := range []string{"a", "b", "c"} {
+		waitTimer(c, clk, timer)
+		clk.Advance(time.Second)
+		select {
+		case fire := <-fired:
+			c.Check(fire, check.Equals, key)
+		case <-time.After(time.Second * 5):
+			c.Fatalf("%s not fired", key)
+		}
+	}
+	waitTimer(c, clk, timer)
+	c.Check(fired, check.HasLen, 0)
+	c.Check(timer.Len(), check.Equals, 1)
+	at, ok := timer.Deadline("d", deadline_ping)
+	c.Check(ok, check.Equals, true)
+	c.Check(at, check.Equals, clock.Stamp(now.Add(time.Hour)))
+	_, ok = timer.Deadline("a", deadline_ping)
+	c.Check(ok, check.Equals, false)
+}
+
+// farmer not pinging is lost once its ping deadline lapses, and offline after lost count of them, pinging keeps it online
+func (t *TestDeadlineTimer) TestPingDeadline(c *check.C) {
+	storage, err := store.NewStore("rocksdb", t.dbpath)
+	c.Assert(err, check.IsNil)
+	clk := clock.NewFake(time.Unix(1000, 0))
+	cfg := newTestConfig()
+	cfg.Clock = clk
+	ctr := NewFarmerAccountController(storage, newTestChallenger(), cfg)
+	defer ctr.Close()
+
+	// deadlines lapsed by now are checked as the timer would, one step at a time
+	step := func(d time.Duration) {
+		clk.Advance(d)
+		keys, _ := ctr.timer.lapsed(clock.Stamp(clk.Now()))
+		for _, key := range keys {
+			ctr.checkHandler(key)
+		}
+	}
+
+	lost, err := ctr.NewFarmerHandler("TestPingDeadlineLost")
+	c.Assert(err, check.IsNil)
+	c.Assert(lost.OnLine(), check.IsNil)
+	pinging, err := ctr.NewFarmerHandler("TestPingDeadlinePinging")
+	c.Assert(err, check.IsNil)
+	c.Assert(pinging.OnLine(), check.IsNil)
+	at, ok := ctr.timer.Deadline(farmerId2Key("TestPingDeadlineLost"), deadline_ping)
+	c.Check(ok, check.Equals, true)
+	c.Check(at, check.Equals, clock.Stamp(clk.Now().Add(cfg.PingInterval)))
+
+	step(cfg.PingInterval / 2)
+	_, err = pinging.Ping(100, 20, ChallengeSupport{})
+	c.Assert(err, check.IsNil)
+	step(cfg.PingInterval/2 - time.Nanosecond)
+	c.Check(lost.Account().State, check.Equals, pb.FarmerState_ONLINE)
+
+	// lost once its ping deadline lapses, with another interval to ping
+	step(time.Nanosecond)
+	c.Check(lost.Account().State, check.Equals, pb.FarmerState_LOST)
+	c.Check(lost.LostCount(), check.Equals, 1)
+	c.Check(pinging.Account().State, check.Equals, pb.FarmerState_ONLINE)
+
+	step(cfg.PingInterval / 3)
+	_, err = pinging.Ping(100, 20, ChallengeSupport{})
+	c.Assert(err, check.IsNil)
+	step(cfg.PingInterval - cfg.PingInterval/3)
+	c.Check(lost.Account().State, check.Equals, pb.FarmerState_OFFLINE)
+	_, err = ctr.accountTree.Get(farmerId2Key("TestPingDeadlineLost"))
+	c.Check(err, check.NotNil)
+	_, ok = ctr.timer.Deadline(farmerId2Key("TestPingDeadlineLost"), deadline_ping)
+	c.Check(ok, check.Equals, false)
+	c.Check(pinging.Account().State, check.Equals, pb.FarmerState_ONLINE)
+	c.Check(pinging.LostCount(), check.Equals, 0)
+}
+
+// a timer of benchmark_farmers ping deadlines, an hour ahead
+func newBenchmarkTimer() *deadlineTimer {
+	timer := newDeadlineTimer(clock.Real(), 8, func(string) {})
+	at := time.Now().Add(time.Hour).UnixNano()
+	for i := 0; i < benchmark_farmers; i++ {
+		timer.Schedule(fmt.Sprintf("%07d", i), deadline_ping, at+int64(i))
+	}
+	return timer
+}
+
+// what every check interval cost before the timer, a goroutine checking each handler, none of them due
+func (t *TestDeadlineTimer) BenchmarkScanHandlers(c *check.C) {
+	storage, err := store.NewStore("rocksdb", t.dbpath)
+	c.Assert(err, check.IsNil)
+	ctr := NewFarmerAccountController(storage, newTestChallenger(), newTestConfig())
+	defer ctr.Close()
+	nextPingTime := clock.Stamp(time.Now().Add(time.Hour))
+	for i := 0; i < benchmark_farmers; i++ {
+		ctr.accountTree.Put(fmt.Sprintf("%07d", i), &FarmerAccountHandler{
+			ctr:          ctr,
+			account:      &pb.FarmerAccount{State: pb.FarmerState_ONLINE},
+			nextPingTime: nextPingTime,
+		})
+	}
+	workers := ctr.cfg.CheckWorkers
+	sema := semaphore.NewSemaphore(workers)
+
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		for _, key := range ctr.accountTree.Keys() {
+			sema.Acquire()
+			go func(key string) {
+				defer sema.Release()
+
+				ctr.checkHandler(key)
+			}(key)
+		}
+		// the interval is over once every check is
+		for j := 0; j < workers; j++ {
+			sema.Acquire()
+		}
+		for j := 0; j < workers; j++ {
+			sema.Release()
+		}
+	}
+}
+
+// what the timer costs when it wakes up, none of the deadlines due
+func (t *TestDeadlineTimer) BenchmarkTimerLapsed(c *check.C) {
+	timer := newBenchmarkTimer()
+
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		if keys, _ := timer.lapsed(time.Now().UnixNano()); len(keys) > 0 {
+			c.Fatal("no deadline is due")
+		}
+	}
+}
+
+// what a ping costs the timer, moving farmer's ping deadline
+func (t *TestDeadlineTimer) BenchmarkTimerSchedule(c *check.C) {
+	timer := newBenchmarkTimer()
+	at := time.Now().Add(time.Hour * 2).UnixNano()
+
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		timer.Schedule(fmt.Sprintf("%07d", i%benchmark_farmers), deadline_ping, at+int64(i))
+	}
+}
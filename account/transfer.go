@@ -0,0 +1,80 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package account
+
+import (
+	"encoding/binary"
+
+	"github.com/conseweb/supervisor/account/store"
+)
+
+var (
+	// column families holding records of farmers, which go along with farmers handed over to another supervisor
+	FarmerColumnFamilies = []string{store.DefaultColumnFamily, store.RuntimeColumnFamily, store.JournalColumnFamily}
+)
+
+// RecordFarmer returns id of the farmer a record of one of FarmerColumnFamilies belongs to
+func RecordFarmer(cf string, key []byte) (string, bool) {
+	switch cf {
+	case store.DefaultColumnFamily, store.RuntimeColumnFamily:
+		return string(key), len(key) > 0
+	case store.JournalColumnFamily:
+		if len(key) < 2 {
+			return "", false
+		}
+		n := int(binary.BigEndian.Uint16(key))
+		if n == 0 || len(key) < 2+n {
+			return "", false
+		}
+		return string(key[2 : 2+n]), true
+	default:
+		return "", false
+	}
+}
+
+// DropHandlers takes handlers of farmers matched out of account tree, all if match is nil,
+// along with their pending challenges, their runtime state stays in storage,
+// for whichever supervisor serves the farmers next
+func (ctr *FarmerAccountController) DropHandlers(match func(farmerId string) bool) int {
+	ctr.l.Lock()
+	defer ctr.l.Unlock()
+
+	dropped := 0
+	for _, key := range ctr.accountTree.Keys() {
+		h, err := ctr.accountTree.Get(key)
+		if err != nil || (match != nil && !match(h.account.FarmerID)) {
+			continue
+		}
+		if req := h.nextFarmerChallengeReq; req != nil {
+			blocksRange := req.BlocksRange()
+			ctr.challenger.FarmerChallengeReqCache().DelFarmerChallengeReq(req.FarmerID(), blocksRange.HighBlockNumber, blocksRange.LowBlockNumber, req.HashAlgo())
+		}
+		ctr.accountTree.Delete(key)
+		ctr.timer.CancelAll(key)
+		ctr.endSession(h)
+		h.dropped = true
+		dropped++
+	}
+
+	return dropped
+}
+
+// RestoreHandlers puts handlers of farmers matched back into account tree, from their runtime state in storage,
+// such as of farmers handed over by another supervisor
+func (ctr *FarmerAccountController) RestoreHandlers(match func(farmerId string) bool) int {
+	return ctr.restoreHandlers(match)
+}
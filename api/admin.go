@@ -0,0 +1,385 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/audit"
+	"github.com/conseweb/supervisor/challenge"
+	"github.com/conseweb/supervisor/mtls"
+	"github.com/conseweb/supervisor/shard"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	default_list_limit = 100
+	max_list_limit     = 1000
+
+	unknown_operator = "unknown"
+
+	snapshot_chunk_size = 64 * 1024
+)
+
+// SupervisorAdmin is the admin service for operators, every call is audited
+type SupervisorAdmin struct {
+	ctr        *account.FarmerAccountController
+	challenger *challenge.Challenger
+	auditor    *audit.Auditor
+	// nil if farmers aren't sharded among supervisors
+	sharder *shard.Sharder
+}
+
+// NewSupervisorAdmin returns admin service upon the account controller and challenger,
+// nil auditor means calls are only logged
+func NewSupervisorAdmin(ctr *account.FarmerAccountController, challenger *challenge.Challenger, auditor *audit.Auditor) *SupervisorAdmin {
+	return &SupervisorAdmin{
+		ctr:        ctr,
+		challenger: challenger,
+		auditor:    auditor,
+	}
+}
+
+// SetSharder lets admin service move slots of the shard map
+func (adm *SupervisorAdmin) SetSharder(sharder *shard.Sharder) {
+	adm.sharder = sharder
+}
+
+// LocalAuthInfo is auth info of an operator on supervisor's own host,
+// calling over the control socket or against a stopped node's db
+type LocalAuthInfo struct {
+	Operator string
+}
+
+func (LocalAuthInfo) AuthType() string {
+	return "local"
+}
+
+// operator is common name of client's certificate, or the local operator
+func operatorOf(ctx context.Context) string {
+	info, ok := credentials.FromContext(ctx)
+	if !ok {
+		return unknown_operator
+	}
+	if localInfo, ok := info.(LocalAuthInfo); ok {
+		return localInfo.Operator
+	}
+	if name := mtls.PeerName(ctx); name != "" {
+		return name
+	}
+
+	return unknown_operator
+}
+
+// log and audit a call once it is done
+func (adm *SupervisorAdmin) audit(ctx context.Context, method, farmerId string, req proto.Message, rspErr *pb.Error) {
+	operator := operatorOf(ctx)
+	var err error
+	if !rspErr.OK() {
+		err = rspErr
+	}
+	logger.Infof("admin %s by %s, req: %v, err: %v", method, operator, req, err)
+
+	if adm.auditor != nil {
+		adm.auditor.Admin(operator, method, farmerId, proto.CompactTextString(req), err)
+	}
+}
+
+// error of loading an existing farmer
+func farmerError(err error) *pb.Error {
+	if err == account.ErrFarmerNotFound {
+		return pb.NewError(pb.ErrorType_FARMER_NOT_FOUND, err.Error())
+	}
+	return pb.NewError(pb.ErrorType_INVALID_PARAM, err.Error())
+}
+
+func (adm *SupervisorAdmin) GetFarmer(ctx context.Context, req *pb.GetFarmerReq) (*pb.GetFarmerRsp, error) {
+	rsp := &pb.GetFarmerRsp{
+		Error: pb.ResponseOK(),
+	}
+	defer func() { adm.audit(ctx, "GetFarmer", req.FarmerID, req, rsp.Error) }()
+
+	farmer, handler, err := adm.ctr.LoadFarmer(req.FarmerID)
+	if err != nil {
+		rsp.Error = farmerError(err)
+		return rsp, nil
+	}
+
+	rsp.Account = farmer
+	if handler == nil {
+		return rsp, nil
+	}
+	rsp.InService = true
+	rsp.LostCount = int32(handler.LostCount())
+	rsp.NextPing = handler.NextPingTime()
+	if challengeReq, deadline := handler.PendingChallenge(); challengeReq != nil {
+		rsp.Challenge = &pb.PendingChallenge{
+			BlocksRange: challengeReq.BlocksRange(),
+			HashAlgo:    challengeReq.HashAlgo(),
+			Kind:        challengeReq.Kind(),
+			Deadline:    deadline,
+		}
+	}
+
+	return rsp, nil
+}
+
+func (adm *SupervisorAdmin) ListFarmers(ctx context.Context, req *pb.ListFarmersReq) (*pb.ListFarmersRsp, error) {
+	rsp := &pb.ListFarmersRsp{
+		Error: pb.ResponseOK(),
+	}
+	defer func() { adm.audit(ctx, "ListFarmers", "", req, rsp.Error) }()
+
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = default_list_limit
+	}
+	if limit > max_list_limit {
+		limit = max_list_limit
+	}
+
+	// farmers out of service are in storage only
+	stored := req.Stored
+	for _, state := range req.States {
+		stored = stored || !account.InService(state)
+	}
+	if stored {
+		accounts, next, err := adm.ctr.StoredFarmers(req.Prefix, req.After, req.States, limit)
+		if err != nil {
+			rsp.Error = pb.NewErrorf(pb.ErrorType_INTERNAL_ERROR, "list stored farmers err: %v", err)
+			return rsp, nil
+		}
+		rsp.Accounts, rsp.Next = accounts, next
+		return rsp, nil
+	}
+
+	handlers, next := adm.ctr.InServiceFarmers(req.Prefix, req.After, req.States, limit)
+	for _, handler := range handlers {
+		rsp.Accounts = append(rsp.Accounts, handler.Account())
+	}
+	rsp.Next = next
+
+	return rsp, nil
+}
+
+func (adm *SupervisorAdmin) AdjustBalance(ctx context.Context, req *pb.AdjustBalanceReq) (*pb.AdminFarmerRsp, error) {
+	rsp := &pb.AdminFarmerRsp{
+		Error: pb.ResponseOK(),
+	}
+	defer func() { adm.audit(ctx, "AdjustBalance", req.FarmerID, req, rsp.Error) }()
+
+	if req.Reason == "" {
+		rsp.Error = pb.NewError(pb.ErrorType_INVALID_PARAM, "reason is empty")
+		return rsp, nil
+	}
+	if _, _, err := adm.ctr.LoadFarmer(req.FarmerID); err != nil {
+		rsp.Error = farmerError(err)
+		return rsp, nil
+	}
+
+	if err := adm.ctr.AdjustBalance(req.FarmerID, req.Balance, req.Reason); err != nil {
+		rsp.Error = pb.NewErrorf(pb.ErrorType_INTERNAL_ERROR, "adjust balance err: %v", err)
+		return rsp, nil
+	}
+	rsp.Account, _, _ = adm.ctr.LoadFarmer(req.FarmerID)
+
+	return rsp, nil
+}
+
+func (adm *SupervisorAdmin) ForceOffline(ctx context.Context, req *pb.AdminFarmerReq) (*pb.AdminFarmerRsp, error) {
+	rsp := &pb.AdminFarmerRsp{
+		Error: pb.ResponseOK(),
+	}
+	defer func() { adm.audit(ctx, "ForceOffline", req.FarmerID, req, rsp.Error) }()
+
+	rsp.Account, rsp.Error = adm.farmerOp(req.FarmerID, pb.ErrorType_INVALID_STATE_FARMER_OFFLINE, adm.ctr.ForceOffline)
+	return rsp, nil
+}
+
+func (adm *SupervisorAdmin) SuspendFarmer(ctx context.Context, req *pb.SuspendFarmerReq) (*pb.AdminFarmerRsp, error) {
+	rsp := &pb.AdminFarmerRsp{
+		Error: pb.ResponseOK(),
+	}
+	defer func() { adm.audit(ctx, "SuspendFarmer", req.FarmerID, req, rsp.Error) }()
+
+	if req.Duration <= 0 {
+		rsp.Error = pb.NewError(pb.ErrorType_INVALID_PARAM, "duration must be positive")
+		return rsp, nil
+	}
+	rsp.Account, rsp.Error = adm.farmerOp(req.FarmerID, pb.ErrorType_INVALID_PARAM, func(farmerId string) error {
+		return adm.ctr.SuspendFarmer(farmerId, time.Duration(req.Duration), req.Reason)
+	})
+	return rsp, nil
+}
+
+func (adm *SupervisorAdmin) BanFarmer(ctx context.Context, req *pb.AdminFarmerReq) (*pb.AdminFarmerRsp, error) {
+	rsp := &pb.AdminFarmerRsp{
+		Error: pb.ResponseOK(),
+	}
+	defer func() { adm.audit(ctx, "BanFarmer", req.FarmerID, req, rsp.Error) }()
+
+	rsp.Account, rsp.Error = adm.farmerOp(req.FarmerID, pb.ErrorType_INVALID_PARAM, func(farmerId string) error {
+		return adm.ctr.BanFarmer(farmerId, req.Reason)
+	})
+	return rsp, nil
+}
+
+func (adm *SupervisorAdmin) LiftFarmer(ctx context.Context, req *pb.AdminFarmerReq) (*pb.AdminFarmerRsp, error) {
+	rsp := &pb.AdminFarmerRsp{
+		Error: pb.ResponseOK(),
+	}
+	defer func() { adm.audit(ctx, "LiftFarmer", req.FarmerID, req, rsp.Error) }()
+
+	rsp.Account, rsp.Error = adm.farmerOp(req.FarmerID, pb.ErrorType_INVALID_PARAM, adm.ctr.LiftFarmer)
+	return rsp, nil
+}
+
+func (adm *SupervisorAdmin) ClearChallenge(ctx context.Context, req *pb.AdminFarmerReq) (*pb.AdminFarmerRsp, error) {
+	rsp := &pb.AdminFarmerRsp{
+		Error: pb.ResponseOK(),
+	}
+	defer func() { adm.audit(ctx, "ClearChallenge", req.FarmerID, req, rsp.Error) }()
+
+	rsp.Account, rsp.Error = adm.farmerOp(req.FarmerID, pb.ErrorType_INVALID_PARAM, func(farmerId string) error {
+		cleared, err := adm.ctr.ClearChallenge(farmerId)
+		if err == nil && !cleared {
+			return errors.New("farmer has no pending challenge")
+		}
+		return err
+	})
+	return rsp, nil
+}
+
+func (adm *SupervisorAdmin) FlushCaches(ctx context.Context, req *pb.FlushCachesReq) (*pb.FlushCachesRsp, error) {
+	rsp := &pb.FlushCachesRsp{
+		Error: pb.ResponseOK(),
+	}
+	defer func() { adm.audit(ctx, "FlushCaches", "", req, rsp.Error) }()
+
+	caches := req.Caches
+	if len(caches) == 0 {
+		caches = []pb.AdminCache{pb.AdminCache_BLOCKS_HASH_CACHE, pb.AdminCache_BLOCK_DIGEST_CACHE}
+	}
+	for _, cache := range caches {
+		switch cache {
+		case pb.AdminCache_BLOCKS_HASH_CACHE:
+			adm.challenger.FlushBlocksHashes()
+		case pb.AdminCache_BLOCK_DIGEST_CACHE:
+			adm.challenger.FlushBlockDigests()
+		default:
+			rsp.Error = pb.NewErrorf(pb.ErrorType_INVALID_PARAM, "unknown cache %v", cache)
+			return rsp, nil
+		}
+		rsp.Flushed = append(rsp.Flushed, cache)
+	}
+
+	return rsp, nil
+}
+
+// Snapshot streams a dump of db as it is at the call, in the format asked for, while supervisor keeps serving
+func (adm *SupervisorAdmin) Snapshot(req *pb.SnapshotReq, stream pb.SupervisorAdmin_SnapshotServer) error {
+	rspErr := pb.ResponseOK()
+	defer func() { adm.audit(stream.Context(), "Snapshot", "", req, rspErr) }()
+
+	var dump func(src store.Iterable, w io.Writer) (int, error)
+	switch req.Format {
+	case pb.SnapshotFormat_ACCOUNTS:
+		dump = account.ExportAccounts
+	case pb.SnapshotFormat_BACKUP:
+		dump = store.WriteBackup
+	default:
+		rspErr = pb.NewErrorf(pb.ErrorType_INVALID_PARAM, "unknown snapshot format %v", req.Format)
+		return stream.Send(&pb.SnapshotChunk{Error: rspErr})
+	}
+
+	snap, err := adm.ctr.Snapshot()
+	if err != nil {
+		rspErr = pb.NewError(pb.ErrorType_INTERNAL_ERROR, err.Error())
+		return stream.Send(&pb.SnapshotChunk{Error: rspErr})
+	}
+	defer snap.Release()
+
+	w := bufio.NewWriterSize(&chunkWriter{stream: stream}, snapshot_chunk_size)
+	count, err := dump(snap, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		rspErr = pb.NewErrorf(pb.ErrorType_INTERNAL_ERROR, "snapshot broken after %d records: %v", count, err)
+		return stream.Send(&pb.SnapshotChunk{Error: rspErr})
+	}
+
+	return nil
+}
+
+// MoveShard hands farmers of a slot over to another supervisor, their requests wait until it's done
+func (adm *SupervisorAdmin) MoveShard(ctx context.Context, req *pb.MoveShardReq) (*pb.MoveShardRsp, error) {
+	rsp := &pb.MoveShardRsp{
+		Error: pb.ResponseOK(),
+	}
+	defer func() { adm.audit(ctx, "MoveShard", "", req, rsp.Error) }()
+
+	if adm.sharder == nil {
+		rsp.Error = pb.NewError(pb.ErrorType_INVALID_PARAM, "farmers aren't sharded")
+		return rsp, nil
+	}
+	farmers, records, err := adm.sharder.MoveShard(ctx, req.Slot, req.To)
+	if err != nil {
+		rsp.Error = pb.NewErrorf(pb.ErrorType_INTERNAL_ERROR, "move shard err: %v", err)
+		return rsp, nil
+	}
+	rsp.Farmers, rsp.Records = uint32(farmers), uint32(records)
+
+	return rsp, nil
+}
+
+// writes to a snapshot stream, a chunk per write
+type chunkWriter struct {
+	stream pb.SupervisorAdmin_SnapshotServer
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if err := w.stream.Send(&pb.SnapshotChunk{Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// op on an existing farmer, its failure is of errorType, farmer's account as op left it is returned
+func (adm *SupervisorAdmin) farmerOp(farmerId string, errorType pb.ErrorType, op func(farmerId string) error) (*pb.FarmerAccount, *pb.Error) {
+	if _, _, err := adm.ctr.LoadFarmer(farmerId); err != nil {
+		return nil, farmerError(err)
+	}
+
+	opErr := op(farmerId)
+	farmer, _, err := adm.ctr.LoadFarmer(farmerId)
+	if err != nil {
+		return nil, farmerError(err)
+	}
+	if opErr != nil {
+		return farmer, pb.NewError(errorType, opErr.Error())
+	}
+	return farmer, pb.ResponseOK()
+}
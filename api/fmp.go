@@ -17,18 +17,65 @@ limitations under the License.
 package api
 
 import (
-	"github.com/conseweb/supervisor/account"
+	"time"
+
 	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/auth"
 	"github.com/op/go-logging"
 	"golang.org/x/net/context"
 )
 
-// TODO vairfy farmerid
 var (
 	logger = logging.MustGetLogger("api")
 )
 
 type FarmerPublic struct {
+	ctr      *account.FarmerAccountController
+	verifier *auth.Verifier
+}
+
+// NewFarmerPublic returns farmer public service upon the account controller,
+// every request is authenticated by verifier, nil verifier means authentication disabled
+func NewFarmerPublic(ctr *account.FarmerAccountController, verifier *auth.Verifier) *FarmerPublic {
+	return &FarmerPublic{
+		ctr:      ctr,
+		verifier: verifier,
+	}
+}
+
+// authenticate returns nil if the request is signed by the farmer's device
+func (fmp *FarmerPublic) authenticate(req auth.SignedRequest) *pb.Error {
+	if fmp.verifier == nil {
+		return nil
+	}
+
+	err := fmp.verifier.Verify(req)
+	switch err {
+	case nil:
+		return nil
+	case auth.ErrInvalidSignature:
+		return pb.NewError(pb.ErrorType_INVALID_SIGNATURE, err.Error())
+	case auth.ErrReplayedRequest:
+		return pb.NewError(pb.ErrorType_REPLAYED_REQUEST, err.Error())
+	case auth.ErrUnknownDevice:
+		return pb.NewError(pb.ErrorType_INVALID_DEVICE, err.Error())
+	default:
+		logger.Errorf("authenticate farmer(%s) err: %v", req.GetFarmerID(), err)
+		return pb.NewError(pb.ErrorType_INTERNAL_ERROR, "can not authenticate farmer")
+	}
+}
+
+// suspended or banned farmer gets its own error type, other errors are otherwise
+func outOfServiceError(handler *account.FarmerAccountHandler, err error, otherwise *pb.Error) *pb.Error {
+	switch err {
+	case account.ErrFarmerSuspended:
+		return pb.NewErrorf(pb.ErrorType_FARMER_SUSPENDED, "farmer is suspended until %v: %s", time.Unix(0, handler.Account().SuspendedUntil), handler.Account().StateReason)
+	case account.ErrFarmerBanned:
+		return pb.NewErrorf(pb.ErrorType_FARMER_BANNED, "farmer is banned: %s", handler.Account().StateReason)
+	default:
+		return otherwise
+	}
 }
 
 func (fmp *FarmerPublic) FarmerOnLine(ctx context.Context, req *pb.FarmerOnLineReq) (*pb.FarmerOnLineRsp, error) {
@@ -37,7 +84,12 @@ func (fmp *FarmerPublic) FarmerOnLine(ctx context.Context, req *pb.FarmerOnLineR
 	rsp := &pb.FarmerOnLineRsp{
 		Error: pb.ResponseOK(),
 	}
-	handler, err := account.NewFarmerHandler(req.FarmerID)
+	if authErr := fmp.authenticate(req); authErr != nil {
+		rsp.Error = authErr
+		return rsp, nil
+	}
+
+	handler, err := fmp.ctr.NewFarmerHandler(req.FarmerID)
 	if err != nil {
 		rsp.Error = pb.NewError(pb.ErrorType_INVALID_PARAM, err.Error())
 
@@ -46,7 +98,7 @@ func (fmp *FarmerPublic) FarmerOnLine(ctx context.Context, req *pb.FarmerOnLineR
 
 	// online
 	if err := handler.OnLine(); err != nil {
-		rsp.Error = pb.NewErrorf(pb.ErrorType_INVALID_STATE_FARMER_ONLINE, "online return err: %v", err)
+		rsp.Error = outOfServiceError(handler, err, pb.NewErrorf(pb.ErrorType_INVALID_STATE_FARMER_ONLINE, "online return err: %v", err))
 
 		goto RET
 	}
@@ -64,11 +116,24 @@ func (fmp *FarmerPublic) FarmerPing(ctx context.Context, req *pb.FarmerPingReq)
 	rsp := &pb.FarmerPingRsp{
 		Error: pb.ResponseOK(),
 	}
-	handler, err := account.NewFarmerHandler(req.FarmerID)
+	if authErr := fmp.authenticate(req); authErr != nil {
+		rsp.Error = authErr
+		return rsp, nil
+	}
+
+	handler, err := fmp.ctr.NewFarmerHandler(req.FarmerID)
 	if err != nil {
 		rsp.Error = pb.NewError(pb.ErrorType_INVALID_PARAM, err.Error())
+		return rsp, nil
+	}
 
-		goto RET
+	return fmp.ping(handler, req), nil
+}
+
+// farmer pings with blocks range and challenges it supports in req, the challenge supervisor chose is in the response
+func (fmp *FarmerPublic) ping(handler *account.FarmerAccountHandler, req *pb.FarmerPingReq) *pb.FarmerPingRsp {
+	rsp := &pb.FarmerPingRsp{
+		Error: pb.ResponseOK(),
 	}
 
 	if req.BlocksRange == nil {
@@ -77,20 +142,27 @@ func (fmp *FarmerPublic) FarmerPing(ctx context.Context, req *pb.FarmerPingReq)
 		goto RET
 	}
 
-	if need, brange, hashAlgo, err := handler.Ping(req.BlocksRange.HighBlockNumber, req.BlocksRange.LowBlockNumber); err != nil {
-		rsp.Error = pb.NewError(pb.ErrorType_INVALID_STATE_FARMER_ONLINE, err.Error())
+	if challengeReq, err := handler.Ping(req.BlocksRange.HighBlockNumber, req.BlocksRange.LowBlockNumber, account.ChallengeSupport{
+		Nonce:  req.ChallengeNonceSupported,
+		Sample: req.SampleChallengeSupported,
+		Root:   req.RootChallengeSupported,
+	}); err != nil {
+		rsp.Error = outOfServiceError(handler, err, pb.NewError(pb.ErrorType_INVALID_STATE_FARMER_ONLINE, err.Error()))
 
 		goto RET
-	} else {
-		rsp.NeedChallenge = need
-		rsp.BlocksRange = brange
-		rsp.HashAlgo = hashAlgo
+	} else if challengeReq != nil {
+		rsp.NeedChallenge = true
+		rsp.BlocksRange = challengeReq.BlocksRange()
+		rsp.HashAlgo = challengeReq.HashAlgo()
+		rsp.ChallengeNonce = challengeReq.Nonce()
+		rsp.ChallengeKind = challengeReq.Kind()
+		rsp.Samples = challengeReq.Samples()
 	}
 	rsp.Account = handler.Account()
 	rsp.NextPing = handler.NextPingTime()
 
 RET:
-	return rsp, nil
+	return rsp
 }
 
 func (fmp *FarmerPublic) FarmerConquerChallenge(ctx context.Context, req *pb.FarmerConquerChallengeReq) (*pb.FarmerConquerChallengeRsp, error) {
@@ -99,7 +171,12 @@ func (fmp *FarmerPublic) FarmerConquerChallenge(ctx context.Context, req *pb.Far
 	rsp := &pb.FarmerConquerChallengeRsp{
 		Error: pb.ResponseOK(),
 	}
-	handler, err := account.NewFarmerHandler(req.FarmerID)
+	if authErr := fmp.authenticate(req); authErr != nil {
+		rsp.Error = authErr
+		return rsp, nil
+	}
+
+	handler, err := fmp.ctr.NewFarmerHandler(req.FarmerID)
 	if err != nil {
 		rsp.Error = pb.NewError(pb.ErrorType_INVALID_PARAM, err.Error())
 
@@ -112,9 +189,9 @@ func (fmp *FarmerPublic) FarmerConquerChallenge(ctx context.Context, req *pb.Far
 		goto RET
 	}
 
-	if err := handler.ConquerChallenge(req.BlocksRange.HighBlockNumber, req.BlocksRange.LowBlockNumber, req.HashAlgo, req.BlocksHash); err != nil {
+	if err := handler.ConquerChallenge(req.BlocksRange.HighBlockNumber, req.BlocksRange.LowBlockNumber, req.HashAlgo, req.BlocksHash, req.Proofs); err != nil {
 		rsp.ConquerOK = false
-		rsp.Error = pb.NewErrorf(pb.ErrorType_FARMER_CHALLENGE_FAIL, "challenge fail: %v", err)
+		rsp.Error = outOfServiceError(handler, err, pb.NewErrorf(pb.ErrorType_FARMER_CHALLENGE_FAIL, "challenge fail: %v", err))
 
 		goto RET
 	}
@@ -132,7 +209,12 @@ func (fmp *FarmerPublic) FarmerOffLine(ctx context.Context, req *pb.FarmerOffLin
 	rsp := &pb.FarmerOffLineRsp{
 		Error: pb.ResponseOK(),
 	}
-	handler, err := account.NewFarmerHandler(req.FarmerID)
+	if authErr := fmp.authenticate(req); authErr != nil {
+		rsp.Error = authErr
+		return rsp, nil
+	}
+
+	handler, err := fmp.ctr.NewFarmerHandler(req.FarmerID)
 	if err != nil {
 		rsp.Error = pb.NewError(pb.ErrorType_INVALID_PARAM, err.Error())
 		goto RET
@@ -149,3 +231,31 @@ func (fmp *FarmerPublic) FarmerOffLine(ctx context.Context, req *pb.FarmerOffLin
 RET:
 	return rsp, nil
 }
+
+func (fmp *FarmerPublic) FarmerBalanceHistory(ctx context.Context, req *pb.FarmerBalanceHistoryReq) (*pb.FarmerBalanceHistoryRsp, error) {
+	logger.Debugf("new connect for FarmerBalanceHistory, req: %+v", req)
+
+	rsp := &pb.FarmerBalanceHistoryRsp{
+		Error: pb.ResponseOK(),
+	}
+	if authErr := fmp.authenticate(req); authErr != nil {
+		rsp.Error = authErr
+		return rsp, nil
+	}
+
+	if req.FarmerID == "" {
+		rsp.Error = pb.NewError(pb.ErrorType_INVALID_PARAM, "farmerId is empty")
+		return rsp, nil
+	}
+
+	entries, next, balance, err := fmp.ctr.Journal().History(req.FarmerID, req.AfterSeq, int(req.Limit))
+	if err != nil {
+		rsp.Error = pb.NewErrorf(pb.ErrorType_INTERNAL_ERROR, "load balance journal err: %v", err)
+		return rsp, nil
+	}
+	rsp.Entries = entries
+	rsp.NextSeq = next
+	rsp.Balance = balance
+
+	return rsp, nil
+}
@@ -0,0 +1,190 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"io"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"golang.org/x/net/context"
+)
+
+// FarmerSession serves a session farmer keeps open instead of polling FarmerPing, see account.Session.
+// supervisor pings farmer down the session every ping interval, with the blocks range farmer declared last,
+// farmer answers with a request, a declare if it has nothing else to ask, before the next ping is due,
+// and farmer is lost once the session drops or the answer is late, unless it went offline first
+func (fmp *FarmerPublic) FarmerSession(stream pb.FarmerPublic_FarmerSessionServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if req.OnLine == nil {
+		return stream.Send(&pb.FarmerSessionRsp{Error: pb.NewError(pb.ErrorType_INVALID_PARAM, "session opens with an online request")})
+	}
+	logger.Debugf("new connect for FarmerSession, req: %+v", req.OnLine)
+
+	handler, session, onLineRsp := fmp.openSession(req.OnLine)
+	if session == nil {
+		return stream.Send(&pb.FarmerSessionRsp{Error: onLineRsp.Error, OnLine: onLineRsp})
+	}
+	defer session.Close()
+	if err := stream.Send(&pb.FarmerSessionRsp{Error: pb.ResponseOK(), OnLine: onLineRsp}); err != nil {
+		return err
+	}
+
+	// requests are received in background, so that supervisor pings farmer meanwhile
+	reqs := make(chan *pb.FarmerSessionReq)
+	recvErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	s := &farmerSession{
+		fmp:     fmp,
+		ctx:     stream.Context(),
+		handler: handler,
+	}
+	for {
+		var rsp *pb.FarmerSessionRsp
+		select {
+		case req := <-reqs:
+			session.Answered()
+			if rsp = s.serve(req); rsp == nil {
+				continue
+			}
+		case <-session.Pings():
+			// a session ended meanwhile isn't pinged anymore
+			select {
+			case <-session.Done():
+				continue
+			default:
+			}
+			rsp = &pb.FarmerSessionRsp{Ping: s.ping()}
+			session.Pinged()
+		case <-session.Done():
+			logger.Debugf("farmer(%s) session ended by supervisor", req.OnLine.FarmerID)
+			return stream.Send(&pb.FarmerSessionRsp{Error: pb.NewError(pb.ErrorType_SESSION_ENDED, "session is over on supervisor's side")})
+		case err := <-recvErr:
+			logger.Debugf("farmer(%s) session dropped: %v", req.OnLine.FarmerID, err)
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if err := stream.Send(rsp); err != nil {
+			return err
+		}
+	}
+}
+
+// session is nil if it can't be opened, the response tells why
+func (fmp *FarmerPublic) openSession(req *pb.FarmerOnLineReq) (*account.FarmerAccountHandler, *account.Session, *pb.FarmerOnLineRsp) {
+	rsp := &pb.FarmerOnLineRsp{
+		Error: pb.ResponseOK(),
+	}
+	if authErr := fmp.authenticate(req); authErr != nil {
+		rsp.Error = authErr
+		return nil, nil, rsp
+	}
+
+	handler, err := fmp.ctr.NewFarmerHandler(req.FarmerID)
+	if err != nil {
+		rsp.Error = pb.NewError(pb.ErrorType_INVALID_PARAM, err.Error())
+		return nil, nil, rsp
+	}
+
+	session, err := handler.OpenSession()
+	if err != nil {
+		rsp.Error = outOfServiceError(handler, err, pb.NewErrorf(pb.ErrorType_INVALID_STATE_FARMER_ONLINE, "open session err: %v", err))
+		return nil, nil, rsp
+	}
+
+	// farmer needn't ping, NextPing is left unset
+	rsp.Account = handler.Account()
+	return handler, session, rsp
+}
+
+// farmerSession is what supervisor knows of an open session
+type farmerSession struct {
+	fmp     *FarmerPublic
+	ctx     context.Context
+	handler *account.FarmerAccountHandler
+	// last declare of farmer's, nil before the first one
+	declared *pb.FarmerPingReq
+}
+
+// reply to a request of farmer's, nil if it needs none
+func (s *farmerSession) serve(req *pb.FarmerSessionReq) *pb.FarmerSessionRsp {
+	farmerId := s.handler.Account().FarmerID
+
+	switch {
+	case req.Declare != nil:
+		if authErr := s.fmp.authenticate(req.Declare); authErr != nil {
+			return &pb.FarmerSessionRsp{Ping: &pb.FarmerPingRsp{Error: authErr}}
+		}
+		if req.Declare.FarmerID != farmerId {
+			return &pb.FarmerSessionRsp{Ping: &pb.FarmerPingRsp{Error: pb.NewErrorf(pb.ErrorType_INVALID_PARAM, "session is of farmer(%s)", farmerId)}}
+		}
+		if req.Declare.BlocksRange == nil {
+			return &pb.FarmerSessionRsp{Ping: &pb.FarmerPingRsp{Error: pb.NewError(pb.ErrorType_INVALID_PARAM, "request blocks range is nil.")}}
+		}
+
+		// the first declare is answered by a ping, the others by what farmer's account is
+		first := s.declared == nil
+		s.declared = req.Declare
+		if first {
+			return &pb.FarmerSessionRsp{Ping: s.ping()}
+		}
+		return &pb.FarmerSessionRsp{Ping: &pb.FarmerPingRsp{Error: pb.ResponseOK(), Account: s.handler.Account()}}
+
+	case req.Conquer != nil:
+		if req.Conquer.FarmerID != farmerId {
+			return &pb.FarmerSessionRsp{Conquer: &pb.FarmerConquerChallengeRsp{Error: pb.NewErrorf(pb.ErrorType_INVALID_PARAM, "session is of farmer(%s)", farmerId)}}
+		}
+		rsp, _ := s.fmp.FarmerConquerChallenge(s.ctx, req.Conquer)
+		return &pb.FarmerSessionRsp{Conquer: rsp}
+
+	case req.OnLine != nil:
+		return &pb.FarmerSessionRsp{OnLine: &pb.FarmerOnLineRsp{Error: pb.NewError(pb.ErrorType_INVALID_STATE_FARMER_ONLINE, "session is open already")}}
+	}
+
+	logger.Debugf("farmer(%s) session got an empty request", farmerId)
+	return nil
+}
+
+// supervisor's ping, farmer that hasn't declared yet is told what its account is only
+func (s *farmerSession) ping() *pb.FarmerPingRsp {
+	if s.declared == nil {
+		return &pb.FarmerPingRsp{Error: pb.ResponseOK(), Account: s.handler.Account()}
+	}
+	return s.fmp.ping(s.handler, s.declared)
+}
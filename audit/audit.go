@@ -0,0 +1,154 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package audit
+
+import (
+	"encoding/hex"
+
+	"github.com/conseweb/supervisor/account"
+	"github.com/op/go-logging"
+)
+
+const (
+	hook_name = "audit"
+
+	verdict_pass = "pass"
+	verdict_fail = "fail"
+
+	result_ok = "ok"
+)
+
+var (
+	logger = logging.MustGetLogger("supervisor")
+)
+
+// Auditor writes every decision published to hooks into the log,
+// it is a sync hook, a decision goes on after its record is written
+type Auditor struct {
+	log   *Log
+	hooks *account.Hooks
+}
+
+// NewAuditor opens the log in cfg.Dir and subscribes to hooks
+func NewAuditor(cfg *Config, hooks *account.Hooks) (*Auditor, error) {
+	lg, err := OpenLog(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Auditor{
+		log:   lg,
+		hooks: hooks,
+	}
+	if err := hooks.Subscribe(account.HookSubscription{Name: hook_name}, a.record); err != nil {
+		lg.Close()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *Auditor) Log() *Log {
+	return a.log
+}
+
+// unsubscribe, and close the log
+func (a *Auditor) Close() error {
+	a.hooks.Unsubscribe(hook_name)
+	return a.log.Close()
+}
+
+func (a *Auditor) record(e *account.HookEvent) error {
+	if err := a.log.Append(NewRecord(e)); err != nil {
+		logger.Errorf("audit %v err: %v", e, err)
+		return err
+	}
+	return nil
+}
+
+// Admin writes an admin call operator made, once it is done, after records of decisions it led to
+func (a *Auditor) Admin(operator, method, farmerId, request string, err error) error {
+	rec := &Record{
+		Kind:     RecordAdmin,
+		FarmerID: farmerId,
+		Operator: operator,
+		Method:   method,
+		Request:  request,
+		Result:   result_ok,
+	}
+	if err != nil {
+		rec.Result = err.Error()
+	}
+
+	if err := a.log.Append(rec); err != nil {
+		logger.Errorf("audit %s %s by %s err: %v", method, request, operator, err)
+		return err
+	}
+	return nil
+}
+
+// NewRecord turns a hook event into an unchained record
+func NewRecord(e *account.HookEvent) *Record {
+	rec := &Record{
+		Time:     e.Time.UnixNano(),
+		FarmerID: e.FarmerID,
+	}
+
+	switch e.Kind {
+	case account.HookTransition:
+		rec.Kind = RecordTransition
+		rec.Event, rec.Src, rec.Dst, rec.State = e.Event, e.Src, e.Dst, e.State.String()
+	case account.HookBalance:
+		rec.Kind = RecordBalance
+		if entry := e.Entry; entry != nil {
+			rec.BalanceReason = entry.Reason.String()
+			rec.After = entry.Balance
+			rec.Delta = int64(entry.Amount)
+			if entry.Debit == account.JournalFarmerAccount(e.FarmerID) {
+				rec.Delta = -rec.Delta
+			}
+			rec.Before = uint32(int64(entry.Balance) - rec.Delta)
+			rec.JournalSeq = entry.Seq
+			rec.Memo = entry.Memo
+		}
+	case account.HookChallenge:
+		rec.Kind = RecordChallenge
+	case account.HookVerdict:
+		rec.Kind = RecordVerdict
+		if v := e.Verdict; v != nil {
+			rec.ChallengeKind = v.Kind.String()
+			rec.FarmerHash, rec.ServerHash, rec.Reason = v.FarmerHash, v.ServerHash, v.Reason
+			rec.Verdict = verdict_fail
+			if v.OK {
+				rec.Verdict = verdict_pass
+			}
+		}
+	default:
+		rec.Kind = e.Kind.String()
+	}
+
+	if req := e.Challenge; req != nil {
+		brange := req.BlocksRange()
+		rec.ChallengeKind = req.Kind().String()
+		rec.HighBlockNumber, rec.LowBlockNumber = brange.HighBlockNumber, brange.LowBlockNumber
+		rec.HashAlgo = req.HashAlgo().String()
+		rec.Nonce = hex.EncodeToString(req.Nonce())
+		rec.Samples = req.Samples()
+	}
+
+	return rec
+}
@@ -0,0 +1,288 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/challenge"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type TestAudit struct {
+	cfg *Config
+}
+
+var _ = check.Suite(&TestAudit{})
+
+func (t *TestAudit) SetUpTest(c *check.C) {
+	t.cfg = &Config{
+		Enabled: true,
+		Dir:     filepath.Join(os.TempDir(), "testAudit"),
+		MaxSize: default_audit_maxsize,
+	}
+	os.RemoveAll(t.cfg.Dir)
+}
+
+func (t *TestAudit) TearDownTest(c *check.C) {
+	os.RemoveAll(t.cfg.Dir)
+}
+
+// append n transitions of farmer
+func (t *TestAudit) append(c *check.C, lg *Log, farmerId string, n int) {
+	for i := 0; i < n; i++ {
+		c.Assert(lg.Append(&Record{Kind: RecordTransition, FarmerID: farmerId, Event: fmt.Sprintf("event%d", i)}), check.IsNil)
+	}
+}
+
+func (t *TestAudit) path(index int) string {
+	return filepath.Join(t.cfg.Dir, fmt.Sprintf(log_file_format, index))
+}
+
+// rewrite a log file line by line
+func (t *TestAudit) rewrite(c *check.C, index int, change func(lines [][]byte) [][]byte) {
+	data, err := ioutil.ReadFile(t.path(index))
+	c.Assert(err, check.IsNil)
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	c.Assert(ioutil.WriteFile(t.path(index), bytes.Join(change(lines[:len(lines)-1]), nil), 0640), check.IsNil)
+}
+
+func (t *TestAudit) TestAppendVerify(c *check.C) {
+	lg, err := OpenLog(t.cfg)
+	c.Assert(err, check.IsNil)
+	t.append(c, lg, "TestAppendVerify", 10)
+	seq, head := lg.Head()
+	c.Check(seq, check.Equals, uint64(10))
+	c.Assert(lg.Close(), check.IsNil)
+	c.Check(lg.Append(&Record{}), check.Equals, ErrLogClosed)
+
+	chain, err := Verify(t.cfg.Dir)
+	c.Assert(err, check.IsNil)
+	c.Check(chain.Files, check.Equals, 1)
+	c.Check(chain.Records, check.Equals, uint64(10))
+	c.Check(chain.Head, check.Equals, head)
+}
+
+func (t *TestAudit) TestRotate(c *check.C) {
+	t.cfg.MaxSize = 1024
+	lg, err := OpenLog(t.cfg)
+	c.Assert(err, check.IsNil)
+	t.append(c, lg, "TestRotate", 50)
+	c.Assert(lg.Close(), check.IsNil)
+
+	chain, err := Verify(t.cfg.Dir)
+	c.Assert(err, check.IsNil)
+	c.Check(chain.Files > 1, check.Equals, true)
+	c.Check(chain.Records, check.Equals, uint64(50))
+	for i := 1; i < chain.Files; i++ {
+		info, err := os.Stat(t.path(i))
+		c.Assert(err, check.IsNil)
+		c.Check(info.Size() < 2*t.cfg.MaxSize, check.Equals, true)
+	}
+
+	// a file removed from the middle
+	c.Assert(os.Remove(t.path(2)), check.IsNil)
+	_, err = Verify(t.cfg.Dir)
+	c.Check(err, check.ErrorMatches, ".*audit-00000002.log missing")
+}
+
+func (t *TestAudit) TestReopen(c *check.C) {
+	t.cfg.MaxSize = 1024
+	lg, err := OpenLog(t.cfg)
+	c.Assert(err, check.IsNil)
+	t.append(c, lg, "TestReopen", 20)
+	c.Assert(lg.Close(), check.IsNil)
+
+	// chain goes on from the last record
+	lg, err = OpenLog(t.cfg)
+	c.Assert(err, check.IsNil)
+	seq, _ := lg.Head()
+	c.Check(seq, check.Equals, uint64(20))
+	t.append(c, lg, "TestReopen", 20)
+	c.Assert(lg.Close(), check.IsNil)
+
+	chain, err := Verify(t.cfg.Dir)
+	c.Assert(err, check.IsNil)
+	c.Check(chain.Records, check.Equals, uint64(40))
+}
+
+func (t *TestAudit) TestReopenAfterEmptyRotation(c *check.C) {
+	lg, err := OpenLog(t.cfg)
+	c.Assert(err, check.IsNil)
+	t.append(c, lg, "TestReopenAfterEmptyRotation", 3)
+	c.Assert(lg.Close(), check.IsNil)
+	// crashed right after rotating
+	c.Assert(ioutil.WriteFile(t.path(2), nil, 0640), check.IsNil)
+
+	lg, err = OpenLog(t.cfg)
+	c.Assert(err, check.IsNil)
+	t.append(c, lg, "TestReopenAfterEmptyRotation", 3)
+	c.Assert(lg.Close(), check.IsNil)
+
+	chain, err := Verify(t.cfg.Dir)
+	c.Assert(err, check.IsNil)
+	c.Check(chain.Files, check.Equals, 2)
+	c.Check(chain.Records, check.Equals, uint64(6))
+}
+
+func (t *TestAudit) TestTornRecordCutOff(c *check.C) {
+	lg, err := OpenLog(t.cfg)
+	c.Assert(err, check.IsNil)
+	t.append(c, lg, "TestTornRecordCutOff", 3)
+	c.Assert(lg.Close(), check.IsNil)
+
+	f, err := os.OpenFile(t.path(1), os.O_WRONLY|os.O_APPEND, 0640)
+	c.Assert(err, check.IsNil)
+	f.WriteString(`{"seq":4,"kind":"bal`)
+	f.Close()
+	_, err = Verify(t.cfg.Dir)
+	c.Check(err, check.ErrorMatches, ".*line 4 is torn")
+
+	lg, err = OpenLog(t.cfg)
+	c.Assert(err, check.IsNil)
+	t.append(c, lg, "TestTornRecordCutOff", 1)
+	c.Assert(lg.Close(), check.IsNil)
+
+	chain, err := Verify(t.cfg.Dir)
+	c.Assert(err, check.IsNil)
+	c.Check(chain.Records, check.Equals, uint64(4))
+}
+
+func (t *TestAudit) TestTampered(c *check.C) {
+	lg, err := OpenLog(t.cfg)
+	c.Assert(err, check.IsNil)
+	t.append(c, lg, "TestTampered", 5)
+	c.Assert(lg.Close(), check.IsNil)
+	original, err := ioutil.ReadFile(t.path(1))
+	c.Assert(err, check.IsNil)
+
+	for _, tamper := range []struct {
+		change func(lines [][]byte) [][]byte
+		err    string
+	}{
+		// changed
+		{func(lines [][]byte) [][]byte {
+			lines[2] = bytes.Replace(lines[2], []byte("event2"), []byte("event9"), 1)
+			return lines
+		}, ".*line 3, record 3 has been changed"},
+		// removed
+		{func(lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		}, ".*line 2 is record 3, want 2"},
+		// reordered
+		{func(lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, ".*line 2 is record 3, want 2"},
+		// reordered and renumbered
+		{func(lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			lines[1] = bytes.Replace(lines[1], []byte(`"seq":3`), []byte(`"seq":2`), 1)
+			return lines
+		}, ".*line 2 doesn't follow record 1"},
+		// corrupted
+		{func(lines [][]byte) [][]byte {
+			lines[4] = []byte("garbage\n")
+			return lines
+		}, ".*line 5 is corrupted.*"},
+	} {
+		t.rewrite(c, 1, tamper.change)
+		chain, err := Verify(t.cfg.Dir)
+		c.Check(err, check.ErrorMatches, tamper.err)
+		c.Check(chain, check.NotNil)
+
+		c.Assert(ioutil.WriteFile(t.path(1), original, 0640), check.IsNil)
+	}
+
+	_, err = Verify(t.cfg.Dir)
+	c.Check(err, check.IsNil)
+}
+
+func (t *TestAudit) TestAuditor(c *check.C) {
+	hooks := account.NewHooks()
+	a, err := NewAuditor(t.cfg, hooks)
+	c.Assert(err, check.IsNil)
+
+	farmerId := "TestAuditor"
+	req := challenge.NewFarmerChallengeReq(farmerId, 100, 20, pb.HashAlgo_SHA256, []byte{1, 2})
+	now := time.Now()
+	hooks.Publish(&account.HookEvent{Kind: account.HookChallenge, FarmerID: farmerId, Time: now, Challenge: req})
+	hooks.Publish(&account.HookEvent{Kind: account.HookVerdict, FarmerID: farmerId, Time: now, Challenge: req, Verdict: &challenge.Verdict{
+		Kind:       pb.ChallengeKind_BLOCKS_HASH,
+		FarmerHash: "farmer",
+		ServerHash: "server",
+		Reason:     "hash mismatch",
+	}})
+	hooks.Publish(&account.HookEvent{Kind: account.HookBalance, FarmerID: farmerId, Time: now, Entry: &pb.BalanceEntry{
+		FarmerID: farmerId,
+		Seq:      7,
+		Reason:   pb.BalanceReason_CHALLENGE_MISSED,
+		Debit:    account.JournalFarmerAccount(farmerId),
+		Credit:   account.JournalAccountPenalties,
+		Amount:   50,
+		Balance:  450,
+	}})
+	hooks.Publish(&account.HookEvent{Kind: account.HookTransition, FarmerID: farmerId, Time: now, Event: "farmer_event_suspend", Src: "ONLINE", Dst: "SUSPENDED", State: pb.FarmerState_SUSPENDED})
+	c.Assert(a.Admin("alice", "BanFarmer", farmerId, `farmerID:"TestAuditor"`, errors.New("no reason")), check.IsNil)
+	c.Assert(a.Close(), check.IsNil)
+	hooks.Close()
+
+	chain, err := Verify(t.cfg.Dir)
+	c.Assert(err, check.IsNil)
+	c.Assert(chain.Records, check.Equals, uint64(5))
+
+	var records []*Record
+	for _, e := range []*Record{
+		{Kind: RecordChallenge, ChallengeKind: "BLOCKS_HASH", HighBlockNumber: 100, LowBlockNumber: 20, HashAlgo: "SHA256", Nonce: "0102"},
+		{Kind: RecordVerdict, ChallengeKind: "BLOCKS_HASH", HighBlockNumber: 100, LowBlockNumber: 20, HashAlgo: "SHA256", Nonce: "0102", FarmerHash: "farmer", ServerHash: "server", Verdict: verdict_fail, Reason: "hash mismatch"},
+		{Kind: RecordBalance, BalanceReason: "CHALLENGE_MISSED", Before: 500, After: 450, Delta: -50, JournalSeq: 7},
+		{Kind: RecordTransition, Event: "farmer_event_suspend", Src: "ONLINE", Dst: "SUSPENDED", State: "SUSPENDED"},
+		{Kind: RecordAdmin, Operator: "alice", Method: "BanFarmer", Request: `farmerID:"TestAuditor"`, Result: "no reason"},
+	} {
+		e.FarmerID = farmerId
+		e.Time = now.UnixNano()
+		records = append(records, e)
+	}
+
+	data, err := ioutil.ReadFile(t.path(1))
+	c.Assert(err, check.IsNil)
+	for i, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		rec := &Record{}
+		c.Assert(json.Unmarshal(line, rec), check.IsNil)
+		rec.Seq, rec.Prev, rec.Hash = 0, "", ""
+		if rec.Kind == RecordAdmin {
+			// stamped when written
+			c.Check(rec.Time >= now.UnixNano(), check.Equals, true)
+			rec.Time = now.UnixNano()
+		}
+		c.Check(rec, check.DeepEquals, records[i])
+	}
+}
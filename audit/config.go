@@ -0,0 +1,59 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package audit
+
+import (
+	"github.com/spf13/viper"
+)
+
+const (
+	default_audit_dir     = "/var/supervisor/audit"
+	default_audit_maxsize = 64 * 1024 * 1024
+)
+
+// Config of audit log, audit section of supervisor.yaml
+type Config struct {
+	// whether or not supervisor's decisions are audited
+	Enabled bool
+	// where log files are, all files in it belong to one chain
+	Dir string
+	// a log file is rotated once it grows over MaxSize bytes
+	MaxSize int64
+	// whether or not a record is synced to disk before the decision goes on
+	Fsync bool
+}
+
+// ConfigFromViper reads audit section, missing values fall back to defaults
+func ConfigFromViper() *Config {
+	cfg := &Config{
+		Enabled: viper.GetBool("audit.enabled"),
+		Dir:     viper.GetString("audit.dir"),
+		MaxSize: int64(viper.GetSizeInBytes("audit.maxsize")),
+		Fsync:   true,
+	}
+	if viper.IsSet("audit.fsync") {
+		cfg.Fsync = viper.GetBool("audit.fsync")
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = default_audit_dir
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = default_audit_maxsize
+	}
+
+	return cfg
+}
@@ -0,0 +1,313 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+)
+
+const (
+	log_file_pattern = "audit-*.log"
+	log_file_format  = "audit-%08d.log"
+)
+
+var (
+	ErrLogClosed = errors.New("supervisor/audit: log closed")
+)
+
+// kinds of records
+const (
+	RecordChallenge  = "challenge_issued"
+	RecordVerdict    = "challenge_verdict"
+	RecordBalance    = "balance"
+	RecordTransition = "transition"
+	RecordAdmin      = "admin"
+)
+
+// Record is one decision supervisor made, a line of log file.
+// Hash is hex of sha256 over json of the record with empty Hash, Prev is Hash of the record before,
+// so changing, removing or reordering records breaks the chain
+type Record struct {
+	Seq      uint64 `json:"seq"`
+	Time     int64  `json:"time"`
+	Kind     string `json:"kind"`
+	FarmerID string `json:"farmerId"`
+
+	// challenge issued or decided on
+	ChallengeKind   string            `json:"challengeKind,omitempty"`
+	HighBlockNumber uint64            `json:"highBlockNumber,omitempty"`
+	LowBlockNumber  uint64            `json:"lowBlockNumber,omitempty"`
+	HashAlgo        string            `json:"hashAlgo,omitempty"`
+	Nonce           string            `json:"nonce,omitempty"`
+	Samples         []*pb.BlockSample `json:"samples,omitempty"`
+
+	// verdict, pass or fail
+	FarmerHash string `json:"farmerHash,omitempty"`
+	ServerHash string `json:"serverHash,omitempty"`
+	Verdict    string `json:"verdict,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+
+	// balance change, JournalSeq is the entry's seq in farmer's journal
+	BalanceReason string `json:"balanceReason,omitempty"`
+	Before        uint32 `json:"before,omitempty"`
+	After         uint32 `json:"after,omitempty"`
+	Delta         int64  `json:"delta,omitempty"`
+	JournalSeq    uint64 `json:"journalSeq,omitempty"`
+	Memo          string `json:"memo,omitempty"`
+
+	// fsm transition, State is the one Dst reports as
+	Event string `json:"event,omitempty"`
+	Src   string `json:"src,omitempty"`
+	Dst   string `json:"dst,omitempty"`
+	State string `json:"state,omitempty"`
+
+	// admin call, Operator is who called, Result is ok or why it failed
+	Operator string `json:"operator,omitempty"`
+	Method   string `json:"method,omitempty"`
+	Request  string `json:"request,omitempty"`
+	Result   string `json:"result,omitempty"`
+
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// what Hash of the record should be
+func (r *Record) digest() (string, error) {
+	unhashed := *r
+	unhashed.Hash = ""
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log appends records to files in a dir, a file is rotated once it grows over max size,
+// the chain goes on across files, files are never removed by supervisor
+type Log struct {
+	cfg   *Config
+	l     *sync.Mutex
+	file  *os.File
+	index int
+	size  int64
+	seq   uint64
+	prev  string
+}
+
+// OpenLog opens the log in cfg.Dir, appending goes on from the last record in it,
+// a record torn by a crash is cut off
+func OpenLog(cfg *Config) (*Log, error) {
+	if err := os.MkdirAll(cfg.Dir, 0750); err != nil {
+		return nil, err
+	}
+	files, err := logFiles(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	lg := &Log{
+		cfg:   cfg,
+		l:     &sync.Mutex{},
+		index: 1,
+	}
+	if len(files) > 0 {
+		lg.index = files[len(files)-1].index
+	}
+
+	// the last file may be rotated just before a crash, with nothing in it
+	for i := len(files) - 1; i >= 0; i-- {
+		last, size, err := tailRecord(files[i].path, i == len(files)-1)
+		if err != nil {
+			return nil, err
+		}
+		if i == len(files)-1 {
+			lg.size = size
+		}
+		if last != nil {
+			lg.seq, lg.prev = last.Seq, last.Hash
+			break
+		}
+	}
+
+	if lg.file, err = os.OpenFile(filepath.Join(cfg.Dir, fmt.Sprintf(log_file_format, lg.index)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640); err != nil {
+		return nil, err
+	}
+
+	return lg, nil
+}
+
+type logFile struct {
+	index int
+	path  string
+}
+
+// log files in dir, in order of index
+func logFiles(dir string) ([]logFile, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, log_file_pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]logFile, 0, len(paths))
+	for _, path := range paths {
+		var index int
+		if _, err := fmt.Sscanf(filepath.Base(path), log_file_format, &index); err != nil || index <= 0 {
+			continue
+		}
+		files = append(files, logFile{index: index, path: path})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].index < files[j].index })
+
+	return files, nil
+}
+
+// last record of a log file and size of the file, a torn line at the end is cut off if repair
+func tailRecord(path string, repair bool) (*Record, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var (
+		last   *Record
+		offset int64
+		lineno int
+	)
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				if !repair {
+					return nil, 0, fmt.Errorf("supervisor/audit: %s line %d is torn", path, lineno+1)
+				}
+				logger.Warningf("audit log %s ends with a torn record, cut off %d bytes", path, len(line))
+				if err := os.Truncate(path, offset); err != nil {
+					return nil, 0, err
+				}
+			}
+			return last, offset, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		lineno++
+
+		rec := &Record{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			return nil, 0, fmt.Errorf("supervisor/audit: %s line %d is corrupted: %v", path, lineno, err)
+		}
+		last = rec
+		offset += int64(len(line))
+	}
+}
+
+// Append chains rec to the log, Seq, Prev and Hash are filled in, so is Time if zero
+func (lg *Log) Append(rec *Record) error {
+	lg.l.Lock()
+	defer lg.l.Unlock()
+
+	if lg.file == nil {
+		return ErrLogClosed
+	}
+	if lg.size >= lg.cfg.MaxSize {
+		if err := lg.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if rec.Time == 0 {
+		rec.Time = time.Now().UnixNano()
+	}
+	rec.Seq = lg.seq + 1
+	rec.Prev = lg.prev
+	hash, err := rec.digest()
+	if err != nil {
+		return err
+	}
+	rec.Hash = hash
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := lg.file.Write(line); err != nil {
+		// don't leave half a record for the next one to follow
+		lg.file.Truncate(lg.size)
+		return err
+	}
+	if lg.cfg.Fsync {
+		if err := lg.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	lg.size += int64(len(line))
+	lg.seq, lg.prev = rec.Seq, rec.Hash
+	return nil
+}
+
+// move on to the next file
+func (lg *Log) rotate() error {
+	f, err := os.OpenFile(filepath.Join(lg.cfg.Dir, fmt.Sprintf(log_file_format, lg.index+1)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	lg.file.Close()
+
+	lg.file = f
+	lg.index++
+	lg.size = 0
+	return nil
+}
+
+// Head returns seq and hash of the last record, 0 and empty if none
+func (lg *Log) Head() (uint64, string) {
+	lg.l.Lock()
+	defer lg.l.Unlock()
+
+	return lg.seq, lg.prev
+}
+
+func (lg *Log) Close() error {
+	lg.l.Lock()
+	defer lg.l.Unlock()
+
+	if lg.file == nil {
+		return nil
+	}
+	err := lg.file.Close()
+	lg.file = nil
+	return err
+}
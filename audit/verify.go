@@ -0,0 +1,120 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Chain tells what a verified log holds, Head is Hash of the last record.
+// records cut off from the end can't be told from the log itself, compare Head with one kept elsewhere
+type Chain struct {
+	Files   int
+	Records uint64
+	Head    string
+}
+
+// Walk reads records of log files in dir in order, a missing file, a torn or corrupted line stops it with an error,
+// so does an error fn returns
+func Walk(dir string, fn func(path string, lineno int, rec *Record) error) error {
+	files, err := logFiles(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("supervisor/audit: no log file in %s", dir)
+	}
+
+	for i, file := range files {
+		if file.index != i+1 {
+			return fmt.Errorf("supervisor/audit: %s missing", filepath.Join(dir, fmt.Sprintf(log_file_format, i+1)))
+		}
+		if err := walkFile(file.path, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func walkFile(path string, fn func(path string, lineno int, rec *Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for lineno := 1; ; lineno++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return fmt.Errorf("supervisor/audit: %s line %d is torn", path, lineno)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rec := &Record{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			return fmt.Errorf("supervisor/audit: %s line %d is corrupted: %v", path, lineno, err)
+		}
+		if err := fn(path, lineno, rec); err != nil {
+			return err
+		}
+	}
+}
+
+// Verify walks the chain of log files in dir from the first record,
+// returns the first record breaking it, changed, removed or reordered, as an error
+func Verify(dir string) (*Chain, error) {
+	chain := &Chain{}
+	lastPath := ""
+	err := Walk(dir, func(path string, lineno int, rec *Record) error {
+		if path != lastPath {
+			chain.Files++
+			lastPath = path
+		}
+
+		if rec.Seq != chain.Records+1 {
+			return fmt.Errorf("supervisor/audit: %s line %d is record %d, want %d", path, lineno, rec.Seq, chain.Records+1)
+		}
+		if rec.Prev != chain.Head {
+			return fmt.Errorf("supervisor/audit: %s line %d doesn't follow record %d", path, lineno, chain.Records)
+		}
+		hash, err := rec.digest()
+		if err != nil {
+			return err
+		}
+		if rec.Hash != hash {
+			return fmt.Errorf("supervisor/audit: %s line %d, record %d has been changed", path, lineno, rec.Seq)
+		}
+
+		chain.Records = rec.Seq
+		chain.Head = rec.Hash
+		return nil
+	})
+
+	return chain, err
+}
@@ -0,0 +1,177 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+var (
+	ErrInvalidSignature = errors.New("supervisor/auth: invalid signature")
+	ErrReplayedRequest  = errors.New("supervisor/auth: replayed request")
+	ErrUnknownDevice    = errors.New("supervisor/auth: unknown farmer device")
+)
+
+const (
+	nonce_size = 16
+)
+
+// SignedRequest is a farmer request carrying a timestamp, a nonce and a signature over the rest of it
+type SignedRequest interface {
+	proto.Message
+	GetFarmerID() string
+	GetTimestamp() (int64, []byte)
+	SetTimestamp(ts int64, nonce []byte)
+	GetSignature() []byte
+	SetSignature(sign []byte)
+	GetDevice() (string, []byte)
+	SetDevice(deviceId string, spub []byte)
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// SignRequest stamps the request with the device, current time and a random nonce, then signs it by the device's signature key,
+// farmer clients call it right before sending a request
+func SignRequest(req SignedRequest, deviceId string, priv *ecdsa.PrivateKey) error {
+	spub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return err
+	}
+	req.SetDevice(deviceId, spub)
+
+	nonce := make([]byte, nonce_size)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	req.SetTimestamp(time.Now().UnixNano(), nonce)
+
+	digest, err := requestDigest(req)
+	if err != nil {
+		return err
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, priv, digest)
+	if err != nil {
+		return err
+	}
+	sign, err := asn1.Marshal(ecdsaSignature{r, s})
+	if err != nil {
+		return err
+	}
+	req.SetSignature(sign)
+
+	return nil
+}
+
+// verifySignature checks req's signature against the device public key
+func verifySignature(pub *ecdsa.PublicKey, req SignedRequest) bool {
+	sig := &ecdsaSignature{}
+	if rest, err := asn1.Unmarshal(req.GetSignature(), sig); err != nil || len(rest) != 0 {
+		return false
+	}
+	if sig.R == nil || sig.S == nil || sig.R.Sign() <= 0 || sig.S.Sign() <= 0 {
+		return false
+	}
+
+	digest, err := requestDigest(req)
+	if err != nil {
+		return false
+	}
+
+	return ecdsa.Verify(pub, digest, sig.R, sig.S)
+}
+
+// digest of the request marshaled with signature unset
+func requestDigest(req SignedRequest) ([]byte, error) {
+	sign := req.GetSignature()
+	req.SetSignature(nil)
+	reqBytes, err := proto.Marshal(req)
+	req.SetSignature(sign)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(reqBytes)
+	return digest[:], nil
+}
+
+// Verifier authenticates farmer requests, a request must be signed by the farmer's device bound in idprovider,
+// signed within the window, and its nonce never seen before
+type Verifier struct {
+	cfg     *Config
+	devices DeviceStore
+	nonces  *nonceCache
+}
+
+func NewVerifier(cfg *Config, devices DeviceStore) *Verifier {
+	return &Verifier{
+		cfg:     cfg,
+		devices: devices,
+		nonces:  newNonceCache(),
+	}
+}
+
+// Verify returns nil if the request is authentic,
+// ErrReplayedRequest if it is replayed or out of window, ErrUnknownDevice if it isn't signed by a device of the farmer, ErrInvalidSignature otherwise
+func (v *Verifier) Verify(req SignedRequest) error {
+	ts, nonce := req.GetTimestamp()
+	if len(nonce) == 0 || len(req.GetSignature()) == 0 {
+		return ErrInvalidSignature
+	}
+
+	now := time.Now()
+	signedAt := time.Unix(0, ts)
+	if signedAt.Before(now.Add(-v.cfg.Window)) || signedAt.After(now.Add(v.cfg.Window)) {
+		return ErrReplayedRequest
+	}
+
+	deviceId, spub := req.GetDevice()
+	if deviceId == "" {
+		return ErrUnknownDevice
+	}
+	pub, err := parseDeviceKey(spub)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !verifySignature(pub, req) {
+		return ErrInvalidSignature
+	}
+	// asked only for well signed requests, so forged ones neither load idprovider nor pin their keys
+	if err := v.devices.VerifyDevice(req.GetFarmerID(), deviceId, spub); err != nil {
+		return err
+	}
+
+	// only authentic requests burn nonces, so forged ones can't block the farmer
+	// a nonce needn't be remembered after its request drops out of window
+	if !v.nonces.add(fmt.Sprintf("%s:%x", req.GetFarmerID(), nonce), signedAt.Add(v.cfg.Window)) {
+		return ErrReplayedRequest
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+// fakeIDPA is a local idprovider admin service, knows devices tests bound to farmers
+type fakeIDPA struct {
+	l *sync.Mutex
+	// bound devices, by farmer id
+	devices  map[string]*pb.Device
+	verifies int
+}
+
+func (idpa *fakeIDPA) VerifyDevice(ctx context.Context, req *pb.VerifyDeviceReq) (*pb.VerifyDeviceRsp, error) {
+	idpa.l.Lock()
+	defer idpa.l.Unlock()
+
+	idpa.verifies++
+	device, ok := idpa.devices[req.UserID]
+	if !ok || device.DeviceID != req.DeviceID || device.For != req.For {
+		return &pb.VerifyDeviceRsp{Error: pb.NewError(pb.ErrorType_INVALID_DEVICE, "no such device bound to user")}, nil
+	}
+	return &pb.VerifyDeviceRsp{Error: pb.ResponseOK()}, nil
+}
+
+// bind a new device to farmer, its id isn't farmer's
+func (idpa *fakeIDPA) register(c *check.C, farmerId string) (string, *ecdsa.PrivateKey) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	spub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	c.Assert(err, check.IsNil)
+
+	device := &pb.Device{
+		UserID:   farmerId,
+		DeviceID: "device-of-" + farmerId,
+		For:      pb.DeviceFor_FARMER,
+		Spub:     spub,
+	}
+	idpa.l.Lock()
+	idpa.devices[farmerId] = device
+	idpa.l.Unlock()
+
+	return device.DeviceID, priv
+}
+
+type AuthTest struct {
+	idpa     *fakeIDPA
+	server   *grpc.Server
+	conn     *grpc.ClientConn
+	verifier *Verifier
+}
+
+var _ = check.Suite(&AuthTest{})
+
+func (t *AuthTest) SetUpSuite(c *check.C) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+
+	t.idpa = &fakeIDPA{l: &sync.Mutex{}, devices: make(map[string]*pb.Device)}
+	t.server = grpc.NewServer()
+	pb.RegisterIDPAServer(t.server, t.idpa)
+	go t.server.Serve(lis)
+
+	t.conn, err = grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	c.Assert(err, check.IsNil)
+}
+
+func (t *AuthTest) SetUpTest(c *check.C) {
+	cfg := &Config{
+		Enabled:        true,
+		Window:         time.Second * 30,
+		DeviceCacheTTL: time.Minute,
+	}
+	t.verifier = NewVerifier(cfg, NewIDPADeviceStore(pb.NewIDPAClient(t.conn), cfg.DeviceCacheTTL))
+}
+
+func (t *AuthTest) TearDownSuite(c *check.C) {
+	t.conn.Close()
+	t.server.Stop()
+}
+
+func (t *AuthTest) TestVerify(c *check.C) {
+	deviceId, priv := t.idpa.register(c, "TestVerify")
+
+	req := &pb.FarmerPingReq{
+		FarmerID:    "TestVerify",
+		BlocksRange: &pb.BlocksRange{HighBlockNumber: 100, LowBlockNumber: 10},
+	}
+	c.Assert(SignRequest(req, deviceId, priv), check.IsNil)
+	c.Check(t.verifier.Verify(req), check.IsNil)
+}
+
+func (t *AuthTest) TestVerifyUnsigned(c *check.C) {
+	t.idpa.register(c, "TestVerifyUnsigned")
+
+	c.Check(t.verifier.Verify(&pb.FarmerOnLineReq{FarmerID: "TestVerifyUnsigned"}), check.Equals, ErrInvalidSignature)
+}
+
+func (t *AuthTest) TestVerifyForged(c *check.C) {
+	deviceId, priv := t.idpa.register(c, "TestVerifyForged")
+
+	// signed by someone else's key, but presenting the device's
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	req := &pb.FarmerOffLineReq{FarmerID: "TestVerifyForged"}
+	c.Assert(SignRequest(req, deviceId, other), check.IsNil)
+	spub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	c.Assert(err, check.IsNil)
+	req.Spub = spub
+	c.Check(t.verifier.Verify(req), check.Equals, ErrInvalidSignature)
+}
+
+func (t *AuthTest) TestVerifyTampered(c *check.C) {
+	deviceId, priv := t.idpa.register(c, "TestVerifyTampered")
+
+	req := &pb.FarmerConquerChallengeReq{
+		FarmerID:    "TestVerifyTampered",
+		BlocksHash:  "hash",
+		BlocksRange: &pb.BlocksRange{HighBlockNumber: 100, LowBlockNumber: 10},
+	}
+	c.Assert(SignRequest(req, deviceId, priv), check.IsNil)
+	req.BlocksHash = "another hash"
+	c.Check(t.verifier.Verify(req), check.Equals, ErrInvalidSignature)
+}
+
+func (t *AuthTest) TestVerifyReplayed(c *check.C) {
+	deviceId, priv := t.idpa.register(c, "TestVerifyReplayed")
+
+	req := &pb.FarmerOnLineReq{FarmerID: "TestVerifyReplayed"}
+	c.Assert(SignRequest(req, deviceId, priv), check.IsNil)
+	c.Check(t.verifier.Verify(req), check.IsNil)
+	c.Check(t.verifier.Verify(req), check.Equals, ErrReplayedRequest)
+}
+
+func (t *AuthTest) TestVerifyOutOfWindow(c *check.C) {
+	deviceId, priv := t.idpa.register(c, "TestVerifyOutOfWindow")
+
+	req := &pb.FarmerOnLineReq{FarmerID: "TestVerifyOutOfWindow"}
+	c.Assert(SignRequest(req, deviceId, priv), check.IsNil)
+	// as if it had been captured a while ago, stale timestamp is rejected before signature checked
+	_, nonce := req.GetTimestamp()
+	req.SetTimestamp(time.Now().Add(-time.Minute).UnixNano(), nonce)
+	c.Check(t.verifier.Verify(req), check.Equals, ErrReplayedRequest)
+}
+
+func (t *AuthTest) TestVerifyUnknownDevice(c *check.C) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+
+	req := &pb.FarmerOnLineReq{FarmerID: "TestVerifyUnknownDevice"}
+	c.Assert(SignRequest(req, "no-such-device", priv), check.IsNil)
+	c.Check(t.verifier.Verify(req), check.Equals, ErrUnknownDevice)
+
+	// a device bound to another farmer
+	deviceId, priv := t.idpa.register(c, "TestVerifyOthersDevice")
+	req = &pb.FarmerOnLineReq{FarmerID: "TestVerifyUnknownDevice"}
+	c.Assert(SignRequest(req, deviceId, priv), check.IsNil)
+	c.Check(t.verifier.Verify(req), check.Equals, ErrUnknownDevice)
+
+	// farmer is bound to a device, but not a farmer one
+	deviceId, priv = t.idpa.register(c, "TestVerifyNotFarmerDevice")
+	t.idpa.l.Lock()
+	t.idpa.devices["TestVerifyNotFarmerDevice"].For = pb.DeviceFor_LEDGER
+	t.idpa.l.Unlock()
+	req = &pb.FarmerOnLineReq{FarmerID: "TestVerifyNotFarmerDevice"}
+	c.Assert(SignRequest(req, deviceId, priv), check.IsNil)
+	c.Check(t.verifier.Verify(req), check.Equals, ErrUnknownDevice)
+}
+
+func (t *AuthTest) TestDeviceKeyPinned(c *check.C) {
+	deviceId, priv := t.idpa.register(c, "TestDeviceKeyPinned")
+
+	req := &pb.FarmerOnLineReq{FarmerID: "TestDeviceKeyPinned"}
+	c.Assert(SignRequest(req, deviceId, priv), check.IsNil)
+	c.Check(t.verifier.Verify(req), check.IsNil)
+
+	// whoever learns the device id can't sign for it with another key
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	req = &pb.FarmerOnLineReq{FarmerID: "TestDeviceKeyPinned"}
+	c.Assert(SignRequest(req, deviceId, other), check.IsNil)
+	c.Check(t.verifier.Verify(req), check.Equals, ErrUnknownDevice)
+}
+
+func (t *AuthTest) TestDeviceCached(c *check.C) {
+	deviceId, priv := t.idpa.register(c, "TestDeviceCached")
+
+	t.idpa.l.Lock()
+	verifies := t.idpa.verifies
+	t.idpa.l.Unlock()
+
+	for i := 0; i < 3; i++ {
+		req := &pb.FarmerOnLineReq{FarmerID: "TestDeviceCached"}
+		c.Assert(SignRequest(req, deviceId, priv), check.IsNil)
+		c.Check(t.verifier.Verify(req), check.IsNil)
+	}
+
+	t.idpa.l.Lock()
+	c.Check(t.idpa.verifies-verifies, check.Equals, 1)
+	t.idpa.l.Unlock()
+}
@@ -0,0 +1,70 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Config of farmer request authentication, farmer.auth section of supervisor.yaml
+type Config struct {
+	// whether or not farmer requests must be signed
+	Enabled bool
+	// max distance between request's timestamp and supervisor's clock
+	Window time.Duration
+	// how long idprovider's word that a device is bound to a farmer is trusted before asking again
+	DeviceCacheTTL time.Duration
+}
+
+// ConfigFromViper reads farmer.auth section, missing values fall back to defaults
+func ConfigFromViper() *Config {
+	return &Config{
+		Enabled:        getAuthEnabled(),
+		Window:         getAuthWindow(),
+		DeviceCacheTTL: getDeviceCacheTTL(),
+	}
+}
+
+// on unless turned off explicitly
+func getAuthEnabled() bool {
+	if viper.IsSet("farmer.auth.enabled") {
+		return viper.GetBool("farmer.auth.enabled")
+	}
+
+	viper.Set("farmer.auth.enabled", true)
+	return true
+}
+
+func getAuthWindow() time.Duration {
+	if window, err := time.ParseDuration(viper.GetString("farmer.auth.window")); err == nil && window > 0 {
+		return window
+	}
+
+	viper.Set("farmer.auth.window", "60s")
+	return time.Duration(60) * time.Second
+}
+
+func getDeviceCacheTTL() time.Duration {
+	if ttl, err := time.ParseDuration(viper.GetString("farmer.auth.devicecache")); err == nil && ttl > 0 {
+		return ttl
+	}
+
+	viper.Set("farmer.auth.devicecache", "10m")
+	return time.Duration(10) * time.Minute
+}
@@ -0,0 +1,118 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"golang.org/x/net/context"
+)
+
+const (
+	verify_device_timeout = 5 * time.Second
+)
+
+// DeviceStore tells whether a device is bound to a farmer, and signs with the key it presents
+type DeviceStore interface {
+	// VerifyDevice returns nil if deviceId is a farmer device of farmerId signing with spub, ErrUnknownDevice otherwise
+	VerifyDevice(farmerId, deviceId string, spub []byte) error
+}
+
+type farmerDevice struct {
+	spub []byte
+	// idprovider is asked again once it expires
+	expire time.Time
+}
+
+// idpaDeviceStore asks idprovider whether a device is bound to a farmer, and keeps its answer for a while,
+// idprovider doesn't hand out device keys, so the key of a device is pinned the first time idprovider vouches for it,
+// another key presented by the device after that is rejected
+type idpaDeviceStore struct {
+	l       *sync.Mutex
+	cli     pb.IDPAClient
+	ttl     time.Duration
+	devices map[string]*farmerDevice
+}
+
+// NewIDPADeviceStore returns a device store upon idprovider admin service, which knows the devices bound to each farmer
+func NewIDPADeviceStore(cli pb.IDPAClient, ttl time.Duration) DeviceStore {
+	return &idpaDeviceStore{
+		l:       &sync.Mutex{},
+		cli:     cli,
+		ttl:     ttl,
+		devices: make(map[string]*farmerDevice),
+	}
+}
+
+func (s *idpaDeviceStore) VerifyDevice(farmerId, deviceId string, spub []byte) error {
+	key := farmerId + "/" + deviceId
+	s.l.Lock()
+	pinned, ok := s.devices[key]
+	s.l.Unlock()
+	if ok && !bytes.Equal(pinned.spub, spub) {
+		return ErrUnknownDevice
+	}
+	if ok && time.Now().Before(pinned.expire) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), verify_device_timeout)
+	defer cancel()
+	rsp, err := s.cli.VerifyDevice(ctx, &pb.VerifyDeviceReq{
+		DeviceID: deviceId,
+		For:      pb.DeviceFor_FARMER,
+		UserID:   farmerId,
+	})
+	if err != nil {
+		return err
+	}
+	if !rsp.GetError().OK() {
+		return ErrUnknownDevice
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	// another request of the device may have pinned a key meanwhile
+	if pinned, ok := s.devices[key]; ok && !bytes.Equal(pinned.spub, spub) {
+		return ErrUnknownDevice
+	}
+	s.devices[key] = &farmerDevice{
+		spub:   spub,
+		expire: time.Now().Add(s.ttl),
+	}
+
+	return nil
+}
+
+// device signature public key is PKIX DER encoded ecdsa key
+func parseDeviceKey(spub []byte) (*ecdsa.PublicKey, error) {
+	pub, err := x509.ParsePKIXPublicKey(spub)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, ErrUnknownDevice
+	}
+	return key, nil
+}
@@ -0,0 +1,61 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// nonceCache remembers nonces until they expire
+type nonceCache struct {
+	l         *sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{
+		l:         &sync.Mutex{},
+		nonces:    make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// add returns false if the nonce is already there
+func (c *nonceCache) add(nonce string, expire time.Time) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	now := time.Now()
+	if exp, ok := c.nonces[nonce]; ok && exp.After(now) {
+		return false
+	}
+	c.nonces[nonce] = expire
+
+	// sweep expired ones now and then, instead of a goroutine
+	if now.Sub(c.lastSweep) > time.Minute {
+		for n, exp := range c.nonces {
+			if !exp.After(now) {
+				delete(c.nonces, n)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	return true
+}
@@ -0,0 +1,443 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package challenge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/conseweb/supervisor/account/store"
+)
+
+const (
+	block_prefix = byte(2)
+
+	// head of the accumulator, leaves count followed by hash of the last block appended,
+	// kept in one key so that a crash never leaves them out of step
+	accumulator_head_key = "head"
+	accumulator_node_key = 'n'
+	accumulator_leaf_key = 'd'
+)
+
+var (
+	ErrNotCommitted = errors.New("supervisor/challenge: blocks not committed to accumulator yet")
+)
+
+// Accumulator is an append only merkle mountain range over blocks, persisted in the account store.
+// leaf n commits block n's chunks root, node (h, i) commits leaves [i*2^h, (i+1)*2^h),
+// so any block or range of blocks is proven by O(log n) nodes, without reading blocks again
+type Accumulator struct {
+	l       *sync.RWMutex
+	syncing *sync.Mutex
+	storage store.Storage
+	size    uint64
+	tipHash []byte
+
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// AccumulatorProof proves block's leaf is committed by accumulator root of Size leaves
+type AccumulatorProof struct {
+	BlockNumber uint64
+	Size        uint64
+	Leaf        []byte
+	// siblings from the leaf up to its peak
+	Path [][]byte
+	// all peaks of the accumulator, left to right
+	Peaks [][]byte
+}
+
+// NewAccumulator loads the accumulator persisted in storage, an empty one if there is none
+func NewAccumulator(storage store.Storage) (*Accumulator, error) {
+	acc := &Accumulator{
+		l:         &sync.RWMutex{},
+		syncing:   &sync.Mutex{},
+		storage:   storage,
+		closed:    make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+
+	head, err := storage.GetCF(store.AccumulatorColumnFamily, []byte(accumulator_head_key))
+	if err != nil && err != store.ErrNotFound {
+		return nil, err
+	}
+	if err == nil {
+		if len(head) < 8 {
+			return nil, fmt.Errorf("supervisor/challenge: broken accumulator head")
+		}
+		acc.size = binary.BigEndian.Uint64(head)
+		acc.tipHash = head[8:]
+	}
+
+	return acc, nil
+}
+
+// BlockLeafHash is block's leaf in the accumulator, farmers holding the block compute the same
+func BlockLeafHash(blockBytes []byte) []byte {
+	return digestLeafHash(chunksCount(len(blockBytes)), BlockChunksRoot(blockBytes))
+}
+
+func digestLeafHash(chunks uint32, root []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{block_prefix})
+	binary.Write(h, binary.BigEndian, chunks)
+	h.Write(root)
+	return h.Sum(nil)
+}
+
+// BlocksRangeRoot is root of blocks (lowBlockNumber, lowBlockNumber+len(leaves)] given their leaves,
+// what a farmer answers BLOCKS_ROOT challenge with, equals RangeRoot of the accumulator
+func BlocksRangeRoot(lowBlockNumber uint64, leaves [][]byte) []byte {
+	nodes := [][]byte{}
+	first := lowBlockNumber + 1
+	rangeCover(first, first+uint64(len(leaves)), func(height uint8, index uint64) {
+		begin := (index << height) - first
+		nodes = append(nodes, subtreeRoot(leaves[begin:begin+(1<<height)]))
+	})
+
+	return bagPeaks(nodes)
+}
+
+// root of a perfect subtree, len(leaves) is a power of 2
+func subtreeRoot(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	half := len(leaves) / 2
+	return nodeHash(subtreeRoot(leaves[:half]), subtreeRoot(leaves[half:]))
+}
+
+// rangeCover walks the fewest aligned perfect subtrees covering leaves [begin, end), left to right
+func rangeCover(begin, end uint64, fn func(height uint8, index uint64)) {
+	for begin < end {
+		height := uint8(0)
+		for height < 63 && begin%(1<<(height+1)) == 0 && begin+(1<<(height+1)) <= end {
+			height++
+		}
+		fn(height, begin>>height)
+		begin += 1 << height
+	}
+}
+
+// peaks of an accumulator of size leaves are the cover of [0, size)
+func peaks(size uint64, fn func(height uint8, index uint64)) {
+	rangeCover(0, size, fn)
+}
+
+// fold peaks right to left, nil if there is none
+func bagPeaks(nodes [][]byte) []byte {
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	root := nodes[len(nodes)-1]
+	for i := len(nodes) - 2; i >= 0; i-- {
+		root = nodeHash(nodes[i], root)
+	}
+	return root
+}
+
+func accumulatorNodeKey(height uint8, index uint64) []byte {
+	key := make([]byte, 10)
+	key[0] = accumulator_node_key
+	key[1] = height
+	binary.BigEndian.PutUint64(key[2:], index)
+	return key
+}
+
+func accumulatorLeafKey(blockNumber uint64) []byte {
+	key := make([]byte, 9)
+	key[0] = accumulator_leaf_key
+	binary.BigEndian.PutUint64(key[1:], blockNumber)
+	return key
+}
+
+// Size is count of blocks committed
+func (acc *Accumulator) Size() uint64 {
+	acc.l.RLock()
+	defer acc.l.RUnlock()
+
+	return acc.size
+}
+
+// Root commits all blocks appended so far, nil if there is none
+func (acc *Accumulator) Root() ([]byte, error) {
+	acc.l.RLock()
+	defer acc.l.RUnlock()
+
+	return acc.bag(0, acc.size)
+}
+
+// RangeRoot commits blocks in range (lowBlockNumber, highBlockNumber], computed from O(log n) stored nodes
+func (acc *Accumulator) RangeRoot(highBlockNumber, lowBlockNumber uint64) ([]byte, error) {
+	if highBlockNumber <= lowBlockNumber {
+		return nil, ErrOutOfBounds
+	}
+
+	acc.l.RLock()
+	defer acc.l.RUnlock()
+
+	if highBlockNumber >= acc.size {
+		return nil, ErrNotCommitted
+	}
+	return acc.bag(lowBlockNumber+1, highBlockNumber+1)
+}
+
+// caller must hold the lock
+func (acc *Accumulator) bag(begin, end uint64) ([]byte, error) {
+	nodes, err := acc.cover(begin, end)
+	if err != nil {
+		return nil, err
+	}
+	return bagPeaks(nodes), nil
+}
+
+// caller must hold the lock
+func (acc *Accumulator) cover(begin, end uint64) ([][]byte, error) {
+	var err error
+	nodes := [][]byte{}
+	rangeCover(begin, end, func(height uint8, index uint64) {
+		if err != nil {
+			return
+		}
+		var node []byte
+		node, err = acc.node(height, index)
+		nodes = append(nodes, node)
+	})
+
+	return nodes, err
+}
+
+// caller must hold the lock
+func (acc *Accumulator) node(height uint8, index uint64) ([]byte, error) {
+	node, err := acc.storage.GetCF(store.AccumulatorColumnFamily, accumulatorNodeKey(height, index))
+	if err == store.ErrNotFound {
+		return nil, fmt.Errorf("supervisor/challenge: accumulator node(%d, %d) missing", height, index)
+	}
+	return node, err
+}
+
+// digest of a committed block, read from storage instead of the block itself
+func (acc *Accumulator) digest(blockNumber uint64) (*blockDigest, error) {
+	acc.l.RLock()
+	defer acc.l.RUnlock()
+
+	if blockNumber >= acc.size {
+		return nil, ErrNotCommitted
+	}
+
+	value, err := acc.storage.GetCF(store.AccumulatorColumnFamily, accumulatorLeafKey(blockNumber))
+	if err != nil && err != store.ErrNotFound {
+		return nil, err
+	}
+	if len(value) < 4 {
+		return nil, fmt.Errorf("supervisor/challenge: accumulator digest of block %d missing", blockNumber)
+	}
+
+	return &blockDigest{
+		blockNumber: blockNumber,
+		chunks:      binary.BigEndian.Uint32(value),
+		root:        value[4:],
+	}, nil
+}
+
+// Prove builds proof of block's leaf against current root
+func (acc *Accumulator) Prove(blockNumber uint64) (*AccumulatorProof, error) {
+	acc.l.RLock()
+	defer acc.l.RUnlock()
+
+	if blockNumber >= acc.size {
+		return nil, ErrNotCommitted
+	}
+
+	leaf, err := acc.node(0, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	peakNodes, err := acc.cover(0, acc.size)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := &AccumulatorProof{
+		BlockNumber: blockNumber,
+		Size:        acc.size,
+		Leaf:        leaf,
+		Path:        [][]byte{},
+		Peaks:       peakNodes,
+	}
+	for height := uint8(0); height < peakHeight(acc.size, blockNumber); height++ {
+		sibling, err := acc.node(height, (blockNumber>>height)^1)
+		if err != nil {
+			return nil, err
+		}
+		proof.Path = append(proof.Path, sibling)
+	}
+
+	return proof, nil
+}
+
+// height of the peak whose subtree holds leaf n, and its position among peaks
+func peakOf(size, n uint64) (height uint8, position int) {
+	position = -1
+	i := 0
+	peaks(size, func(h uint8, index uint64) {
+		if position < 0 && n>>h == index {
+			height, position = h, i
+		}
+		i++
+	})
+	return
+}
+
+func peakHeight(size, n uint64) uint8 {
+	height, _ := peakOf(size, n)
+	return height
+}
+
+// VerifyAccumulatorProof checks the proof leads leaf to root
+func VerifyAccumulatorProof(root []byte, proof *AccumulatorProof) bool {
+	if proof == nil || proof.BlockNumber >= proof.Size {
+		return false
+	}
+
+	count := 0
+	peaks(proof.Size, func(uint8, uint64) { count++ })
+	height, position := peakOf(proof.Size, proof.BlockNumber)
+	if len(proof.Peaks) != count || len(proof.Path) != int(height) {
+		return false
+	}
+
+	h := proof.Leaf
+	for i, sibling := range proof.Path {
+		if (proof.BlockNumber>>uint(i))%2 == 1 {
+			h = nodeHash(sibling, h)
+		} else {
+			h = nodeHash(h, sibling)
+		}
+	}
+
+	return bytes.Equal(h, proof.Peaks[position]) && bytes.Equal(bagPeaks(proof.Peaks), root)
+}
+
+// Sync appends blocks the source has beyond the accumulator, checking they chain up with the last one appended,
+// returns how many blocks appended
+func (acc *Accumulator) Sync(src BlockSource) (uint64, error) {
+	acc.syncing.Lock()
+	defer acc.syncing.Unlock()
+
+	appended := uint64(0)
+	for size := src.GetBlockchainSize(); acc.Size() < size; appended++ {
+		blockNumber := acc.Size()
+		block, err := src.GetBlockByNumber(blockNumber)
+		if err != nil {
+			return appended, err
+		}
+		if block == nil {
+			return appended, fmt.Errorf("Block %d is nil.", blockNumber)
+		}
+		blockBytes, err := block.Bytes()
+		if err != nil {
+			return appended, err
+		}
+		blockHash, err := block.GetHash()
+		if err != nil {
+			return appended, err
+		}
+
+		acc.l.Lock()
+		if blockNumber > 0 && !bytes.Equal(block.PreviousBlockHash, acc.tipHash) {
+			acc.l.Unlock()
+			return appended, fmt.Errorf("Blocks hash can not match.")
+		}
+		err = acc.append(chunksCount(len(blockBytes)), BlockChunksRoot(blockBytes), blockHash)
+		acc.l.Unlock()
+		if err != nil {
+			return appended, err
+		}
+	}
+
+	return appended, nil
+}
+
+// caller must hold the lock, nodes go first and head last, an append interrupted is just redone
+func (acc *Accumulator) append(chunks uint32, root, blockHash []byte) error {
+	n := acc.size
+
+	value := make([]byte, 4, 4+len(root))
+	binary.BigEndian.PutUint32(value, chunks)
+	if err := acc.storage.SetCF(store.AccumulatorColumnFamily, accumulatorLeafKey(n), append(value, root...)); err != nil {
+		return err
+	}
+
+	node := digestLeafHash(chunks, root)
+	if err := acc.storage.SetCF(store.AccumulatorColumnFamily, accumulatorNodeKey(0, n), node); err != nil {
+		return err
+	}
+	// every right child completes its parent
+	for height, index := uint8(0), n; index%2 == 1; height, index = height+1, index/2 {
+		left, err := acc.node(height, index-1)
+		if err != nil {
+			return err
+		}
+		node = nodeHash(left, node)
+		if err := acc.storage.SetCF(store.AccumulatorColumnFamily, accumulatorNodeKey(height+1, index/2), node); err != nil {
+			return err
+		}
+	}
+
+	head := make([]byte, 8, 8+len(blockHash))
+	binary.BigEndian.PutUint64(head, n+1)
+	if err := acc.storage.SetCF(store.AccumulatorColumnFamily, []byte(accumulator_head_key), append(head, blockHash...)); err != nil {
+		return err
+	}
+
+	acc.size = n + 1
+	acc.tipHash = blockHash
+	return nil
+}
+
+// keepSynced syncs with the source every interval, until the accumulator closed
+func (acc *Accumulator) keepSynced(src BlockSource, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := acc.Sync(src); err != nil {
+			logger.Errorf("sync blocks accumulator err: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-acc.closed:
+			return
+		}
+	}
+}
+
+// Close stops syncing, storage is owned by the caller
+func (acc *Accumulator) Close() {
+	acc.closeOnce.Do(func() {
+		close(acc.closed)
+	})
+}
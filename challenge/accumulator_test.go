@@ -0,0 +1,302 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package challenge
+
+import (
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account/store"
+	fpb "github.com/hyperledger/fabric/protos"
+	"gopkg.in/check.v1"
+)
+
+type AccumulatorTest struct {
+	source *syntheticBlockSource
+	leaves [][]byte
+}
+
+var _ = check.Suite(&AccumulatorTest{})
+
+func (t *AccumulatorTest) SetUpSuite(c *check.C) {
+	t.source = newSyntheticBlockSource(c, 40, 3*ChunkSize+5)
+	t.leaves = make([][]byte, 40)
+	for i := range t.leaves {
+		block, err := t.source.GetBlockByNumber(uint64(i))
+		c.Assert(err, check.IsNil)
+		blockBytes, err := block.Bytes()
+		c.Assert(err, check.IsNil)
+		t.leaves[i] = BlockLeafHash(blockBytes)
+	}
+}
+
+// memStorage keeps column families in memory, missing keys are reported like rocksdb storage does
+type memStorage struct {
+	l   *sync.Mutex
+	cfs map[string]map[string][]byte
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		l:   &sync.Mutex{},
+		cfs: make(map[string]map[string][]byte),
+	}
+}
+
+func (s *memStorage) Get(key []byte) ([]byte, error) {
+	return s.GetCF(store.DefaultColumnFamily, key)
+}
+
+func (s *memStorage) Set(key, value []byte) error {
+	return s.SetCF(store.DefaultColumnFamily, key, value)
+}
+
+func (s *memStorage) Del(key []byte) error {
+	return s.DelCF(store.DefaultColumnFamily, key)
+}
+
+func (s *memStorage) GetCF(cf string, key []byte) ([]byte, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	value, ok := s.cfs[cf][string(key)]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *memStorage) SetCF(cf string, key, value []byte) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.cfs[cf] == nil {
+		s.cfs[cf] = make(map[string][]byte)
+	}
+	s.cfs[cf][string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (s *memStorage) DelCF(cf string, key []byte) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	delete(s.cfs[cf], string(key))
+	return nil
+}
+
+func (s *memStorage) IterateCF(cf string, fn func(key, value []byte) bool) error {
+	return s.SeekCF(cf, nil, fn)
+}
+
+func (s *memStorage) SeekCF(cf string, start []byte, fn func(key, value []byte) bool) error {
+	s.l.Lock()
+	keys := []string{}
+	for key := range s.cfs[cf] {
+		if key >= string(start) {
+			keys = append(keys, key)
+		}
+	}
+	s.l.Unlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, _ := s.GetCF(cf, []byte(key))
+		if !fn([]byte(key), value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) Close() error {
+	return nil
+}
+
+// a chain seen while growing, only the first size blocks of the source
+type growingBlockSource struct {
+	src  BlockSource
+	size uint64
+}
+
+func (s *growingBlockSource) GetBlockchainSize() uint64 {
+	return s.size
+}
+
+func (s *growingBlockSource) GetBlockByNumber(blockNumber uint64) (*fpb.Block, error) {
+	if blockNumber >= s.size {
+		return nil, ErrOutOfBounds
+	}
+	return s.src.GetBlockByNumber(blockNumber)
+}
+
+// root of leaves [0, size) built from scratch
+func naiveRoot(leaves [][]byte, size uint64) []byte {
+	nodes := [][]byte{}
+	peaks(size, func(height uint8, index uint64) {
+		begin := index << height
+		nodes = append(nodes, subtreeRoot(leaves[begin:begin+(1<<height)]))
+	})
+	return bagPeaks(nodes)
+}
+
+func (t *AccumulatorTest) TestAccumulatorGrowth(c *check.C) {
+	acc, err := NewAccumulator(newMemStorage())
+	c.Assert(err, check.IsNil)
+	root, err := acc.Root()
+	c.Assert(err, check.IsNil)
+	c.Check(root, check.IsNil)
+
+	src := &growingBlockSource{src: t.source}
+	var lastRoot []byte
+	for size := uint64(1); size <= t.source.GetBlockchainSize(); size++ {
+		src.size = size
+		appended, err := acc.Sync(src)
+		c.Assert(err, check.IsNil)
+		c.Check(appended, check.Equals, uint64(1))
+		c.Check(acc.Size(), check.Equals, size)
+
+		root, err := acc.Root()
+		c.Assert(err, check.IsNil)
+		c.Check(root, check.DeepEquals, naiveRoot(t.leaves, size), check.Commentf("size %d", size))
+		c.Check(root, check.Not(check.DeepEquals), lastRoot)
+
+		// every block is proven against the grown root, never against the old one
+		for n := uint64(0); n < size; n++ {
+			proof, err := acc.Prove(n)
+			c.Assert(err, check.IsNil)
+			c.Check(proof.Leaf, check.DeepEquals, t.leaves[n])
+			c.Check(VerifyAccumulatorProof(root, proof), check.Equals, true, check.Commentf("size %d, block %d", size, n))
+			if lastRoot != nil {
+				c.Check(VerifyAccumulatorProof(lastRoot, proof), check.Equals, false)
+			}
+		}
+		lastRoot = root
+	}
+
+	_, err = acc.Prove(acc.Size())
+	c.Check(err, check.Equals, ErrNotCommitted)
+}
+
+func (t *AccumulatorTest) TestAccumulatorProofTampered(c *check.C) {
+	acc, err := NewAccumulator(newMemStorage())
+	c.Assert(err, check.IsNil)
+	_, err = acc.Sync(t.source)
+	c.Assert(err, check.IsNil)
+	root, err := acc.Root()
+	c.Assert(err, check.IsNil)
+
+	proof, err := acc.Prove(13)
+	c.Assert(err, check.IsNil)
+
+	// leaf of another block
+	forged := *proof
+	forged.Leaf = t.leaves[12]
+	c.Check(VerifyAccumulatorProof(root, &forged), check.Equals, false)
+
+	// claims another block number
+	forged = *proof
+	forged.BlockNumber = 12
+	c.Check(VerifyAccumulatorProof(root, &forged), check.Equals, false)
+
+	// path cut short
+	forged = *proof
+	forged.Path = proof.Path[1:]
+	c.Check(VerifyAccumulatorProof(root, &forged), check.Equals, false)
+}
+
+func (t *AccumulatorTest) TestAccumulatorRangeRoot(c *check.C) {
+	acc, err := NewAccumulator(newMemStorage())
+	c.Assert(err, check.IsNil)
+	_, err = acc.Sync(t.source)
+	c.Assert(err, check.IsNil)
+
+	for _, r := range [][2]uint64{{1, 0}, {39, 0}, {16, 0}, {31, 15}, {38, 3}, {20, 19}} {
+		high, low := r[0], r[1]
+		root, err := acc.RangeRoot(high, low)
+		c.Assert(err, check.IsNil)
+		c.Check(root, check.DeepEquals, BlocksRangeRoot(low, t.leaves[low+1:high+1]), check.Commentf("range [%d, %d]", high, low))
+	}
+
+	_, err = acc.RangeRoot(40, 10)
+	c.Check(err, check.Equals, ErrNotCommitted)
+	_, err = acc.RangeRoot(10, 10)
+	c.Check(err, check.Equals, ErrOutOfBounds)
+}
+
+func (t *AccumulatorTest) TestAccumulatorPersisted(c *check.C) {
+	storage := newMemStorage()
+	acc, err := NewAccumulator(storage)
+	c.Assert(err, check.IsNil)
+	_, err = acc.Sync(&growingBlockSource{src: t.source, size: 25})
+	c.Assert(err, check.IsNil)
+
+	// supervisor restarts, accumulator picks up where it was
+	acc, err = NewAccumulator(storage)
+	c.Assert(err, check.IsNil)
+	c.Check(acc.Size(), check.Equals, uint64(25))
+
+	appended, err := acc.Sync(t.source)
+	c.Assert(err, check.IsNil)
+	c.Check(appended, check.Equals, uint64(15))
+	root, err := acc.Root()
+	c.Assert(err, check.IsNil)
+	c.Check(root, check.DeepEquals, naiveRoot(t.leaves, 40))
+
+	digest, err := acc.digest(7)
+	c.Assert(err, check.IsNil)
+	c.Check(digestLeafHash(digest.chunks, digest.root), check.DeepEquals, t.leaves[7])
+}
+
+func (t *AccumulatorTest) TestAccumulatorBrokenChain(c *check.C) {
+	acc, err := NewAccumulator(newMemStorage())
+	c.Assert(err, check.IsNil)
+	_, err = acc.Sync(t.source)
+	c.Assert(err, check.IsNil)
+
+	// a chain forked from another genesis doesn't extend the accumulator
+	_, err = acc.Sync(newSyntheticBlockSource(c, 50, 100))
+	c.Check(err, check.NotNil)
+	c.Check(acc.Size(), check.Equals, uint64(40))
+}
+
+func (t *AccumulatorTest) TestConquerRootChallenge(c *check.C) {
+	cfg := &Config{
+		HashAlgo: pb.HashAlgo_SHA256,
+		Delay:    time.Second * 10,
+	}
+	ch := NewChallenger(cfg, t.source, NewDefaultFarmerChallengeReqCache(cfg.Delay, 0), NewDefaultBlocksHashCache(0, 0))
+	defer ch.Close()
+	c.Check(ch.ChallengeKind(false, true), check.Equals, pb.ChallengeKind_BLOCKS_HASH)
+
+	c.Assert(ch.EnableAccumulator(newMemStorage()), check.IsNil)
+	c.Check(ch.Committed(39), check.Equals, true)
+	c.Check(ch.ChallengeKind(false, true), check.Equals, pb.ChallengeKind_BLOCKS_ROOT)
+	c.Check(ch.ChallengeKind(false, false), check.Equals, pb.ChallengeKind_BLOCKS_HASH)
+
+	answer := FarmerBindConquerHashWithNonce("TestConquerRootChallenge", pb.HashAlgo_SHA256, hex.EncodeToString(BlocksRangeRoot(10, t.leaves[11:31])), []byte("nonce"))
+	ch.FarmerChallengeReqCache().AddFarmerChallengeReq(NewFarmerRootChallengeReq("TestConquerRootChallenge", 30, 10, []byte("nonce")))
+	c.Check(ch.ConquerChallenge("TestConquerRootChallenge", 30, 10, pb.HashAlgo_SHA256, answer, nil), check.Equals, true)
+
+	// answer without the nonce
+	wrong := FarmerBindConquerHash("TestConquerRootChallenge", pb.HashAlgo_SHA256, hex.EncodeToString(BlocksRangeRoot(10, t.leaves[11:31])))
+	ch.FarmerChallengeReqCache().AddFarmerChallengeReq(NewFarmerRootChallengeReq("TestConquerRootChallenge", 30, 10, []byte("nonce")))
+	c.Check(ch.ConquerChallenge("TestConquerRootChallenge", 30, 10, pb.HashAlgo_SHA256, wrong, nil), check.Equals, false)
+}
@@ -0,0 +1,74 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package challenge
+
+import (
+	"fmt"
+
+	fpb "github.com/hyperledger/fabric/protos"
+)
+
+const (
+	BlockSourceLedger = "ledger"
+	BlockSourceFile   = "file"
+
+	default_block_source = BlockSourceLedger
+)
+
+// BlockSource is where supervisor reads blocks from when verifying a challenge,
+// *ledger.Ledger itself satisfies it
+type BlockSource interface {
+	GetBlockchainSize() uint64
+	GetBlockByNumber(blockNumber uint64) (*fpb.Block, error)
+}
+
+// NewBlockSource returns a block source of the given kind,
+// ledger source accepts an optional fabric file system path, file source needs a blocks dir
+func NewBlockSource(source string, args ...interface{}) (src BlockSource, err error) {
+	if source == "" {
+		source = default_block_source
+	}
+
+	switch source {
+	case BlockSourceLedger:
+		fileSystemPath := ""
+		if len(args) > 0 {
+			path, ok := args[0].(string)
+			if !ok {
+				err = fmt.Errorf("ledger block source needs a file system path string, got %T", args[0])
+				return
+			}
+			fileSystemPath = path
+		}
+		src, err = NewLedgerBlockSource(fileSystemPath)
+	case BlockSourceFile:
+		if len(args) < 1 {
+			err = fmt.Errorf("file block source set up at least need a blocks dir")
+			return
+		}
+		dir, ok := args[0].(string)
+		if !ok {
+			err = fmt.Errorf("file block source needs a blocks dir string, got %T", args[0])
+			return
+		}
+		src, err = NewFileBlockSource(dir)
+	default:
+		err = fmt.Errorf("not supported block source: %v", source)
+	}
+
+	return
+}
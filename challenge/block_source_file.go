@@ -0,0 +1,99 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package challenge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	fpb "github.com/hyperledger/fabric/protos"
+)
+
+// FileBlockSource reads blocks from a directory,
+// every block is serialized by Block.Bytes() into a file named by its block number
+type FileBlockSource struct {
+	dir string
+}
+
+func NewFileBlockSource(dir string) (*FileBlockSource, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("file block source need a blocks dir")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileBlockSource{
+		dir: dir,
+	}, nil
+}
+
+// blockchain size is the highest block number in the dir plus 1
+func (s *FileBlockSource) GetBlockchainSize() uint64 {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		logger.Errorf("read blocks dir %s err: %v", s.dir, err)
+		return 0
+	}
+
+	size := uint64(0)
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+
+		blockNumber, err := strconv.ParseUint(info.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		if blockNumber+1 > size {
+			size = blockNumber + 1
+		}
+	}
+
+	return size
+}
+
+func (s *FileBlockSource) GetBlockByNumber(blockNumber uint64) (*fpb.Block, error) {
+	blockBytes, err := ioutil.ReadFile(s.blockFile(blockNumber))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrOutOfBounds
+		}
+		return nil, err
+	}
+
+	return fpb.UnmarshallBlock(blockBytes)
+}
+
+// PutBlock writes block into the dir, used for filling fixtures or exporting blocks from a peer
+func (s *FileBlockSource) PutBlock(blockNumber uint64, block *fpb.Block) error {
+	blockBytes, err := block.Bytes()
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(s.blockFile(blockNumber), blockBytes, 0644)
+}
+
+func (s *FileBlockSource) blockFile(blockNumber uint64) string {
+	return filepath.Join(s.dir, strconv.FormatUint(blockNumber, 10))
+}
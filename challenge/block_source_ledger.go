@@ -0,0 +1,144 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package challenge
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric/core/ledger"
+	fpb "github.com/hyperledger/fabric/protos"
+	"github.com/tecbot/gorocksdb"
+)
+
+const (
+	// where fabric keeps blocks and the count of them in its db, see fabric's core/ledger/blockchain.go
+	ledger_blockchain_cf   = "blockchainCF"
+	ledger_block_count_key = "blockCount"
+
+	// how stale a ledger opened read only may get, blocks the peer commits show up after it
+	ledger_refresh_interval = time.Second
+)
+
+// NewLedgerBlockSource opens the fabric ledger as a block source, the peer's own one if fileSystemPath is empty,
+// otherwise the ledger db under fileSystemPath, read only, leaving fabric's global config as it is
+func NewLedgerBlockSource(fileSystemPath string) (BlockSource, error) {
+	if fileSystemPath == "" {
+		ldg, err := ledger.GetLedger()
+		if err != nil {
+			return nil, err
+		}
+		return ldg, nil
+	}
+
+	src := &ledgerDBBlockSource{
+		path: filepath.Join(fileSystemPath, "db"),
+		l:    &sync.RWMutex{},
+	}
+	if err := src.open(); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// ledgerDBBlockSource reads blocks straight from fabric's db, which the peer keeps open, so it is opened read only,
+// and reopened once the view gets stale
+type ledgerDBBlockSource struct {
+	path     string
+	l        *sync.RWMutex
+	db       *gorocksdb.DB
+	cfh      *gorocksdb.ColumnFamilyHandle
+	openedAt time.Time
+}
+
+// caller must hold the write lock, or be the only one holding the source
+func (s *ledgerDBBlockSource) open() error {
+	opts := gorocksdb.NewDefaultOptions()
+	defer opts.Destroy()
+
+	db, cfhs, err := gorocksdb.OpenDbForReadOnlyColumnFamilies(opts, s.path, []string{"default", ledger_blockchain_cf}, []*gorocksdb.Options{opts, opts}, false)
+	if err != nil {
+		return fmt.Errorf("supervisor/challenge: open ledger db %s: %v", s.path, err)
+	}
+	cfhs[0].Destroy()
+
+	if s.db != nil {
+		s.cfh.Destroy()
+		s.db.Close()
+	}
+	s.db, s.cfh, s.openedAt = db, cfhs[1], time.Now()
+	return nil
+}
+
+func (s *ledgerDBBlockSource) get(key []byte) ([]byte, error) {
+	s.l.RLock()
+	stale := time.Since(s.openedAt) > ledger_refresh_interval
+	s.l.RUnlock()
+	if stale {
+		s.l.Lock()
+		if time.Since(s.openedAt) > ledger_refresh_interval {
+			if err := s.open(); err != nil {
+				logger.Warningf("reopen ledger db err: %v, blocks read are stale", err)
+			}
+		}
+		s.l.Unlock()
+	}
+
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	opts := gorocksdb.NewDefaultReadOptions()
+	defer opts.Destroy()
+	slice, err := s.db.GetCF(opts, s.cfh, key)
+	if err != nil {
+		return nil, err
+	}
+	defer slice.Free()
+
+	if len(slice.Data()) == 0 {
+		return nil, nil
+	}
+	return append([]byte(nil), slice.Data()...), nil
+}
+
+func (s *ledgerDBBlockSource) GetBlockchainSize() uint64 {
+	count, err := s.get([]byte(ledger_block_count_key))
+	if err != nil {
+		logger.Errorf("read ledger block count err: %v", err)
+		return 0
+	}
+	if len(count) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(count)
+}
+
+func (s *ledgerDBBlockSource) GetBlockByNumber(blockNumber uint64) (*fpb.Block, error) {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, blockNumber)
+	blockBytes, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if blockBytes == nil {
+		return nil, fmt.Errorf("supervisor/challenge: block %d not in ledger", blockNumber)
+	}
+	return fpb.UnmarshallBlock(blockBytes)
+}
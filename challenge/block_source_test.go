@@ -0,0 +1,134 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package challenge
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	fpb "github.com/hyperledger/fabric/protos"
+	"gopkg.in/check.v1"
+)
+
+type BlockSourceTest struct {
+	dir    string
+	source *FileBlockSource
+	blocks []*fpb.Block
+}
+
+var _ = check.Suite(&BlockSourceTest{})
+
+func (t *BlockSourceTest) SetUpSuite(c *check.C) {
+	t.dir = filepath.Join(os.TempDir(), "testBlockSource")
+	os.RemoveAll(t.dir)
+
+	var err error
+	t.source, err = NewFileBlockSource(t.dir)
+	c.Assert(err, check.IsNil)
+
+	t.blocks = fillChainedBlocks(c, t.source, 10)
+}
+
+func (t *BlockSourceTest) TearDownSuite(c *check.C) {
+	os.RemoveAll(t.dir)
+}
+
+// fill source with count blocks, every block points to the hash of its previous one
+func fillChainedBlocks(c *check.C, source *FileBlockSource, count int) []*fpb.Block {
+	blocks := []*fpb.Block{}
+	var previousBlockHash []byte
+	for i := 0; i < count; i++ {
+		block := fpb.NewBlock(nil, []byte{byte(i)})
+		block.SetPreviousBlockHash(previousBlockHash)
+		c.Assert(source.PutBlock(uint64(i), block), check.IsNil)
+
+		var err error
+		previousBlockHash, err = block.GetHash()
+		c.Assert(err, check.IsNil)
+		blocks = append(blocks, block)
+	}
+
+	return blocks
+}
+
+func (t *BlockSourceTest) TestNewBlockSource(c *check.C) {
+	src, err := NewBlockSource(BlockSourceFile, t.dir)
+	c.Check(err, check.IsNil)
+	c.Check(src.GetBlockchainSize(), check.Equals, uint64(10))
+
+	_, err = NewBlockSource(BlockSourceFile)
+	c.Check(err, check.NotNil)
+
+	_, err = NewBlockSource("unknown")
+	c.Check(err, check.NotNil)
+
+	// args of a wrong type are refused, not panicked on
+	_, err = NewBlockSource(BlockSourceFile, 10)
+	c.Check(err, check.NotNil)
+	_, err = NewBlockSource(BlockSourceLedger, []byte(t.dir))
+	c.Check(err, check.NotNil)
+}
+
+func (t *BlockSourceTest) TestFileBlockSourceGetBlockByNumber(c *check.C) {
+	block, err := t.source.GetBlockByNumber(3)
+	c.Assert(err, check.IsNil)
+	c.Check(block.ConsensusMetadata, check.DeepEquals, []byte{3})
+
+	_, err = t.source.GetBlockByNumber(10)
+	c.Check(err, check.Equals, ErrOutOfBounds)
+}
+
+func (t *BlockSourceTest) TestGetBlocksBytes(c *check.C) {
+	expected := bytes.NewBufferString("")
+	for i := 8; i > 2; i-- {
+		blockBytes, err := t.blocks[i].Bytes()
+		c.Assert(err, check.IsNil)
+		expected.Write(blockBytes)
+	}
+
+	blocksBytes, err := getBlocksBytes(t.source, 8, 2)
+	c.Assert(err, check.IsNil)
+	c.Check(blocksBytes, check.DeepEquals, expected.Bytes())
+}
+
+func (t *BlockSourceTest) TestGetBlocksBytesOutOfBounds(c *check.C) {
+	_, err := getBlocksBytes(t.source, 10, 2)
+	c.Check(err, check.Equals, ErrOutOfBounds)
+
+	_, err = getBlocksBytes(t.source, 2, 8)
+	c.Check(err, check.Equals, ErrOutOfBounds)
+}
+
+func (t *BlockSourceTest) TestGetBlocksBytesBrokenChain(c *check.C) {
+	dir := filepath.Join(os.TempDir(), "testBrokenBlockSource")
+	defer os.RemoveAll(dir)
+
+	source, err := NewFileBlockSource(dir)
+	c.Assert(err, check.IsNil)
+	blocks := fillChainedBlocks(c, source, 5)
+
+	// tamper block 2, block 3 no longer points to it
+	blocks[2].ConsensusMetadata = []byte("tampered")
+	c.Assert(source.PutBlock(2, blocks[2]), check.IsNil)
+
+	_, err = getBlocksBytes(source, 4, 0)
+	c.Check(err, check.NotNil)
+
+	_, err = getBlocksBytes(source, 4, 3)
+	c.Check(err, check.IsNil)
+}
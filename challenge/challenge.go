@@ -18,107 +18,484 @@ package challenge
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	mrand "math/rand"
 	"strings"
+	"time"
 
 	pb "github.com/conseweb/common/protos"
-	"github.com/hyperledger/fabric/core/ledger"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/clock"
 	"github.com/op/go-logging"
 )
 
+const (
+	challenge_nonce_size = 32
+)
+
 var (
 	logger         = logging.MustGetLogger("supervisor")
 	ErrOutOfBounds = errors.New("supervisor/challenge: blocks out of bounds")
 )
 
-func ConquerChallenge(farmerId string, highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo, blocksHash string) bool {
+// Challenger issues and verifies challenges, owns the caches and the block source it reads from
+type Challenger struct {
+	cfg       *Config
+	source    BlockSource
+	reqCache  FarmerChallengeCache
+	hashCache BlocksHashCache
+	digests   *blockDigestCache
+	acc       *Accumulator
+	// hash cache warming up, nil if not enabled
+	warm *defaultBlocksHashCache
+}
+
+// NewChallenger assembles a challenger from given parts
+func NewChallenger(cfg *Config, source BlockSource, reqCache FarmerChallengeCache, hashCache BlocksHashCache) *Challenger {
+	return &Challenger{
+		cfg:       cfg,
+		source:    source,
+		reqCache:  reqCache,
+		hashCache: hashCache,
+		digests:   newBlockDigestCache(cfg.DigestCacheSize),
+	}
+}
+
+// NewChallengerFromConfig builds caches from cfg, if source is nil, block source is built from cfg too,
+// starts hash cache warming up if enabled
+func NewChallengerFromConfig(cfg *Config, source BlockSource) (*Challenger, error) {
+	if source == nil {
+		var err error
+		if source, err = cfg.NewBlockSource(); err != nil {
+			return nil, err
+		}
+	}
+
+	hashCache := newDefaultBlocksHashCache(cfg.HashCacheMaxEntries, cfg.HashCacheMaxBytes)
+	ch := NewChallenger(cfg, source, NewFarmerChallengeReqCacheWithClock(clock.OrReal(cfg.Clock), cfg.Delay, cfg.CacheMaxSize), hashCache)
+	if cfg.WarmUp {
+		ch.warm = hashCache
+		go hashCache.warmUp(source, cfg.HashAlgo, cfg.WarmUpInterval, cfg.WarmUpWidths)
+	}
+
+	return ch, nil
+}
+
+// WarmedRange picks one of the ranges hash cache warmed up within [low, high] farmer declared,
+// at cfg.WarmUpRatio, so that conquering it hits the cache, false if farmer is challenged on a random range
+func (ch *Challenger) WarmedRange(highBlockNumber, lowBlockNumber uint64) (*pb.BlocksRange, bool) {
+	if ch.warm == nil || mrand.Float64() >= ch.cfg.WarmUpRatio {
+		return nil, false
+	}
+	tip, warmed := ch.warm.warmedTip()
+	if !warmed || tip > highBlockNumber {
+		return nil, false
+	}
+
+	fits := []uint64{}
+	for _, width := range ch.cfg.WarmUpWidths {
+		if width > tip {
+			width = tip
+		}
+		if tip-width >= lowBlockNumber {
+			fits = append(fits, width)
+		}
+	}
+	if len(fits) == 0 {
+		return nil, false
+	}
+
+	width := fits[mrand.Intn(len(fits))]
+	return &pb.BlocksRange{HighBlockNumber: tip, LowBlockNumber: tip - width}, true
+}
+
+func (ch *Challenger) FarmerChallengeReqCache() FarmerChallengeCache {
+	return ch.reqCache
+}
+
+func (ch *Challenger) BlocksHashCache() BlocksHashCache {
+	return ch.hashCache
+}
+
+func (ch *Challenger) BlockSource() BlockSource {
+	return ch.source
+}
+
+// blocks accumulator, nil if not enabled
+func (ch *Challenger) Accumulator() *Accumulator {
+	return ch.acc
+}
+
+// EnableAccumulator loads blocks accumulator from storage, syncs it with the block source once,
+// then keeps it synced every cfg.AccumulatorInterval until challenger closed
+func (ch *Challenger) EnableAccumulator(storage store.Storage) error {
+	acc, err := NewAccumulator(storage)
+	if err != nil {
+		return err
+	}
+	if _, err := acc.Sync(ch.source); err != nil {
+		return err
+	}
+
+	interval := ch.cfg.AccumulatorInterval
+	if interval <= 0 {
+		interval = default_accumulator_interval
+	}
+	go acc.keepSynced(ch.source, interval)
+	ch.acc = acc
+
+	return nil
+}
+
+// Committed reports whether block is committed by blocks accumulator
+func (ch *Challenger) Committed(blockNumber uint64) bool {
+	return ch.acc != nil && blockNumber < ch.acc.Size()
+}
+
+// hash algorithm challenges are issued with
+func (ch *Challenger) HashAlgo() pb.HashAlgo {
+	return ch.cfg.HashAlgo
+}
+
+// max delay farmer can stand for conquer challenge after ping
+func (ch *Challenger) Delay() time.Duration {
+	return ch.cfg.Delay
+}
+
+// NewNonce returns a fresh random nonce for a challenge, nil if nonce challenges aren't enabled
+func (ch *Challenger) NewNonce() ([]byte, error) {
+	if !ch.cfg.Nonce {
+		return nil, nil
+	}
+
+	nonce := make([]byte, challenge_nonce_size)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// ChallengeKind chooses challenge kind by policy, farmers can't answer samples always get hash challenges,
+// a hash challenge is a BLOCKS_ROOT one when accumulator enabled and farmer supports it
+func (ch *Challenger) ChallengeKind(sampleSupported, rootSupported bool) pb.ChallengeKind {
+	if sampleSupported {
+		switch ch.cfg.Policy {
+		case ChallengePolicySample:
+			return pb.ChallengeKind_BLOCKS_SAMPLE
+		case ChallengePolicyMixed:
+			if mrand.Float64() < ch.cfg.SampleRatio {
+				return pb.ChallengeKind_BLOCKS_SAMPLE
+			}
+		}
+	}
+
+	if rootSupported && ch.acc != nil {
+		return pb.ChallengeKind_BLOCKS_ROOT
+	}
+	return pb.ChallengeKind_BLOCKS_HASH
+}
+
+// NewSamples picks random blocks in range (lowBlockNumber, highBlockNumber], and a random chunk of each
+func (ch *Challenger) NewSamples(highBlockNumber, lowBlockNumber uint64) ([]*pb.BlockSample, error) {
+	if highBlockNumber <= lowBlockNumber || highBlockNumber >= ch.source.GetBlockchainSize() {
+		return nil, ErrOutOfBounds
+	}
+
+	count := ch.cfg.SampleCount
+	if count <= 0 {
+		count = default_sample_count
+	}
+	samples := make([]*pb.BlockSample, 0, count)
+	for i := 0; i < count; i++ {
+		offset, err := randUint64(highBlockNumber - lowBlockNumber)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := ch.blockDigest(lowBlockNumber + 1 + offset)
+		if err != nil {
+			return nil, err
+		}
+		chunkIndex, err := randUint64(uint64(digest.chunks))
+		if err != nil {
+			return nil, err
+		}
+
+		samples = append(samples, &pb.BlockSample{
+			BlockNumber: digest.blockNumber,
+			ChunkIndex:  uint32(chunkIndex),
+		})
+	}
+
+	return samples, nil
+}
+
+// digest of the block, read from accumulator if committed, otherwise computed once and cached
+func (ch *Challenger) blockDigest(blockNumber uint64) (*blockDigest, error) {
+	if ch.Committed(blockNumber) {
+		return ch.acc.digest(blockNumber)
+	}
+	if digest, ok := ch.digests.get(blockNumber); ok {
+		return digest, nil
+	}
+
+	block, err := ch.source.GetBlockByNumber(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, fmt.Errorf("Block %d is nil.", blockNumber)
+	}
+	blockBytes, err := block.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	digest := &blockDigest{
+		blockNumber: blockNumber,
+		root:        BlockChunksRoot(blockBytes),
+		chunks:      chunksCount(len(blockBytes)),
+	}
+	ch.digests.set(digest)
+
+	return digest, nil
+}
+
+// FlushBlocksHashes drops cached blocks hashes, they are hashed again on demand
+func (ch *Challenger) FlushBlocksHashes() {
+	ch.hashCache.Flush()
+}
+
+// FlushBlockDigests drops cached block digests, they are digested again on demand
+func (ch *Challenger) FlushBlockDigests() {
+	ch.digests.clear()
+}
+
+// Close closes both caches, stops syncing accumulator
+func (ch *Challenger) Close() error {
+	if ch.acc != nil {
+		ch.acc.Close()
+	}
+	ch.digests.clear()
+	ch.reqCache.Close()
+	return ch.hashCache.Close()
+}
+
+// Verdict is what supervisor decided on farmer's answer to a challenge, and why
+type Verdict struct {
+	Kind pb.ChallengeKind
+	// farmer's answer and the one supervisor expects, empty for BLOCKS_SAMPLE challenge
+	FarmerHash string
+	ServerHash string
+	OK         bool
+	// why farmer failed, empty if OK
+	Reason string
+}
+
+func failed(v *Verdict, reason string) *Verdict {
+	v.OK = false
+	v.Reason = reason
+	return v
+}
+
+// ConquerChallenge checks farmer's answer to a pending challenge, blocksHash for BLOCKS_HASH and BLOCKS_ROOT challenge, proofs for BLOCKS_SAMPLE one
+func (ch *Challenger) ConquerChallenge(farmerId string, highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo, blocksHash string, proofs []*pb.ChunkProof) bool {
+	return ch.Conquer(farmerId, highBlockNumber, lowBlockNumber, hashAlgo, blocksHash, proofs).OK
+}
+
+// Conquer is ConquerChallenge telling the verdict
+func (ch *Challenger) Conquer(farmerId string, highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo, blocksHash string, proofs []*pb.ChunkProof) *Verdict {
+	verdict := &Verdict{FarmerHash: blocksHash}
+
 	// get challenge request hash, if not found, mean there is no such challenge request, farmer fake it
-	_, get := GetFarmerChallengeReqCache().GetFarmerChallengeReq(farmerId, highBlockNumber, lowBlockNumber, hashAlgo)
+	req, get := ch.reqCache.GetFarmerChallengeReq(farmerId, highBlockNumber, lowBlockNumber, hashAlgo)
 	if !get {
 		logger.Errorf("supervisor/challenge: invalid challenge request. farmerId' %s, highBlockNumber: %d, lowBlockNumber: %d, hashAlgo: %v, blocksHash: %s", farmerId, highBlockNumber, lowBlockNumber, hashAlgo, blocksHash)
-		return false
+		return failed(verdict, "no such challenge request")
 	}
+	verdict.Kind = req.Kind()
 
 	// once get challenge request from the cache, delete it, one request just can be fetch one time
 	// TODO whether or not just move del into get
-	GetFarmerChallengeReqCache().DelFarmerChallengeReq(farmerId, highBlockNumber, lowBlockNumber, hashAlgo)
+	ch.reqCache.DelFarmerChallengeReq(farmerId, highBlockNumber, lowBlockNumber, hashAlgo)
+
+	switch req.Kind() {
+	case pb.ChallengeKind_BLOCKS_SAMPLE:
+		verdict.FarmerHash = ""
+		return ch.conquerSamples(verdict, farmerId, req.Samples(), proofs)
+	case pb.ChallengeKind_BLOCKS_ROOT:
+		return ch.conquerRoot(verdict, farmerId, req, blocksHash)
+	}
 
 	// get blocks hash from blocks hash cache, if not found, just hash it and put it into cache
-	originalHash, get := GetBlocksHashCache().GetFromBlocksHashCache(highBlockNumber, lowBlockNumber, hashAlgo)
+	originalHash, get := ch.hashCache.GetFromBlocksHashCache(highBlockNumber, lowBlockNumber, hashAlgo)
 	if !get {
-		blocksBytes, err := GetBlocksBytes(highBlockNumber, lowBlockNumber)
+		var err error
+		originalHash, err = ch.HashBlocks(hashAlgo, highBlockNumber, lowBlockNumber)
 		if err != nil {
-			logger.Errorf("get blocks[%d, %d] bytes err: %v", highBlockNumber, lowBlockNumber, err)
-			return false
+			logger.Errorf("hash blocks[%d, %d] err: %v", highBlockNumber, lowBlockNumber, err)
+			return failed(verdict, fmt.Sprintf("hash blocks err: %v", err))
 		}
-		originalHash = HASH(hashAlgo, blocksBytes)
-		GetBlocksHashCache().SetBlocksHashToCache(highBlockNumber, lowBlockNumber, hashAlgo, originalHash)
+		ch.hashCache.SetBlocksHashToCache(highBlockNumber, lowBlockNumber, hashAlgo, originalHash)
 	}
 
 	// compare farmer result & sv result
-	serverHash := FarmerBindConquerHash(farmerId, hashAlgo, originalHash)
-	if strings.Compare(blocksHash, serverHash) != 0 {
-		logger.Warningf("farmer[%s] conquer challenge fail, farmer hash: %s, server hash: %s", farmerId, blocksHash, serverHash)
-		return false
+	verdict.ServerHash = FarmerBindConquerHashWithNonce(farmerId, hashAlgo, originalHash, req.Nonce())
+	if strings.Compare(blocksHash, verdict.ServerHash) != 0 {
+		logger.Warningf("farmer[%s] conquer challenge fail, farmer hash: %s, server hash: %s", farmerId, blocksHash, verdict.ServerHash)
+		return failed(verdict, "hash mismatch")
 	}
 	logger.Debugf("farmer[%s] conquer challenge success.", farmerId)
 
-	return true
+	verdict.OK = true
+	return verdict
+}
+
+// range root comes from accumulator, no block is read
+func (ch *Challenger) conquerRoot(verdict *Verdict, farmerId string, req *FarmerChallengeReq, blocksHash string) *Verdict {
+	if ch.acc == nil {
+		logger.Errorf("farmer[%s] conquer root challenge, but accumulator not enabled", farmerId)
+		return failed(verdict, "accumulator not enabled")
+	}
+
+	brange := req.BlocksRange()
+	root, err := ch.acc.RangeRoot(brange.HighBlockNumber, brange.LowBlockNumber)
+	if err != nil {
+		logger.Errorf("root of blocks[%d, %d] err: %v", brange.HighBlockNumber, brange.LowBlockNumber, err)
+		return failed(verdict, fmt.Sprintf("root of blocks err: %v", err))
+	}
+
+	verdict.ServerHash = FarmerBindConquerHashWithNonce(farmerId, req.HashAlgo(), hex.EncodeToString(root), req.Nonce())
+	if strings.Compare(blocksHash, verdict.ServerHash) != 0 {
+		logger.Warningf("farmer[%s] conquer root challenge fail, farmer hash: %s, server hash: %s", farmerId, blocksHash, verdict.ServerHash)
+		return failed(verdict, "hash mismatch")
+	}
+	logger.Debugf("farmer[%s] conquer root challenge success.", farmerId)
+
+	verdict.OK = true
+	return verdict
+}
+
+// every sample must be answered, in order, by a proof leading to the block's chunks root
+func (ch *Challenger) conquerSamples(verdict *Verdict, farmerId string, samples []*pb.BlockSample, proofs []*pb.ChunkProof) *Verdict {
+	if len(samples) != len(proofs) {
+		logger.Warningf("farmer[%s] conquer sample challenge fail, %d samples, %d proofs", farmerId, len(samples), len(proofs))
+		return failed(verdict, fmt.Sprintf("%d samples, %d proofs", len(samples), len(proofs)))
+	}
+
+	for i, sample := range samples {
+		proof := proofs[i]
+		if proof == nil || proof.BlockNumber != sample.BlockNumber || proof.ChunkIndex != sample.ChunkIndex {
+			logger.Warningf("farmer[%s] conquer sample challenge fail, proof %d doesn't answer sample %v", farmerId, i, sample)
+			return failed(verdict, fmt.Sprintf("proof %d doesn't answer its sample", i))
+		}
+
+		digest, err := ch.blockDigest(sample.BlockNumber)
+		if err != nil {
+			logger.Errorf("digest block %d err: %v", sample.BlockNumber, err)
+			return failed(verdict, fmt.Sprintf("digest block %d err: %v", sample.BlockNumber, err))
+		}
+		if !VerifyChunkProof(digest.root, digest.chunks, proof) {
+			logger.Warningf("farmer[%s] conquer sample challenge fail, invalid proof of sample %v", farmerId, sample)
+			return failed(verdict, fmt.Sprintf("invalid proof of block %d chunk %d", sample.BlockNumber, sample.ChunkIndex))
+		}
+	}
+	logger.Debugf("farmer[%s] conquer sample challenge success.", farmerId)
+
+	verdict.OK = true
+	return verdict
 }
 
 // compare hash isn't hash of blocks, is hash of (farmerId string and hash of blocks's string)
 func FarmerBindConquerHash(farmerId string, hashAlgo pb.HashAlgo, originalHash string) string {
-	return HASH(hashAlgo, bytes.NewBufferString(fmt.Sprintf("%s%s", originalHash, farmerId)).Bytes())
+	return FarmerBindConquerHashWithNonce(farmerId, hashAlgo, originalHash, nil)
+}
+
+// with a nonce issued by supervisor, compare hash is hash of (nonce, hash of blocks's string and farmerId string),
+// so that answers can't be precomputed, nil nonce gives the same hash as FarmerBindConquerHash
+func FarmerBindConquerHashWithNonce(farmerId string, hashAlgo pb.HashAlgo, originalHash string, nonce []byte) string {
+	buf := bytes.NewBuffer(nil)
+	buf.Write(nonce)
+	buf.WriteString(fmt.Sprintf("%s%s", originalHash, farmerId))
+	return HASH(hashAlgo, buf.Bytes())
 }
 
-func GetBlocksBytes(highBlockNumber, lowBlockNumber uint64) ([]byte, error) {
-	return []byte(""), nil
+func (ch *Challenger) GetBlocksBytes(highBlockNumber, lowBlockNumber uint64) ([]byte, error) {
+	return getBlocksBytes(ch.source, highBlockNumber, lowBlockNumber)
+}
 
+// concat blocks in range into one buffer
+func getBlocksBytes(src BlockSource, highBlockNumber, lowBlockNumber uint64) ([]byte, error) {
 	blocksBuffer := bytes.NewBufferString("")
-	ldg, err := ledger.GetLedger()
+	err := walkBlocks(src, highBlockNumber, lowBlockNumber, func(blockBytes []byte) error {
+		_, err := blocksBuffer.Write(blockBytes)
+		return err
+	})
+
+	return blocksBuffer.Bytes(), err
+}
+
+// HashBlocks digests blocks in range while walking them, never holds the whole range in memory,
+// returns the same digest as HASH(hashAlgo, GetBlocksBytes(...))
+func (ch *Challenger) HashBlocks(hashAlgo pb.HashAlgo, highBlockNumber, lowBlockNumber uint64) (string, error) {
+	return hashBlocks(ch.source, hashAlgo, highBlockNumber, lowBlockNumber)
+}
+
+func hashBlocks(src BlockSource, hashAlgo pb.HashAlgo, highBlockNumber, lowBlockNumber uint64) (string, error) {
+	h := NewHash(hashAlgo)
+	err := walkBlocks(src, highBlockNumber, lowBlockNumber, func(blockBytes []byte) error {
+		_, err := h.Write(blockBytes)
+		return err
+	})
 	if err != nil {
-		return blocksBuffer.Bytes(), err
+		return "", err
 	}
 
-	if highBlockNumber >= ldg.GetBlockchainSize() {
-		return blocksBuffer.Bytes(), ErrOutOfBounds
+	return HashSum(h), nil
+}
+
+// walk blocks from high to low, verify the hash chain, and hand every block's bytes to fn
+func walkBlocks(src BlockSource, highBlockNumber, lowBlockNumber uint64, fn func(blockBytes []byte) error) error {
+	if highBlockNumber >= src.GetBlockchainSize() {
+		return ErrOutOfBounds
 	}
 	if highBlockNumber < lowBlockNumber {
-		return blocksBuffer.Bytes(), ErrOutOfBounds
+		return ErrOutOfBounds
 	}
 
-	currentBlock, err := ldg.GetBlockByNumber(highBlockNumber)
+	currentBlock, err := src.GetBlockByNumber(highBlockNumber)
 	if err != nil {
-		return blocksBuffer.Bytes(), fmt.Errorf("Error fetching block %d.", highBlockNumber)
+		return fmt.Errorf("Error fetching block %d.", highBlockNumber)
 	}
 	if currentBlock == nil {
-		return blocksBuffer.Bytes(), fmt.Errorf("Block %d is nil.", highBlockNumber)
+		return fmt.Errorf("Block %d is nil.", highBlockNumber)
 	}
 
 	for i := highBlockNumber; i > lowBlockNumber; i-- {
-		previousBlock, err := ldg.GetBlockByNumber(i - 1)
+		previousBlock, err := src.GetBlockByNumber(i - 1)
 		if err != nil {
-			return blocksBuffer.Bytes(), err
+			return err
 		}
 		if previousBlock == nil {
-			return blocksBuffer.Bytes(), fmt.Errorf("Block %d is nil.", i)
+			return fmt.Errorf("Block %d is nil.", i)
 		}
 		previousBlockHash, err := previousBlock.GetHash()
 		if err != nil {
-			return blocksBuffer.Bytes(), err
+			return err
 		}
 		if bytes.Compare(previousBlockHash, currentBlock.PreviousBlockHash) != 0 {
-			return blocksBuffer.Bytes(), fmt.Errorf("Blocks hash can not match.")
+			return fmt.Errorf("Blocks hash can not match.")
 		}
 
 		if currentBlockBytes, err := currentBlock.Bytes(); err != nil {
-			return blocksBuffer.Bytes(), err
-		} else {
-			blocksBuffer.Write(currentBlockBytes)
+			return err
+		} else if err := fn(currentBlockBytes); err != nil {
+			return err
 		}
 		currentBlock = previousBlock
 	}
 
-	return blocksBuffer.Bytes(), nil
+	return nil
 }
@@ -17,30 +17,104 @@ limitations under the License.
 package challenge
 
 import (
+	"container/list"
 	"fmt"
 	"sync"
+	"time"
 
 	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/clock"
 )
 
 // once a farmer required to challenge the blocks hash,
 // supervisor will store the random blocks range into cache,
 // in order to avoid farmer fake requests
 type FarmerChallengeCache interface {
-	SetFarmerChallengeReq(farmerId string, highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo) (*FarmerChallengeReq, bool)
+	// nonce may be nil, for farmers don't support nonce challenges
+	SetFarmerChallengeReq(farmerId string, highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo, nonce []byte) (*FarmerChallengeReq, bool)
+	// add a request built by caller, such as a sample challenge,
+	// false if the same one is pending, or the cache is full
+	AddFarmerChallengeReq(req *FarmerChallengeReq) bool
 	GetFarmerChallengeReq(farmerId string, highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo) (*FarmerChallengeReq, bool)
 	DelFarmerChallengeReq(farmerId string, highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo)
+	Stats() CacheStats
 	Close() error
 }
 
+// CacheStats is a snapshot of a cache's counters
+type CacheStats struct {
+	Size        int
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	// entries refused as the cache is full, only for caches never evicting
+	Refusals uint64
+	// memory taken by entries, only for caches accounting it
+	Bytes int64
+}
+
+// defaultFarmerChallengeReqCache is safe for concurrent use,
+// every request expires after ttl, and when the cache is full of live ones, a new one is refused
 type defaultFarmerChallengeReqCache struct {
-	caches map[string]*FarmerChallengeReq
+	l       *sync.Mutex
+	clock   clock.Clock
+	ttl     time.Duration
+	maxSize int
+	caches  map[string]*list.Element
+	// entries ordered by expire time, front expires first
+	entries *list.List
+	stats   CacheStats
+	closed  chan struct{}
+	once    *sync.Once
+}
+
+type farmerChallengeReqEntry struct {
+	key      string
+	req      *FarmerChallengeReq
+	expireAt time.Time
 }
 
 type FarmerChallengeReq struct {
 	farmerId    string
 	blocksRange *pb.BlocksRange
 	hashAlgo    pb.HashAlgo
+	// issued by supervisor with the challenge, bound into the expected answer
+	nonce []byte
+	kind  pb.ChallengeKind
+	// only for sample challenges
+	samples []*pb.BlockSample
+}
+
+func NewFarmerChallengeReq(farmerId string, highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo, nonce []byte) *FarmerChallengeReq {
+	return &FarmerChallengeReq{
+		farmerId: farmerId,
+		blocksRange: &pb.BlocksRange{
+			HighBlockNumber: highBlockNumber,
+			LowBlockNumber:  lowBlockNumber,
+		},
+		hashAlgo: hashAlgo,
+		nonce:    nonce,
+		kind:     pb.ChallengeKind_BLOCKS_HASH,
+	}
+}
+
+// NewFarmerSampleChallengeReq returns a sample challenge request, samples are drawn from the blocks range,
+// chunks merkle tree is always built with SHA256
+func NewFarmerSampleChallengeReq(farmerId string, highBlockNumber, lowBlockNumber uint64, samples []*pb.BlockSample) *FarmerChallengeReq {
+	req := NewFarmerChallengeReq(farmerId, highBlockNumber, lowBlockNumber, pb.HashAlgo_SHA256, nil)
+	req.kind = pb.ChallengeKind_BLOCKS_SAMPLE
+	req.samples = samples
+
+	return req
+}
+
+// root challenge req, farmer binds the range root with SHA256
+func NewFarmerRootChallengeReq(farmerId string, highBlockNumber, lowBlockNumber uint64, nonce []byte) *FarmerChallengeReq {
+	req := NewFarmerChallengeReq(farmerId, highBlockNumber, lowBlockNumber, pb.HashAlgo_SHA256, nonce)
+	req.kind = pb.ChallengeKind_BLOCKS_ROOT
+
+	return req
 }
 
 func (r *FarmerChallengeReq) FarmerID() string {
@@ -54,7 +128,7 @@ func (r *FarmerChallengeReq) BlocksRange() *pb.BlocksRange {
 
 	return &pb.BlocksRange{
 		HighBlockNumber: 0,
-		LowBlockNumber: 0,
+		LowBlockNumber:  0,
 	}
 }
 
@@ -62,75 +136,187 @@ func (r *FarmerChallengeReq) HashAlgo() pb.HashAlgo {
 	return r.hashAlgo
 }
 
+// nil if the challenge is issued without a nonce
+func (r *FarmerChallengeReq) Nonce() []byte {
+	return r.nonce
+}
+
+func (r *FarmerChallengeReq) Kind() pb.ChallengeKind {
+	return r.kind
+}
+
+func (r *FarmerChallengeReq) Samples() []*pb.BlockSample {
+	return r.samples
+}
+
 func (c *defaultFarmerChallengeReqCache) cachekey(farmerId string, highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo) string {
 	return HASH(pb.HashAlgo_SHA256, []byte(fmt.Sprintf("%s/%v/%v/%s", farmerId, highBlockNumber, lowBlockNumber, hashAlgo.String())))
 }
 
-func (c *defaultFarmerChallengeReqCache) SetFarmerChallengeReq(farmerId string, highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo) (*FarmerChallengeReq, bool) {
-	key := c.cachekey(farmerId, highBlockNumber, lowBlockNumber, hashAlgo)
+func (c *defaultFarmerChallengeReqCache) SetFarmerChallengeReq(farmerId string, highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo, nonce []byte) (*FarmerChallengeReq, bool) {
+	req := NewFarmerChallengeReq(farmerId, highBlockNumber, lowBlockNumber, hashAlgo, nonce)
+	if !c.AddFarmerChallengeReq(req) {
+		return nil, false
+	}
+
+	return req, true
+}
+
+func (c *defaultFarmerChallengeReqCache) AddFarmerChallengeReq(req *FarmerChallengeReq) bool {
+	blocksRange := req.BlocksRange()
+	key := c.cachekey(req.farmerId, blocksRange.HighBlockNumber, blocksRange.LowBlockNumber, req.hashAlgo)
+	now := c.clock.Now()
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if elem, ok := c.caches[key]; ok {
+		if !c.expired(elem, now) {
+			return false
+		}
+		c.remove(elem)
+		c.stats.Expirations++
+	}
 
-	if _, ok := c.caches[key]; !ok {
-		logger.Debugf("challengeReq(%s) set to the cache", key)
-		req := &FarmerChallengeReq{
-			farmerId: farmerId,
-			blocksRange: &pb.BlocksRange{
-				HighBlockNumber: highBlockNumber,
-				LowBlockNumber:  lowBlockNumber,
-			},
-			hashAlgo: hashAlgo,
+	// a live request is never dropped, farmers would be punished for challenges they can't conquer
+	if c.maxSize > 0 && len(c.caches) >= c.maxSize {
+		c.removeExpired(now)
+		if len(c.caches) >= c.maxSize {
+			logger.Debugf("challengeReq(%s) refused, the cache is full", key)
+			c.stats.Refusals++
+			return false
 		}
-		c.caches[key] = req
+	}
 
-		return req, true
+	logger.Debugf("challengeReq(%s) set to the cache", key)
+	entry := &farmerChallengeReqEntry{
+		key: key,
+		req: req,
+	}
+	if c.ttl > 0 {
+		entry.expireAt = now.Add(c.ttl)
 	}
+	c.caches[key] = c.entries.PushBack(entry)
 
-	return nil, false
+	return true
 }
 
 func (c *defaultFarmerChallengeReqCache) GetFarmerChallengeReq(farmerId string, highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo) (*FarmerChallengeReq, bool) {
 	key := c.cachekey(farmerId, highBlockNumber, lowBlockNumber, hashAlgo)
 
-	cache, ok := c.caches[key]
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	elem, ok := c.caches[key]
 	if !ok {
 		logger.Debugf("challengeReq(%s) didn't hit the cache", key)
+		c.stats.Misses++
+		return nil, false
+	}
+
+	if c.expired(elem, c.clock.Now()) {
+		logger.Debugf("challengeReq(%s) expired", key)
+		c.remove(elem)
+		c.stats.Expirations++
+		c.stats.Misses++
 		return nil, false
 	}
 
+	cache := elem.Value.(*farmerChallengeReqEntry).req
 	logger.Debugf("challengeReq(%s) hit the cache: %v", key, cache)
+	c.stats.Hits++
 	return cache, true
 }
 
 func (c *defaultFarmerChallengeReqCache) DelFarmerChallengeReq(farmerId string, highBlockNumber, lowBlockNumber uint64, hashAlgo pb.HashAlgo) {
 	key := c.cachekey(farmerId, highBlockNumber, lowBlockNumber, hashAlgo)
 
-	delete(c.caches, key)
+	c.l.Lock()
+	if elem, ok := c.caches[key]; ok {
+		c.remove(elem)
+	}
+	c.l.Unlock()
+}
+
+func (c *defaultFarmerChallengeReqCache) Stats() CacheStats {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	stats := c.stats
+	stats.Size = len(c.caches)
+	return stats
 }
 
 func (c *defaultFarmerChallengeReqCache) Close() error {
-	c.caches = nil
+	c.once.Do(func() {
+		close(c.closed)
+	})
+
+	c.l.Lock()
+	c.caches = make(map[string]*list.Element)
+	c.entries.Init()
+	c.l.Unlock()
+
 	return nil
 }
 
-func newDefaultFarmerChallengeReqCache() FarmerChallengeCache {
-	return &defaultFarmerChallengeReqCache{
-		caches: make(map[string]*FarmerChallengeReq),
+func (c *defaultFarmerChallengeReqCache) expired(elem *list.Element, now time.Time) bool {
+	expireAt := elem.Value.(*farmerChallengeReqEntry).expireAt
+	return !expireAt.IsZero() && !now.Before(expireAt)
+}
+
+// caller must hold the lock
+func (c *defaultFarmerChallengeReqCache) remove(elem *list.Element) {
+	delete(c.caches, elem.Value.(*farmerChallengeReqEntry).key)
+	c.entries.Remove(elem)
+}
+
+// caller must hold the lock
+func (c *defaultFarmerChallengeReqCache) removeExpired(now time.Time) {
+	for elem := c.entries.Front(); elem != nil && c.expired(elem, now); elem = c.entries.Front() {
+		c.remove(elem)
+		c.stats.Expirations++
 	}
 }
 
-var (
-	farmerChallengeReqCache FarmerChallengeCache
-	challengeOnce           *sync.Once
-)
+// sweep expired requests in background, so that they don't stay until someone touches them
+func (c *defaultFarmerChallengeReqCache) sweep() {
+	ticker := c.clock.NewTicker(c.ttl)
+	defer ticker.Stop()
 
-// now just using the default farmer challenge request cache
-func GetFarmerChallengeReqCache() FarmerChallengeCache {
-	challengeOnce.Do(func() {
-		farmerChallengeReqCache = newDefaultFarmerChallengeReqCache()
-	})
+	for {
+		select {
+		case <-ticker.C():
+			c.l.Lock()
+			c.removeExpired(c.clock.Now())
+			c.l.Unlock()
+		case <-c.closed:
+			return
+		}
+	}
+}
 
-	return farmerChallengeReqCache
+// NewDefaultFarmerChallengeReqCache returns the default cache,
+// ttl <= 0 means requests never expire, maxSize <= 0 means unlimited
+func NewDefaultFarmerChallengeReqCache(ttl time.Duration, maxSize int) FarmerChallengeCache {
+	return NewFarmerChallengeReqCacheWithClock(clock.Real(), ttl, maxSize)
 }
 
-func init() {
-	challengeOnce = &sync.Once{}
+// NewFarmerChallengeReqCacheWithClock returns the default cache, requests expire by clk
+func NewFarmerChallengeReqCacheWithClock(clk clock.Clock, ttl time.Duration, maxSize int) FarmerChallengeCache {
+	c := &defaultFarmerChallengeReqCache{
+		l:       &sync.Mutex{},
+		clock:   clk,
+		ttl:     ttl,
+		maxSize: maxSize,
+		caches:  make(map[string]*list.Element),
+		entries: list.New(),
+		closed:  make(chan struct{}),
+		once:    &sync.Once{},
+	}
+	if ttl > 0 {
+		go c.sweep()
+	}
+
+	return c
 }
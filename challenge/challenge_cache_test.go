@@ -18,70 +18,173 @@ package challenge
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/clock"
 	"github.com/op/go-logging"
 	"gopkg.in/check.v1"
 )
 
 type TestFarmerChallengeCache struct {
+	cache FarmerChallengeCache
 }
 
 var _ = check.Suite(&TestFarmerChallengeCache{})
 
 func (t *TestFarmerChallengeCache) SetUpSuite(c *check.C) {
 	logging.SetLevel(logging.INFO, "supervisor/challenge")
+	t.cache = NewDefaultFarmerChallengeReqCache(time.Second*10, 0)
+}
+
+func (t *TestFarmerChallengeCache) TearDownSuite(c *check.C) {
+	t.cache.Close()
 }
 
 func (t *TestFarmerChallengeCache) TestSetFarmerChallengeReq(c *check.C) {
-	_, set := GetFarmerChallengeReqCache().SetFarmerChallengeReq("farmerId001", 100, 20, pb.HashAlgo_SHA1)
+	_, set := t.cache.SetFarmerChallengeReq("farmerId001", 100, 20, pb.HashAlgo_SHA1, nil)
 	c.Check(set, check.Equals, true)
-	_, set1 := GetFarmerChallengeReqCache().SetFarmerChallengeReq("farmerId001", 100, 20, pb.HashAlgo_SHA1)
+	_, set1 := t.cache.SetFarmerChallengeReq("farmerId001", 100, 20, pb.HashAlgo_SHA1, nil)
 	c.Check(set1, check.Equals, false)
 }
 
 func (t *TestFarmerChallengeCache) TestGetFarmerChallengeReq(c *check.C) {
-	_, set := GetFarmerChallengeReqCache().SetFarmerChallengeReq("farmerId002", 100, 20, pb.HashAlgo_SHA1)
+	_, set := t.cache.SetFarmerChallengeReq("farmerId002", 100, 20, pb.HashAlgo_SHA1, nil)
 	c.Check(set, check.Equals, true)
 
-	req, get := GetFarmerChallengeReqCache().GetFarmerChallengeReq("farmerId002", 100, 20, pb.HashAlgo_SHA1)
+	req, get := t.cache.GetFarmerChallengeReq("farmerId002", 100, 20, pb.HashAlgo_SHA1)
 	c.Check(get, check.Equals, true)
 	c.Check(req.farmerId, check.Equals, "farmerId002")
 }
 
 func (t *TestFarmerChallengeCache) TestDelFarmerChallengeReq(c *check.C) {
-	_, set := GetFarmerChallengeReqCache().SetFarmerChallengeReq("farmerId003", 100, 20, pb.HashAlgo_SHA1)
+	_, set := t.cache.SetFarmerChallengeReq("farmerId003", 100, 20, pb.HashAlgo_SHA1, nil)
 	c.Check(set, check.Equals, true)
 
-	req, get := GetFarmerChallengeReqCache().GetFarmerChallengeReq("farmerId003", 100, 20, pb.HashAlgo_SHA1)
+	req, get := t.cache.GetFarmerChallengeReq("farmerId003", 100, 20, pb.HashAlgo_SHA1)
 	c.Check(get, check.Equals, true)
 	c.Check(req.farmerId, check.Equals, "farmerId003")
 
-	GetFarmerChallengeReqCache().DelFarmerChallengeReq("farmerId003", 100, 20, pb.HashAlgo_SHA1)
+	t.cache.DelFarmerChallengeReq("farmerId003", 100, 20, pb.HashAlgo_SHA1)
 
-	req, get = GetFarmerChallengeReqCache().GetFarmerChallengeReq("farmerId003", 100, 20, pb.HashAlgo_SHA1)
+	req, get = t.cache.GetFarmerChallengeReq("farmerId003", 100, 20, pb.HashAlgo_SHA1)
 	c.Check(get, check.Equals, false)
 	c.Check(req, check.IsNil)
 }
 
+func (t *TestFarmerChallengeCache) TestFarmerChallengeReqExpire(c *check.C) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	cache := NewFarmerChallengeReqCacheWithClock(clk, time.Millisecond*50, 0)
+	defer cache.Close()
+
+	_, set := cache.SetFarmerChallengeReq("farmerId004", 100, 20, pb.HashAlgo_SHA1, nil)
+	c.Check(set, check.Equals, true)
+	clk.Advance(time.Millisecond * 49)
+	_, get := cache.GetFarmerChallengeReq("farmerId004", 100, 20, pb.HashAlgo_SHA1)
+	c.Check(get, check.Equals, true)
+
+	// expires once ttl passed
+	clk.Advance(time.Millisecond)
+	_, get = cache.GetFarmerChallengeReq("farmerId004", 100, 20, pb.HashAlgo_SHA1)
+	c.Check(get, check.Equals, false)
+
+	// expired request can be set again
+	_, set = cache.SetFarmerChallengeReq("farmerId004", 100, 20, pb.HashAlgo_SHA1, nil)
+	c.Check(set, check.Equals, true)
+	c.Check(cache.Stats().Expirations, check.Equals, uint64(1))
+}
+
+func (t *TestFarmerChallengeCache) TestFarmerChallengeReqSweep(c *check.C) {
+	cache := NewDefaultFarmerChallengeReqCache(time.Millisecond*20, 0)
+	defer cache.Close()
+
+	for i := 0; i < 10; i++ {
+		cache.SetFarmerChallengeReq(fmt.Sprintf("farmerId%v", i), 100, 20, pb.HashAlgo_SHA1, nil)
+	}
+	c.Check(cache.Stats().Size, check.Equals, 10)
+
+	time.Sleep(time.Millisecond * 100)
+	stats := cache.Stats()
+	c.Check(stats.Size, check.Equals, 0)
+	c.Check(stats.Expirations, check.Equals, uint64(10))
+}
+
+func (t *TestFarmerChallengeCache) TestFarmerChallengeReqRefused(c *check.C) {
+	clk := clock.NewFake(time.Now())
+	cache := NewFarmerChallengeReqCacheWithClock(clk, time.Minute, 3)
+	defer cache.Close()
+
+	for i := 0; i < 5; i++ {
+		_, set := cache.SetFarmerChallengeReq(fmt.Sprintf("farmerId%v", i), 100, 20, pb.HashAlgo_SHA1, nil)
+		c.Check(set, check.Equals, i < 3)
+	}
+
+	// live requests are kept, the two newest are refused
+	_, get := cache.GetFarmerChallengeReq("farmerId0", 100, 20, pb.HashAlgo_SHA1)
+	c.Check(get, check.Equals, true)
+	_, get = cache.GetFarmerChallengeReq("farmerId4", 100, 20, pb.HashAlgo_SHA1)
+	c.Check(get, check.Equals, false)
+
+	stats := cache.Stats()
+	c.Check(stats.Size, check.Equals, 3)
+	c.Check(stats.Evictions, check.Equals, uint64(0))
+	c.Check(stats.Refusals, check.Equals, uint64(2))
+	c.Check(stats.Hits, check.Equals, uint64(1))
+	c.Check(stats.Misses, check.Equals, uint64(1))
+
+	// expired ones make room
+	clk.Advance(time.Minute)
+	_, set := cache.SetFarmerChallengeReq("farmerId4", 100, 20, pb.HashAlgo_SHA1, nil)
+	c.Check(set, check.Equals, true)
+	c.Check(cache.Stats().Size, check.Equals, 1)
+}
+
+// run with -race
+func (t *TestFarmerChallengeCache) TestFarmerChallengeReqConcurrent(c *check.C) {
+	cache := NewDefaultFarmerChallengeReqCache(time.Millisecond*10, 64)
+	defer cache.Close()
+
+	wg := &sync.WaitGroup{}
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < 500; i++ {
+				farmerId := fmt.Sprintf("farmerId%v", (g*500+i)%100)
+				cache.SetFarmerChallengeReq(farmerId, 100, 20, pb.HashAlgo_SHA1, nil)
+				if req, get := cache.GetFarmerChallengeReq(farmerId, 100, 20, pb.HashAlgo_SHA1); get {
+					c.Check(req.FarmerID(), check.Equals, farmerId)
+				}
+				cache.DelFarmerChallengeReq(farmerId, 100, 20, pb.HashAlgo_SHA1)
+				cache.Stats()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	c.Check(cache.Stats().Size <= 64, check.Equals, true)
+}
+
 func (t *TestFarmerChallengeCache) BenchmarkSetFarmerChallengeReq(c *check.C) {
 	for i := 0; i < c.N; i++ {
-		GetFarmerChallengeReqCache().SetFarmerChallengeReq(fmt.Sprintf("farmerId%v", i), 100, 20, pb.HashAlgo_SHA1)
+		t.cache.SetFarmerChallengeReq(fmt.Sprintf("farmerId%v", i), 100, 20, pb.HashAlgo_SHA1, nil)
 	}
 }
 
 func (t *TestFarmerChallengeCache) BenchmarkGetFarmerChallengeReq(c *check.C) {
 	farmerId := "farmerIdGet"
-	GetFarmerChallengeReqCache().SetFarmerChallengeReq(farmerId, 100, 20, pb.HashAlgo_SHA1)
+	t.cache.SetFarmerChallengeReq(farmerId, 100, 20, pb.HashAlgo_SHA1, nil)
 	for i := 0; i < c.N; i++ {
-		GetFarmerChallengeReqCache().GetFarmerChallengeReq(farmerId, 100, 20, pb.HashAlgo_SHA1)
+		t.cache.GetFarmerChallengeReq(farmerId, 100, 20, pb.HashAlgo_SHA1)
 	}
 }
 
 func (t *TestFarmerChallengeCache) BenchmarkDelFarmerChallengeReq(c *check.C) {
 	farmerId := "farmerIdDel"
-	GetFarmerChallengeReqCache().SetFarmerChallengeReq(farmerId, 100, 20, pb.HashAlgo_SHA1)
+	t.cache.SetFarmerChallengeReq(farmerId, 100, 20, pb.HashAlgo_SHA1, nil)
 	for i := 0; i < c.N; i++ {
-		GetFarmerChallengeReqCache().DelFarmerChallengeReq(farmerId, 100, 20, pb.HashAlgo_SHA1)
+		t.cache.DelFarmerChallengeReq(farmerId, 100, 20, pb.HashAlgo_SHA1)
 	}
 }
@@ -17,8 +17,12 @@ limitations under the License.
 package challenge
 
 import (
+	"bytes"
 	"testing"
+	"time"
 
+	pb "github.com/conseweb/common/protos"
+	fpb "github.com/hyperledger/fabric/protos"
 	"gopkg.in/check.v1"
 )
 
@@ -26,6 +30,175 @@ func Test(t *testing.T) {
 	check.TestingT(t)
 }
 
-type ChallengeTest struct{}
+type ChallengeTest struct {
+	source *syntheticBlockSource
+}
 
 var _ = check.Suite(&ChallengeTest{})
+
+func (t *ChallengeTest) SetUpSuite(c *check.C) {
+	t.source = newSyntheticBlockSource(c, 1000, 64*1024)
+}
+
+// syntheticBlockSource builds blocks on the fly, only keeps their hashes,
+// so a wide range costs no memory on the source side
+type syntheticBlockSource struct {
+	payloadSize int
+	hashes      [][]byte
+}
+
+func newSyntheticBlockSource(c *check.C, size, payloadSize int) *syntheticBlockSource {
+	src := &syntheticBlockSource{
+		payloadSize: payloadSize,
+		hashes:      make([][]byte, size),
+	}
+	for i := 0; i < size; i++ {
+		block, err := src.GetBlockByNumber(uint64(i))
+		c.Assert(err, check.IsNil)
+		src.hashes[i], err = block.GetHash()
+		c.Assert(err, check.IsNil)
+	}
+
+	return src
+}
+
+func (s *syntheticBlockSource) GetBlockchainSize() uint64 {
+	return uint64(len(s.hashes))
+}
+
+func (s *syntheticBlockSource) GetBlockByNumber(blockNumber uint64) (*fpb.Block, error) {
+	if blockNumber >= s.GetBlockchainSize() {
+		return nil, ErrOutOfBounds
+	}
+
+	block := fpb.NewBlock(nil, bytes.Repeat([]byte{byte(blockNumber)}, s.payloadSize))
+	if blockNumber > 0 {
+		block.SetPreviousBlockHash(s.hashes[blockNumber-1])
+	}
+
+	return block, nil
+}
+
+func (t *ChallengeTest) TestHashBlocksSameAsHASH(c *check.C) {
+	blocksBytes, err := getBlocksBytes(t.source, 100, 10)
+	c.Assert(err, check.IsNil)
+
+	for algo := range pb.HashAlgo_name {
+		hashAlgo := pb.HashAlgo(algo)
+		streamed, err := hashBlocks(t.source, hashAlgo, 100, 10)
+		c.Assert(err, check.IsNil)
+		c.Check(streamed, check.Equals, HASH(hashAlgo, blocksBytes), check.Commentf("hash algo %v", hashAlgo))
+	}
+}
+
+func (t *ChallengeTest) TestHashBlocksOutOfBounds(c *check.C) {
+	_, err := hashBlocks(t.source, pb.HashAlgo_SHA256, t.source.GetBlockchainSize(), 0)
+	c.Check(err, check.Equals, ErrOutOfBounds)
+}
+
+func (t *ChallengeTest) newChallenger(nonce bool) *Challenger {
+	cfg := &Config{
+		HashAlgo: pb.HashAlgo_SHA256,
+		Delay:    time.Second * 10,
+		Nonce:    nonce,
+	}
+
+	return NewChallenger(cfg, t.source, NewDefaultFarmerChallengeReqCache(cfg.Delay, 0), NewDefaultBlocksHashCache(0, 0))
+}
+
+func (t *ChallengeTest) TestConquerChallenge(c *check.C) {
+	ch := t.newChallenger(false)
+	defer ch.Close()
+
+	nonce, err := ch.NewNonce()
+	c.Assert(err, check.IsNil)
+	c.Check(nonce, check.IsNil)
+
+	originalHash, err := ch.HashBlocks(pb.HashAlgo_SHA256, 100, 10)
+	c.Assert(err, check.IsNil)
+	_, set := ch.FarmerChallengeReqCache().SetFarmerChallengeReq("TestConquerChallenge", 100, 10, pb.HashAlgo_SHA256, nonce)
+	c.Assert(set, check.Equals, true)
+
+	c.Check(ch.ConquerChallenge("TestConquerChallenge", 100, 10, pb.HashAlgo_SHA256, FarmerBindConquerHash("TestConquerChallenge", pb.HashAlgo_SHA256, originalHash), nil), check.Equals, true)
+	// one request can only be conquered once
+	c.Check(ch.ConquerChallenge("TestConquerChallenge", 100, 10, pb.HashAlgo_SHA256, FarmerBindConquerHash("TestConquerChallenge", pb.HashAlgo_SHA256, originalHash), nil), check.Equals, false)
+}
+
+func (t *ChallengeTest) TestConquerVerdict(c *check.C) {
+	ch := t.newChallenger(false)
+	defer ch.Close()
+
+	originalHash, err := ch.HashBlocks(pb.HashAlgo_SHA256, 100, 10)
+	c.Assert(err, check.IsNil)
+	serverHash := FarmerBindConquerHash("TestConquerVerdict", pb.HashAlgo_SHA256, originalHash)
+
+	_, set := ch.FarmerChallengeReqCache().SetFarmerChallengeReq("TestConquerVerdict", 100, 10, pb.HashAlgo_SHA256, nil)
+	c.Assert(set, check.Equals, true)
+	c.Check(ch.Conquer("TestConquerVerdict", 100, 10, pb.HashAlgo_SHA256, "wrong", nil), check.DeepEquals, &Verdict{
+		Kind:       pb.ChallengeKind_BLOCKS_HASH,
+		FarmerHash: "wrong",
+		ServerHash: serverHash,
+		Reason:     "hash mismatch",
+	})
+
+	_, set = ch.FarmerChallengeReqCache().SetFarmerChallengeReq("TestConquerVerdict", 100, 10, pb.HashAlgo_SHA256, nil)
+	c.Assert(set, check.Equals, true)
+	c.Check(ch.Conquer("TestConquerVerdict", 100, 10, pb.HashAlgo_SHA256, serverHash, nil), check.DeepEquals, &Verdict{
+		Kind:       pb.ChallengeKind_BLOCKS_HASH,
+		FarmerHash: serverHash,
+		ServerHash: serverHash,
+		OK:         true,
+	})
+
+	verdict := ch.Conquer("TestConquerVerdict", 100, 10, pb.HashAlgo_SHA256, serverHash, nil)
+	c.Check(verdict.OK, check.Equals, false)
+	c.Check(verdict.Reason, check.Equals, "no such challenge request")
+}
+
+func (t *ChallengeTest) TestConquerChallengeWithNonce(c *check.C) {
+	ch := t.newChallenger(true)
+	defer ch.Close()
+
+	nonce, err := ch.NewNonce()
+	c.Assert(err, check.IsNil)
+	c.Check(len(nonce), check.Equals, challenge_nonce_size)
+	another, err := ch.NewNonce()
+	c.Assert(err, check.IsNil)
+	c.Check(another, check.Not(check.DeepEquals), nonce)
+
+	originalHash, err := ch.HashBlocks(pb.HashAlgo_SHA256, 100, 10)
+	c.Assert(err, check.IsNil)
+
+	// a precomputed answer without the nonce fails
+	_, set := ch.FarmerChallengeReqCache().SetFarmerChallengeReq("TestConquerChallengeWithNonce", 100, 10, pb.HashAlgo_SHA256, nonce)
+	c.Assert(set, check.Equals, true)
+	c.Check(ch.ConquerChallenge("TestConquerChallengeWithNonce", 100, 10, pb.HashAlgo_SHA256, FarmerBindConquerHash("TestConquerChallengeWithNonce", pb.HashAlgo_SHA256, originalHash), nil), check.Equals, false)
+
+	_, set = ch.FarmerChallengeReqCache().SetFarmerChallengeReq("TestConquerChallengeWithNonce", 100, 10, pb.HashAlgo_SHA256, nonce)
+	c.Assert(set, check.Equals, true)
+	c.Check(ch.ConquerChallenge("TestConquerChallengeWithNonce", 100, 10, pb.HashAlgo_SHA256, FarmerBindConquerHashWithNonce("TestConquerChallengeWithNonce", pb.HashAlgo_SHA256, originalHash, nonce), nil), check.Equals, true)
+}
+
+func (t *ChallengeTest) TestFarmerBindConquerHashWithoutNonce(c *check.C) {
+	c.Check(FarmerBindConquerHashWithNonce("farmer", pb.HashAlgo_SHA256, "hash", nil), check.Equals, HASH(pb.HashAlgo_SHA256, []byte("hashfarmer")))
+	c.Check(FarmerBindConquerHashWithNonce("farmer", pb.HashAlgo_SHA256, "hash", []byte("nonce")), check.Equals, HASH(pb.HashAlgo_SHA256, []byte("noncehashfarmer")))
+}
+
+// run with -check.bmem, B/op of buffered hashing grows with the range, streamed stays flat
+func (t *ChallengeTest) BenchmarkBufferedHashBlocks(c *check.C) {
+	for i := 0; i < c.N; i++ {
+		blocksBytes, err := getBlocksBytes(t.source, t.source.GetBlockchainSize()-1, 0)
+		if err != nil {
+			c.Fatal(err)
+		}
+		HASH(pb.HashAlgo_SHA256, blocksBytes)
+	}
+}
+
+func (t *ChallengeTest) BenchmarkStreamedHashBlocks(c *check.C) {
+	for i := 0; i < c.N; i++ {
+		if _, err := hashBlocks(t.source, pb.HashAlgo_SHA256, t.source.GetBlockchainSize()-1, 0); err != nil {
+			c.Fatal(err)
+		}
+	}
+}
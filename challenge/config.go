@@ -0,0 +1,202 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package challenge
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/clock"
+	"github.com/spf13/viper"
+)
+
+const (
+	// always challenge with hash of the whole blocks range
+	ChallengePolicyHash = "hash"
+	// always challenge with block samples, to farmers supporting them
+	ChallengePolicySample = "sample"
+	// challenge with block samples at SampleRatio, with hash otherwise
+	ChallengePolicyMixed = "mixed"
+
+	default_sample_count         = 8
+	default_accumulator_interval = time.Duration(10) * time.Second
+)
+
+// Config of challenges, farmer.challenge section of supervisor.yaml
+type Config struct {
+	// hash algorithm challenges are issued with
+	HashAlgo pb.HashAlgo
+	// max delay farmer can stand for conquer challenge after ping, a challenge request expires after it
+	Delay time.Duration
+	// max count of pending challenge requests
+	CacheMaxSize int
+	// issue a random nonce with each challenge, to farmers declaring support of it
+	Nonce bool
+
+	// which kind of challenge is issued, hash, sample or mixed
+	Policy string
+	// chance of a sample challenge under mixed policy, in [0, 1]
+	SampleRatio float64
+	// how many blocks sampled by a sample challenge
+	SampleCount int
+	// max count of block digests kept for checking samples
+	DigestCacheSize int
+
+	// keep a merkle accumulator of blocks in the account store, for BLOCKS_ROOT challenges
+	Accumulator bool
+	// how often accumulator catches up with the block source
+	AccumulatorInterval time.Duration
+
+	HashCacheMaxEntries int
+	HashCacheMaxBytes   int64
+	WarmUp              bool
+	WarmUpInterval      time.Duration
+	WarmUpWidths        []uint64
+	// chance of challenging a range warmed up, if one fits blocks farmer declared, in [0, 1]
+	WarmUpRatio float64
+
+	// block source, ledger or file
+	BlockSource          string
+	LedgerFileSystemPath string
+	BlocksDir            string
+
+	// challenge requests expire by it, nil is the system clock
+	Clock clock.Clock
+}
+
+// ConfigFromViper reads farmer.challenge section, missing values fall back to defaults
+func ConfigFromViper() *Config {
+	return &Config{
+		HashAlgo:             getChallengeHashAlgo(),
+		Delay:                getChallengeDelay(),
+		CacheMaxSize:         viper.GetInt("farmer.challenge.cache.maxsize"),
+		Nonce:                viper.GetBool("farmer.challenge.nonce.enabled"),
+		Policy:               viper.GetString("farmer.challenge.policy"),
+		SampleRatio:          viper.GetFloat64("farmer.challenge.sample.ratio"),
+		SampleCount:          getSampleCount(),
+		DigestCacheSize:      viper.GetInt("farmer.challenge.sample.digestcache"),
+		Accumulator:          viper.GetBool("farmer.challenge.accumulator.enabled"),
+		AccumulatorInterval:  getAccumulatorInterval(),
+		HashCacheMaxEntries:  viper.GetInt("farmer.challenge.hashcache.maxentries"),
+		HashCacheMaxBytes:    int64(viper.GetSizeInBytes("farmer.challenge.hashcache.maxbytes")),
+		WarmUp:               viper.GetBool("farmer.challenge.hashcache.warmup.enabled"),
+		WarmUpInterval:       getWarmUpInterval(),
+		WarmUpWidths:         getWarmUpWidths(),
+		WarmUpRatio:          viper.GetFloat64("farmer.challenge.hashcache.warmup.ratio"),
+		BlockSource:          viper.GetString("farmer.challenge.blocksource"),
+		LedgerFileSystemPath: viper.GetString("farmer.challenge.ledger.fileSystemPath"),
+		BlocksDir:            viper.GetString("farmer.challenge.file.dir"),
+	}
+}
+
+// Check reports the first value of cfg supervisor can't work with, without opening the block source
+func (cfg *Config) Check() error {
+	switch cfg.Policy {
+	case "", ChallengePolicyHash, ChallengePolicySample, ChallengePolicyMixed:
+	default:
+		return fmt.Errorf("supervisor/challenge: unknown challenge policy %q", cfg.Policy)
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return fmt.Errorf("supervisor/challenge: sample ratio %v not in [0, 1]", cfg.SampleRatio)
+	}
+	if cfg.WarmUpRatio < 0 || cfg.WarmUpRatio > 1 {
+		return fmt.Errorf("supervisor/challenge: warm up ratio %v not in [0, 1]", cfg.WarmUpRatio)
+	}
+
+	switch cfg.BlockSource {
+	case "", BlockSourceLedger:
+	case BlockSourceFile:
+		if cfg.BlocksDir == "" {
+			return fmt.Errorf("supervisor/challenge: file block source needs a blocks dir")
+		}
+	default:
+		return fmt.Errorf("supervisor/challenge: not supported block source: %v", cfg.BlockSource)
+	}
+
+	return nil
+}
+
+// NewBlockSource returns the block source described by cfg
+func (cfg *Config) NewBlockSource() (BlockSource, error) {
+	switch cfg.BlockSource {
+	case BlockSourceFile:
+		return NewBlockSource(cfg.BlockSource, cfg.BlocksDir)
+	default:
+		return NewBlockSource(cfg.BlockSource, cfg.LedgerFileSystemPath)
+	}
+}
+
+func getChallengeHashAlgo() pb.HashAlgo {
+	hashAlgo := viper.GetString("farmer.challenge.hashalgo")
+	if hashAlgo == "" {
+		hashAlgo = pb.HashAlgo_SHA256.String()
+	}
+	return pb.HashAlgo(pb.HashAlgo_value[hashAlgo])
+}
+
+func getChallengeDelay() time.Duration {
+	if delay, err := time.ParseDuration(viper.GetString("farmer.challenge.delay")); err == nil {
+		return delay
+	}
+
+	viper.Set("farmer.challenge.delay", "10s")
+	return time.Duration(10) * time.Second
+}
+
+func getSampleCount() int {
+	count := viper.GetInt("farmer.challenge.sample.count")
+	if count <= 0 {
+		viper.Set("farmer.challenge.sample.count", default_sample_count)
+		count = default_sample_count
+	}
+
+	return count
+}
+
+func getAccumulatorInterval() time.Duration {
+	if interval, err := time.ParseDuration(viper.GetString("farmer.challenge.accumulator.interval")); err == nil && interval > 0 {
+		return interval
+	}
+
+	viper.Set("farmer.challenge.accumulator.interval", "10s")
+	return default_accumulator_interval
+}
+
+func getWarmUpInterval() time.Duration {
+	if interval, err := time.ParseDuration(viper.GetString("farmer.challenge.hashcache.warmup.interval")); err == nil && interval > 0 {
+		return interval
+	}
+
+	viper.Set("farmer.challenge.hashcache.warmup.interval", "60s")
+	return time.Duration(60) * time.Second
+}
+
+func getWarmUpWidths() []uint64 {
+	widths := []uint64{}
+	for _, w := range viper.GetStringSlice("farmer.challenge.hashcache.warmup.widths") {
+		width, err := strconv.ParseUint(w, 10, 64)
+		if err != nil {
+			logger.Warningf("invalid warm up width: %v", w)
+			continue
+		}
+		widths = append(widths, width)
+	}
+
+	return widths
+}
@@ -28,6 +28,14 @@ import (
 )
 
 func HASH(hashAlgo pb.HashAlgo, p []byte) string {
+	h := NewHash(hashAlgo)
+	h.Write(p)
+
+	return HashSum(h)
+}
+
+// NewHash returns a hash.Hash of hashAlgo, unknown algo falls back to SHA256
+func NewHash(hashAlgo pb.HashAlgo) hash.Hash {
 	var h hash.Hash
 
 	switch hashAlgo {
@@ -55,7 +63,10 @@ func HASH(hashAlgo pb.HashAlgo, p []byte) string {
 		h = sha256.New()
 	}
 
-	h.Write(p)
+	return h
+}
 
+// HashSum returns the hex digest string of h, the same format HASH returns
+func HashSum(h hash.Hash) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
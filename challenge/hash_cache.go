@@ -17,8 +17,10 @@ limitations under the License.
 package challenge
 
 import (
+	"container/list"
 	"fmt"
 	"sync"
+	"time"
 
 	pb "github.com/conseweb/common/protos"
 )
@@ -26,54 +28,119 @@ import (
 type BlocksHashCache interface {
 	GetFromBlocksHashCache(highBlockNumber, lowBlockBumber uint64, hashAlgo pb.HashAlgo) (string, bool)
 	SetBlocksHashToCache(highBlockNumber, lowBlockBumber uint64, hashAlgo pb.HashAlgo, hash string) bool
+	// drop all hashes, counters are kept
+	Flush()
+	Stats() CacheStats
 	Close() error
 }
 
+// defaultBlocksHashCache is a lru cache safe for concurrent use,
+// bounded by entry count and by bytes the entries take, whichever reached first
 type defaultBlocksHashCache struct {
-	caches map[string]*blocksHashItem
+	l          *sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	caches     map[string]*list.Element
+	// front is the most recently used
+	lru   *list.List
+	stats CacheStats
+	// chain tip ranges were warmed up to last, only if warmed is true
+	warmTip uint64
+	warmed  bool
+	closed  chan struct{}
+	once    *sync.Once
 }
 
 type blocksHashItem struct {
+	key         string
 	blocksRange *pb.BlocksRange
 	hashAlgo    pb.HashAlgo
 	hash        string
 }
 
+// rough memory an item takes, key and hash strings, plus the item, range and list element
+func (item *blocksHashItem) size() int64 {
+	return int64(len(item.key) + len(item.hash) + 128)
+}
+
 func (c *defaultBlocksHashCache) GetFromBlocksHashCache(highBlockNumber, lowBlockBumber uint64, hashAlgo pb.HashAlgo) (string, bool) {
 	key := c.blocksHashCacheKey(highBlockNumber, lowBlockBumber, hashAlgo)
 
-	cache, ok := c.caches[key]
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	elem, ok := c.caches[key]
 	if !ok {
 		logger.Debugf("blockshash(%s) didn't hit the cache", key)
+		c.stats.Misses++
 		return "", false
 	}
 
+	c.lru.MoveToFront(elem)
+	cache := elem.Value.(*blocksHashItem)
 	logger.Debugf("blockshash(%s) hit the cache: %v", key, cache)
+	c.stats.Hits++
 	return cache.hash, true
 }
 
 func (c *defaultBlocksHashCache) SetBlocksHashToCache(highBlockNumber, lowBlockBumber uint64, hashAlgo pb.HashAlgo, hash string) bool {
 	key := c.blocksHashCacheKey(highBlockNumber, lowBlockBumber, hashAlgo)
 
-	if _, ok := c.caches[key]; !ok {
-		logger.Debugf("blockshash(%s) set to the cache", key)
-		c.caches[key] = &blocksHashItem{
-			blocksRange: &pb.BlocksRange{
-				HighBlockNumber: highBlockNumber,
-				LowBlockNumber:  lowBlockBumber,
-			},
-			hashAlgo: hashAlgo,
-			hash:     hash,
-		}
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if _, ok := c.caches[key]; ok {
+		return false
+	}
 
-		return true
+	logger.Debugf("blockshash(%s) set to the cache", key)
+	item := &blocksHashItem{
+		key: key,
+		blocksRange: &pb.BlocksRange{
+			HighBlockNumber: highBlockNumber,
+			LowBlockNumber:  lowBlockBumber,
+		},
+		hashAlgo: hashAlgo,
+		hash:     hash,
+	}
+	c.caches[key] = c.lru.PushFront(item)
+	c.bytes += item.size()
+
+	for c.full() {
+		oldest := c.lru.Back()
+		logger.Debugf("blockshash(%s) evicted from the cache", oldest.Value.(*blocksHashItem).key)
+		c.remove(oldest)
+		c.stats.Evictions++
 	}
 
-	return false
+	return true
+}
+
+func (c *defaultBlocksHashCache) Stats() CacheStats {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	stats := c.stats
+	stats.Size = len(c.caches)
+	stats.Bytes = c.bytes
+	return stats
+}
+
+func (c *defaultBlocksHashCache) Flush() {
+	c.l.Lock()
+	c.caches = make(map[string]*list.Element)
+	c.lru.Init()
+	c.bytes = 0
+	c.l.Unlock()
 }
 
 func (c *defaultBlocksHashCache) Close() error {
-	c.caches = nil
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	c.Flush()
+
 	return nil
 }
 
@@ -81,25 +148,99 @@ func (c *defaultBlocksHashCache) blocksHashCacheKey(highBlockNumber, lowBlockBum
 	return HASH(pb.HashAlgo_SHA256, []byte(fmt.Sprintf("%v/%v/%s", highBlockNumber, lowBlockBumber, hashAlgo.String())))
 }
 
-var (
-	blocksHashCache BlocksHashCache
-	hashonce        *sync.Once
-)
+// caller must hold the lock, the newest one always stays
+func (c *defaultBlocksHashCache) full() bool {
+	if c.lru.Len() <= 1 {
+		return false
+	}
 
-func newDefaultBlocksHashCache() BlocksHashCache {
-	return &defaultBlocksHashCache{
-		caches: make(map[string]*blocksHashItem),
+	return (c.maxEntries > 0 && c.lru.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)
+}
+
+// caller must hold the lock
+func (c *defaultBlocksHashCache) remove(elem *list.Element) {
+	item := elem.Value.(*blocksHashItem)
+	delete(c.caches, item.key)
+	c.lru.Remove(elem)
+	c.bytes -= item.size()
+}
+
+// caller must hold the lock, unlike GetFromBlocksHashCache, doesn't touch lru order or counters
+func (c *defaultBlocksHashCache) contains(highBlockNumber, lowBlockBumber uint64, hashAlgo pb.HashAlgo) bool {
+	_, ok := c.caches[c.blocksHashCacheKey(highBlockNumber, lowBlockBumber, hashAlgo)]
+	return ok
+}
+
+// warmUp precomputes hashes of ranges ending at the chain tip, one range per width,
+// every time the tip moves, until the cache closed
+func (c *defaultBlocksHashCache) warmUp(src BlockSource, hashAlgo pb.HashAlgo, interval time.Duration, widths []uint64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastSize := uint64(0)
+	for {
+		if size := src.GetBlockchainSize(); size > 0 && size != lastSize {
+			lastSize = size
+			c.warmUpTip(src, hashAlgo, size-1, widths)
+
+			c.l.Lock()
+			c.warmTip, c.warmed = size-1, true
+			c.l.Unlock()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return
+		}
 	}
 }
 
-func GetBlocksHashCache() BlocksHashCache {
-	hashonce.Do(func() {
-		blocksHashCache = newDefaultBlocksHashCache()
-	})
+func (c *defaultBlocksHashCache) warmUpTip(src BlockSource, hashAlgo pb.HashAlgo, tip uint64, widths []uint64) {
+	for _, width := range widths {
+		if width > tip {
+			width = tip
+		}
+		lowBlockNumber := tip - width
+
+		c.l.Lock()
+		cached := c.contains(tip, lowBlockNumber, hashAlgo)
+		c.l.Unlock()
+		if cached {
+			continue
+		}
 
-	return blocksHashCache
+		hash, err := hashBlocks(src, hashAlgo, tip, lowBlockNumber)
+		if err != nil {
+			logger.Warningf("warm up blockshash[%d, %d] err: %v", tip, lowBlockNumber, err)
+			continue
+		}
+		c.SetBlocksHashToCache(tip, lowBlockNumber, hashAlgo, hash)
+	}
+}
+
+// chain tip ranges were warmed up to last, false if not warmed up yet
+func (c *defaultBlocksHashCache) warmedTip() (uint64, bool) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	return c.warmTip, c.warmed
 }
 
-func init() {
-	hashonce = &sync.Once{}
+// NewDefaultBlocksHashCache returns the default lru cache,
+// maxEntries or maxBytes <= 0 means no limit on it
+func NewDefaultBlocksHashCache(maxEntries int, maxBytes int64) BlocksHashCache {
+	return newDefaultBlocksHashCache(maxEntries, maxBytes)
+}
+
+func newDefaultBlocksHashCache(maxEntries int, maxBytes int64) *defaultBlocksHashCache {
+	return &defaultBlocksHashCache{
+		l:          &sync.Mutex{},
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		caches:     make(map[string]*list.Element),
+		lru:        list.New(),
+		closed:     make(chan struct{}),
+		once:       &sync.Once{},
+	}
 }
@@ -17,6 +17,10 @@ limitations under the License.
 package challenge
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	pb "github.com/conseweb/common/protos"
 	"gopkg.in/check.v1"
 )
@@ -27,15 +31,23 @@ type BlocksHashCacheTest struct {
 
 var _ = check.Suite(&BlocksHashCacheTest{})
 
+func (t *BlocksHashCacheTest) SetUpSuite(c *check.C) {
+	t.cache = newDefaultBlocksHashCache(0, 0)
+}
+
+func (t *BlocksHashCacheTest) TearDownSuite(c *check.C) {
+	t.cache.Close()
+}
+
 func (t *BlocksHashCacheTest) TestDefaultBlocksHashCacheSet(c *check.C) {
-	cache := GetBlocksHashCache()
+	cache := t.cache
 
 	c.Check(cache.SetBlocksHashToCache(100, 21, pb.HashAlgo_SHA1, "pretend as hash"), check.Equals, true)
 	c.Check(cache.SetBlocksHashToCache(100, 21, pb.HashAlgo_SHA1, "pretend as hash"), check.Equals, false)
 }
 
 func (t *BlocksHashCacheTest) TestDefaultBlocksHashCacheGet(c *check.C) {
-	cache := GetBlocksHashCache()
+	cache := t.cache
 	cache.SetBlocksHashToCache(100, 20, pb.HashAlgo_SHA1, "pretend as hash")
 
 	hash, getted := cache.GetFromBlocksHashCache(100, 20, pb.HashAlgo_SHA1)
@@ -43,15 +55,146 @@ func (t *BlocksHashCacheTest) TestDefaultBlocksHashCacheGet(c *check.C) {
 	c.Check(hash, check.Equals, "pretend as hash")
 }
 
+func (t *BlocksHashCacheTest) TestDefaultBlocksHashCacheEvictByEntries(c *check.C) {
+	cache := newDefaultBlocksHashCache(3, 0)
+
+	for i := uint64(0); i < 3; i++ {
+		c.Check(cache.SetBlocksHashToCache(100+i, 20, pb.HashAlgo_SHA1, "pretend as hash"), check.Equals, true)
+	}
+	// touch the oldest, so the second one becomes least recently used
+	_, getted := cache.GetFromBlocksHashCache(100, 20, pb.HashAlgo_SHA1)
+	c.Check(getted, check.Equals, true)
+
+	c.Check(cache.SetBlocksHashToCache(103, 20, pb.HashAlgo_SHA1, "pretend as hash"), check.Equals, true)
+	_, getted = cache.GetFromBlocksHashCache(101, 20, pb.HashAlgo_SHA1)
+	c.Check(getted, check.Equals, false)
+	_, getted = cache.GetFromBlocksHashCache(100, 20, pb.HashAlgo_SHA1)
+	c.Check(getted, check.Equals, true)
+
+	stats := cache.Stats()
+	c.Check(stats.Size, check.Equals, 3)
+	c.Check(stats.Hits, check.Equals, uint64(2))
+	c.Check(stats.Misses, check.Equals, uint64(1))
+	c.Check(stats.Evictions, check.Equals, uint64(1))
+}
+
+func (t *BlocksHashCacheTest) TestDefaultBlocksHashCacheEvictByBytes(c *check.C) {
+	item := &blocksHashItem{
+		key:  newDefaultBlocksHashCache(0, 0).blocksHashCacheKey(100, 20, pb.HashAlgo_SHA1),
+		hash: "pretend as hash",
+	}
+	cache := newDefaultBlocksHashCache(0, item.size()*4)
+
+	for i := uint64(0); i < 10; i++ {
+		cache.SetBlocksHashToCache(100+i, 20, pb.HashAlgo_SHA1, "pretend as hash")
+	}
+
+	stats := cache.Stats()
+	c.Check(stats.Size, check.Equals, 4)
+	c.Check(stats.Bytes, check.Equals, item.size()*4)
+	c.Check(stats.Evictions, check.Equals, uint64(6))
+
+	_, getted := cache.GetFromBlocksHashCache(109, 20, pb.HashAlgo_SHA1)
+	c.Check(getted, check.Equals, true)
+	cache.Flush()
+	c.Check(cache.Stats().Size, check.Equals, 0)
+	c.Check(cache.Stats().Evictions, check.Equals, uint64(6))
+	_, getted = cache.GetFromBlocksHashCache(109, 20, pb.HashAlgo_SHA1)
+	c.Check(getted, check.Equals, false)
+
+	cache.Close()
+	c.Check(cache.Stats().Bytes, check.Equals, int64(0))
+}
+
+func (t *BlocksHashCacheTest) TestDefaultBlocksHashCacheWarmUp(c *check.C) {
+	src := newSyntheticBlockSource(c, 50, 16)
+	cache := newDefaultBlocksHashCache(0, 0)
+	go cache.warmUp(src, pb.HashAlgo_SHA256, time.Millisecond*10, []uint64{10, 100})
+	defer cache.Close()
+
+	time.Sleep(time.Millisecond * 100)
+
+	expected, err := hashBlocks(src, pb.HashAlgo_SHA256, 49, 39)
+	c.Assert(err, check.IsNil)
+	hash, getted := cache.GetFromBlocksHashCache(49, 39, pb.HashAlgo_SHA256)
+	c.Check(getted, check.Equals, true)
+	c.Check(hash, check.Equals, expected)
+
+	// width beyond the chain is cut to the whole chain
+	_, getted = cache.GetFromBlocksHashCache(49, 0, pb.HashAlgo_SHA256)
+	c.Check(getted, check.Equals, true)
+}
+
+// challenges picked from ranges warmed up hit the cache
+func (t *BlocksHashCacheTest) TestWarmedRange(c *check.C) {
+	cfg := &Config{
+		HashAlgo:       pb.HashAlgo_SHA256,
+		Delay:          time.Second * 10,
+		WarmUp:         true,
+		WarmUpInterval: time.Millisecond * 10,
+		WarmUpWidths:   []uint64{10, 30},
+		WarmUpRatio:    1,
+	}
+	ch, err := NewChallengerFromConfig(cfg, newSyntheticBlockSource(c, 50, 16))
+	c.Assert(err, check.IsNil)
+	defer ch.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	for i := 0; i < 20; i++ {
+		brange, ok := ch.WarmedRange(60, 15)
+		c.Assert(ok, check.Equals, true)
+		c.Check(brange.HighBlockNumber, check.Equals, uint64(49))
+		// both [39, 49] and [19, 49] fit within [15, 60]
+		c.Check(brange.LowBlockNumber == 39 || brange.LowBlockNumber == 19, check.Equals, true)
+		_, getted := ch.BlocksHashCache().GetFromBlocksHashCache(brange.HighBlockNumber, brange.LowBlockNumber, pb.HashAlgo_SHA256)
+		c.Check(getted, check.Equals, true)
+	}
+
+	// farmer lacking the tip, or the low blocks of every range, is challenged on a random range
+	_, ok := ch.WarmedRange(48, 0)
+	c.Check(ok, check.Equals, false)
+	_, ok = ch.WarmedRange(49, 40)
+	c.Check(ok, check.Equals, false)
+
+	cfg.WarmUpRatio = 0
+	_, ok = ch.WarmedRange(60, 15)
+	c.Check(ok, check.Equals, false)
+}
+
+// run with -race
+func (t *BlocksHashCacheTest) TestDefaultBlocksHashCacheConcurrent(c *check.C) {
+	cache := newDefaultBlocksHashCache(64, 0)
+
+	wg := &sync.WaitGroup{}
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < 500; i++ {
+				high := uint64((g*500 + i) % 100)
+				cache.SetBlocksHashToCache(high, 0, pb.HashAlgo_SHA1, fmt.Sprintf("hash%v", high))
+				if hash, getted := cache.GetFromBlocksHashCache(high, 0, pb.HashAlgo_SHA1); getted {
+					c.Check(hash, check.Equals, fmt.Sprintf("hash%v", high))
+				}
+				cache.Stats()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	c.Check(cache.Stats().Size, check.Equals, 64)
+}
+
 func (t *BlocksHashCacheTest) BenchmarkDefaultBlocksHashCacheSet(c *check.C) {
-	cache := GetBlocksHashCache()
+	cache := t.cache
 	for i := 0; i < c.N; i++ {
 		cache.SetBlocksHashToCache(100+uint64(i), 20, pb.HashAlgo_SHA1, "pretend as hash")
 	}
 }
 
 func (t *BlocksHashCacheTest) BenchmarkDefaultBlocksHashCacheGet(c *check.C) {
-	cache := GetBlocksHashCache()
+	cache := t.cache
 	for i := 0; i < c.N; i++ {
 		cache.GetFromBlocksHashCache(100+uint64(i), 20, pb.HashAlgo_SHA1)
 	}
@@ -0,0 +1,229 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package challenge
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"math/big"
+	"sync"
+
+	pb "github.com/conseweb/common/protos"
+)
+
+const (
+	// blocks are cut into chunks of ChunkSize for sample challenges, the last chunk may be shorter
+	ChunkSize = 1024
+
+	leaf_prefix = byte(0)
+	node_prefix = byte(1)
+)
+
+// chunks count of a block, an empty block still has one empty chunk
+func chunksCount(blockSize int) uint32 {
+	if blockSize == 0 {
+		return 1
+	}
+	return uint32((blockSize + ChunkSize - 1) / ChunkSize)
+}
+
+func chunkAt(blockBytes []byte, chunkIndex uint32) []byte {
+	begin := int(chunkIndex) * ChunkSize
+	end := begin + ChunkSize
+	if end > len(blockBytes) {
+		end = len(blockBytes)
+	}
+
+	return blockBytes[begin:end]
+}
+
+func leafHash(chunk []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leaf_prefix})
+	h.Write(chunk)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{node_prefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkle tree levels over block's chunks, levels[0] are leaves, the last level is the root,
+// a node without sibling is promoted to upper level as it is
+func chunksTree(blockBytes []byte) [][][]byte {
+	count := chunksCount(len(blockBytes))
+	level := make([][]byte, count)
+	for i := uint32(0); i < count; i++ {
+		level[i] = leafHash(chunkAt(blockBytes, i))
+	}
+
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		upper := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				upper = append(upper, nodeHash(level[i], level[i+1]))
+			} else {
+				upper = append(upper, level[i])
+			}
+		}
+		levels = append(levels, upper)
+		level = upper
+	}
+
+	return levels
+}
+
+// BlockChunksRoot returns merkle root of block's chunks
+func BlockChunksRoot(blockBytes []byte) []byte {
+	levels := chunksTree(blockBytes)
+	return levels[len(levels)-1][0]
+}
+
+// BuildChunkProof is what a farmer answers a block sample with, the chunk and its merkle path
+func BuildChunkProof(blockNumber uint64, blockBytes []byte, chunkIndex uint32) (*pb.ChunkProof, error) {
+	if chunkIndex >= chunksCount(len(blockBytes)) {
+		return nil, ErrOutOfBounds
+	}
+
+	proof := &pb.ChunkProof{
+		BlockNumber: blockNumber,
+		ChunkIndex:  chunkIndex,
+		Chunk:       chunkAt(blockBytes, chunkIndex),
+		Path:        [][]byte{},
+	}
+	idx := int(chunkIndex)
+	for _, level := range chunksTree(blockBytes) {
+		if len(level) == 1 {
+			break
+		}
+		if idx%2 == 1 {
+			proof.Path = append(proof.Path, level[idx-1])
+		} else if idx+1 < len(level) {
+			proof.Path = append(proof.Path, level[idx+1])
+		}
+		idx /= 2
+	}
+
+	return proof, nil
+}
+
+// VerifyChunkProof checks the chunk and its merkle path lead to the root of a block having chunks chunks
+func VerifyChunkProof(root []byte, chunks uint32, proof *pb.ChunkProof) bool {
+	if proof == nil || proof.ChunkIndex >= chunks || len(proof.Chunk) > ChunkSize {
+		return false
+	}
+
+	h := leafHash(proof.Chunk)
+	path := proof.Path
+	idx, width := proof.ChunkIndex, chunks
+	for width > 1 {
+		if idx%2 == 1 || idx+1 < width {
+			if len(path) == 0 {
+				return false
+			}
+			if idx%2 == 1 {
+				h = nodeHash(path[0], h)
+			} else {
+				h = nodeHash(h, path[0])
+			}
+			path = path[1:]
+		}
+		idx /= 2
+		width = (width + 1) / 2
+	}
+
+	return len(path) == 0 && bytes.Equal(h, root)
+}
+
+// blockDigest is all supervisor keeps of a block to check samples of it
+type blockDigest struct {
+	blockNumber uint64
+	root        []byte
+	chunks      uint32
+}
+
+// blockDigestCache is a lru cache of block digests, safe for concurrent use
+type blockDigestCache struct {
+	l          *sync.Mutex
+	maxEntries int
+	digests    map[uint64]*list.Element
+	// front is the most recently used
+	lru *list.List
+}
+
+// maxEntries <= 0 means unlimited
+func newBlockDigestCache(maxEntries int) *blockDigestCache {
+	return &blockDigestCache{
+		l:          &sync.Mutex{},
+		maxEntries: maxEntries,
+		digests:    make(map[uint64]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (c *blockDigestCache) get(blockNumber uint64) (*blockDigest, bool) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	elem, ok := c.digests[blockNumber]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*blockDigest), true
+}
+
+func (c *blockDigestCache) set(digest *blockDigest) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if elem, ok := c.digests[digest.blockNumber]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.digests[digest.blockNumber] = c.lru.PushFront(digest)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		back := c.lru.Back()
+		delete(c.digests, back.Value.(*blockDigest).blockNumber)
+		c.lru.Remove(back)
+	}
+}
+
+func (c *blockDigestCache) clear() {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	c.digests = make(map[uint64]*list.Element)
+	c.lru.Init()
+}
+
+// random number in [0, n)
+func randUint64(n uint64) (uint64, error) {
+	r, err := rand.Int(rand.Reader, new(big.Int).SetUint64(n))
+	if err != nil {
+		return 0, err
+	}
+	return r.Uint64(), nil
+}
@@ -0,0 +1,182 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package challenge
+
+import (
+	"bytes"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"gopkg.in/check.v1"
+)
+
+type SampleTest struct {
+	source *syntheticBlockSource
+}
+
+var _ = check.Suite(&SampleTest{})
+
+func (t *SampleTest) SetUpSuite(c *check.C) {
+	t.source = newSyntheticBlockSource(c, 100, 10*ChunkSize+100)
+}
+
+func (t *SampleTest) TestChunkProof(c *check.C) {
+	for _, size := range []int{0, 1, ChunkSize, ChunkSize + 1, 2 * ChunkSize, 7*ChunkSize + 3} {
+		blockBytes := bytes.Repeat([]byte{0xab}, size)
+		for i := range blockBytes {
+			blockBytes[i] = byte(i)
+		}
+		root := BlockChunksRoot(blockBytes)
+		chunks := chunksCount(size)
+
+		for idx := uint32(0); idx < chunks; idx++ {
+			proof, err := BuildChunkProof(1, blockBytes, idx)
+			c.Assert(err, check.IsNil)
+			c.Check(VerifyChunkProof(root, chunks, proof), check.Equals, true, check.Commentf("size %d, chunk %d", size, idx))
+		}
+
+		_, err := BuildChunkProof(1, blockBytes, chunks)
+		c.Check(err, check.Equals, ErrOutOfBounds)
+	}
+}
+
+func (t *SampleTest) TestChunkProofTampered(c *check.C) {
+	blockBytes := bytes.Repeat([]byte{0xab}, 5*ChunkSize)
+	blockBytes[3*ChunkSize] = 0xcd
+	root := BlockChunksRoot(blockBytes)
+
+	proof, err := BuildChunkProof(1, blockBytes, 3)
+	c.Assert(err, check.IsNil)
+
+	// a chunk the farmer doesn't keep, replaced by another one
+	forged := *proof
+	forged.Chunk = chunkAt(blockBytes, 2)
+	c.Check(VerifyChunkProof(root, 5, &forged), check.Equals, false)
+
+	// path cut short
+	forged = *proof
+	forged.Path = proof.Path[:len(proof.Path)-1]
+	c.Check(VerifyChunkProof(root, 5, &forged), check.Equals, false)
+
+	// claims another chunk index
+	forged = *proof
+	forged.ChunkIndex = 2
+	c.Check(VerifyChunkProof(root, 5, &forged), check.Equals, false)
+}
+
+func (t *SampleTest) newChallenger(policy string) *Challenger {
+	cfg := &Config{
+		HashAlgo:        pb.HashAlgo_SHA256,
+		Delay:           time.Second * 10,
+		Policy:          policy,
+		SampleRatio:     0.5,
+		SampleCount:     4,
+		DigestCacheSize: 10,
+	}
+
+	return NewChallenger(cfg, t.source, NewDefaultFarmerChallengeReqCache(cfg.Delay, 0), NewDefaultBlocksHashCache(0, 0))
+}
+
+// farmer side, answers samples with blocks it keeps
+func (t *SampleTest) answer(c *check.C, samples []*pb.BlockSample) []*pb.ChunkProof {
+	proofs := []*pb.ChunkProof{}
+	for _, sample := range samples {
+		block, err := t.source.GetBlockByNumber(sample.BlockNumber)
+		c.Assert(err, check.IsNil)
+		blockBytes, err := block.Bytes()
+		c.Assert(err, check.IsNil)
+		proof, err := BuildChunkProof(sample.BlockNumber, blockBytes, sample.ChunkIndex)
+		c.Assert(err, check.IsNil)
+		proofs = append(proofs, proof)
+	}
+
+	return proofs
+}
+
+func (t *SampleTest) TestChallengeKind(c *check.C) {
+	c.Check(t.newChallenger(ChallengePolicyHash).ChallengeKind(true, false), check.Equals, pb.ChallengeKind_BLOCKS_HASH)
+	c.Check(t.newChallenger(ChallengePolicySample).ChallengeKind(true, false), check.Equals, pb.ChallengeKind_BLOCKS_SAMPLE)
+	// older farmers keep getting hash challenges
+	c.Check(t.newChallenger(ChallengePolicySample).ChallengeKind(false, false), check.Equals, pb.ChallengeKind_BLOCKS_HASH)
+
+	kinds := map[pb.ChallengeKind]int{}
+	ch := t.newChallenger(ChallengePolicyMixed)
+	for i := 0; i < 1000; i++ {
+		kinds[ch.ChallengeKind(true, false)]++
+	}
+	c.Check(kinds[pb.ChallengeKind_BLOCKS_HASH] > 0, check.Equals, true)
+	c.Check(kinds[pb.ChallengeKind_BLOCKS_SAMPLE] > 0, check.Equals, true)
+}
+
+func (t *SampleTest) TestNewSamples(c *check.C) {
+	ch := t.newChallenger(ChallengePolicySample)
+	defer ch.Close()
+
+	samples, err := ch.NewSamples(50, 40)
+	c.Assert(err, check.IsNil)
+	c.Check(samples, check.HasLen, 4)
+	for _, sample := range samples {
+		c.Check(sample.BlockNumber > 40 && sample.BlockNumber <= 50, check.Equals, true)
+		c.Check(sample.ChunkIndex < 11, check.Equals, true)
+	}
+
+	_, err = ch.NewSamples(40, 40)
+	c.Check(err, check.Equals, ErrOutOfBounds)
+	_, err = ch.NewSamples(t.source.GetBlockchainSize(), 40)
+	c.Check(err, check.Equals, ErrOutOfBounds)
+}
+
+func (t *SampleTest) TestConquerSampleChallenge(c *check.C) {
+	ch := t.newChallenger(ChallengePolicySample)
+	defer ch.Close()
+
+	samples, err := ch.NewSamples(50, 10)
+	c.Assert(err, check.IsNil)
+	c.Assert(ch.FarmerChallengeReqCache().AddFarmerChallengeReq(NewFarmerSampleChallengeReq("TestConquerSampleChallenge", 50, 10, samples)), check.Equals, true)
+
+	c.Check(ch.ConquerChallenge("TestConquerSampleChallenge", 50, 10, pb.HashAlgo_SHA256, "", t.answer(c, samples)), check.Equals, true)
+}
+
+func (t *SampleTest) TestConquerSampleChallengeFail(c *check.C) {
+	ch := t.newChallenger(ChallengePolicySample)
+	defer ch.Close()
+
+	samples, err := ch.NewSamples(50, 10)
+	c.Assert(err, check.IsNil)
+
+	// missing a proof
+	c.Assert(ch.FarmerChallengeReqCache().AddFarmerChallengeReq(NewFarmerSampleChallengeReq("TestConquerSampleChallengeFail", 50, 10, samples)), check.Equals, true)
+	c.Check(ch.ConquerChallenge("TestConquerSampleChallengeFail", 50, 10, pb.HashAlgo_SHA256, "", t.answer(c, samples)[1:]), check.Equals, false)
+
+	// a chunk farmer doesn't keep
+	c.Assert(ch.FarmerChallengeReqCache().AddFarmerChallengeReq(NewFarmerSampleChallengeReq("TestConquerSampleChallengeFail", 50, 10, samples)), check.Equals, true)
+	proofs := t.answer(c, samples)
+	proofs[0].Chunk = bytes.Repeat([]byte{0}, len(proofs[0].Chunk))
+	c.Check(ch.ConquerChallenge("TestConquerSampleChallengeFail", 50, 10, pb.HashAlgo_SHA256, "", proofs), check.Equals, false)
+}
+
+func (t *SampleTest) TestBlockDigestCacheEvict(c *check.C) {
+	cache := newBlockDigestCache(2)
+	for i := uint64(0); i < 3; i++ {
+		cache.set(&blockDigest{blockNumber: i})
+	}
+
+	_, ok := cache.get(0)
+	c.Check(ok, check.Equals, false)
+	_, ok = cache.get(2)
+	c.Check(ok, check.Equals, true)
+}
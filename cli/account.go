@@ -0,0 +1,152 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cli
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"golang.org/x/net/context"
+)
+
+const (
+	list_page_size = 1000
+)
+
+// AccountGet prints farmer's account, and its runtime state if it is in service
+func AccountGet(s *Session, p *Printer, farmerId string) error {
+	rsp, err := s.Admin.GetFarmer(context.Background(), &pb.GetFarmerReq{FarmerID: farmerId})
+	if err != nil {
+		return err
+	}
+	if !rsp.Error.OK() {
+		return rsp.Error
+	}
+
+	view := newFarmerView(rsp)
+	return p.Print(view, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "Farmer:\t%s\n", view.FarmerID)
+		fmt.Fprintf(tw, "State:\t%s\n", view.State)
+		fmt.Fprintf(tw, "FSM state:\t%s\n", orDash(view.FsmState))
+		fmt.Fprintf(tw, "Balance:\t%d\n", view.Balance)
+		fmt.Fprintf(tw, "State reason:\t%s\n", orDash(view.StateReason))
+		fmt.Fprintf(tw, "Suspended until:\t%s\n", formatTime(view.SuspendedUntil))
+		fmt.Fprintf(tw, "Last modified:\t%s\n", formatTime(view.LastModifiedTime))
+		fmt.Fprintf(tw, "Last challenge:\t%s\n", formatTime(view.LastChallengeTime))
+		fmt.Fprintf(tw, "In service:\t%v\n", view.InService)
+		if !view.InService {
+			return
+		}
+		fmt.Fprintf(tw, "Lost count:\t%d\n", view.LostCount)
+		fmt.Fprintf(tw, "Next ping:\t%s\n", formatTime(view.NextPing))
+		if view.Challenge != nil {
+			printChallenge(tw, view.Challenge)
+		}
+	})
+}
+
+// AccountList prints farmers whose id starts with prefix, in one of states if any given, up to limit, 0 means all.
+// only farmers in service are listed, unless stored is true
+func AccountList(s *Session, p *Printer, prefix string, states []string, stored bool, limit int) error {
+	req := &pb.ListFarmersReq{
+		Prefix: prefix,
+		Stored: stored,
+	}
+	for _, state := range states {
+		value, ok := pb.FarmerState_value[state]
+		if !ok {
+			return fmt.Errorf("supervisor/cli: unknown farmer state %q", state)
+		}
+		req.States = append(req.States, pb.FarmerState(value))
+	}
+
+	records := []*account.AccountRecord{}
+	for {
+		req.Limit = list_page_size
+		if limit > 0 && limit-len(records) < list_page_size {
+			req.Limit = uint32(limit - len(records))
+		}
+		rsp, err := s.Admin.ListFarmers(context.Background(), req)
+		if err != nil {
+			return err
+		}
+		if !rsp.Error.OK() {
+			return rsp.Error
+		}
+
+		for _, acc := range rsp.Accounts {
+			records = append(records, account.NewAccountRecord(acc))
+		}
+		if rsp.Next == "" || (limit > 0 && len(records) >= limit) {
+			break
+		}
+		req.After = rsp.Next
+	}
+
+	return p.Print(records, func(tw *tabwriter.Writer) {
+		printAccounts(tw, records)
+	})
+}
+
+// AccountAdjust sets farmer's balance, reason goes to farmer's balance journal
+func AccountAdjust(s *Session, p *Printer, farmerId string, balance uint32, reason string) error {
+	rsp, err := s.Admin.AdjustBalance(context.Background(), &pb.AdjustBalanceReq{
+		FarmerID: farmerId,
+		Balance:  balance,
+		Reason:   reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	return printAdminFarmerRsp(p, rsp)
+}
+
+// AccountBan takes farmer out of service until lifted, or lifts it if lift is true
+func AccountBan(s *Session, p *Printer, farmerId, reason string, lift bool) error {
+	req := &pb.AdminFarmerReq{
+		FarmerID: farmerId,
+		Reason:   reason,
+	}
+
+	var rsp *pb.AdminFarmerRsp
+	var err error
+	if lift {
+		rsp, err = s.Admin.LiftFarmer(context.Background(), req)
+	} else {
+		rsp, err = s.Admin.BanFarmer(context.Background(), req)
+	}
+	if err != nil {
+		return err
+	}
+
+	return printAdminFarmerRsp(p, rsp)
+}
+
+// account farmer is left with
+func printAdminFarmerRsp(p *Printer, rsp *pb.AdminFarmerRsp) error {
+	if !rsp.Error.OK() {
+		return rsp.Error
+	}
+
+	records := []*account.AccountRecord{account.NewAccountRecord(rsp.Account)}
+	return p.Print(records[0], func(tw *tabwriter.Writer) {
+		printAccounts(tw, records)
+	})
+}
@@ -0,0 +1,58 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cli
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	pb "github.com/conseweb/common/protos"
+	"golang.org/x/net/context"
+)
+
+// ChallengeInspect prints farmer's pending challenge, or clears it if clear is true
+func ChallengeInspect(s *Session, p *Printer, farmerId string, clear bool) error {
+	rsp, err := s.Admin.GetFarmer(context.Background(), &pb.GetFarmerReq{FarmerID: farmerId})
+	if err != nil {
+		return err
+	}
+	if !rsp.Error.OK() {
+		return rsp.Error
+	}
+
+	view := newChallengeView(farmerId, rsp.Challenge)
+	if view == nil {
+		return fmt.Errorf("supervisor/cli: farmer(%s) has no pending challenge", farmerId)
+	}
+	if clear {
+		clearRsp, err := s.Admin.ClearChallenge(context.Background(), &pb.AdminFarmerReq{FarmerID: farmerId})
+		if err != nil {
+			return err
+		}
+		if !clearRsp.Error.OK() {
+			return clearRsp.Error
+		}
+	}
+
+	return p.Print(view, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "Farmer:\t%s\n", view.FarmerID)
+		printChallenge(tw, view)
+		if clear {
+			fmt.Fprintf(tw, "Cleared:\t%v\n", clear)
+		}
+	})
+}
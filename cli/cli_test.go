@@ -0,0 +1,268 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/challenge"
+	"github.com/conseweb/supervisor/node"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type CLITest struct {
+	dir string
+}
+
+var _ = check.Suite(&CLITest{})
+
+func (t *CLITest) SetUpTest(c *check.C) {
+	t.dir = filepath.Join(os.TempDir(), "testCLI")
+	os.RemoveAll(t.dir)
+}
+
+func (t *CLITest) TearDownTest(c *check.C) {
+	os.RemoveAll(t.dir)
+}
+
+func (t *CLITest) newConfig(c *check.C, name string) *node.Config {
+	blocks, err := challenge.NewFileBlockSource(filepath.Join(t.dir, name, "blocks"))
+	c.Assert(err, check.IsNil)
+
+	return &node.Config{
+		Address:       "127.0.0.1:0",
+		StoreBackend:  "rocksdb",
+		DBPath:        filepath.Join(t.dir, name, "account"),
+		ControlSocket: filepath.Join(t.dir, name, "supervisor.sock"),
+		Account: &account.Config{
+			CheckWorkers: 8,
+			PingInterval: time.Second * 900,
+			LostCount:    2,
+		},
+		Challenge: &challenge.Config{
+			HashAlgo: pb.HashAlgo_SHA256,
+			Delay:    time.Second * 10,
+		},
+		BlockSource: blocks,
+	}
+}
+
+// a stopped node whose db has farmers in it
+func (t *CLITest) newStoppedNode(c *check.C, name string, farmerIds ...string) *node.Config {
+	cfg := t.newConfig(c, name)
+	session, err := Open(&Options{DBPath: cfg.DBPath, Node: cfg})
+	c.Assert(err, check.NotNil)
+
+	sv, err := node.NewSupervisor(cfg)
+	c.Assert(err, check.IsNil)
+	for i, id := range farmerIds {
+		c.Assert(sv.Controller().AdjustBalance(id, uint32(100*(i+1)), "opening"), check.IsNil)
+	}
+	c.Assert(sv.Stop(), check.IsNil)
+
+	session, err = Open(&Options{Node: cfg})
+	c.Assert(err, check.IsNil)
+	c.Check(session.Offline(), check.Equals, true)
+	c.Assert(session.Close(), check.IsNil)
+	return cfg
+}
+
+func (t *CLITest) TestOffline(c *check.C) {
+	cfg := t.newStoppedNode(c, "sv", "A", "B")
+	session, err := Open(&Options{Node: cfg})
+	c.Assert(err, check.IsNil)
+
+	out := &bytes.Buffer{}
+	printer, err := NewPrinter(out, OutputJSON)
+	c.Assert(err, check.IsNil)
+	c.Assert(AccountGet(session, printer, "B"), check.IsNil)
+	farmer := &farmerView{}
+	c.Assert(json.Unmarshal(out.Bytes(), farmer), check.IsNil)
+	c.Check(farmer.FarmerID, check.Equals, "B")
+	c.Check(farmer.Balance, check.Equals, uint32(200))
+	c.Check(farmer.State, check.Equals, "OFFLINE")
+	c.Check(farmer.InService, check.Equals, false)
+
+	c.Check(AccountGet(session, printer, "C"), check.ErrorMatches, ".*not found.*")
+	c.Check(ChallengeInspect(session, printer, "A", false), check.ErrorMatches, ".*no pending challenge")
+
+	// a change made offline makes it to db before the session closes
+	out.Reset()
+	c.Assert(AccountBan(session, printer, "A", "cheating", false), check.IsNil)
+	c.Assert(session.Close(), check.IsNil)
+
+	session, err = Open(&Options{Node: cfg})
+	c.Assert(err, check.IsNil)
+	defer session.Close()
+
+	out.Reset()
+	c.Assert(AccountList(session, printer, "", nil, true, 0), check.IsNil)
+	records := []*account.AccountRecord{}
+	c.Assert(json.Unmarshal(out.Bytes(), &records), check.IsNil)
+	c.Assert(records, check.HasLen, 2)
+	c.Check(records[0].FarmerID, check.Equals, "A")
+	c.Check(records[0].State, check.Equals, "BANNED")
+	c.Check(records[0].StateReason, check.Equals, "cheating")
+	c.Check(records[1].FarmerID, check.Equals, "B")
+
+	out.Reset()
+	c.Assert(AccountList(session, printer, "", []string{"BANNED"}, true, 0), check.IsNil)
+	records = []*account.AccountRecord{}
+	c.Assert(json.Unmarshal(out.Bytes(), &records), check.IsNil)
+	c.Assert(records, check.HasLen, 1)
+	c.Check(AccountList(session, printer, "", []string{"GONE"}, true, 0), check.ErrorMatches, ".*unknown farmer state.*")
+
+	// table is for people
+	table, err := NewPrinter(out, OutputTable)
+	c.Assert(err, check.IsNil)
+	out.Reset()
+	c.Assert(AccountList(session, table, "", nil, true, 1), check.IsNil)
+	c.Check(out.String(), check.Matches, "FARMER +STATE +FSM STATE +BALANCE .*\nA +BANNED +\\S+ +100 .*\n")
+}
+
+func (t *CLITest) TestOnline(c *check.C) {
+	cfg := t.newConfig(c, "sv")
+	sv, err := node.NewSupervisor(cfg)
+	c.Assert(err, check.IsNil)
+	c.Assert(sv.Start(), check.IsNil)
+	defer sv.Stop()
+
+	handler, err := sv.Controller().NewFarmerHandler("TestOnline")
+	c.Assert(err, check.IsNil)
+	c.Assert(handler.OnLine(), check.IsNil)
+
+	session, err := Open(&Options{Node: cfg})
+	c.Assert(err, check.IsNil)
+	defer session.Close()
+	c.Check(session.Offline(), check.Equals, false)
+	c.Check(session.Target, check.Equals, cfg.ControlSocket)
+
+	out := &bytes.Buffer{}
+	printer, err := NewPrinter(out, OutputJSON)
+	c.Assert(err, check.IsNil)
+	c.Assert(AccountAdjust(session, printer, "TestOnline", 42, "compensation"), check.IsNil)
+	c.Check(handler.Account().Balance, check.Equals, uint32(42))
+
+	out.Reset()
+	c.Assert(AccountList(session, printer, "", []string{"ONLINE"}, false, 0), check.IsNil)
+	records := []*account.AccountRecord{}
+	c.Assert(json.Unmarshal(out.Bytes(), &records), check.IsNil)
+	c.Assert(records, check.HasLen, 1)
+	c.Check(records[0].Balance, check.Equals, uint32(42))
+
+	// snapshots are taken while node keeps serving
+	exported := &bytes.Buffer{}
+	count, err := DBExport(session, exported)
+	c.Assert(err, check.IsNil)
+	c.Check(count, check.Equals, 1)
+	c.Check(exported.String(), check.Matches, `\{"farmerID":"TestOnline","balance":42,"state":"ONLINE".*\n`)
+	backup := &bytes.Buffer{}
+	_, err = DBBackup(session, backup)
+	c.Assert(err, check.IsNil)
+
+	// the rest of db commands leave db of a running node alone
+	c.Check(DBImport(&Options{Node: cfg}, printer, bytes.NewReader(exported.Bytes())), check.ErrorMatches, ".*node is running.*")
+	c.Check(DBRestore(&Options{Node: cfg}, printer, bytes.NewReader(backup.Bytes())), check.ErrorMatches, ".*node is running.*")
+
+	restored := filepath.Join(t.dir, "restored")
+	c.Assert(DBRestore(&Options{DBPath: restored, Node: cfg}, printer, bytes.NewReader(backup.Bytes())), check.IsNil)
+	offline, err := Open(&Options{DBPath: restored, Node: cfg})
+	c.Assert(err, check.IsNil)
+	defer offline.Close()
+	out.Reset()
+	c.Assert(AccountGet(offline, printer, "TestOnline"), check.IsNil)
+	farmer := &farmerView{}
+	c.Assert(json.Unmarshal(out.Bytes(), farmer), check.IsNil)
+	c.Check(farmer.Balance, check.Equals, uint32(42))
+}
+
+// dump of a stopped node
+func (t *CLITest) dump(c *check.C, cfg *node.Config, dump func(*Session, io.Writer) (int, error)) (*bytes.Buffer, int) {
+	session, err := Open(&Options{Node: cfg})
+	c.Assert(err, check.IsNil)
+	defer session.Close()
+
+	out := &bytes.Buffer{}
+	count, err := dump(session, out)
+	c.Assert(err, check.IsNil)
+	return out, count
+}
+
+func (t *CLITest) TestExportImport(c *check.C) {
+	src := t.newStoppedNode(c, "src", "A", "B", "C")
+	dst := t.newStoppedNode(c, "dst", "B")
+
+	exported, count := t.dump(c, src, DBExport)
+	c.Check(count, check.Equals, 3)
+
+	out := &bytes.Buffer{}
+	printer, err := NewPrinter(out, OutputJSON)
+	c.Assert(err, check.IsNil)
+	c.Assert(DBImport(&Options{Node: dst}, printer, bytes.NewReader(exported.Bytes())), check.IsNil)
+	result := &dbResult{}
+	c.Assert(json.Unmarshal(out.Bytes(), result), check.IsNil)
+	c.Check(result.Accounts, check.Equals, 3)
+	c.Assert(DBCompact(&Options{Node: dst}, printer), check.IsNil)
+
+	again, _ := t.dump(c, dst, DBExport)
+	c.Check(again.String(), check.Equals, exported.String())
+}
+
+func (t *CLITest) TestBackupRestore(c *check.C) {
+	src := t.newStoppedNode(c, "src", "A", "B", "C")
+	backup, count := t.dump(c, src, DBBackup)
+	// accounts and their journal entries at least
+	c.Check(count >= 6, check.Equals, true)
+
+	out := &bytes.Buffer{}
+	printer, err := NewPrinter(out, OutputJSON)
+	c.Assert(err, check.IsNil)
+	dst := t.newConfig(c, "dst")
+	c.Assert(DBRestore(&Options{Node: dst}, printer, bytes.NewReader(backup.Bytes())), check.IsNil)
+	result := &dbResult{}
+	c.Assert(json.Unmarshal(out.Bytes(), result), check.IsNil)
+	c.Check(result.Records, check.Equals, count)
+
+	// byte for byte
+	again, _ := t.dump(c, dst, DBBackup)
+	c.Check(again.String(), check.Equals, backup.String())
+	exported, _ := t.dump(c, src, DBExport)
+	restored, _ := t.dump(c, dst, DBExport)
+	c.Check(restored.String(), check.Equals, exported.String())
+
+	// into a new db only
+	c.Check(DBRestore(&Options{Node: dst}, printer, bytes.NewReader(backup.Bytes())), check.ErrorMatches, ".*exists, backup is restored into a new db only")
+
+	// a broken backup leaves no db behind
+	broken := t.newConfig(c, "broken")
+	truncated := backup.Bytes()[:backup.Len()/2]
+	c.Check(DBRestore(&Options{Node: broken}, printer, bytes.NewReader(truncated)), check.ErrorMatches, ".*, db .* removed")
+	_, err = os.Stat(broken.DBPath)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
@@ -0,0 +1,48 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cli
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/conseweb/supervisor/node"
+)
+
+type configCheckResult struct {
+	OK       bool     `json:"ok"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// ConfigCheck prints every problem of node config, ok is false if there is any
+func ConfigCheck(cfg *node.Config, p *Printer) (ok bool, err error) {
+	result := &configCheckResult{}
+	for _, problem := range cfg.Check() {
+		result.Problems = append(result.Problems, problem.Error())
+	}
+	result.OK = len(result.Problems) == 0
+
+	return result.OK, p.Print(result, func(tw *tabwriter.Writer) {
+		if result.OK {
+			fmt.Fprintln(tw, "config ok")
+			return
+		}
+		for _, problem := range result.Problems {
+			fmt.Fprintln(tw, problem)
+		}
+	})
+}
@@ -0,0 +1,159 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/account/store"
+	"golang.org/x/net/context"
+)
+
+// what a db command did, import, restore and compact work on db of a stopped node only
+type dbResult struct {
+	DB       string `json:"db"`
+	Accounts int    `json:"accounts,omitempty"`
+	Records  int    `json:"records,omitempty"`
+}
+
+// DBExport writes every farmer account to w, one json object per line,
+// taken from a snapshot of db of the running node, or from db of a stopped node.
+// returns how many are written
+func DBExport(s *Session, w io.Writer) (int, error) {
+	return dbSnapshot(s, pb.SnapshotFormat_ACCOUNTS, w)
+}
+
+// DBBackup writes every key of db to w, taken as DBExport does, DBRestore restores it into a new db.
+// returns how many records are written
+func DBBackup(s *Session, w io.Writer) (int, error) {
+	lines, err := dbSnapshot(s, pb.SnapshotFormat_BACKUP, w)
+	// header and end of backup are not records
+	if lines -= 2; lines < 0 {
+		lines = 0
+	}
+	return lines, err
+}
+
+// streams snapshot from admin service to w, returns how many lines are written
+func dbSnapshot(s *Session, format pb.SnapshotFormat, w io.Writer) (int, error) {
+	stream, err := s.Admin.Snapshot(context.Background(), &pb.SnapshotReq{Format: format})
+	if err != nil {
+		return 0, err
+	}
+
+	lines := 0
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+		if chunk.Error != nil && !chunk.Error.OK() {
+			return lines, chunk.Error
+		}
+
+		if _, err := w.Write(chunk.Data); err != nil {
+			return lines, err
+		}
+		lines += bytes.Count(chunk.Data, []byte{'\n'})
+	}
+}
+
+// DBRestore restores a backup written by DBBackup from r into a new db,
+// which is removed again if the backup turns out broken
+func DBRestore(opts *Options, p *Printer, r io.Reader) error {
+	if opts.DBPath == "" && opts.nodeRunning() {
+		return fmt.Errorf("supervisor/cli: node is running on %s, stop it first", opts.socket())
+	}
+	dbpath := opts.dbPath()
+	if f, err := os.Open(dbpath); err == nil {
+		_, err = f.Readdirnames(1)
+		f.Close()
+		if err != io.EOF {
+			return fmt.Errorf("supervisor/cli: db %s exists, backup is restored into a new db only", dbpath)
+		}
+	}
+
+	storage, err := store.NewStore(opts.Node.StoreBackend, dbpath)
+	if err != nil {
+		return err
+	}
+	count, err := store.RestoreBackup(storage, r)
+	storage.Close()
+	if err != nil {
+		os.RemoveAll(dbpath)
+		return fmt.Errorf("%v, db %s removed", err, dbpath)
+	}
+
+	result := &dbResult{DB: dbpath, Records: count}
+	return p.Print(result, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "%d records restored into %s\n", result.Records, result.DB)
+	})
+}
+
+// DBImport reads farmer accounts written by DBExport from r into db
+func DBImport(opts *Options, p *Printer, r io.Reader) error {
+	fsm, err := account.NewFarmerFSMDef(opts.Node.Account.FSM)
+	if err != nil {
+		return err
+	}
+	storage, dbpath, err := OpenStorage(opts)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	count, err := account.ImportAccounts(storage, fsm, r)
+	if err != nil {
+		return fmt.Errorf("%v, %d accounts imported before it", err, count)
+	}
+
+	result := &dbResult{DB: dbpath, Accounts: count}
+	return p.Print(result, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "%d accounts imported into %s\n", result.Accounts, result.DB)
+	})
+}
+
+// DBCompact compacts db, such as after a large import
+func DBCompact(opts *Options, p *Printer) error {
+	storage, dbpath, err := OpenStorage(opts)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	compacter, ok := storage.(store.Compacter)
+	if !ok {
+		return fmt.Errorf("supervisor/cli: db %s can't be compacted", dbpath)
+	}
+	if err := compacter.Compact(); err != nil {
+		return err
+	}
+
+	result := &dbResult{DB: dbpath}
+	return p.Print(result, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "%s compacted\n", result.DB)
+	})
+}
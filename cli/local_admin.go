@@ -0,0 +1,152 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cli
+
+import (
+	"io"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/api"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// localAdmin calls admin service in process, as the local operator
+type localAdmin struct {
+	srv      pb.SupervisorAdminServer
+	operator string
+}
+
+func newLocalAdmin(srv pb.SupervisorAdminServer, operator string) pb.SupervisorAdminClient {
+	return &localAdmin{
+		srv:      srv,
+		operator: operator,
+	}
+}
+
+func (adm *localAdmin) context(ctx context.Context) context.Context {
+	return credentials.NewContext(ctx, api.LocalAuthInfo{Operator: adm.operator})
+}
+
+func (adm *localAdmin) GetFarmer(ctx context.Context, in *pb.GetFarmerReq, opts ...grpc.CallOption) (*pb.GetFarmerRsp, error) {
+	return adm.srv.GetFarmer(adm.context(ctx), in)
+}
+
+func (adm *localAdmin) ListFarmers(ctx context.Context, in *pb.ListFarmersReq, opts ...grpc.CallOption) (*pb.ListFarmersRsp, error) {
+	return adm.srv.ListFarmers(adm.context(ctx), in)
+}
+
+func (adm *localAdmin) AdjustBalance(ctx context.Context, in *pb.AdjustBalanceReq, opts ...grpc.CallOption) (*pb.AdminFarmerRsp, error) {
+	return adm.srv.AdjustBalance(adm.context(ctx), in)
+}
+
+func (adm *localAdmin) ForceOffline(ctx context.Context, in *pb.AdminFarmerReq, opts ...grpc.CallOption) (*pb.AdminFarmerRsp, error) {
+	return adm.srv.ForceOffline(adm.context(ctx), in)
+}
+
+func (adm *localAdmin) SuspendFarmer(ctx context.Context, in *pb.SuspendFarmerReq, opts ...grpc.CallOption) (*pb.AdminFarmerRsp, error) {
+	return adm.srv.SuspendFarmer(adm.context(ctx), in)
+}
+
+func (adm *localAdmin) BanFarmer(ctx context.Context, in *pb.AdminFarmerReq, opts ...grpc.CallOption) (*pb.AdminFarmerRsp, error) {
+	return adm.srv.BanFarmer(adm.context(ctx), in)
+}
+
+func (adm *localAdmin) LiftFarmer(ctx context.Context, in *pb.AdminFarmerReq, opts ...grpc.CallOption) (*pb.AdminFarmerRsp, error) {
+	return adm.srv.LiftFarmer(adm.context(ctx), in)
+}
+
+func (adm *localAdmin) ClearChallenge(ctx context.Context, in *pb.AdminFarmerReq, opts ...grpc.CallOption) (*pb.AdminFarmerRsp, error) {
+	return adm.srv.ClearChallenge(adm.context(ctx), in)
+}
+
+func (adm *localAdmin) FlushCaches(ctx context.Context, in *pb.FlushCachesReq, opts ...grpc.CallOption) (*pb.FlushCachesRsp, error) {
+	return adm.srv.FlushCaches(adm.context(ctx), in)
+}
+
+func (adm *localAdmin) MoveShard(ctx context.Context, in *pb.MoveShardReq, opts ...grpc.CallOption) (*pb.MoveShardRsp, error) {
+	return adm.srv.MoveShard(adm.context(ctx), in)
+}
+
+func (adm *localAdmin) Snapshot(ctx context.Context, in *pb.SnapshotReq, opts ...grpc.CallOption) (pb.SupervisorAdmin_SnapshotClient, error) {
+	stream := &localSnapshotStream{
+		ctx:    adm.context(ctx),
+		chunks: make(chan *pb.SnapshotChunk),
+	}
+	go func() {
+		stream.err = adm.srv.Snapshot(in, stream)
+		close(stream.chunks)
+	}()
+
+	return stream, nil
+}
+
+// localSnapshotStream carries chunks from in process admin service to the caller,
+// it's the server stream of the service and the client stream of the caller at once
+type localSnapshotStream struct {
+	ctx    context.Context
+	chunks chan *pb.SnapshotChunk
+	// what the service returned, set before chunks is closed
+	err error
+}
+
+func (s *localSnapshotStream) Context() context.Context {
+	return s.ctx
+}
+
+// data is copied, service reuses its buffer once a chunk is sent
+func (s *localSnapshotStream) Send(chunk *pb.SnapshotChunk) error {
+	chunk = &pb.SnapshotChunk{Error: chunk.Error, Data: append([]byte(nil), chunk.Data...)}
+	select {
+	case s.chunks <- chunk:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *localSnapshotStream) Recv() (*pb.SnapshotChunk, error) {
+	chunk, ok := <-s.chunks
+	if !ok {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+	return chunk, nil
+}
+
+func (s *localSnapshotStream) SendMsg(m interface{}) error {
+	return s.Send(m.(*pb.SnapshotChunk))
+}
+
+func (s *localSnapshotStream) RecvMsg(m interface{}) error {
+	chunk, err := s.Recv()
+	if err != nil {
+		return err
+	}
+	*m.(*pb.SnapshotChunk) = *chunk
+	return nil
+}
+
+func (s *localSnapshotStream) Header() (metadata.MD, error) { return nil, nil }
+func (s *localSnapshotStream) Trailer() metadata.MD         { return nil }
+func (s *localSnapshotStream) CloseSend() error             { return nil }
+func (s *localSnapshotStream) SendHeader(metadata.MD) error { return nil }
+func (s *localSnapshotStream) SetTrailer(metadata.MD)       {}
@@ -0,0 +1,145 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+)
+
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+)
+
+// Outputs are what the cli can print in
+var Outputs = []string{OutputTable, OutputJSON}
+
+// Printer prints results as a table for people, or as json for scripts
+type Printer struct {
+	w    io.Writer
+	json bool
+}
+
+func NewPrinter(w io.Writer, output string) (*Printer, error) {
+	switch output {
+	case "", OutputTable:
+		return &Printer{w: w}, nil
+	case OutputJSON:
+		return &Printer{w: w, json: true}, nil
+	}
+
+	return nil, fmt.Errorf("supervisor/cli: unknown output %q", output)
+}
+
+// Print writes v as indented json, or as a table written by table
+func (p *Printer) Print(v interface{}, table func(tw *tabwriter.Writer)) error {
+	if p.json {
+		out, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(p.w, "%s\n", out)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	table(tw)
+	return tw.Flush()
+}
+
+// farmer as told by GetFarmer
+type farmerView struct {
+	*account.AccountRecord
+	InService bool           `json:"inService"`
+	LostCount int32          `json:"lostCount,omitempty"`
+	NextPing  int64          `json:"nextPing,omitempty"`
+	Challenge *challengeView `json:"challenge,omitempty"`
+}
+
+func newFarmerView(rsp *pb.GetFarmerRsp) *farmerView {
+	return &farmerView{
+		AccountRecord: account.NewAccountRecord(rsp.Account),
+		InService:     rsp.InService,
+		LostCount:     rsp.LostCount,
+		NextPing:      rsp.NextPing,
+		Challenge:     newChallengeView(rsp.Account.FarmerID, rsp.Challenge),
+	}
+}
+
+// pending challenge of a farmer
+type challengeView struct {
+	FarmerID        string `json:"farmerID"`
+	Kind            string `json:"kind"`
+	HashAlgo        string `json:"hashAlgo"`
+	HighBlockNumber uint64 `json:"highBlockNumber"`
+	LowBlockNumber  uint64 `json:"lowBlockNumber"`
+	Deadline        int64  `json:"deadline"`
+}
+
+func newChallengeView(farmerId string, challenge *pb.PendingChallenge) *challengeView {
+	if challenge == nil {
+		return nil
+	}
+
+	view := &challengeView{
+		FarmerID: farmerId,
+		Kind:     challenge.Kind.String(),
+		HashAlgo: challenge.HashAlgo.String(),
+		Deadline: challenge.Deadline,
+	}
+	if challenge.BlocksRange != nil {
+		view.HighBlockNumber = challenge.BlocksRange.HighBlockNumber
+		view.LowBlockNumber = challenge.BlocksRange.LowBlockNumber
+	}
+	return view
+}
+
+func printAccounts(tw *tabwriter.Writer, records []*account.AccountRecord) {
+	fmt.Fprintln(tw, "FARMER\tSTATE\tFSM STATE\tBALANCE\tSUSPENDED UNTIL\tREASON\tLAST MODIFIED")
+	for _, r := range records {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", r.FarmerID, r.State, orDash(r.FsmState), r.Balance, formatTime(r.SuspendedUntil), orDash(r.StateReason), formatTime(r.LastModifiedTime))
+	}
+}
+
+func printChallenge(tw *tabwriter.Writer, challenge *challengeView) {
+	fmt.Fprintf(tw, "Kind:\t%s\n", challenge.Kind)
+	fmt.Fprintf(tw, "Hash algo:\t%s\n", challenge.HashAlgo)
+	fmt.Fprintf(tw, "Blocks range:\t(%d, %d]\n", challenge.LowBlockNumber, challenge.HighBlockNumber)
+	fmt.Fprintf(tw, "Deadline:\t%s\n", formatTime(challenge.Deadline))
+}
+
+// unix nano time, - for none
+func formatTime(nano int64) string {
+	if nano == 0 {
+		return "-"
+	}
+	return time.Unix(0, nano).Format(time.RFC3339)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,208 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cli
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/api"
+	"github.com/conseweb/supervisor/audit"
+	"github.com/conseweb/supervisor/challenge"
+	"github.com/conseweb/supervisor/node"
+	"github.com/op/go-logging"
+	"google.golang.org/grpc"
+)
+
+const (
+	dial_timeout = time.Duration(3) * time.Second
+)
+
+var (
+	logger = logging.MustGetLogger("cli")
+)
+
+// Options tell where supervisor is
+type Options struct {
+	// control socket of a running node, node config's if empty
+	Socket string
+	// db of a stopped node, if set, the control socket isn't tried
+	DBPath string
+	// config of the node, its storage, challenge, account and audit sections are used offline
+	Node *node.Config
+}
+
+func (opts *Options) socket() string {
+	if opts.Socket != "" {
+		return opts.Socket
+	}
+	return opts.Node.ControlSocket
+}
+
+func (opts *Options) dbPath() string {
+	if opts.DBPath != "" {
+		return opts.DBPath
+	}
+	return opts.Node.DBPath
+}
+
+// whether or not a node is listening on the control socket
+func (opts *Options) nodeRunning() bool {
+	socket := opts.socket()
+	if socket == "" {
+		return false
+	}
+
+	conn, err := net.DialTimeout("unix", socket, dial_timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Session calls admin service of supervisor, over control socket of a running node,
+// or in process upon the db of a stopped node
+type Session struct {
+	Admin pb.SupervisorAdminClient
+	// control socket or db the session works on
+	Target string
+
+	conn    *grpc.ClientConn
+	offline *offlineNode
+}
+
+// Open connects to the node on the control socket, unless DBPath is given or no node is listening,
+// in which case the db is opened instead
+func Open(opts *Options) (*Session, error) {
+	if opts.DBPath == "" && opts.nodeRunning() {
+		socket := opts.socket()
+		conn, err := grpc.Dial(socket, grpc.WithInsecure(), grpc.WithTimeout(dial_timeout), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+		if err != nil {
+			return nil, err
+		}
+
+		return &Session{
+			Admin:  pb.NewSupervisorAdminClient(conn),
+			Target: socket,
+			conn:   conn,
+		}, nil
+	}
+
+	off, err := openOfflineNode(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{
+		Admin:   newLocalAdmin(off.admin, localOperator()),
+		Target:  off.dbpath,
+		offline: off,
+	}, nil
+}
+
+// Offline tells whether or not the session works on db of a stopped node
+func (s *Session) Offline() bool {
+	return s.offline != nil
+}
+
+func (s *Session) Close() error {
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return s.offline.close()
+}
+
+// OpenStorage opens db of a stopped node, fails if a node is listening on the control socket
+func OpenStorage(opts *Options) (store.Storage, string, error) {
+	if opts.DBPath == "" && opts.nodeRunning() {
+		return nil, "", fmt.Errorf("supervisor/cli: node is running on %s, stop it first", opts.socket())
+	}
+
+	dbpath := opts.dbPath()
+	if _, err := os.Stat(dbpath); err != nil {
+		return nil, "", fmt.Errorf("supervisor/cli: no db at %s: %v", dbpath, err)
+	}
+	storage, err := store.NewStore(opts.Node.StoreBackend, dbpath)
+	if err != nil {
+		return nil, "", fmt.Errorf("supervisor/cli: open db %s err: %v, is the node running?", dbpath, err)
+	}
+
+	return storage, dbpath, nil
+}
+
+// what a stopped node is made of, enough to serve admin service in process
+type offlineNode struct {
+	dbpath     string
+	challenger *challenge.Challenger
+	controller *account.FarmerAccountController
+	auditor    *audit.Auditor
+	admin      *api.SupervisorAdmin
+}
+
+// challenges of a stopped node can be inspected and cleared, but no block source is needed for it
+func openOfflineNode(opts *Options) (*offlineNode, error) {
+	storage, dbpath, err := OpenStorage(opts)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("no node on control socket %q, work on db %s", opts.socket(), dbpath)
+
+	cfg := opts.Node
+	off := &offlineNode{
+		dbpath:     dbpath,
+		challenger: challenge.NewChallenger(cfg.Challenge, nil, challenge.NewDefaultFarmerChallengeReqCache(cfg.Challenge.Delay, cfg.Challenge.CacheMaxSize), challenge.NewDefaultBlocksHashCache(cfg.Challenge.HashCacheMaxEntries, cfg.Challenge.HashCacheMaxBytes)),
+	}
+	off.controller = account.NewFarmerAccountController(storage, off.challenger, cfg.Account)
+
+	// changes made offline are audited as the node would
+	if cfg.Audit != nil && cfg.Audit.Enabled {
+		if off.auditor, err = audit.NewAuditor(cfg.Audit, off.controller.Hooks()); err != nil {
+			off.challenger.Close()
+			off.controller.Close()
+			return nil, err
+		}
+	}
+	off.admin = api.NewSupervisorAdmin(off.controller, off.challenger, off.auditor)
+
+	return off, nil
+}
+
+func (off *offlineNode) close() error {
+	if off.auditor != nil {
+		off.auditor.Close()
+	}
+	off.challenger.Close()
+
+	return off.controller.Close()
+}
+
+// local:<user name> running the cli
+func localOperator() string {
+	u, err := user.Current()
+	if err != nil {
+		return "local"
+	}
+	return "local:" + u.Username
+}
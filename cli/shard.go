@@ -0,0 +1,52 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cli
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	pb "github.com/conseweb/common/protos"
+	"golang.org/x/net/context"
+)
+
+// slot of the shard map moved
+type shardView struct {
+	Slot    uint32 `json:"slot"`
+	To      string `json:"to"`
+	Farmers uint32 `json:"farmers"`
+	Records uint32 `json:"records"`
+}
+
+// ShardMove hands farmers of slot over to supervisor to, and prints how many were moved
+func ShardMove(s *Session, p *Printer, slot uint32, to string) error {
+	rsp, err := s.Admin.MoveShard(context.Background(), &pb.MoveShardReq{Slot: slot, To: to})
+	if err != nil {
+		return err
+	}
+	if !rsp.Error.OK() {
+		return rsp.Error
+	}
+
+	view := &shardView{Slot: slot, To: to, Farmers: rsp.Farmers, Records: rsp.Records}
+	return p.Print(view, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "Slot:\t%d\n", view.Slot)
+		fmt.Fprintf(tw, "Moved to:\t%s\n", view.To)
+		fmt.Fprintf(tw, "Farmers:\t%d\n", view.Farmers)
+		fmt.Fprintf(tw, "Records:\t%d\n", view.Records)
+	})
+}
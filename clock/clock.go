@@ -0,0 +1,98 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package clock is where supervisor tells the time, so that timing can be stepped through by tests.
+//
+// Timestamps supervisor keeps, in accounts, journals, handlers' deadlines and challenges,
+// are nanoseconds since epoch, Stamp and Time convert between them and time.Time.
+package clock
+
+import (
+	"time"
+)
+
+// Clock tells the time and waits for it
+type Clock interface {
+	Now() time.Time
+	// timer fires once after d
+	NewTimer(d time.Duration) Timer
+	// ticker fires every d, ticks missed by a slow receiver are dropped
+	NewTicker(d time.Duration) Ticker
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	// false if the timer had already fired or been stopped
+	Stop() bool
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Stamp is the timestamp of t
+func Stamp(t time.Time) int64 {
+	return t.UnixNano()
+}
+
+// Time is the time of timestamp stamp
+func Time(stamp int64) time.Time {
+	return time.Unix(0, stamp)
+}
+
+// Real is the system clock
+func Real() Clock {
+	return realClock{}
+}
+
+// OrReal is c, or the system clock if c is nil
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real()
+	}
+	return c
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
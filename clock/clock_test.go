@@ -0,0 +1,92 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type ClockTest struct{}
+
+var _ = check.Suite(&ClockTest{})
+
+func (t *ClockTest) TestStamp(c *check.C) {
+	now := time.Now()
+	c.Check(Time(Stamp(now)).Equal(now), check.Equals, true)
+	c.Check(Stamp(time.Unix(1, 0)), check.Equals, int64(time.Second))
+}
+
+// a timer fires once the clock passes it, a stopped one never does
+func (t *ClockTest) TestFakeTimer(c *check.C) {
+	start := time.Unix(1000, 0)
+	clk := NewFake(start)
+	timer := clk.NewTimer(time.Minute)
+	stopped := clk.NewTimer(time.Minute)
+	c.Check(clk.Waiters(), check.Equals, 2)
+	c.Check(stopped.Stop(), check.Equals, true)
+
+	clk.Advance(time.Second * 59)
+	c.Check(fired(timer), check.Equals, false)
+	clk.Advance(time.Second)
+	c.Check(clk.Now(), check.Equals, start.Add(time.Minute))
+	c.Check(fired(timer), check.Equals, true)
+	c.Check(fired(stopped), check.Equals, false)
+	c.Check(timer.Stop(), check.Equals, false)
+	c.Check(clk.Waiters(), check.Equals, 0)
+
+	// a due timer fires right away
+	c.Check(fired(clk.NewTimer(0)), check.Equals, true)
+}
+
+// a ticker fires every period the clock passes, only once for periods passed at once
+func (t *ClockTest) TestFakeTicker(c *check.C) {
+	clk := NewFake(time.Unix(1000, 0))
+	ticker := clk.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	clk.Advance(time.Second)
+	c.Check(fired(ticker), check.Equals, true)
+	clk.Advance(time.Second * 5)
+	c.Check(fired(ticker), check.Equals, true)
+	c.Check(fired(ticker), check.Equals, false)
+	clk.Advance(time.Millisecond * 500)
+	c.Check(fired(ticker), check.Equals, false)
+	clk.Advance(time.Millisecond * 500)
+	c.Check(fired(ticker), check.Equals, true)
+
+	ticker.Stop()
+	clk.Advance(time.Second)
+	c.Check(fired(ticker), check.Equals, false)
+}
+
+func fired(w interface {
+	C() <-chan time.Time
+}) bool {
+	select {
+	case <-w.C():
+		return true
+	default:
+		return false
+	}
+}
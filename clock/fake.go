@@ -0,0 +1,152 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a clock only moving when told to, timers and tickers fire as it passes them
+type Fake struct {
+	l       *sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// a timer, or a ticker if period > 0
+type fakeWaiter struct {
+	clock  *Fake
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+// NewFake returns a fake clock starting at now
+func NewFake(now time.Time) *Fake {
+	return &Fake{
+		l:   &sync.Mutex{},
+		now: now,
+	}
+}
+
+func (f *Fake) Now() time.Time {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return f.wait(d, 0)
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("supervisor/clock: non-positive interval for NewTicker")
+	}
+	return fakeTicker{f.wait(d, d)}
+}
+
+func (f *Fake) wait(d, period time.Duration) *fakeWaiter {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	w := &fakeWaiter{
+		clock:  f,
+		at:     f.now.Add(d),
+		period: period,
+		c:      make(chan time.Time, 1),
+	}
+	f.waiters = append(f.waiters, w)
+	f.fire()
+	return w
+}
+
+// Advance moves the clock on by d, firing timers and tickers it passes
+func (f *Fake) Advance(d time.Duration) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	f.now = f.now.Add(d)
+	f.fire()
+}
+
+// Waiters is how many timers and tickers are waiting for the clock,
+// so that a test knows a goroutine is waiting before it advances the clock
+func (f *Fake) Waiters() int {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	return len(f.waiters)
+}
+
+// caller must hold the lock
+func (f *Fake) fire() {
+	waiters := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.at.After(f.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+
+		select {
+		case w.c <- f.now:
+		default:
+		}
+		if w.period > 0 {
+			for !w.at.After(f.now) {
+				w.at = w.at.Add(w.period)
+			}
+			waiters = append(waiters, w)
+		}
+	}
+	for i := len(waiters); i < len(f.waiters); i++ {
+		f.waiters[i] = nil
+	}
+	f.waiters = waiters
+}
+
+// caller must hold the lock
+func (f *Fake) remove(w *fakeWaiter) bool {
+	for i, waiter := range f.waiters {
+		if waiter == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+func (w *fakeWaiter) Stop() bool {
+	w.clock.l.Lock()
+	defer w.clock.l.Unlock()
+
+	return w.clock.remove(w)
+}
+
+type fakeTicker struct {
+	*fakeWaiter
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeWaiter.Stop()
+}
@@ -0,0 +1,163 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/mtls"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Cluster is what a supervisor needs to run in a cluster, raft over its db, the replicated storage,
+// and cluster service, which serves raft and farmer requests forwarded by followers, to peers only
+type Cluster struct {
+	cfg     *Config
+	raft    *Raft
+	storage *Storage
+	conns   []*grpc.ClientConn
+	// farmer public service of peers, requests are forwarded to the leader's
+	farmers  map[string]pb.FarmerPublicClient
+	creds    credentials.TransportAuthenticator
+	server   *grpc.Server
+	listener net.Listener
+	l        *sync.Mutex
+}
+
+// New restores raft of the supervisor from its local db and connects peers, nothing is served until Start
+func New(cfg *Config, local store.Storage) (*Cluster, error) {
+	if err := cfg.Check(); err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{
+		cfg:     cfg,
+		farmers: make(map[string]pb.FarmerPublicClient),
+		l:       &sync.Mutex{},
+	}
+	serverCreds, clientTLS, err := mtls.Load(cfg.CertFile, cfg.KeyFile, cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	c.creds = serverCreds
+
+	peers := make(map[string]pb.SupervisorRaftClient)
+	for id, addr := range cfg.Peers {
+		if id == cfg.ID {
+			continue
+		}
+		// credentials of a dial take server name of the peer into their tls config, so every peer has its own
+		conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(clientTLS.Clone())))
+		if err != nil {
+			c.closeConns()
+			return nil, fmt.Errorf("supervisor/cluster: dial peer %s at %s err: %v", id, addr, err)
+		}
+		c.conns = append(c.conns, conn)
+		peers[id] = pb.NewSupervisorRaftClient(conn)
+		c.farmers[id] = pb.NewFarmerPublicClient(conn)
+	}
+
+	raft, err := NewRaft(cfg, peers, local)
+	if err != nil {
+		c.closeConns()
+		return nil, err
+	}
+	c.raft = raft
+	c.storage = newStorage(local, raft, c.Stop)
+
+	return c, nil
+}
+
+// Storage is the replicated db, it owns the local one, closing it stops the cluster
+func (c *Cluster) Storage() store.Storage {
+	return c.storage
+}
+
+// OnLeadership sets what is called once the supervisor becomes a leader ready to serve, and once it stops being one,
+// it must be set before Start
+func (c *Cluster) OnLeadership(fn func(leader bool)) {
+	c.raft.OnLeadership(fn)
+}
+
+// Leader returns id of the leader, empty if unknown, and whether or not this supervisor is the leader and ready to serve
+func (c *Cluster) Leader() (id string, self bool) {
+	return c.raft.Leader()
+}
+
+// Start serves cluster service and runs raft, farmer requests forwarded to the supervisor are served by farmers once it leads
+func (c *Cluster) Start(farmers pb.FarmerPublicServer) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.server != nil {
+		return errors.New("supervisor/cluster: cluster already started")
+	}
+
+	lis := c.cfg.Listener
+	if lis == nil {
+		var err error
+		if lis, err = net.Listen("tcp", c.cfg.Address); err != nil {
+			return err
+		}
+	}
+	c.server = grpc.NewServer(grpc.Creds(c.creds))
+	c.listener = lis
+	pb.RegisterSupervisorRaftServer(c.server, c.raft)
+	pb.RegisterFarmerPublicServer(c.server, &FarmerPublic{local: farmers, cluster: c, fromPeers: true})
+
+	go c.server.Serve(lis)
+	c.raft.Start()
+	logger.Infof("supervisor %s of cluster listening on %s, peers: %v", c.cfg.ID, lis.Addr(), c.cfg.Peers)
+
+	return nil
+}
+
+// Addr returns the address cluster service is listening on, nil if not started
+func (c *Cluster) Addr() net.Addr {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.listener == nil {
+		return nil
+	}
+	return c.listener.Addr()
+}
+
+// Stop stops serving and raft, and disconnects peers, the local db is left to whoever closes Storage
+func (c *Cluster) Stop() {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.server != nil {
+		c.server.Stop()
+	}
+	c.raft.Stop()
+	c.closeConns()
+}
+
+func (c *Cluster) closeConns() {
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	c.conns = nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	default_election_timeout   = time.Second
+	default_heartbeat_interval = time.Duration(100) * time.Millisecond
+	default_propose_timeout    = time.Duration(5) * time.Second
+	default_snapshot_entries   = 10000
+)
+
+// Config of a supervisor in a cluster, cluster section of supervisor.yaml
+type Config struct {
+	// whether or not supervisor runs in a cluster, single node if not
+	Enabled bool
+	// id of the supervisor, one of Peers
+	ID string
+	// where cluster service listens, raft and farmer requests forwarded by followers
+	Address string
+	// every supervisor of the cluster, this one included, id to the address its cluster service is reached at
+	Peers map[string]string
+	// a follower not hearing from leader for so long starts an election, the timeout is randomized up to twice of it
+	ElectionTimeout time.Duration
+	// how often leader replicates its log, with or without entries
+	HeartbeatInterval time.Duration
+	// how long a write waits to be committed before it's given up, default if 0
+	ProposeTimeout time.Duration
+	// the log is compacted once so many entries are applied since it last was, keeping the latest half of them
+	// for followers a little behind, followers further behind are sent a snapshot of db, default if 0
+	SnapshotEntries int
+	// mutual tls between supervisors of the cluster, peers' certificates must be signed by CAFile,
+	// and have their ids as common names
+	CertFile string
+	KeyFile  string
+	CAFile   string
+
+	// if set, cluster service is served on it instead of Address, handy for tests
+	Listener net.Listener
+}
+
+// ConfigFromViper reads cluster section, missing values fall back to defaults
+func ConfigFromViper() *Config {
+	cfg := &Config{
+		Enabled:           viper.GetBool("cluster.enabled"),
+		ID:                viper.GetString("cluster.id"),
+		Address:           viper.GetString("cluster.address"),
+		Peers:             viper.GetStringMapString("cluster.peers"),
+		ElectionTimeout:   viper.GetDuration("cluster.election.timeout"),
+		HeartbeatInterval: viper.GetDuration("cluster.heartbeat.interval"),
+		ProposeTimeout:    viper.GetDuration("cluster.propose.timeout"),
+		SnapshotEntries:   viper.GetInt("cluster.snapshot.entries"),
+		CertFile:          viper.GetString("cluster.tls.cert.file"),
+		KeyFile:           viper.GetString("cluster.tls.key.file"),
+		CAFile:            viper.GetString("cluster.tls.ca.file"),
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = default_election_timeout
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = default_heartbeat_interval
+	}
+	if cfg.ProposeTimeout <= 0 {
+		cfg.ProposeTimeout = default_propose_timeout
+	}
+	if cfg.SnapshotEntries <= 0 {
+		cfg.SnapshotEntries = default_snapshot_entries
+	}
+
+	return cfg
+}
+
+// Check reports the first problem of cfg a cluster would fail to start with
+func (cfg *Config) Check() error {
+	if cfg.ID == "" {
+		return errors.New("supervisor/cluster: no id")
+	}
+	if _, ok := cfg.Peers[cfg.ID]; !ok {
+		return fmt.Errorf("supervisor/cluster: %s is not one of peers", cfg.ID)
+	}
+	for id, addr := range cfg.Peers {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("supervisor/cluster: invalid address %q of peer %s: %v", addr, id, err)
+		}
+	}
+	if cfg.Listener == nil {
+		if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+			return fmt.Errorf("supervisor/cluster: invalid address %q: %v", cfg.Address, err)
+		}
+	}
+	if cfg.HeartbeatInterval <= 0 || cfg.ElectionTimeout <= cfg.HeartbeatInterval {
+		return fmt.Errorf("supervisor/cluster: election timeout %v must be longer than heartbeat interval %v", cfg.ElectionTimeout, cfg.HeartbeatInterval)
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" || cfg.CAFile == "" {
+		return errors.New("supervisor/cluster: mutual tls is required, it needs cert, key and ca files")
+	}
+
+	return nil
+}
+
+func (cfg *Config) proposeTimeout() time.Duration {
+	if cfg.ProposeTimeout <= 0 {
+		return default_propose_timeout
+	}
+	return cfg.ProposeTimeout
+}
+
+func (cfg *Config) snapshotEntries() uint64 {
+	if cfg.SnapshotEntries <= 0 {
+		return default_snapshot_entries
+	}
+	return uint64(cfg.SnapshotEntries)
+}
+
+// how many supervisors make a majority
+func (cfg *Config) quorum() int {
+	return len(cfg.Peers)/2 + 1
+}
@@ -0,0 +1,195 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cluster
+
+import (
+	"io"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// metadata key of a farmer request forwarded by a follower, the supervisor it came from
+	forwarded_by_key = "supervisor-forwarded-by"
+)
+
+// FarmerPublic serves farmer requests on the leader, followers forward them to the leader,
+// without a leader, such as during an election, requests wait for one up to twice of the election timeout
+type FarmerPublic struct {
+	local   pb.FarmerPublicServer
+	cluster *Cluster
+	// served on cluster service, only to requests peers forwarded
+	fromPeers bool
+}
+
+// NewFarmerPublic wraps local farmer public service of the supervisor, so that farmers can reach any supervisor of the cluster
+func NewFarmerPublic(local pb.FarmerPublicServer, cluster *Cluster) *FarmerPublic {
+	return &FarmerPublic{
+		local:   local,
+		cluster: cluster,
+	}
+}
+
+// leader to forward the request to, nil if this supervisor serves it itself
+func (fmp *FarmerPublic) leader(ctx context.Context) (pb.FarmerPublicClient, context.Context, error) {
+	md, _ := metadata.FromContext(ctx)
+	forwarded := len(md[forwarded_by_key]) > 0
+	if fmp.fromPeers {
+		if !forwarded {
+			return nil, nil, grpc.Errorf(codes.PermissionDenied, "supervisor/cluster: request not forwarded by a peer")
+		}
+		if err := fmp.cluster.raft.checkPeer(ctx, md[forwarded_by_key][0]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	deadline := time.Now().Add(2 * fmp.cluster.cfg.ElectionTimeout)
+	for {
+		id, self := fmp.cluster.raft.Leader()
+		if self {
+			return nil, ctx, nil
+		}
+		// a forwarded request is never forwarded again, the leader it was meant for just lost leadership
+		if id != "" && id != fmp.cluster.cfg.ID && !forwarded {
+			md = md.Copy()
+			md[forwarded_by_key] = []string{fmp.cluster.cfg.ID}
+			return fmp.cluster.farmers[id], metadata.NewContext(ctx, md), nil
+		}
+		if forwarded || time.Now().After(deadline) {
+			return nil, nil, grpc.Errorf(codes.Unavailable, "supervisor/cluster: no leader to serve the request, try again later")
+		}
+
+		select {
+		case <-time.After(fmp.cluster.cfg.HeartbeatInterval):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+func (fmp *FarmerPublic) FarmerOnLine(ctx context.Context, req *pb.FarmerOnLineReq) (*pb.FarmerOnLineRsp, error) {
+	leader, ctx, err := fmp.leader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader == nil {
+		return fmp.local.FarmerOnLine(ctx, req)
+	}
+	return leader.FarmerOnLine(ctx, req)
+}
+
+func (fmp *FarmerPublic) FarmerPing(ctx context.Context, req *pb.FarmerPingReq) (*pb.FarmerPingRsp, error) {
+	leader, ctx, err := fmp.leader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader == nil {
+		return fmp.local.FarmerPing(ctx, req)
+	}
+	return leader.FarmerPing(ctx, req)
+}
+
+func (fmp *FarmerPublic) FarmerConquerChallenge(ctx context.Context, req *pb.FarmerConquerChallengeReq) (*pb.FarmerConquerChallengeRsp, error) {
+	leader, ctx, err := fmp.leader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader == nil {
+		return fmp.local.FarmerConquerChallenge(ctx, req)
+	}
+	return leader.FarmerConquerChallenge(ctx, req)
+}
+
+func (fmp *FarmerPublic) FarmerOffLine(ctx context.Context, req *pb.FarmerOffLineReq) (*pb.FarmerOffLineRsp, error) {
+	leader, ctx, err := fmp.leader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader == nil {
+		return fmp.local.FarmerOffLine(ctx, req)
+	}
+	return leader.FarmerOffLine(ctx, req)
+}
+
+func (fmp *FarmerPublic) FarmerBalanceHistory(ctx context.Context, req *pb.FarmerBalanceHistoryReq) (*pb.FarmerBalanceHistoryRsp, error) {
+	leader, ctx, err := fmp.leader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if leader == nil {
+		return fmp.local.FarmerBalanceHistory(ctx, req)
+	}
+	return leader.FarmerBalanceHistory(ctx, req)
+}
+
+// FarmerSession relays farmer's session to the leader, the leader losing its leadership ends the session,
+// farmer opens another one, to be relayed to the new leader
+func (fmp *FarmerPublic) FarmerSession(stream pb.FarmerPublic_FarmerSessionServer) error {
+	leader, ctx, err := fmp.leader(stream.Context())
+	if err != nil {
+		return err
+	}
+	if leader == nil {
+		return fmp.local.FarmerSession(stream)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	relay, err := leader.FarmerSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := relay.Send(req); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			rsp, err := relay.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := stream.Send(rsp); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	// either side is over, cancelling ends the other
+	if err := <-errs; err != io.EOF {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cluster
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	raft_meta_key     = "meta"
+	raft_applied_key  = "applied"
+	raft_snapshot_key = "snapshot"
+	raft_entry_key    = "entry/"
+)
+
+var (
+	errCompacted = errors.New("supervisor/cluster: raft entry compacted")
+)
+
+// raftMeta is what raft must remember across restarts, besides its log
+type raftMeta struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"votedFor,omitempty"`
+}
+
+// raftSnapshot is where the log is compacted up to, entries up to Index are applied to db and dropped
+type raftSnapshot struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+}
+
+// raftLog keeps raft's log, meta and how far the log is applied in raft column family,
+// entries are keyed by big endian index, so that they are iterated in order.
+// it isn't safe for concurrent use, raft guards it
+type raftLog struct {
+	storage store.Storage
+	// index and term of the last entry compacted, 0 if none is
+	snapIndex uint64
+	snapTerm  uint64
+	// index and term of the last entry, the snapshot's if log is empty
+	lastIndex uint64
+	lastTerm  uint64
+}
+
+func newRaftLog(storage store.Storage) (*raftLog, error) {
+	log := &raftLog{storage: storage}
+
+	snapBytes, err := storage.GetCF(store.RaftColumnFamily, []byte(raft_snapshot_key))
+	if err != nil && err != store.ErrNotFound {
+		return nil, err
+	}
+	if err == nil {
+		snap := &raftSnapshot{}
+		if err := json.Unmarshal(snapBytes, snap); err != nil {
+			return nil, fmt.Errorf("supervisor/cluster: raft snapshot broken: %v", err)
+		}
+		log.snapIndex, log.snapTerm = snap.Index, snap.Term
+	}
+	log.lastIndex, log.lastTerm = log.snapIndex, log.snapTerm
+
+	var loadErr error
+	err = storage.SeekCF(store.RaftColumnFamily, entryKey(log.snapIndex+1), func(key, value []byte) bool {
+		if len(key) != len(raft_entry_key)+8 || string(key[:len(raft_entry_key)]) != raft_entry_key {
+			return false
+		}
+		entry := &pb.RaftEntry{}
+		if loadErr = proto.Unmarshal(value, entry); loadErr != nil {
+			return false
+		}
+		log.lastIndex, log.lastTerm = entry.Index, entry.Term
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if loadErr != nil {
+		return nil, fmt.Errorf("supervisor/cluster: raft log broken: %v", loadErr)
+	}
+
+	return log, nil
+}
+
+func entryKey(index uint64) []byte {
+	key := make([]byte, len(raft_entry_key)+8)
+	copy(key, raft_entry_key)
+	binary.BigEndian.PutUint64(key[len(raft_entry_key):], index)
+	return key
+}
+
+func (log *raftLog) meta() (*raftMeta, error) {
+	meta := &raftMeta{}
+	metaBytes, err := log.storage.GetCF(store.RaftColumnFamily, []byte(raft_meta_key))
+	if err == store.ErrNotFound {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, json.Unmarshal(metaBytes, meta)
+}
+
+func (log *raftLog) setMeta(meta *raftMeta) error {
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return log.storage.SetCF(store.RaftColumnFamily, []byte(raft_meta_key), metaBytes)
+}
+
+// index of the last entry applied to db
+func (log *raftLog) applied() (uint64, error) {
+	appliedBytes, err := log.storage.GetCF(store.RaftColumnFamily, []byte(raft_applied_key))
+	if err == store.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(appliedBytes) != 8 {
+		return 0, fmt.Errorf("supervisor/cluster: raft applied index broken")
+	}
+
+	return binary.BigEndian.Uint64(appliedBytes), nil
+}
+
+func (log *raftLog) setApplied(index uint64) error {
+	appliedBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(appliedBytes, index)
+	return log.storage.SetCF(store.RaftColumnFamily, []byte(raft_applied_key), appliedBytes)
+}
+
+func (log *raftLog) entry(index uint64) (*pb.RaftEntry, error) {
+	if index <= log.snapIndex {
+		return nil, errCompacted
+	}
+	entryBytes, err := log.storage.GetCF(store.RaftColumnFamily, entryKey(index))
+	if err != nil {
+		return nil, fmt.Errorf("supervisor/cluster: raft entry %d: %v", index, err)
+	}
+
+	entry := &pb.RaftEntry{}
+	return entry, proto.Unmarshal(entryBytes, entry)
+}
+
+// term of entry at index, 0 for index 0, the snapshot's for the last entry compacted
+func (log *raftLog) term(index uint64) (uint64, error) {
+	if index == 0 {
+		return 0, nil
+	}
+	if index == log.snapIndex {
+		return log.snapTerm, nil
+	}
+	if index == log.lastIndex {
+		return log.lastTerm, nil
+	}
+
+	entry, err := log.entry(index)
+	if err != nil {
+		return 0, err
+	}
+	return entry.Term, nil
+}
+
+// entries from index from on, up to max of them
+func (log *raftLog) entries(from uint64, max int) ([]*pb.RaftEntry, error) {
+	if from <= log.snapIndex {
+		return nil, errCompacted
+	}
+	var entries []*pb.RaftEntry
+	for index := from; index <= log.lastIndex && len(entries) < max; index++ {
+		entry, err := log.entry(index)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// append entry right after the last one
+func (log *raftLog) append(entry *pb.RaftEntry) error {
+	if entry.Index != log.lastIndex+1 {
+		return fmt.Errorf("supervisor/cluster: raft entry %d appended after %d", entry.Index, log.lastIndex)
+	}
+
+	entryBytes, err := proto.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := log.storage.SetCF(store.RaftColumnFamily, entryKey(entry.Index), entryBytes); err != nil {
+		return err
+	}
+	log.lastIndex, log.lastTerm = entry.Index, entry.Term
+
+	return nil
+}
+
+// drop entries from index from on, which conflict with leader's, compacted ones are never dropped
+func (log *raftLog) truncate(from uint64) error {
+	for index := log.lastIndex; index >= from && index > log.snapIndex; index-- {
+		if err := log.storage.DelCF(store.RaftColumnFamily, entryKey(index)); err != nil {
+			return err
+		}
+		log.lastIndex = index - 1
+	}
+
+	log.lastTerm = log.snapTerm
+	if log.lastIndex > log.snapIndex {
+		entry, err := log.entry(log.lastIndex)
+		if err != nil {
+			return err
+		}
+		log.lastTerm = entry.Term
+	}
+	return nil
+}
+
+func (log *raftLog) setSnapshot(index, term uint64) error {
+	snapBytes, err := json.Marshal(&raftSnapshot{Index: index, Term: term})
+	if err != nil {
+		return err
+	}
+	if err := log.storage.SetCF(store.RaftColumnFamily, []byte(raft_snapshot_key), snapBytes); err != nil {
+		return err
+	}
+	log.snapIndex, log.snapTerm = index, term
+
+	return nil
+}
+
+// compact drops entries up to index, which must be applied to db already
+func (log *raftLog) compact(index uint64) error {
+	if index <= log.snapIndex {
+		return nil
+	}
+	if index > log.lastIndex {
+		return fmt.Errorf("supervisor/cluster: raft log compacted to %d beyond its end %d", index, log.lastIndex)
+	}
+	term, err := log.term(index)
+	if err != nil {
+		return err
+	}
+
+	// snapshot goes first, entries it covers are never read again even if they are left
+	from := log.snapIndex + 1
+	if err := log.setSnapshot(index, term); err != nil {
+		return err
+	}
+	for ; from <= index; from++ {
+		if err := log.storage.DelCF(store.RaftColumnFamily, entryKey(from)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reset drops the whole log, which starts over after index and term of a snapshot installed,
+// entries a compaction left behind are dropped too
+func (log *raftLog) reset(index, term uint64) error {
+	var keys [][]byte
+	err := log.storage.SeekCF(store.RaftColumnFamily, []byte(raft_entry_key), func(key, value []byte) bool {
+		if len(key) != len(raft_entry_key)+8 || string(key[:len(raft_entry_key)]) != raft_entry_key {
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := log.storage.DelCF(store.RaftColumnFamily, key); err != nil {
+			return err
+		}
+	}
+
+	if err := log.setSnapshot(index, term); err != nil {
+		return err
+	}
+	log.lastIndex, log.lastTerm = index, term
+
+	return nil
+}
@@ -0,0 +1,1050 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/mtls"
+	"github.com/op/go-logging"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// most entries leader sends in one append
+	max_append_entries = 256
+	// most writes leader sends in one chunk of a snapshot
+	max_snapshot_writes = 256
+)
+
+var (
+	logger = logging.MustGetLogger("cluster")
+
+	ErrNotLeader      = errors.New("supervisor/cluster: not the leader")
+	ErrLeadershipLost = errors.New("supervisor/cluster: leadership lost before the write committed, it may or may not be applied")
+	ErrStopped        = errors.New("supervisor/cluster: raft stopped")
+	ErrProposeTimeout = errors.New("supervisor/cluster: write not committed in time, it may or may not be applied")
+)
+
+type role int
+
+const (
+	role_follower role = iota
+	role_candidate
+	role_leader
+)
+
+func (r role) String() string {
+	switch r {
+	case role_candidate:
+		return "candidate"
+	case role_leader:
+		return "leader"
+	default:
+		return "follower"
+	}
+}
+
+// an entry leader appended, waiting to be applied
+type proposal struct {
+	term uint64
+	done chan error
+}
+
+// a snapshot follower is installing, chunk by chunk
+type snapshotInstall struct {
+	leaderID  string
+	term      uint64
+	lastIndex uint64
+	lastTerm  uint64
+	// seq of the chunk expected next
+	next uint64
+}
+
+// leadership change, told to callback in the order they happen
+type leadership struct {
+	leader bool
+	term   uint64
+}
+
+// Raft replicates writes to db among supervisors of a cluster, and applies committed ones to db,
+// see https://raft.github.io/raft.pdf, leader election, log replication and compaction,
+// a leader not hearing from a majority for an election timeout steps down,
+// followers missing entries compacted are sent a snapshot of db, membership is fixed by config
+type Raft struct {
+	cfg          *Config
+	peers        map[string]pb.SupervisorRaftClient
+	storage      store.Storage
+	log          *raftLog
+	onLeadership func(leader bool)
+
+	// held while entries are applied to db, or a snapshot is installed or taken, so db matches lastApplied,
+	// it's taken before l
+	applyL      *sync.Mutex
+	l           *sync.Mutex
+	role        role
+	term        uint64
+	votedFor    string
+	leaderID    string
+	commitIndex uint64
+	lastApplied uint64
+	// follower starts an election once it hasn't heard from leader by then
+	electionDeadline time.Time
+	// where leader sends peers' next entries from, and how far their logs match leader's
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	// when leader last heard from peers in its term
+	lastAck map[string]time.Time
+	// first entry of leader's term, leader is ready once it's applied and callback told
+	termStart   uint64
+	ready       bool
+	proposals   map[uint64]*proposal
+	leaderships []leadership
+	installing  *snapshotInstall
+
+	replicateC  map[string]chan struct{}
+	applyC      chan struct{}
+	leadershipC chan struct{}
+	ctx         context.Context
+	cancel      context.CancelFunc
+	stop        chan struct{}
+	stopOnce    *sync.Once
+	wg          *sync.WaitGroup
+}
+
+// NewRaft restores raft of supervisor cfg.ID from raft column family of storage,
+// peers are the other supervisors of the cluster, committed entries are applied to storage
+func NewRaft(cfg *Config, peers map[string]pb.SupervisorRaftClient, storage store.Storage) (*Raft, error) {
+	for id := range peers {
+		if _, ok := cfg.Peers[id]; !ok || id == cfg.ID {
+			return nil, fmt.Errorf("supervisor/cluster: %s is not a peer", id)
+		}
+	}
+	if len(peers) != len(cfg.Peers)-1 {
+		return nil, fmt.Errorf("supervisor/cluster: %d peers given, config has %d", len(peers), len(cfg.Peers)-1)
+	}
+
+	log, err := newRaftLog(storage)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := log.meta()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := log.applied()
+	if err != nil {
+		return nil, err
+	}
+	// installing a snapshot was cut short, the log starts over as it did once the install began
+	if applied < log.snapIndex {
+		logger.Warningf("raft of %s left a snapshot at %d half installed", cfg.ID, log.snapIndex)
+		if err := log.reset(0, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Raft{
+		cfg:         cfg,
+		peers:       peers,
+		storage:     storage,
+		log:         log,
+		applyL:      &sync.Mutex{},
+		l:           &sync.Mutex{},
+		term:        meta.Term,
+		votedFor:    meta.VotedFor,
+		commitIndex: applied,
+		lastApplied: applied,
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		lastAck:     make(map[string]time.Time),
+		proposals:   make(map[uint64]*proposal),
+		replicateC:  make(map[string]chan struct{}),
+		applyC:      make(chan struct{}, 1),
+		leadershipC: make(chan struct{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+		stop:        make(chan struct{}),
+		stopOnce:    &sync.Once{},
+		wg:          &sync.WaitGroup{},
+	}
+	for id := range peers {
+		r.replicateC[id] = make(chan struct{}, 1)
+	}
+	logger.Infof("raft of %s restored, term %d, log compacted to %d, ends at %d, applied %d", cfg.ID, r.term, log.snapIndex, log.lastIndex, applied)
+
+	return r, nil
+}
+
+// OnLeadership sets what is called once this supervisor becomes a leader ready to serve, and once it stops being one,
+// in the order it happens, it must be set before Start
+func (r *Raft) OnLeadership(fn func(leader bool)) {
+	r.onLeadership = fn
+}
+
+// Start runs elections, replication and applying in background, until Stop
+func (r *Raft) Start() {
+	r.l.Lock()
+	r.resetElectionDeadline()
+	r.l.Unlock()
+
+	r.wg.Add(3 + len(r.peers))
+	go r.run()
+	go r.applyCommitted()
+	go r.tellLeaderships()
+	for id, peer := range r.peers {
+		go r.replicate(id, peer)
+	}
+}
+
+// Stop stops raft, waits for everything it runs in background, storage is left open
+func (r *Raft) Stop() {
+	r.stopOnce.Do(func() {
+		r.l.Lock()
+		close(r.stop)
+		r.l.Unlock()
+		r.cancel()
+	})
+	r.wg.Wait()
+}
+
+// caller must hold the lock
+func (r *Raft) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Leader returns id of the leader, empty if unknown, and whether or not this supervisor is the leader and ready to serve
+func (r *Raft) Leader() (id string, self bool) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	return r.leaderID, r.role == role_leader && r.ready
+}
+
+// Propose appends writes to leader's log, and returns once they are applied to db of the leader,
+// ErrNotLeader if this supervisor isn't the leader, ErrProposeTimeout if ctx is done before that
+func (r *Raft) Propose(ctx context.Context, writes []*pb.RaftWrite) error {
+	r.l.Lock()
+	if r.stopped() {
+		r.l.Unlock()
+		return ErrStopped
+	}
+	if r.role != role_leader {
+		r.l.Unlock()
+		return ErrNotLeader
+	}
+
+	entry := &pb.RaftEntry{
+		Term:   r.term,
+		Index:  r.log.lastIndex + 1,
+		Writes: writes,
+	}
+	if err := r.log.append(entry); err != nil {
+		r.l.Unlock()
+		return err
+	}
+	p := &proposal{
+		term: entry.Term,
+		done: make(chan error, 1),
+	}
+	r.proposals[entry.Index] = p
+	r.kickReplicators()
+	r.advanceCommit()
+	r.l.Unlock()
+
+	select {
+	case err := <-p.done:
+		return err
+	case <-ctx.Done():
+		r.l.Lock()
+		if r.proposals[entry.Index] == p {
+			delete(r.proposals, entry.Index)
+		}
+		r.l.Unlock()
+		return ErrProposeTimeout
+	case <-r.stop:
+		return ErrStopped
+	}
+}
+
+// RequestVote grants candidate the vote of this term, if not granted to another one yet,
+// and candidate's log is at least as up to date as this one's
+func (r *Raft) RequestVote(ctx context.Context, req *pb.RaftVoteReq) (*pb.RaftVoteRsp, error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.stopped() {
+		return nil, ErrStopped
+	}
+	if err := r.checkPeer(ctx, req.CandidateID); err != nil {
+		return nil, err
+	}
+
+	if req.Term > r.term {
+		r.becomeFollower(req.Term)
+	}
+	rsp := &pb.RaftVoteRsp{Term: r.term}
+	if req.Term < r.term {
+		return rsp, nil
+	}
+
+	upToDate := req.LastLogTerm > r.log.lastTerm || (req.LastLogTerm == r.log.lastTerm && req.LastLogIndex >= r.log.lastIndex)
+	if (r.votedFor == "" || r.votedFor == req.CandidateID) && upToDate {
+		r.votedFor = req.CandidateID
+		if err := r.persistMeta(); err != nil {
+			return nil, err
+		}
+		r.resetElectionDeadline()
+		rsp.Granted = true
+		logger.Debugf("%s votes for %s in term %d", r.cfg.ID, req.CandidateID, r.term)
+	}
+
+	return rsp, nil
+}
+
+// AppendEntries appends leader's entries after the one both logs have, dropping conflicting ones of this log first
+func (r *Raft) AppendEntries(ctx context.Context, req *pb.RaftAppendReq) (*pb.RaftAppendRsp, error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.stopped() {
+		return nil, ErrStopped
+	}
+	if err := r.checkPeer(ctx, req.LeaderID); err != nil {
+		return nil, err
+	}
+
+	rsp := &pb.RaftAppendRsp{Term: r.term, LastLogIndex: r.log.lastIndex}
+	if req.Term < r.term {
+		return rsp, nil
+	}
+	if req.Term > r.term || r.role != role_follower {
+		r.becomeFollower(req.Term)
+	}
+	rsp.Term = r.term
+	r.leaderID = req.LeaderID
+	r.resetElectionDeadline()
+
+	// leader retries from where the logs may match
+	if req.PrevLogIndex > r.log.lastIndex {
+		return rsp, nil
+	}
+	// entries compacted are committed, they match leader's
+	entries := req.Entries
+	if req.PrevLogIndex < r.log.snapIndex {
+		for len(entries) > 0 && entries[0].Index <= r.log.snapIndex {
+			entries = entries[1:]
+		}
+	} else {
+		prevTerm, err := r.log.term(req.PrevLogIndex)
+		if err != nil {
+			return nil, err
+		}
+		if prevTerm != req.PrevLogTerm {
+			rsp.LastLogIndex = req.PrevLogIndex - 1
+			return rsp, nil
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.Index <= r.log.lastIndex {
+			term, err := r.log.term(entry.Index)
+			if err != nil {
+				return nil, err
+			}
+			if term == entry.Term {
+				continue
+			}
+			if entry.Index <= r.commitIndex {
+				return nil, fmt.Errorf("supervisor/cluster: entry %d of leader %s conflicts with a committed one", entry.Index, req.LeaderID)
+			}
+			if err := r.log.truncate(entry.Index); err != nil {
+				return nil, err
+			}
+		}
+		if err := r.log.append(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	if last := req.PrevLogIndex + uint64(len(req.Entries)); req.LeaderCommit > r.commitIndex && last > r.commitIndex {
+		r.commitIndex = req.LeaderCommit
+		if last < r.commitIndex {
+			r.commitIndex = last
+		}
+		r.kickApplier()
+	}
+	rsp.Success = true
+	rsp.LastLogIndex = r.log.lastIndex
+
+	return rsp, nil
+}
+
+// caller of an rpc must be peer id, as its certificate tells
+func (r *Raft) checkPeer(ctx context.Context, id string) error {
+	if _, ok := r.peers[id]; !ok {
+		return grpc.Errorf(codes.PermissionDenied, "supervisor/cluster: %s is not a peer", id)
+	}
+	if name := mtls.PeerName(ctx); name != id {
+		return grpc.Errorf(codes.PermissionDenied, "supervisor/cluster: %q calls as peer %s", name, id)
+	}
+
+	return nil
+}
+
+// InstallSnapshot replaces db and log with leader's snapshot, chunk by chunk,
+// the log starts over after the snapshot's last entry once its last chunk is installed
+func (r *Raft) InstallSnapshot(ctx context.Context, req *pb.RaftSnapshotReq) (*pb.RaftSnapshotRsp, error) {
+	if err := r.checkPeer(ctx, req.LeaderID); err != nil {
+		return nil, err
+	}
+
+	r.applyL.Lock()
+	defer r.applyL.Unlock()
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.stopped() {
+		return nil, ErrStopped
+	}
+
+	rsp := &pb.RaftSnapshotRsp{Term: r.term}
+	if req.Term < r.term {
+		return rsp, nil
+	}
+	if req.Term > r.term || r.role != role_follower {
+		r.becomeFollower(req.Term)
+	}
+	rsp.Term = r.term
+	r.leaderID = req.LeaderID
+	r.resetElectionDeadline()
+
+	if req.Seq == 0 {
+		// nothing to install if the entries are committed here already
+		if req.LastIndex <= r.commitIndex {
+			r.installing = nil
+			return rsp, nil
+		}
+		// db and log are dropped first, if it's never done, the log is replayed from its start or another snapshot is sent
+		logger.Infof("%s installs snapshot of %s at %d", r.cfg.ID, req.LeaderID, req.LastIndex)
+		if err := r.dropAll(); err != nil {
+			r.installing = nil
+			return nil, err
+		}
+		r.installing = &snapshotInstall{
+			leaderID:  req.LeaderID,
+			term:      req.Term,
+			lastIndex: req.LastIndex,
+			lastTerm:  req.LastTerm,
+		}
+	}
+	in := r.installing
+	if in == nil || in.leaderID != req.LeaderID || in.term != req.Term || in.lastIndex != req.LastIndex || in.next != req.Seq {
+		return nil, fmt.Errorf("supervisor/cluster: snapshot chunk %d of %s at %d out of order", req.Seq, req.LeaderID, req.LastIndex)
+	}
+
+	for _, write := range req.Writes {
+		if err := r.storage.SetCF(write.Cf, write.Key, write.Value); err != nil {
+			r.installing = nil
+			return nil, err
+		}
+	}
+	in.next++
+	if req.Done {
+		r.installing = nil
+		if err := r.log.reset(in.lastIndex, in.lastTerm); err != nil {
+			return nil, err
+		}
+		if err := r.log.setApplied(in.lastIndex); err != nil {
+			return nil, err
+		}
+		r.commitIndex, r.lastApplied = in.lastIndex, in.lastIndex
+		logger.Infof("%s installed snapshot of %s at %d", r.cfg.ID, req.LeaderID, in.lastIndex)
+	}
+	rsp.Success = true
+
+	return rsp, nil
+}
+
+// drop the log and what it's applied to db, for a snapshot to be installed, caller must hold both locks
+func (r *Raft) dropAll() error {
+	if err := r.log.reset(0, 0); err != nil {
+		return err
+	}
+	if err := r.log.setApplied(0); err != nil {
+		return err
+	}
+	r.commitIndex, r.lastApplied = 0, 0
+
+	for _, cf := range account.FarmerColumnFamilies {
+		var keys [][]byte
+		if err := r.storage.IterateCF(cf, func(key, value []byte) bool {
+			keys = append(keys, key)
+			return true
+		}); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := r.storage.DelCF(cf, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// starts elections once leader isn't heard from for long, and steps leader down once a majority isn't
+func (r *Raft) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.cfg.HeartbeatInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.l.Lock()
+			if r.role == role_leader {
+				r.checkQuorum()
+			}
+			due := r.role != role_leader && time.Now().After(r.electionDeadline)
+			r.l.Unlock()
+			if due {
+				r.campaign()
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// leader cut off from a majority steps down, so its writes fail instead of waiting forever,
+// caller must hold the lock
+func (r *Raft) checkQuorum() {
+	acked := 1
+	for _, at := range r.lastAck {
+		if time.Since(at) < r.cfg.ElectionTimeout {
+			acked++
+		}
+	}
+	if acked < r.cfg.quorum() {
+		logger.Warningf("%s hears from %d of %d supervisors, no quorum", r.cfg.ID, acked, len(r.cfg.Peers))
+		r.becomeFollower(r.term)
+	}
+}
+
+// become a candidate of the next term and ask peers for votes
+func (r *Raft) campaign() {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	r.role = role_candidate
+	r.term++
+	r.votedFor = r.cfg.ID
+	r.leaderID = ""
+	r.resetElectionDeadline()
+	if err := r.persistMeta(); err != nil {
+		logger.Errorf("%s persist raft meta err: %v", r.cfg.ID, err)
+		return
+	}
+	logger.Infof("%s starts election of term %d", r.cfg.ID, r.term)
+
+	req := &pb.RaftVoteReq{
+		Term:         r.term,
+		CandidateID:  r.cfg.ID,
+		LastLogIndex: r.log.lastIndex,
+		LastLogTerm:  r.log.lastTerm,
+	}
+	votes := 1
+	if votes >= r.cfg.quorum() {
+		r.becomeLeader()
+		return
+	}
+
+	r.wg.Add(len(r.peers))
+	for id, peer := range r.peers {
+		go func(id string, peer pb.SupervisorRaftClient) {
+			defer r.wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.ctx, r.cfg.ElectionTimeout)
+			rsp, err := peer.RequestVote(ctx, req)
+			cancel()
+			if err != nil {
+				logger.Debugf("%s request vote of %s err: %v", r.cfg.ID, id, err)
+				return
+			}
+
+			r.l.Lock()
+			defer r.l.Unlock()
+			if r.stopped() {
+				return
+			}
+			if rsp.Term > r.term {
+				r.becomeFollower(rsp.Term)
+				return
+			}
+			if r.role != role_candidate || r.term != req.Term || !rsp.Granted {
+				return
+			}
+			if votes++; votes == r.cfg.quorum() {
+				r.becomeLeader()
+			}
+		}(id, peer)
+	}
+}
+
+// caller must hold the lock
+func (r *Raft) becomeLeader() {
+	r.role = role_leader
+	r.leaderID = r.cfg.ID
+	r.ready = false
+	for id := range r.peers {
+		r.nextIndex[id] = r.log.lastIndex + 1
+		r.matchIndex[id] = 0
+		r.lastAck[id] = time.Now()
+	}
+
+	// entries of former terms are committed along with the first one of leader's term
+	entry := &pb.RaftEntry{
+		Term:  r.term,
+		Index: r.log.lastIndex + 1,
+	}
+	if err := r.log.append(entry); err != nil {
+		logger.Errorf("%s append raft entry err: %v", r.cfg.ID, err)
+		r.becomeFollower(r.term)
+		return
+	}
+	r.termStart = entry.Index
+	logger.Infof("%s is leader of term %d", r.cfg.ID, r.term)
+
+	r.kickReplicators()
+	r.advanceCommit()
+}
+
+// caller must hold the lock
+func (r *Raft) becomeFollower(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		if err := r.persistMeta(); err != nil {
+			logger.Errorf("%s persist raft meta err: %v", r.cfg.ID, err)
+		}
+	}
+
+	wasLeader := r.role == role_leader
+	r.role = role_follower
+	r.resetElectionDeadline()
+	if !wasLeader {
+		return
+	}
+
+	logger.Infof("%s steps down in term %d", r.cfg.ID, r.term)
+	r.leaderID = ""
+	r.ready = false
+	for index, p := range r.proposals {
+		p.done <- ErrLeadershipLost
+		delete(r.proposals, index)
+	}
+	r.tellLeadership(false)
+}
+
+// caller must hold the lock
+func (r *Raft) persistMeta() error {
+	return r.log.setMeta(&raftMeta{Term: r.term, VotedFor: r.votedFor})
+}
+
+// caller must hold the lock
+func (r *Raft) resetElectionDeadline() {
+	timeout := r.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(r.cfg.ElectionTimeout)))
+	r.electionDeadline = time.Now().Add(timeout)
+}
+
+// commit the last entry of leader's term a majority has, caller must hold the lock
+func (r *Raft) advanceCommit() {
+	matches := []uint64{r.log.lastIndex}
+	for _, match := range r.matchIndex {
+		matches = append(matches, match)
+	}
+	sort.Sort(sort.Reverse(uint64s(matches)))
+
+	if n := matches[r.cfg.quorum()-1]; n > r.commitIndex && n >= r.termStart {
+		r.commitIndex = n
+		r.kickApplier()
+	}
+}
+
+// caller must hold the lock
+func (r *Raft) tellLeadership(leader bool) {
+	r.leaderships = append(r.leaderships, leadership{leader: leader, term: r.term})
+	select {
+	case r.leadershipC <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Raft) kickReplicators() {
+	for _, c := range r.replicateC {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *Raft) kickApplier() {
+	select {
+	case r.applyC <- struct{}{}:
+	default:
+	}
+}
+
+// leader sends peer the entries it doesn't have yet, on every heartbeat, or once kicked
+func (r *Raft) replicate(id string, peer pb.SupervisorRaftClient) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.replicateC[id]:
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+
+		r.l.Lock()
+		if r.role != role_leader {
+			r.l.Unlock()
+			continue
+		}
+		next := r.nextIndex[id]
+		if next-1 < r.log.snapIndex {
+			term := r.term
+			r.l.Unlock()
+			r.sendSnapshot(id, peer, term)
+			continue
+		}
+		prevTerm, err := r.log.term(next - 1)
+		var entries []*pb.RaftEntry
+		if err == nil {
+			entries, err = r.log.entries(next, max_append_entries)
+		}
+		req := &pb.RaftAppendReq{
+			Term:         r.term,
+			LeaderID:     r.cfg.ID,
+			PrevLogIndex: next - 1,
+			PrevLogTerm:  prevTerm,
+			Entries:      entries,
+			LeaderCommit: r.commitIndex,
+		}
+		r.l.Unlock()
+		if err != nil {
+			logger.Errorf("%s read raft log for %s err: %v", r.cfg.ID, id, err)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(r.ctx, r.cfg.ElectionTimeout)
+		rsp, err := peer.AppendEntries(ctx, req)
+		cancel()
+		if err != nil {
+			logger.Debugf("%s append entries to %s err: %v", r.cfg.ID, id, err)
+			continue
+		}
+
+		r.l.Lock()
+		switch {
+		case r.stopped():
+		case rsp.Term > r.term:
+			r.becomeFollower(rsp.Term)
+		case r.role != role_leader || r.term != req.Term:
+		case rsp.Success:
+			r.lastAck[id] = time.Now()
+			if match := req.PrevLogIndex + uint64(len(req.Entries)); match > r.matchIndex[id] {
+				r.matchIndex[id] = match
+				r.nextIndex[id] = match + 1
+				r.advanceCommit()
+			}
+			if r.nextIndex[id] <= r.log.lastIndex {
+				r.kick(id)
+			}
+		default:
+			r.lastAck[id] = time.Now()
+			// back off to the end of peer's log, or to the entry before the mismatched one
+			next := req.PrevLogIndex
+			if rsp.LastLogIndex+1 < next {
+				next = rsp.LastLogIndex + 1
+			}
+			if next < 1 {
+				next = 1
+			}
+			r.nextIndex[id] = next
+			r.kick(id)
+		}
+		r.l.Unlock()
+	}
+}
+
+// leader sends peer a snapshot of its db, once peer misses entries compacted,
+// peer is replicated entries after the snapshot's last one once it's installed
+func (r *Raft) sendSnapshot(id string, peer pb.SupervisorRaftClient, term uint64) {
+	snap, index, lastTerm, err := r.snapshot()
+	if err != nil {
+		logger.Errorf("%s snapshot for %s err: %v", r.cfg.ID, id, err)
+		return
+	}
+	defer snap.Release()
+	logger.Infof("%s sends %s snapshot at %d", r.cfg.ID, id, index)
+
+	req := &pb.RaftSnapshotReq{
+		Term:      term,
+		LeaderID:  r.cfg.ID,
+		LastIndex: index,
+		LastTerm:  lastTerm,
+	}
+	// false once the snapshot isn't needed any more
+	var installed bool
+	send := func(done bool) (bool, error) {
+		req.Done = done
+		ctx, cancel := context.WithTimeout(r.ctx, r.cfg.ElectionTimeout)
+		rsp, err := peer.InstallSnapshot(ctx, req)
+		cancel()
+		if err != nil {
+			return false, err
+		}
+
+		r.l.Lock()
+		defer r.l.Unlock()
+		if rsp.Term > r.term {
+			r.becomeFollower(rsp.Term)
+		}
+		if r.stopped() || r.role != role_leader || r.term != term {
+			return false, ErrLeadershipLost
+		}
+		r.lastAck[id] = time.Now()
+		req.Seq++
+		req.Writes = nil
+		installed = done || !rsp.Success
+		return rsp.Success && !done, nil
+	}
+
+	goon := true
+	for _, cf := range account.FarmerColumnFamilies {
+		var sendErr error
+		err := snap.IterateCF(cf, func(key, value []byte) bool {
+			req.Writes = append(req.Writes, &pb.RaftWrite{Cf: cf, Key: key, Value: value})
+			if len(req.Writes) == max_snapshot_writes {
+				goon, sendErr = send(false)
+			}
+			return goon && sendErr == nil
+		})
+		if err == nil {
+			err = sendErr
+		}
+		if err != nil {
+			logger.Errorf("%s send snapshot to %s err: %v", r.cfg.ID, id, err)
+			return
+		}
+		if !goon {
+			break
+		}
+	}
+	if goon {
+		if _, err := send(true); err != nil {
+			logger.Errorf("%s send snapshot to %s err: %v", r.cfg.ID, id, err)
+			return
+		}
+	}
+	if !installed {
+		return
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.role != role_leader || r.term != term {
+		return
+	}
+	if index > r.matchIndex[id] {
+		r.matchIndex[id] = index
+		r.advanceCommit()
+	}
+	r.nextIndex[id] = index + 1
+	r.kick(id)
+}
+
+// snapshot of db as it is once the log is applied up to index, caller must release it
+func (r *Raft) snapshot() (snap store.Snapshot, index, term uint64, err error) {
+	snapshotter, ok := r.storage.(store.Snapshotter)
+	if !ok {
+		return nil, 0, 0, errors.New("supervisor/cluster: storage can't be snapshotted")
+	}
+
+	r.applyL.Lock()
+	defer r.applyL.Unlock()
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	index = r.lastApplied
+	if term, err = r.log.term(index); err != nil {
+		return nil, 0, 0, err
+	}
+	if snap, err = snapshotter.Snapshot(); err != nil {
+		return nil, 0, 0, err
+	}
+	return snap, index, term, nil
+}
+
+func (r *Raft) kick(id string) {
+	select {
+	case r.replicateC[id] <- struct{}{}:
+	default:
+	}
+}
+
+// apply committed entries to db in order, and tell proposers
+func (r *Raft) applyCommitted() {
+	defer r.wg.Done()
+
+	for {
+		select {
+		case <-r.applyC:
+		case <-r.stop:
+			return
+		}
+
+		for {
+			r.applyL.Lock()
+			r.l.Lock()
+			if r.stopped() || r.lastApplied >= r.commitIndex {
+				r.l.Unlock()
+				r.applyL.Unlock()
+				break
+			}
+			index := r.lastApplied + 1
+			entry, err := r.log.entry(index)
+			r.l.Unlock()
+			if err == nil {
+				err = r.apply(entry)
+			}
+			if err != nil {
+				r.applyL.Unlock()
+				logger.Errorf("%s apply raft entry %d err: %v", r.cfg.ID, index, err)
+				break
+			}
+
+			r.l.Lock()
+			r.lastApplied = index
+			if p, ok := r.proposals[index]; ok {
+				delete(r.proposals, index)
+				if p.term == entry.Term {
+					p.done <- nil
+				} else {
+					p.done <- ErrLeadershipLost
+				}
+			}
+			if r.role == role_leader && index == r.termStart && entry.Term == r.term {
+				r.tellLeadership(true)
+			}
+			r.compact()
+			r.l.Unlock()
+			r.applyL.Unlock()
+		}
+	}
+}
+
+// compact the log once enough entries are applied since it last was, caller must hold the lock
+func (r *Raft) compact() {
+	entries := r.cfg.snapshotEntries()
+	if r.lastApplied-r.log.snapIndex < entries {
+		return
+	}
+	if err := r.log.compact(r.lastApplied - entries/2); err != nil {
+		logger.Errorf("%s compact raft log err: %v", r.cfg.ID, err)
+		return
+	}
+	logger.Debugf("%s raft log compacted to %d", r.cfg.ID, r.log.snapIndex)
+}
+
+// writes of a committed entry go to db, then how far the log is applied
+func (r *Raft) apply(entry *pb.RaftEntry) error {
+	for _, write := range entry.Writes {
+		var err error
+		if write.Delete {
+			err = r.storage.DelCF(write.Cf, write.Key)
+		} else {
+			err = r.storage.SetCF(write.Cf, write.Key, write.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.log.setApplied(entry.Index)
+}
+
+// tell callback leadership changes in order, leader is ready once told
+func (r *Raft) tellLeaderships() {
+	defer r.wg.Done()
+
+	for {
+		select {
+		case <-r.leadershipC:
+		case <-r.stop:
+			return
+		}
+
+		r.l.Lock()
+		leaderships := r.leaderships
+		r.leaderships = nil
+		r.l.Unlock()
+
+		for _, change := range leaderships {
+			if r.onLeadership != nil {
+				r.onLeadership(change.leader)
+			}
+			if change.leader {
+				r.l.Lock()
+				if r.role == role_leader && r.term == change.term {
+					r.ready = true
+					logger.Infof("%s is ready to serve as leader of term %d", r.cfg.ID, r.term)
+				}
+				r.l.Unlock()
+			}
+		}
+	}
+}
+
+type uint64s []uint64
+
+func (s uint64s) Len() int           { return len(s) }
+func (s uint64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
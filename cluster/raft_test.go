@@ -0,0 +1,513 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/mtls"
+	"github.com/conseweb/supervisor/mtls/mtlstest"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type RaftTest struct {
+	dir string
+	// issues certificates of members
+	ca *mtlstest.CA
+}
+
+var _ = check.Suite(&RaftTest{})
+
+func (t *RaftTest) SetUpTest(c *check.C) {
+	t.dir = filepath.Join(os.TempDir(), "testCluster")
+	os.RemoveAll(t.dir)
+	t.ca = nil
+}
+
+func (t *RaftTest) TearDownTest(c *check.C) {
+	os.RemoveAll(t.dir)
+}
+
+// member of a test cluster, and the leadership changes it was told
+type testMember struct {
+	*Cluster
+	local       store.Storage
+	l           *sync.Mutex
+	leaderships []bool
+}
+
+func (m *testMember) told() []bool {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	return append([]bool(nil), m.leaderships...)
+}
+
+func (m *testMember) stop() {
+	m.Storage().Close()
+}
+
+// configs of n supervisors listening on localhost
+func (t *RaftTest) newConfigs(c *check.C, n int) []*Config {
+	peers := make(map[string]string)
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, check.IsNil)
+		listeners[i] = lis
+		peers[fmt.Sprintf("sv%d", i)] = lis.Addr().String()
+	}
+
+	if t.ca == nil {
+		var err error
+		t.ca, err = mtlstest.NewCA(filepath.Join(t.dir, "certs"))
+		c.Assert(err, check.IsNil)
+	}
+	cfgs := make([]*Config, n)
+	for i := range cfgs {
+		id := fmt.Sprintf("sv%d", i)
+		certFile, keyFile, err := t.ca.IssuePeer(id)
+		c.Assert(err, check.IsNil)
+		cfgs[i] = &Config{
+			Enabled:           true,
+			ID:                id,
+			Peers:             peers,
+			ElectionTimeout:   time.Millisecond * 300,
+			HeartbeatInterval: time.Millisecond * 50,
+			CertFile:          certFile,
+			KeyFile:           keyFile,
+			CAFile:            t.ca.File,
+			Listener:          listeners[i],
+		}
+	}
+	return cfgs
+}
+
+func (t *RaftTest) startMember(c *check.C, cfg *Config) *testMember {
+	local, err := store.NewStore("rocksdb", filepath.Join(t.dir, cfg.ID))
+	c.Assert(err, check.IsNil)
+	cluster, err := New(cfg, local)
+	c.Assert(err, check.IsNil)
+
+	m := &testMember{Cluster: cluster, local: local, l: &sync.Mutex{}}
+	cluster.OnLeadership(func(leader bool) {
+		m.l.Lock()
+		m.leaderships = append(m.leaderships, leader)
+		m.l.Unlock()
+	})
+	c.Assert(cluster.Start(nil), check.IsNil)
+
+	return m
+}
+
+// the only ready leader among members, once every member knows it
+func waitLeader(c *check.C, members []*testMember) *testMember {
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		var leader *testMember
+		leaders, agreed := 0, true
+		for _, m := range members {
+			if _, self := m.Leader(); self {
+				leader = m
+				leaders++
+			}
+		}
+		if leaders == 1 {
+			for _, m := range members {
+				if id, _ := m.Leader(); id != leader.cfg.ID {
+					agreed = false
+				}
+			}
+			if agreed {
+				return leader
+			}
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	c.Fatal("no leader elected")
+	return nil
+}
+
+// wait until key of default column family is value in local db of every member, empty value means deleted
+func waitValue(c *check.C, members []*testMember, key, value string) {
+	deadline := time.Now().Add(time.Second * 10)
+	for _, m := range members {
+		for {
+			got, err := m.local.Get([]byte(key))
+			if (err == nil && string(got) == value) || (value == "" && err == store.ErrNotFound) {
+				break
+			}
+			if time.Now().After(deadline) {
+				c.Fatalf("%s has %q of %s, not %q, err: %v", m.cfg.ID, got, key, value, err)
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+	}
+}
+
+func (t *RaftTest) TestReplicate(c *check.C) {
+	members := []*testMember{}
+	for _, cfg := range t.newConfigs(c, 3) {
+		m := t.startMember(c, cfg)
+		defer m.stop()
+		members = append(members, m)
+	}
+
+	leader := waitLeader(c, members)
+	c.Check(leader.told(), check.DeepEquals, []bool{true})
+	c.Assert(leader.Storage().Set([]byte("k1"), []byte("v1")), check.IsNil)
+	// leader has it applied once written
+	got, err := leader.local.Get([]byte("k1"))
+	c.Assert(err, check.IsNil)
+	c.Check(string(got), check.Equals, "v1")
+	waitValue(c, members, "k1", "v1")
+
+	c.Assert(leader.Storage().Del([]byte("k1")), check.IsNil)
+	waitValue(c, members, "k1", "")
+
+	for _, m := range members {
+		if m != leader {
+			c.Check(m.Storage().Set([]byte("k2"), []byte("v2")), check.Equals, ErrNotLeader)
+			c.Check(m.told(), check.HasLen, 0)
+		}
+	}
+	_, err = leader.local.Get([]byte("k2"))
+	c.Check(err, check.Equals, store.ErrNotFound)
+}
+
+func (t *RaftTest) TestFailover(c *check.C) {
+	members := []*testMember{}
+	for _, cfg := range t.newConfigs(c, 3) {
+		members = append(members, t.startMember(c, cfg))
+	}
+
+	leader := waitLeader(c, members)
+	c.Assert(leader.Storage().Set([]byte("k1"), []byte("v1")), check.IsNil)
+	leader.stop()
+
+	survivors := []*testMember{}
+	for _, m := range members {
+		if m != leader {
+			survivors = append(survivors, m)
+			defer m.stop()
+		}
+	}
+	newLeader := waitLeader(c, survivors)
+	c.Check(newLeader.told(), check.DeepEquals, []bool{true})
+	// what the old leader committed survives it
+	got, err := newLeader.local.Get([]byte("k1"))
+	c.Assert(err, check.IsNil)
+	c.Check(string(got), check.Equals, "v1")
+
+	c.Assert(newLeader.Storage().Set([]byte("k2"), []byte("v2")), check.IsNil)
+	waitValue(c, survivors, "k2", "v2")
+	c.Check(leader.Storage().Set([]byte("k3"), []byte("v3")), check.Equals, ErrStopped)
+}
+
+// a leader cut off from the others steps down, its writes fail instead of waiting for a quorum
+func (t *RaftTest) TestLeaderWithoutQuorum(c *check.C) {
+	cfgs := t.newConfigs(c, 3)
+	members := []*testMember{}
+	for _, cfg := range cfgs {
+		cfg.ProposeTimeout = time.Second * 5
+		members = append(members, t.startMember(c, cfg))
+	}
+
+	leader := waitLeader(c, members)
+	defer leader.stop()
+	for _, m := range members {
+		if m != leader {
+			m.stop()
+		}
+	}
+
+	start := time.Now()
+	c.Check(leader.Storage().Set([]byte("k1"), []byte("v1")), check.NotNil)
+	c.Check(time.Since(start) < cfgs[0].ProposeTimeout, check.Equals, true)
+	_, self := leader.Leader()
+	c.Check(self, check.Equals, false)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for told := leader.told(); len(told) < 2 || told[len(told)-1]; told = leader.told() {
+		if time.Now().After(deadline) {
+			c.Fatalf("leader was told %v", told)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	c.Check(leader.Storage().Set([]byte("k2"), []byte("v2")), check.Equals, ErrNotLeader)
+}
+
+// cluster service serves peers only, each as the peer its certificate tells
+func (t *RaftTest) TestPeersOnly(c *check.C) {
+	members := []*testMember{}
+	for _, cfg := range t.newConfigs(c, 3) {
+		m := t.startMember(c, cfg)
+		defer m.stop()
+		members = append(members, m)
+	}
+	leader := waitLeader(c, members)
+	var follower, other *testMember
+	for _, m := range members {
+		switch {
+		case m == leader:
+		case follower == nil:
+			follower = m
+		default:
+			other = m
+		}
+	}
+
+	intruderCert, intruderKey, err := t.ca.IssuePeer("intruder")
+	c.Assert(err, check.IsNil)
+	for _, caller := range []struct {
+		certFile, keyFile string
+	}{
+		// signed by the ca, but not a peer
+		{intruderCert, intruderKey},
+		// a peer, but not the leader it claims to be
+		{other.cfg.CertFile, other.cfg.KeyFile},
+	} {
+		_, clientTLS, err := mtls.Load(caller.certFile, caller.keyFile, t.ca.File)
+		c.Assert(err, check.IsNil)
+		conn, err := grpc.Dial(follower.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)))
+		c.Assert(err, check.IsNil)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		defer cancel()
+		_, err = pb.NewSupervisorRaftClient(conn).AppendEntries(ctx, &pb.RaftAppendReq{Term: 100, LeaderID: leader.cfg.ID})
+		c.Check(grpc.Code(err), check.Equals, codes.PermissionDenied)
+		_, err = pb.NewSupervisorRaftClient(conn).RequestVote(ctx, &pb.RaftVoteReq{Term: 100, CandidateID: leader.cfg.ID})
+		c.Check(grpc.Code(err), check.Equals, codes.PermissionDenied)
+		fctx := metadata.NewContext(ctx, metadata.Pairs(forwarded_by_key, leader.cfg.ID))
+		_, err = pb.NewFarmerPublicClient(conn).FarmerOnLine(fctx, &pb.FarmerOnLineReq{})
+		c.Check(grpc.Code(err), check.Equals, codes.PermissionDenied)
+	}
+
+	// nothing of it disturbed the cluster
+	c.Check(leader.Storage().Set([]byte("k1"), []byte("v1")), check.IsNil)
+	waitValue(c, members, "k1", "v1")
+	id, _ := follower.Leader()
+	c.Check(id, check.Equals, leader.cfg.ID)
+}
+
+// a member restarted on its db catches up with entries it missed
+func (t *RaftTest) TestRestartMember(c *check.C) {
+	cfgs := t.newConfigs(c, 3)
+	members := []*testMember{}
+	for _, cfg := range cfgs {
+		members = append(members, t.startMember(c, cfg))
+	}
+
+	leader := waitLeader(c, members)
+	c.Assert(leader.Storage().Set([]byte("k1"), []byte("v1")), check.IsNil)
+	waitValue(c, members, "k1", "v1")
+
+	var follower int
+	for i, m := range members {
+		if m != leader {
+			follower = i
+			break
+		}
+	}
+	members[follower].stop()
+	c.Assert(leader.Storage().Set([]byte("k2"), []byte("v2")), check.IsNil)
+
+	lis, err := net.Listen("tcp", cfgs[follower].Peers[cfgs[follower].ID])
+	c.Assert(err, check.IsNil)
+	cfgs[follower].Listener = lis
+	members[follower] = t.startMember(c, cfgs[follower])
+	for _, m := range members {
+		defer m.stop()
+	}
+
+	waitValue(c, members, "k2", "v2")
+	waitLeader(c, members)
+}
+
+// a member missing entries the leader compacted is sent a snapshot, which replaces its db
+func (t *RaftTest) TestSnapshot(c *check.C) {
+	cfgs := t.newConfigs(c, 3)
+	members := []*testMember{}
+	for _, cfg := range cfgs {
+		cfg.SnapshotEntries = 8
+		members = append(members, t.startMember(c, cfg))
+	}
+
+	leader := waitLeader(c, members)
+	c.Assert(leader.Storage().Set([]byte("gone"), []byte("v")), check.IsNil)
+	waitValue(c, members, "gone", "v")
+
+	var follower int
+	for i, m := range members {
+		if m != leader {
+			follower = i
+			break
+		}
+	}
+	members[follower].stop()
+	c.Assert(leader.Storage().Del([]byte("gone")), check.IsNil)
+	for i := 0; i < max_snapshot_writes+10; i++ {
+		c.Assert(leader.Storage().Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i))), check.IsNil)
+	}
+	leader.raft.l.Lock()
+	compacted := leader.raft.log.snapIndex
+	leader.raft.l.Unlock()
+	c.Assert(compacted > 2, check.Equals, true)
+
+	lis, err := net.Listen("tcp", cfgs[follower].Peers[cfgs[follower].ID])
+	c.Assert(err, check.IsNil)
+	cfgs[follower].Listener = lis
+	members[follower] = t.startMember(c, cfgs[follower])
+	for _, m := range members {
+		defer m.stop()
+	}
+
+	for i := 0; i < max_snapshot_writes+10; i++ {
+		waitValue(c, members, fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+	waitValue(c, members, "gone", "")
+	// entries after the snapshot are replicated as usual, the restarted member may have called an election
+	leader = waitLeader(c, members)
+	c.Assert(leader.Storage().Set([]byte("after"), []byte("v")), check.IsNil)
+	waitValue(c, members, "after", "v")
+
+	restarted := members[follower].raft
+	restarted.l.Lock()
+	c.Check(restarted.log.snapIndex >= compacted, check.Equals, true)
+	restarted.l.Unlock()
+}
+
+func (t *RaftTest) TestLogTruncate(c *check.C) {
+	storage, err := store.NewStore("rocksdb", filepath.Join(t.dir, "log"))
+	c.Assert(err, check.IsNil)
+	defer storage.Close()
+
+	log, err := newRaftLog(storage)
+	c.Assert(err, check.IsNil)
+	for i, term := range []uint64{1, 1, 2, 2, 3} {
+		c.Assert(log.append(&pb.RaftEntry{Term: term, Index: uint64(i + 1)}), check.IsNil)
+	}
+	c.Check(log.append(&pb.RaftEntry{Term: 3, Index: 7}), check.NotNil)
+
+	c.Assert(log.truncate(4), check.IsNil)
+	c.Check(log.lastIndex, check.Equals, uint64(3))
+	c.Check(log.lastTerm, check.Equals, uint64(2))
+	entries, err := log.entries(2, 10)
+	c.Assert(err, check.IsNil)
+	c.Check(entries, check.HasLen, 2)
+
+	// log is reloaded from db as it was left
+	log, err = newRaftLog(storage)
+	c.Assert(err, check.IsNil)
+	c.Check(log.lastIndex, check.Equals, uint64(3))
+	c.Check(log.lastTerm, check.Equals, uint64(2))
+}
+
+func (t *RaftTest) TestLogCompact(c *check.C) {
+	storage, err := store.NewStore("rocksdb", filepath.Join(t.dir, "log"))
+	c.Assert(err, check.IsNil)
+	defer storage.Close()
+
+	log, err := newRaftLog(storage)
+	c.Assert(err, check.IsNil)
+	for i, term := range []uint64{1, 1, 2, 2, 3} {
+		c.Assert(log.append(&pb.RaftEntry{Term: term, Index: uint64(i + 1)}), check.IsNil)
+	}
+
+	c.Assert(log.compact(3), check.IsNil)
+	_, err = log.entry(3)
+	c.Check(err, check.Equals, errCompacted)
+	_, err = log.entries(2, 10)
+	c.Check(err, check.Equals, errCompacted)
+	term, err := log.term(3)
+	c.Assert(err, check.IsNil)
+	c.Check(term, check.Equals, uint64(2))
+	entries, err := log.entries(4, 10)
+	c.Assert(err, check.IsNil)
+	c.Check(entries, check.HasLen, 2)
+	// compacted entries are never truncated
+	c.Assert(log.truncate(1), check.IsNil)
+	c.Check(log.lastIndex, check.Equals, uint64(3))
+	c.Check(log.lastTerm, check.Equals, uint64(2))
+
+	c.Assert(log.append(&pb.RaftEntry{Term: 4, Index: 4}), check.IsNil)
+	log, err = newRaftLog(storage)
+	c.Assert(err, check.IsNil)
+	c.Check(log.snapIndex, check.Equals, uint64(3))
+	c.Check(log.lastIndex, check.Equals, uint64(4))
+	c.Check(log.lastTerm, check.Equals, uint64(4))
+
+	// a snapshot installed drops the whole log
+	c.Assert(log.reset(10, 5), check.IsNil)
+	log, err = newRaftLog(storage)
+	c.Assert(err, check.IsNil)
+	c.Check(log.snapIndex, check.Equals, uint64(10))
+	c.Check(log.lastIndex, check.Equals, uint64(10))
+	c.Check(log.lastTerm, check.Equals, uint64(5))
+	c.Check(log.append(&pb.RaftEntry{Term: 5, Index: 11}), check.IsNil)
+}
+
+func (t *RaftTest) TestConfigCheck(c *check.C) {
+	valid := func() *Config {
+		return &Config{
+			ID:                "sv0",
+			Address:           "127.0.0.1:9378",
+			Peers:             map[string]string{"sv0": "127.0.0.1:9378", "sv1": "127.0.0.1:9379"},
+			ElectionTimeout:   time.Second,
+			HeartbeatInterval: time.Millisecond * 100,
+			CertFile:          "sv0.pem",
+			KeyFile:           "sv0.key",
+			CAFile:            "ca.pem",
+		}
+	}
+	c.Check(valid().Check(), check.IsNil)
+
+	for _, tc := range []struct {
+		broken func(cfg *Config)
+		err    string
+	}{
+		{func(cfg *Config) { cfg.ID = "" }, ".*no id"},
+		{func(cfg *Config) { cfg.ID = "sv2" }, ".*not one of peers"},
+		{func(cfg *Config) { cfg.Peers["sv1"] = "nowhere" }, ".*invalid address.*sv1.*"},
+		{func(cfg *Config) { cfg.HeartbeatInterval = cfg.ElectionTimeout }, ".*must be longer.*"},
+		{func(cfg *Config) { cfg.CertFile = "" }, ".*mutual tls is required.*"},
+		{func(cfg *Config) { cfg.CAFile = "" }, ".*mutual tls is required.*"},
+	} {
+		cfg := valid()
+		tc.broken(cfg)
+		c.Check(cfg.Check(), check.ErrorMatches, tc.err)
+	}
+}
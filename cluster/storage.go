@@ -0,0 +1,100 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cluster
+
+import (
+	"errors"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account/store"
+	"golang.org/x/net/context"
+)
+
+// Storage is the db every supervisor of a cluster shares,
+// reads are served by the local db, writes are replicated by raft, and only leader can write
+type Storage struct {
+	local store.Storage
+	raft  *Raft
+	// stops the cluster the storage belongs to
+	stop func()
+}
+
+func newStorage(local store.Storage, raft *Raft, stop func()) *Storage {
+	return &Storage{
+		local: local,
+		raft:  raft,
+		stop:  stop,
+	}
+}
+
+func (s *Storage) Get(key []byte) ([]byte, error) {
+	return s.local.Get(key)
+}
+
+func (s *Storage) Set(key, value []byte) error {
+	return s.SetCF(store.DefaultColumnFamily, key, value)
+}
+
+func (s *Storage) Del(key []byte) error {
+	return s.DelCF(store.DefaultColumnFamily, key)
+}
+
+func (s *Storage) GetCF(cf string, key []byte) ([]byte, error) {
+	return s.local.GetCF(cf, key)
+}
+
+// SetCF returns once the write is applied to leader's db, ErrNotLeader on followers,
+// ErrProposeTimeout if it isn't committed within propose timeout
+func (s *Storage) SetCF(cf string, key, value []byte) error {
+	return s.propose(&pb.RaftWrite{Cf: cf, Key: key, Value: value})
+}
+
+// DelCF returns once the delete is applied to leader's db, ErrNotLeader on followers,
+// ErrProposeTimeout if it isn't committed within propose timeout
+func (s *Storage) DelCF(cf string, key []byte) error {
+	return s.propose(&pb.RaftWrite{Cf: cf, Key: key, Delete: true})
+}
+
+func (s *Storage) propose(write *pb.RaftWrite) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.raft.cfg.proposeTimeout())
+	defer cancel()
+
+	return s.raft.Propose(ctx, []*pb.RaftWrite{write})
+}
+
+func (s *Storage) IterateCF(cf string, fn func(key, value []byte) bool) error {
+	return s.local.IterateCF(cf, fn)
+}
+
+func (s *Storage) SeekCF(cf string, start []byte, fn func(key, value []byte) bool) error {
+	return s.local.SeekCF(cf, start, fn)
+}
+
+// Snapshot of the local db
+func (s *Storage) Snapshot() (store.Snapshot, error) {
+	snapshotter, ok := s.local.(store.Snapshotter)
+	if !ok {
+		return nil, errors.New("supervisor/cluster: storage can't be snapshotted")
+	}
+	return snapshotter.Snapshot()
+}
+
+// Close stops the cluster, then closes the local db
+func (s *Storage) Close() error {
+	s.stop()
+	return s.local.Close()
+}
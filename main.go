@@ -17,7 +17,12 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
+
 	"github.com/conseweb/common/config"
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/audit"
+	"github.com/conseweb/supervisor/cli"
 	"github.com/conseweb/supervisor/node"
 	"github.com/hyperledger/fabric/flogging"
 	"github.com/op/go-logging"
@@ -34,6 +39,57 @@ var (
 	logger = logging.MustGetLogger("main")
 	app    = kingpin.New(appName, "A command-line trust-chain supervisor cli.")
 	svnode = app.Command("node", "Supervisor Node")
+	svfsm  = app.Command("fsm", "Farmer account state machine")
+	fsmdot = svfsm.Command("dot", "Render farmer account state machine in graphviz dot")
+
+	svaudit     = app.Command("audit", "Audit log of supervisor decisions")
+	auditverify = svaudit.Command("verify", "Check the hash chain of audit log")
+	auditdir    = auditverify.Flag("dir", "Dir of audit log files, audit.dir of config if not given").String()
+
+	// operator commands, against the node on control socket, or the db of a stopped node
+	output = app.Flag("output", "Output format, table or json").Short('o').Default(cli.OutputTable).Enum(cli.Outputs...)
+	socket = app.Flag("socket", "Control socket of a running node, node.control.socket of config if not given").String()
+	dbpath = app.Flag("db", "DB of a stopped node, used instead of control socket").String()
+
+	svaccount      = app.Command("account", "Farmer accounts")
+	accountget     = svaccount.Command("get", "Show farmer account")
+	accountgetid   = accountget.Arg("farmer", "Farmer ID").Required().String()
+	accountlist    = svaccount.Command("list", "List farmer accounts in service")
+	accountprefix  = accountlist.Flag("prefix", "Farmers whose id starts with it").String()
+	accountstates  = accountlist.Flag("state", "Farmers in the state, repeatable").Strings()
+	accountstored  = accountlist.Flag("stored", "List every farmer in db, not only the ones in service").Bool()
+	accountlimit   = accountlist.Flag("limit", "Max count of farmers, 0 means all").Default("0").Int()
+	accountadjust  = svaccount.Command("adjust", "Set farmer's balance")
+	adjustid       = accountadjust.Arg("farmer", "Farmer ID").Required().String()
+	adjustbalance  = accountadjust.Arg("balance", "New balance").Required().Uint32()
+	adjustreason   = accountadjust.Flag("reason", "Why, goes to farmer's balance journal").Required().String()
+	accountban     = svaccount.Command("ban", "Take farmer out of service until lifted")
+	banid          = accountban.Arg("farmer", "Farmer ID").Required().String()
+	banreason      = accountban.Flag("reason", "Why").String()
+	banlift        = accountban.Flag("lift", "Lift the ban or suspension instead").Bool()
+	svchallenge    = app.Command("challenge", "Farmer challenges")
+	challengeinsp  = svchallenge.Command("inspect", "Show farmer's pending challenge")
+	challengeid    = challengeinsp.Arg("farmer", "Farmer ID").Required().String()
+	challengeclear = challengeinsp.Flag("clear", "Drop the challenge after showing it").Bool()
+
+	svshard   = app.Command("shard", "Shard map of farmers among supervisors")
+	shardmove = svshard.Command("move", "Hand farmers of a slot over to another supervisor")
+	shardslot = shardmove.Arg("slot", "Slot of the shard map").Required().Uint32()
+	shardto   = shardmove.Arg("node", "ID of the supervisor taking the slot over").Required().String()
+
+	svdb       = app.Command("db", "Account db, export and backup work on a running node too, the rest on a stopped node only")
+	dbexport   = svdb.Command("export", "Export farmer accounts as json lines")
+	dbexportf  = dbexport.Flag("file", "Write to file instead of stdout").String()
+	dbimport   = svdb.Command("import", "Import farmer accounts exported by db export")
+	dbimportf  = dbimport.Arg("file", "Exported file, - for stdin").Required().String()
+	dbbackup   = svdb.Command("backup", "Back up every key of db")
+	dbbackupf  = dbbackup.Flag("file", "Write to file instead of stdout").String()
+	dbrestore  = svdb.Command("restore", "Restore a backup into a new db")
+	dbrestoref = dbrestore.Arg("file", "Backup file, - for stdin").Required().String()
+	dbcompact  = svdb.Command("compact", "Compact db")
+
+	svconfig    = app.Command("config", "Supervisor config")
+	configcheck = svconfig.Command("check", "Check config, without starting node")
 )
 
 func init() {
@@ -48,8 +104,136 @@ func init() {
 
 func main() {
 	app.Version(viper.GetString("server.version"))
-	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+	switch cmd := kingpin.MustParse(app.Parse(os.Args[1:])); cmd {
 	case svnode.FullCommand():
 		node.StartNode()
+	case fsmdot.FullCommand():
+		def, err := account.NewFarmerFSMDef(account.FSMConfigFromViper())
+		if err != nil {
+			logger.Fatalf("load farmer state machine err: %v", err)
+		}
+		fmt.Print(def.Dot())
+	case auditverify.FullCommand():
+		dir := *auditdir
+		if dir == "" {
+			dir = audit.ConfigFromViper().Dir
+		}
+		chain, err := audit.Verify(dir)
+		if err != nil {
+			logger.Fatalf("audit log broken after %d records: %v", chain.Records, err)
+		}
+		fmt.Printf("%d records in %d files, head: %s\n", chain.Records, chain.Files, chain.Head)
+	default:
+		runOperatorCommand(cmd)
+	}
+}
+
+func runOperatorCommand(cmd string) {
+	printer, err := cli.NewPrinter(os.Stdout, *output)
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	opts := &cli.Options{
+		Socket: *socket,
+		DBPath: *dbpath,
+		Node:   node.ConfigFromViper(),
+	}
+
+	switch cmd {
+	case dbexport.FullCommand(), dbbackup.FullCommand():
+		err = runSnapshotCommand(cmd, opts)
+	case dbimport.FullCommand():
+		r := os.Stdin
+		if *dbimportf != "-" {
+			if r, err = os.Open(*dbimportf); err != nil {
+				logger.Fatalf("%v", err)
+			}
+			defer r.Close()
+		}
+		err = cli.DBImport(opts, printer, r)
+	case dbrestore.FullCommand():
+		r := os.Stdin
+		if *dbrestoref != "-" {
+			if r, err = os.Open(*dbrestoref); err != nil {
+				logger.Fatalf("%v", err)
+			}
+			defer r.Close()
+		}
+		err = cli.DBRestore(opts, printer, r)
+	case dbcompact.FullCommand():
+		err = cli.DBCompact(opts, printer)
+	case configcheck.FullCommand():
+		var ok bool
+		if ok, err = cli.ConfigCheck(opts.Node, printer); err == nil && !ok {
+			os.Exit(1)
+		}
+	default:
+		err = runSessionCommand(cmd, opts, printer)
+	}
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+}
+
+// commands dumping a snapshot of db, of the running node or a stopped one
+func runSnapshotCommand(cmd string, opts *cli.Options) error {
+	file, dump, what := *dbexportf, cli.DBExport, "accounts"
+	if cmd == dbbackup.FullCommand() {
+		file, dump, what = *dbbackupf, cli.DBBackup, "records"
+	}
+
+	session, err := cli.Open(opts)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	// stdout is left open, only a file created here is closed
+	w := os.Stdout
+	if file != "" {
+		if w, err = os.Create(file); err != nil {
+			return err
+		}
+	}
+	count, err := dump(session, w)
+	if file != "" {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		if file != "" {
+			os.Remove(file)
+		}
+		return fmt.Errorf("dump err after %d %s: %v", count, what, err)
 	}
+	logger.Infof("%d %s dumped from %s", count, what, session.Target)
+
+	return nil
+}
+
+// commands calling admin service, of the running node or in process
+func runSessionCommand(cmd string, opts *cli.Options, printer *cli.Printer) error {
+	session, err := cli.Open(opts)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	switch cmd {
+	case accountget.FullCommand():
+		return cli.AccountGet(session, printer, *accountgetid)
+	case accountlist.FullCommand():
+		return cli.AccountList(session, printer, *accountprefix, *accountstates, *accountstored, *accountlimit)
+	case accountadjust.FullCommand():
+		return cli.AccountAdjust(session, printer, *adjustid, *adjustbalance, *adjustreason)
+	case accountban.FullCommand():
+		return cli.AccountBan(session, printer, *banid, *banreason, *banlift)
+	case challengeinsp.FullCommand():
+		return cli.ChallengeInspect(session, printer, *challengeid, *challengeclear)
+	case shardmove.FullCommand():
+		return cli.ShardMove(session, printer, *shardslot, *shardto)
+	}
+
+	return fmt.Errorf("unknown command %s", cmd)
 }
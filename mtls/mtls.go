@@ -0,0 +1,73 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package mtls loads certificates of mutual tls, which supervisors talk to each other and operators over.
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+)
+
+// Load returns credentials of a server verifying clients' certificates against ca in caFile,
+// and tls config of a client presenting the same certificate and verifying servers' against the same ca
+func Load(certFile, keyFile, caFile string) (credentials.TransportAuthenticator, *tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	caBytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cas := x509.NewCertPool()
+	if !cas.AppendCertsFromPEM(caBytes) {
+		return nil, nil, fmt.Errorf("supervisor/mtls: no certificate in %s", caFile)
+	}
+
+	serverCreds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    cas,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})
+	clientTLS := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      cas,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	return serverCreds, clientTLS, nil
+}
+
+// PeerName returns common name of the certificate the client of a call presented, empty if none
+func PeerName(ctx context.Context) string {
+	info, ok := credentials.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	tlsInfo, ok := info.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return ""
+	}
+
+	return tlsInfo.State.PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,211 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package node
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/challenge"
+	"github.com/conseweb/supervisor/cluster"
+	fpb "github.com/hyperledger/fabric/protos"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"gopkg.in/check.v1"
+)
+
+// configs of n supervisors sv0, sv1..., with blocks in their block sources,
+// listeners they serve each other on, and addresses of the listeners by id
+func (t *SupervisorTest) newPeerConfigs(c *check.C, n, blocks int) ([]*Config, []net.Listener, map[string]string) {
+	peers := make(map[string]string)
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, check.IsNil)
+		listeners[i] = lis
+		peers[fmt.Sprintf("sv%d", i)] = lis.Addr().String()
+	}
+
+	cfgs := make([]*Config, n)
+	for i := range cfgs {
+		cfgs[i] = t.newConfig(c, fmt.Sprintf("sv%d", i))
+
+		var previousBlockHash []byte
+		for j := 0; j < blocks; j++ {
+			block := fpb.NewBlock(nil, []byte{byte(j)})
+			block.SetPreviousBlockHash(previousBlockHash)
+			c.Assert(cfgs[i].BlockSource.(*challenge.FileBlockSource).PutBlock(uint64(j), block), check.IsNil)
+
+			var err error
+			previousBlockHash, err = block.GetHash()
+			c.Assert(err, check.IsNil)
+		}
+	}
+	return cfgs, listeners, peers
+}
+
+// configs of a cluster of n supervisors
+func (t *SupervisorTest) newClusterConfigs(c *check.C, n, blocks int) []*Config {
+	cfgs, listeners, peers := t.newPeerConfigs(c, n, blocks)
+	for i, cfg := range cfgs {
+		id := fmt.Sprintf("sv%d", i)
+		certFile, keyFile := t.issuePeer(c, id)
+		cfg.Cluster = &cluster.Config{
+			Enabled:           true,
+			ID:                id,
+			Peers:             peers,
+			ElectionTimeout:   time.Millisecond * 300,
+			HeartbeatInterval: time.Millisecond * 50,
+			CertFile:          certFile,
+			KeyFile:           keyFile,
+			CAFile:            t.ca.File,
+			Listener:          listeners[i],
+		}
+	}
+	return cfgs
+}
+
+// certificate of supervisor id talking to its peers, signed by t.ca
+func (t *SupervisorTest) issuePeer(c *check.C, id string) (certFile, keyFile string) {
+	if t.ca == nil {
+		t.ca = newTestCA(c, filepath.Join(t.dir, "certs"))
+	}
+	return t.ca.issue(c, id, x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth)
+}
+
+// the only supervisor leading the cluster and ready to serve
+func waitClusterLeader(c *check.C, svs []*Supervisor) *Supervisor {
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		var leader *Supervisor
+		for _, sv := range svs {
+			if _, self := sv.Cluster().Leader(); self {
+				if leader != nil {
+					leader = nil
+					break
+				}
+				leader = sv
+			}
+		}
+		if leader != nil {
+			return leader
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	c.Fatal("no leader elected")
+	return nil
+}
+
+func dialFarmerPublic(c *check.C, sv *Supervisor) (pb.FarmerPublicClient, *grpc.ClientConn) {
+	conn, err := grpc.Dial(sv.Addr().String(), grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Second*3))
+	c.Assert(err, check.IsNil)
+	return pb.NewFarmerPublicClient(conn), conn
+}
+
+// leader is killed while the farmer has a challenge pending, the farmer conquers it on the new leader
+func (t *SupervisorTest) TestClusterFailover(c *check.C) {
+	svs := []*Supervisor{}
+	for _, cfg := range t.newClusterConfigs(c, 3, 10) {
+		sv, err := NewSupervisor(cfg)
+		c.Assert(err, check.IsNil)
+		c.Assert(sv.Start(), check.IsNil)
+		svs = append(svs, sv)
+	}
+	leader := waitClusterLeader(c, svs)
+
+	// farmer talks to a follower, which forwards to the leader
+	var follower *Supervisor
+	for _, sv := range svs {
+		if sv != leader {
+			follower = sv
+			break
+		}
+	}
+	client, conn := dialFarmerPublic(c, follower)
+	onlineRsp, err := client.FarmerOnLine(context.Background(), &pb.FarmerOnLineReq{FarmerID: "TestClusterFailover"})
+	c.Assert(err, check.IsNil)
+	c.Assert(onlineRsp.GetError().OK(), check.Equals, true)
+	c.Check(onlineRsp.Account.State, check.Equals, pb.FarmerState_ONLINE)
+
+	var pingRsp *pb.FarmerPingRsp
+	for i := 0; i < 64; i++ {
+		pingRsp, err = client.FarmerPing(context.Background(), &pb.FarmerPingReq{
+			FarmerID:    "TestClusterFailover",
+			BlocksRange: &pb.BlocksRange{HighBlockNumber: 9, LowBlockNumber: 0},
+		})
+		c.Assert(err, check.IsNil)
+		c.Assert(pingRsp.GetError().OK(), check.Equals, true)
+		if pingRsp.NeedChallenge {
+			break
+		}
+	}
+	conn.Close()
+	c.Assert(pingRsp.NeedChallenge, check.Equals, true)
+	balance := pingRsp.Account.Balance
+	brange := pingRsp.BlocksRange
+	// only the leader holds the challenge
+	_, pending := follower.Challenger().FarmerChallengeReqCache().GetFarmerChallengeReq("TestClusterFailover", brange.HighBlockNumber, brange.LowBlockNumber, pingRsp.HashAlgo)
+	c.Check(pending, check.Equals, false)
+
+	// leader goes without flushing anything, whatever the farmer was told is committed already
+	leader.Stop()
+
+	survivors := []*Supervisor{}
+	for _, sv := range svs {
+		if sv != leader {
+			survivors = append(survivors, sv)
+			defer sv.Stop()
+		}
+	}
+	newLeader := waitClusterLeader(c, survivors)
+	_, pending = newLeader.Challenger().FarmerChallengeReqCache().GetFarmerChallengeReq("TestClusterFailover", brange.HighBlockNumber, brange.LowBlockNumber, pingRsp.HashAlgo)
+	c.Check(pending, check.Equals, true)
+
+	hash, err := newLeader.Challenger().HashBlocks(pingRsp.HashAlgo, brange.HighBlockNumber, brange.LowBlockNumber)
+	c.Assert(err, check.IsNil)
+	for _, sv := range survivors {
+		client, conn := dialFarmerPublic(c, sv)
+		historyRsp, err := client.FarmerBalanceHistory(context.Background(), &pb.FarmerBalanceHistoryReq{FarmerID: "TestClusterFailover"})
+		conn.Close()
+		c.Assert(err, check.IsNil)
+		c.Check(historyRsp.Balance, check.Equals, balance)
+	}
+
+	// conquered through the follower left
+	for _, sv := range survivors {
+		if sv == newLeader {
+			continue
+		}
+		client, conn := dialFarmerPublic(c, sv)
+		defer conn.Close()
+		conquerRsp, err := client.FarmerConquerChallenge(context.Background(), &pb.FarmerConquerChallengeReq{
+			FarmerID:    "TestClusterFailover",
+			BlocksRange: brange,
+			HashAlgo:    pingRsp.HashAlgo,
+			BlocksHash:  challenge.FarmerBindConquerHash("TestClusterFailover", pingRsp.HashAlgo, hash),
+		})
+		c.Assert(err, check.IsNil)
+		c.Check(conquerRsp.GetError().OK(), check.Equals, true)
+		c.Check(conquerRsp.ConquerOK, check.Equals, true)
+		c.Check(conquerRsp.Account.Balance > balance, check.Equals, true)
+	}
+}
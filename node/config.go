@@ -0,0 +1,197 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package node
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/audit"
+	"github.com/conseweb/supervisor/auth"
+	"github.com/conseweb/supervisor/challenge"
+	"github.com/conseweb/supervisor/cluster"
+	"github.com/conseweb/supervisor/notify"
+	"github.com/conseweb/supervisor/shard"
+	"github.com/spf13/viper"
+)
+
+const (
+	default_addr            = ":9376"
+	default_admin_addr      = "127.0.0.1:9377"
+	default_storage_backend = "rocksdb"
+)
+
+// Config of a supervisor, everything a supervisor needs is in it, nothing read from globals
+type Config struct {
+	// the address that the supervisor listenning on
+	Address string
+	// whether to trace RPCs using the golang.org/x/net/trace package
+	Trace bool
+
+	TLSEnabled  bool
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// admin service, served on its own address, to clients with certificates signed by AdminClientCAFile only
+	AdminEnabled      bool
+	AdminAddress      string
+	AdminCertFile     string
+	AdminKeyFile      string
+	AdminClientCAFile string
+	// unix socket serving admin service to operators on the same host, as the cli does, empty disables it
+	ControlSocket string
+
+	// storage backend and where to store db file
+	StoreBackend string
+	DBPath       string
+
+	// idprovider admin service, which tells the devices bound to farmers
+	IDProviderAddress      string
+	IDProviderTLS          bool
+	IDProviderCertFile     string
+	IDProviderHostOverride string
+
+	Account   *account.Config
+	Challenge *challenge.Config
+	// nil means farmer requests aren't authenticated
+	Auth *auth.Config
+	// nil means farmer events aren't posted anywhere
+	Notify *notify.Config
+	// nil means decisions aren't audited
+	Audit *audit.Config
+	// nil means a single supervisor, not a cluster
+	Cluster *cluster.Config
+	// nil means every farmer is served by this supervisor
+	Shard *shard.Config
+
+	// if set, used instead of the ones described above, handy for embedding and tests
+	Storage     store.Storage
+	BlockSource challenge.BlockSource
+}
+
+// ConfigFromViper reads supervisor.yaml into a config
+func ConfigFromViper() *Config {
+	cfg := &Config{
+		Address:                viper.GetString("node.address"),
+		Trace:                  viper.GetBool("node.trace"),
+		TLSEnabled:             viper.GetBool("node.tls.enabled"),
+		TLSCertFile:            viper.GetString("node.tls.cert.file"),
+		TLSKeyFile:             viper.GetString("node.tls.key.file"),
+		AdminEnabled:           viper.GetBool("node.admin.enabled"),
+		AdminAddress:           viper.GetString("node.admin.address"),
+		AdminCertFile:          viper.GetString("node.admin.tls.cert.file"),
+		AdminKeyFile:           viper.GetString("node.admin.tls.key.file"),
+		AdminClientCAFile:      viper.GetString("node.admin.tls.clientca.file"),
+		ControlSocket:          viper.GetString("node.control.socket"),
+		StoreBackend:           viper.GetString("account.store.backend"),
+		DBPath:                 viper.GetString("account.store.rocksdb.dbpath"),
+		IDProviderAddress:      viper.GetString("idprovider.port"),
+		IDProviderTLS:          viper.GetBool("idprovider.tls.enabled"),
+		IDProviderCertFile:     viper.GetString("idprovider.tls.cert.file"),
+		IDProviderHostOverride: viper.GetString("idprovider.tls.serverhostoverride"),
+		Account:                account.ConfigFromViper(),
+		Challenge:              challenge.ConfigFromViper(),
+		Auth:                   auth.ConfigFromViper(),
+		Notify:                 notify.ConfigFromViper(),
+		Audit:                  audit.ConfigFromViper(),
+		Cluster:                cluster.ConfigFromViper(),
+		Shard:                  shard.ConfigFromViper(),
+	}
+	if cfg.Address == "" {
+		cfg.Address = default_addr
+	}
+	if cfg.AdminAddress == "" {
+		cfg.AdminAddress = default_admin_addr
+	}
+	if cfg.StoreBackend == "" {
+		cfg.StoreBackend = default_storage_backend
+	}
+
+	return cfg
+}
+
+// Check reports every problem supervisor would fail to start with, or would work badly with,
+// without opening the storage, the block source or any listener
+func (cfg *Config) Check() []error {
+	var errs []error
+	addErr := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		addErr(fmt.Errorf("supervisor/node: invalid address %q: %v", cfg.Address, err))
+	}
+	if cfg.TLSEnabled {
+		if _, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			addErr(fmt.Errorf("supervisor/node: tls: %v", err))
+		}
+	}
+	if cfg.AdminEnabled {
+		if _, _, err := net.SplitHostPort(cfg.AdminAddress); err != nil {
+			addErr(fmt.Errorf("supervisor/node: invalid admin address %q: %v", cfg.AdminAddress, err))
+		}
+		_, err := initMutualTLSForServer(cfg.AdminCertFile, cfg.AdminKeyFile, cfg.AdminClientCAFile)
+		addErr(err)
+	}
+
+	if cfg.Storage == nil {
+		if cfg.StoreBackend != default_storage_backend {
+			addErr(fmt.Errorf("supervisor/node: not supported storage backend: %v", cfg.StoreBackend))
+		}
+		if cfg.DBPath == "" {
+			addErr(errors.New("supervisor/node: storage backend specified, but no dbpath"))
+		}
+	}
+
+	if cfg.Account == nil || cfg.Challenge == nil {
+		addErr(errors.New("supervisor/node: account and challenge config are required"))
+	} else {
+		_, err := account.NewFarmerFSMDef(cfg.Account.FSM)
+		addErr(err)
+		addErr(cfg.Challenge.Check())
+	}
+	if cfg.Auth != nil && cfg.Auth.Enabled && cfg.IDProviderAddress == "" {
+		addErr(errors.New("supervisor/node: farmer auth enabled, but no idprovider address"))
+	}
+	if cfg.Notify != nil && cfg.Notify.Enabled {
+		addErr(cfg.Notify.Check())
+	}
+	if cfg.Audit != nil && cfg.Audit.Enabled {
+		if fi, err := os.Stat(cfg.Audit.Dir); err == nil && !fi.IsDir() {
+			addErr(fmt.Errorf("supervisor/node: audit dir %s is not a dir", cfg.Audit.Dir))
+		}
+	}
+
+	if cfg.Cluster != nil && cfg.Cluster.Enabled {
+		addErr(cfg.Cluster.Check())
+	}
+	if cfg.Shard != nil && cfg.Shard.Enabled {
+		addErr(cfg.Shard.Check())
+		if cfg.Cluster != nil && cfg.Cluster.Enabled {
+			addErr(errors.New("supervisor/node: cluster and shard can't be enabled together yet"))
+		}
+	}
+
+	return errs
+}
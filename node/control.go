@@ -0,0 +1,102 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package node
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/conseweb/supervisor/api"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	local_operator = "local"
+)
+
+// localCreds marks calls over the control socket with the local operator,
+// who is the user running the calling process if the platform tells
+type localCreds struct{}
+
+func (localCreds) ClientHandshake(addr string, rawConn net.Conn, timeout time.Duration) (net.Conn, credentials.AuthInfo, error) {
+	return rawConn, nil, nil
+}
+
+func (localCreds) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return rawConn, api.LocalAuthInfo{Operator: localOperator(rawConn)}, nil
+}
+
+func (localCreds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: local_operator}
+}
+
+func (localCreds) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (localCreds) RequireTransportSecurity() bool {
+	return false
+}
+
+// local:<user name> of peer on the control socket
+func localOperator(conn net.Conn) string {
+	uid, ok := peerUid(conn)
+	if !ok {
+		return local_operator
+	}
+
+	name := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	return local_operator + ":" + name
+}
+
+// listenControl listens on unix socket path, which only its owner can connect to,
+// a socket left behind by a node that didn't stop cleanly is taken over
+func listenControl(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("supervisor/node: control socket %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	// the socket is created owner only, a chmod after listen leaves a window others can connect in,
+	// umask is of the whole process, so it's put back right away
+	mask := syscall.Umask(0177)
+	lis, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, err
+	}
+
+	return lis, nil
+}
@@ -0,0 +1,187 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package node
+
+import (
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/clock"
+	"golang.org/x/net/context"
+	"gopkg.in/check.v1"
+)
+
+// farmer keeps a session open, supervisor pings and challenges it down the session,
+// farmer is lost once the session drops, and its session ends once it goes offline
+func (t *SupervisorTest) TestFarmerSession(c *check.C) {
+	clk := clock.NewFake(time.Unix(1500000000, 0))
+	cfg := t.newConfig(c, "sv")
+	cfg.Account.Clock = clk
+	sv, err := NewSupervisor(cfg)
+	c.Assert(err, check.IsNil)
+	c.Assert(sv.Start(), check.IsNil)
+	defer sv.Stop()
+
+	transitions := make(chan *account.HookEvent, 8)
+	c.Assert(sv.Controller().Hooks().Subscribe(account.HookSubscription{
+		Name:   "TestFarmerSession",
+		Filter: account.OnTransitionTo(),
+	}, func(e *account.HookEvent) error {
+		transitions <- e
+		return nil
+	}), check.IsNil)
+
+	farmerId := "TestFarmerSession"
+	client, conn := dialFarmerPublic(c, sv)
+	defer conn.Close()
+
+	// a session opens with an online request only
+	stream, err := client.FarmerSession(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(stream.Send(&pb.FarmerSessionReq{Declare: &pb.FarmerPingReq{FarmerID: farmerId}}), check.IsNil)
+	rsp, err := stream.Recv()
+	c.Assert(err, check.IsNil)
+	c.Check(rsp.Error.ErrorType, check.Equals, pb.ErrorType_INVALID_PARAM)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err = client.FarmerSession(ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(stream.Send(&pb.FarmerSessionReq{OnLine: &pb.FarmerOnLineReq{FarmerID: farmerId}}), check.IsNil)
+	rsp, err = stream.Recv()
+	c.Assert(err, check.IsNil)
+	c.Assert(rsp.GetError().OK(), check.Equals, true)
+	c.Assert(rsp.OnLine.Error.OK(), check.Equals, true)
+	c.Check(rsp.OnLine.Account.State, check.Equals, pb.FarmerState_ONLINE)
+	c.Check(rsp.OnLine.NextPing, check.Equals, int64(0))
+	c.Check((<-transitions).State, check.Equals, pb.FarmerState_ONLINE)
+
+	// pinged before declaring anything, farmer is only told what its account is
+	clk.Advance(cfg.Account.PingInterval)
+	rsp, err = stream.Recv()
+	c.Assert(err, check.IsNil)
+	c.Assert(rsp.Ping, check.NotNil)
+	c.Check(rsp.Ping.Error.OK(), check.Equals, true)
+	c.Check(rsp.Ping.NeedChallenge, check.Equals, false)
+
+	// the first declare is answered by a ping, then supervisor pings every interval, till it challenges,
+	// farmer answers every ping of supervisor's by declaring again
+	brange := &pb.BlocksRange{HighBlockNumber: 100, LowBlockNumber: 20}
+	declare := &pb.FarmerSessionReq{Declare: &pb.FarmerPingReq{FarmerID: farmerId, BlocksRange: brange}}
+	c.Assert(stream.Send(declare), check.IsNil)
+	for i := 0; ; i++ {
+		rsp, err = stream.Recv()
+		c.Assert(err, check.IsNil)
+		c.Assert(rsp.Ping, check.NotNil)
+		c.Assert(rsp.Ping.Error.OK(), check.Equals, true)
+		if rsp.Ping.NeedChallenge {
+			break
+		}
+		c.Assert(i < 1000, check.Equals, true)
+		if i > 0 {
+			c.Assert(stream.Send(declare), check.IsNil)
+			rsp, err = stream.Recv()
+			c.Assert(err, check.IsNil)
+			c.Assert(rsp.Ping, check.NotNil)
+			c.Check(rsp.Ping.NeedChallenge, check.Equals, false)
+		}
+		clk.Advance(cfg.Account.PingInterval)
+	}
+	c.Assert(stream.Send(&pb.FarmerSessionReq{Conquer: &pb.FarmerConquerChallengeReq{
+		FarmerID:    farmerId,
+		BlocksRange: rsp.Ping.BlocksRange,
+		HashAlgo:    rsp.Ping.HashAlgo,
+		BlocksHash:  "wrong",
+	}}), check.IsNil)
+	rsp, err = stream.Recv()
+	c.Assert(err, check.IsNil)
+	c.Assert(rsp.Conquer, check.NotNil)
+	c.Check(rsp.Conquer.ConquerOK, check.Equals, false)
+	c.Check(rsp.Conquer.Error.ErrorType, check.Equals, pb.ErrorType_FARMER_CHALLENGE_FAIL)
+
+	// the session drops, farmer is lost right away, not a ping interval later
+	cancel()
+	select {
+	case e := <-transitions:
+		c.Check(e.State, check.Equals, pb.FarmerState_LOST)
+	case <-time.After(time.Second * 3):
+		c.Fatal("farmer isn't lost once its session dropped")
+	}
+
+	// reconnecting brings farmer back online, going offline ends its session
+	stream, err = client.FarmerSession(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(stream.Send(&pb.FarmerSessionReq{OnLine: &pb.FarmerOnLineReq{FarmerID: farmerId}}), check.IsNil)
+	rsp, err = stream.Recv()
+	c.Assert(err, check.IsNil)
+	c.Assert(rsp.OnLine.Error.OK(), check.Equals, true)
+	c.Check((<-transitions).State, check.Equals, pb.FarmerState_ONLINE)
+
+	offRsp, err := client.FarmerOffLine(context.Background(), &pb.FarmerOffLineReq{FarmerID: farmerId})
+	c.Assert(err, check.IsNil)
+	c.Assert(offRsp.Error.OK(), check.Equals, true)
+	rsp, err = stream.Recv()
+	c.Assert(err, check.IsNil)
+	c.Check(rsp.Error.ErrorType, check.Equals, pb.ErrorType_SESSION_ENDED)
+	c.Check((<-transitions).State, check.Equals, pb.FarmerState_OFFLINE)
+}
+
+// farmer whose stream is half open, still there but reading and sending nothing, is lost once it doesn't answer a ping
+func (t *SupervisorTest) TestFarmerSessionUnanswered(c *check.C) {
+	clk := clock.NewFake(time.Unix(1500000000, 0))
+	cfg := t.newConfig(c, "sv")
+	cfg.Account.Clock = clk
+	sv, err := NewSupervisor(cfg)
+	c.Assert(err, check.IsNil)
+	c.Assert(sv.Start(), check.IsNil)
+	defer sv.Stop()
+
+	transitions := make(chan *account.HookEvent, 8)
+	c.Assert(sv.Controller().Hooks().Subscribe(account.HookSubscription{
+		Name:   "TestFarmerSessionUnanswered",
+		Filter: account.OnTransitionTo(),
+	}, func(e *account.HookEvent) error {
+		transitions <- e
+		return nil
+	}), check.IsNil)
+
+	farmerId := "TestFarmerSessionUnanswered"
+	client, conn := dialFarmerPublic(c, sv)
+	defer conn.Close()
+	stream, err := client.FarmerSession(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(stream.Send(&pb.FarmerSessionReq{OnLine: &pb.FarmerOnLineReq{FarmerID: farmerId}}), check.IsNil)
+	rsp, err := stream.Recv()
+	c.Assert(err, check.IsNil)
+	c.Assert(rsp.OnLine.Error.OK(), check.Equals, true)
+	c.Check((<-transitions).State, check.Equals, pb.FarmerState_ONLINE)
+
+	// the stream stays open, but farmer reads and sends nothing from now on
+	for i := 0; ; i++ {
+		c.Assert(i < 100, check.Equals, true)
+		clk.Advance(cfg.Account.PingInterval)
+		select {
+		case e := <-transitions:
+			c.Check(e.State, check.Equals, pb.FarmerState_LOST)
+			// pinged once at least, and not answered in an interval
+			c.Check(i > 0, check.Equals, true)
+			return
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+}
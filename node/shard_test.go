@@ -0,0 +1,196 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package node
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/mtls"
+	"github.com/conseweb/supervisor/shard"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"gopkg.in/check.v1"
+)
+
+// configs of n supervisors sharding farmers into slots
+func (t *SupervisorTest) newShardConfigs(c *check.C, n, slots int) []*Config {
+	cfgs, listeners, peers := t.newPeerConfigs(c, n, 0)
+	// farmers are redirected to the address, it must be known before supervisor listens
+	nodes := make(map[string]string)
+	for id := range peers {
+		public, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, check.IsNil)
+		nodes[id] = public.Addr().String()
+		public.Close()
+	}
+
+	for i, cfg := range cfgs {
+		id := fmt.Sprintf("sv%d", i)
+		certFile, keyFile := t.issuePeer(c, id)
+		cfg.Address = nodes[id]
+		cfg.Shard = &shard.Config{
+			Enabled:  true,
+			ID:       id,
+			Slots:    slots,
+			Nodes:    nodes,
+			Peers:    peers,
+			CertFile: certFile,
+			KeyFile:  keyFile,
+			CAFile:   t.ca.File,
+			Listener: listeners[i],
+		}
+	}
+	return cfgs
+}
+
+// farmer goes where it is redirected, its slot is moved to another supervisor, which serves it on
+func (t *SupervisorTest) TestShardMove(c *check.C) {
+	svs := map[string]*Supervisor{}
+	for _, cfg := range t.newShardConfigs(c, 3, 16) {
+		sv, err := NewSupervisor(cfg)
+		c.Assert(err, check.IsNil)
+		c.Assert(sv.Start(), check.IsNil)
+		defer sv.Stop()
+		svs[cfg.Shard.ID] = sv
+	}
+
+	farmerId := "TestShardMove"
+	brange := &pb.BlocksRange{HighBlockNumber: 9, LowBlockNumber: 0}
+	slot := shard.Slot(farmerId, 16)
+	ownerId, _ := svs["sv0"].Sharder().Map().Owner(slot)
+	var otherId string
+	for id := range svs {
+		if id != ownerId {
+			otherId = id
+			break
+		}
+	}
+	owner, other := svs[ownerId], svs[otherId]
+
+	// redirected to the owner
+	client, conn := dialFarmerPublic(c, other)
+	onlineRsp, err := client.FarmerOnLine(context.Background(), &pb.FarmerOnLineReq{FarmerID: farmerId})
+	conn.Close()
+	c.Assert(err, check.IsNil)
+	c.Check(onlineRsp.Error.ErrorType, check.Equals, pb.ErrorType_WRONG_SHARD)
+	c.Check(onlineRsp.Error.Owner, check.Equals, owner.Addr().String())
+	c.Check(onlineRsp.Account, check.IsNil)
+
+	conn, err = grpc.Dial(onlineRsp.Error.Owner, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Second*3))
+	c.Assert(err, check.IsNil)
+	client = pb.NewFarmerPublicClient(conn)
+	onlineRsp, err = client.FarmerOnLine(context.Background(), &pb.FarmerOnLineReq{FarmerID: farmerId})
+	c.Assert(err, check.IsNil)
+	c.Assert(onlineRsp.Error.OK(), check.Equals, true)
+	pingRsp, err := client.FarmerPing(context.Background(), &pb.FarmerPingReq{FarmerID: farmerId, BlocksRange: brange})
+	conn.Close()
+	c.Assert(err, check.IsNil)
+	c.Assert(pingRsp.Error.OK(), check.Equals, true)
+	// a balance goes along with the farmer
+	balance := pingRsp.Account.Balance + 500
+	c.Assert(owner.Controller().AdjustBalance(farmerId, balance, "TestShardMove"), check.IsNil)
+
+	// handed over to the other one
+	farmers, records, err := owner.Sharder().MoveShard(context.Background(), slot, otherId)
+	c.Assert(err, check.IsNil)
+	c.Check(farmers, check.Equals, 1)
+	c.Check(records > 2, check.Equals, true)
+	_, err = owner.Controller().FarmerHandler(farmerId)
+	c.Check(err, check.NotNil)
+	newOwnerId, epoch := other.Sharder().Map().Owner(slot)
+	c.Check(newOwnerId, check.Equals, otherId)
+	c.Check(epoch, check.Equals, uint64(1))
+
+	// the old owner redirects to the new one
+	client, conn = dialFarmerPublic(c, owner)
+	pingRsp, err = client.FarmerPing(context.Background(), &pb.FarmerPingReq{FarmerID: farmerId, BlocksRange: brange})
+	conn.Close()
+	c.Assert(err, check.IsNil)
+	c.Check(pingRsp.Error.ErrorType, check.Equals, pb.ErrorType_WRONG_SHARD)
+	c.Check(pingRsp.Error.Owner, check.Equals, other.Addr().String())
+
+	// the new one serves the farmer as it was
+	handler, err := other.Controller().FarmerHandler(farmerId)
+	c.Assert(err, check.IsNil)
+	c.Check(handler.Account().State, check.Equals, pb.FarmerState_ONLINE)
+	client, conn = dialFarmerPublic(c, other)
+	defer conn.Close()
+	historyRsp, err := client.FarmerBalanceHistory(context.Background(), &pb.FarmerBalanceHistoryReq{FarmerID: farmerId})
+	c.Assert(err, check.IsNil)
+	c.Assert(historyRsp.Error.OK(), check.Equals, true)
+	c.Check(historyRsp.Balance, check.Equals, balance)
+	c.Check(len(historyRsp.Entries) > 0, check.Equals, true)
+	pingRsp, err = client.FarmerPing(context.Background(), &pb.FarmerPingReq{FarmerID: farmerId, BlocksRange: brange})
+	c.Assert(err, check.IsNil)
+	c.Assert(pingRsp.Error.OK(), check.Equals, true)
+	c.Check(pingRsp.Account.State, check.Equals, pb.FarmerState_ONLINE)
+
+	// moving a slot it doesn't own fails
+	_, _, err = owner.Sharder().MoveShard(context.Background(), slot, otherId)
+	c.Check(err, check.ErrorMatches, ".*is owned by.*")
+}
+
+// slots are taken over only from peers, each as the peer its certificate tells
+func (t *SupervisorTest) TestShardPeersOnly(c *check.C) {
+	cfgs := t.newShardConfigs(c, 3, 16)
+	var sv0 *Supervisor
+	for _, cfg := range cfgs {
+		sv, err := NewSupervisor(cfg)
+		c.Assert(err, check.IsNil)
+		c.Assert(sv.Start(), check.IsNil)
+		defer sv.Stop()
+		if sv0 == nil {
+			sv0 = sv
+		}
+	}
+	// a slot sv1 hands over to sv0 if asked
+	slot := sv0.Sharder().Map().Slots("sv1")[0]
+	_, epoch := sv0.Sharder().Map().Owner(slot)
+
+	intruderCert, intruderKey := t.issuePeer(c, "intruder")
+	for _, caller := range []struct {
+		certFile, keyFile string
+	}{
+		// signed by the ca, but not a peer
+		{intruderCert, intruderKey},
+		// a peer, but not the one it sends as
+		{cfgs[2].Shard.CertFile, cfgs[2].Shard.KeyFile},
+	} {
+		_, clientTLS, err := mtls.Load(caller.certFile, caller.keyFile, t.ca.File)
+		c.Assert(err, check.IsNil)
+		conn, err := grpc.Dial(cfgs[0].Shard.Peers["sv0"], grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)), grpc.WithBlock(), grpc.WithTimeout(time.Second*3))
+		c.Assert(err, check.IsNil)
+		defer conn.Close()
+
+		rsp, err := pb.NewSupervisorShardClient(conn).ReceiveShard(context.Background(), &pb.ShardRecordsReq{
+			Slot:  slot,
+			Epoch: epoch + 1,
+			From:  "sv1",
+			Done:  true,
+		})
+		c.Assert(err, check.IsNil)
+		c.Check(rsp.Error.ErrorType, check.Equals, pb.ErrorType_INVALID_PARAM)
+	}
+
+	owner, ownerEpoch := sv0.Sharder().Map().Owner(slot)
+	c.Check(owner, check.Equals, "sv1")
+	c.Check(ownerEpoch, check.Equals, epoch)
+}
@@ -0,0 +1,393 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package node
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/conseweb/common/clientconn"
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/api"
+	"github.com/conseweb/supervisor/audit"
+	"github.com/conseweb/supervisor/auth"
+	"github.com/conseweb/supervisor/challenge"
+	"github.com/conseweb/supervisor/cluster"
+	"github.com/conseweb/supervisor/mtls"
+	"github.com/conseweb/supervisor/notify"
+	"github.com/conseweb/supervisor/shard"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Supervisor owns everything a running supervisor node needs,
+// several supervisors can live in one process, each with its own config
+type Supervisor struct {
+	cfg        *Config
+	storage    store.Storage
+	challenger *challenge.Challenger
+	controller *account.FarmerAccountController
+	idpConn    *grpc.ClientConn
+	verifier   *auth.Verifier
+	notifier   *notify.Notifier
+	auditor    *audit.Auditor
+	// only if running in a cluster
+	cluster *cluster.Cluster
+	// only if farmers are sharded among supervisors
+	sharder  *shard.Sharder
+	server   *grpc.Server
+	listener net.Listener
+	// admin service, only if enabled
+	adminCreds    credentials.TransportAuthenticator
+	adminServer   *grpc.Server
+	adminListener net.Listener
+	// control socket, only if configured
+	controlServer   *grpc.Server
+	controlListener net.Listener
+	l               *sync.Mutex
+}
+
+// NewSupervisor builds a supervisor upon cfg, doesn't listen until Start
+func NewSupervisor(cfg *Config) (_ *Supervisor, err error) {
+	if cfg.Account == nil || cfg.Challenge == nil {
+		return nil, errors.New("supervisor/node: account and challenge config are required")
+	}
+	// a broken state machine fails supervisor at startup, rather than falling back
+	if _, err := account.NewFarmerFSMDef(cfg.Account.FSM); err != nil {
+		return nil, err
+	}
+	if cfg.Cluster != nil && cfg.Cluster.Enabled && cfg.Shard != nil && cfg.Shard.Enabled {
+		return nil, errors.New("supervisor/node: cluster and shard can't be enabled together yet")
+	}
+	var adminCreds credentials.TransportAuthenticator
+	if cfg.AdminEnabled {
+		if adminCreds, err = initMutualTLSForServer(cfg.AdminCertFile, cfg.AdminKeyFile, cfg.AdminClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	storage := cfg.Storage
+	if storage == nil {
+		if cfg.DBPath == "" {
+			return nil, errors.New("supervisor/node: storage backend specified, but no dbpath")
+		}
+
+		if storage, err = store.NewStore(cfg.StoreBackend, cfg.DBPath); err != nil {
+			return nil, err
+		}
+	}
+
+	sv := &Supervisor{
+		cfg:        cfg,
+		storage:    storage,
+		adminCreds: adminCreds,
+		l:          &sync.Mutex{},
+	}
+	// farmer accounts are replicated among supervisors of a cluster, blocks accumulator and webhook queue stay local
+	accountStorage, accountCfg := storage, cfg.Account
+	// whatever is built so far is closed again, once building the rest fails
+	defer func() {
+		if err == nil {
+			return
+		}
+		if sv.sharder != nil {
+			sv.sharder.Stop()
+		}
+		if sv.idpConn != nil {
+			sv.idpConn.Close()
+		}
+		if sv.auditor != nil {
+			sv.auditor.Close()
+		}
+		if sv.challenger != nil {
+			sv.challenger.Close()
+		}
+		// controller closes account storage it is built upon
+		if sv.controller != nil {
+			sv.controller.Close()
+		} else {
+			accountStorage.Close()
+		}
+	}()
+
+	if cfg.Cluster != nil && cfg.Cluster.Enabled {
+		if sv.cluster, err = cluster.New(cfg.Cluster, storage); err != nil {
+			return nil, err
+		}
+		accountStorage = sv.cluster.Storage()
+		// a farmer isn't answered until its account is committed, the leader may go any time
+		syncCfg := *cfg.Account
+		syncCfg.SyncPersist = true
+		accountCfg = &syncCfg
+	}
+
+	if sv.challenger, err = challenge.NewChallengerFromConfig(cfg.Challenge, cfg.BlockSource); err != nil {
+		return nil, err
+	}
+	if cfg.Challenge.Accumulator {
+		if err = sv.challenger.EnableAccumulator(storage); err != nil {
+			return nil, err
+		}
+	}
+
+	sv.controller = account.NewFarmerAccountController(accountStorage, sv.challenger, accountCfg)
+	// only the leader serves farmers
+	if sv.cluster != nil {
+		sv.controller.SetStandby(true)
+		sv.cluster.OnLeadership(func(leader bool) {
+			sv.controller.SetStandby(!leader)
+		})
+	}
+
+	// farmers of other supervisors are redirected to them
+	if cfg.Shard != nil && cfg.Shard.Enabled {
+		if sv.sharder, err = shard.New(cfg.Shard, sv.controller, storage); err != nil {
+			return nil, err
+		}
+	}
+
+	// idprovider tells which devices are bound to farmers
+	if cfg.Auth != nil && cfg.Auth.Enabled {
+		if sv.idpConn, err = dialIDProvider(cfg, false); err != nil {
+			return nil, err
+		}
+		sv.verifier = auth.NewVerifier(cfg.Auth, auth.NewIDPADeviceStore(pb.NewIDPAClient(sv.idpConn), cfg.Auth.DeviceCacheTTL))
+	}
+
+	// decisions are written to audit log
+	if cfg.Audit != nil && cfg.Audit.Enabled {
+		if sv.auditor, err = audit.NewAuditor(cfg.Audit, sv.controller.Hooks()); err != nil {
+			return nil, err
+		}
+	}
+
+	// farmer events are posted to webhooks
+	if cfg.Notify != nil && cfg.Notify.Enabled {
+		if sv.notifier, err = notify.NewNotifier(cfg.Notify, storage, sv.controller.Hooks()); err != nil {
+			return nil, err
+		}
+	}
+
+	return sv, nil
+}
+
+// Start listens on the configured address and serves grpc services in background
+func (sv *Supervisor) Start() error {
+	sv.l.Lock()
+	defer sv.l.Unlock()
+
+	if sv.server != nil {
+		return errors.New("supervisor/node: supervisor already started")
+	}
+
+	lis, err := net.Listen("tcp", sv.cfg.Address)
+	if err != nil {
+		return err
+	}
+
+	grpc.EnableTracing = sv.cfg.Trace
+	logger.Infof("grpc.EnableTracing: %v", grpc.EnableTracing)
+
+	opts := []grpc.ServerOption{}
+	if sv.cfg.TLSEnabled {
+		opts = append(opts, grpc.Creds(initTLSForServer(sv.cfg.TLSCertFile, sv.cfg.TLSKeyFile)))
+	}
+	sv.server = grpc.NewServer(opts...)
+	sv.listener = lis
+
+	// register, farmer requests reaching a follower are forwarded to the leader,
+	// the ones of farmers sharded to other supervisors are redirected to them
+	var farmers pb.FarmerPublicServer = api.NewFarmerPublic(sv.controller, sv.verifier)
+	if sv.sharder != nil {
+		if err := sv.sharder.Start(); err != nil {
+			lis.Close()
+			sv.server, sv.listener = nil, nil
+			return err
+		}
+		farmers = shard.NewFarmerPublic(farmers, sv.sharder)
+	}
+	if sv.cluster != nil {
+		if err := sv.cluster.Start(farmers); err != nil {
+			lis.Close()
+			sv.server, sv.listener = nil, nil
+			return err
+		}
+		farmers = cluster.NewFarmerPublic(farmers, sv.cluster)
+	}
+	pb.RegisterFarmerPublicServer(sv.server, farmers)
+
+	admin := api.NewSupervisorAdmin(sv.controller, sv.challenger, sv.auditor)
+	if sv.sharder != nil {
+		admin.SetSharder(sv.sharder)
+	}
+	if sv.adminCreds != nil {
+		adminLis, err := net.Listen("tcp", sv.cfg.AdminAddress)
+		if err != nil {
+			lis.Close()
+			sv.server, sv.listener = nil, nil
+			return err
+		}
+		sv.adminServer = grpc.NewServer(grpc.Creds(sv.adminCreds))
+		sv.adminListener = adminLis
+		pb.RegisterSupervisorAdminServer(sv.adminServer, admin)
+
+		go sv.adminServer.Serve(adminLis)
+		logger.Infof("supervisor admin listening on %s", adminLis.Addr())
+	}
+	if sv.cfg.ControlSocket != "" {
+		controlLis, err := listenControl(sv.cfg.ControlSocket)
+		if err != nil {
+			lis.Close()
+			if sv.adminListener != nil {
+				sv.adminListener.Close()
+			}
+			sv.server, sv.listener, sv.adminServer, sv.adminListener = nil, nil, nil, nil
+			return err
+		}
+		sv.controlServer = grpc.NewServer(grpc.Creds(localCreds{}))
+		sv.controlListener = controlLis
+		pb.RegisterSupervisorAdminServer(sv.controlServer, admin)
+
+		go sv.controlServer.Serve(controlLis)
+		logger.Infof("supervisor control socket listening on %s", controlLis.Addr())
+	}
+
+	sv.controller.Start()
+	go sv.server.Serve(lis)
+	logger.Infof("supervisor node listening on %s, waiting for connect...", lis.Addr())
+
+	return nil
+}
+
+// Stop stops serving, closes the controller and the challenger
+func (sv *Supervisor) Stop() error {
+	sv.l.Lock()
+	defer sv.l.Unlock()
+
+	// server.GracefulStop()
+	if sv.server != nil {
+		sv.server.Stop()
+	}
+	if sv.cluster != nil {
+		sv.cluster.Stop()
+	}
+	if sv.sharder != nil {
+		sv.sharder.Stop()
+	}
+	if sv.adminServer != nil {
+		sv.adminServer.Stop()
+	}
+	if sv.controlServer != nil {
+		sv.controlServer.Stop()
+	}
+	if sv.idpConn != nil {
+		sv.idpConn.Close()
+	}
+	if sv.notifier != nil {
+		sv.notifier.Close()
+	}
+	if sv.auditor != nil {
+		sv.auditor.Close()
+	}
+	sv.challenger.Close()
+
+	return sv.controller.Close()
+}
+
+// Addr returns the address supervisor is listening on, nil if not started
+func (sv *Supervisor) Addr() net.Addr {
+	sv.l.Lock()
+	defer sv.l.Unlock()
+
+	if sv.listener == nil {
+		return nil
+	}
+	return sv.listener.Addr()
+}
+
+// AdminAddr returns the address admin service is listening on, nil if not started or not enabled
+func (sv *Supervisor) AdminAddr() net.Addr {
+	sv.l.Lock()
+	defer sv.l.Unlock()
+
+	if sv.adminListener == nil {
+		return nil
+	}
+	return sv.adminListener.Addr()
+}
+
+// ControlAddr returns the control socket supervisor is listening on, nil if not started or not configured
+func (sv *Supervisor) ControlAddr() net.Addr {
+	sv.l.Lock()
+	defer sv.l.Unlock()
+
+	if sv.controlListener == nil {
+		return nil
+	}
+	return sv.controlListener.Addr()
+}
+
+func (sv *Supervisor) Controller() *account.FarmerAccountController {
+	return sv.controller
+}
+
+func (sv *Supervisor) Challenger() *challenge.Challenger {
+	return sv.challenger
+}
+
+// Cluster the supervisor runs in, nil if it runs alone
+func (sv *Supervisor) Cluster() *cluster.Cluster {
+	return sv.cluster
+}
+
+// Sharder redirecting farmers of other supervisors, nil if farmers aren't sharded
+func (sv *Supervisor) Sharder() *shard.Sharder {
+	return sv.sharder
+}
+
+// InitTLSForServer returns TLS credentials for node
+func initTLSForServer(certFile, keyFile string) credentials.TransportAuthenticator {
+	creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+	if err != nil {
+		logger.Errorf("Failed to create TLS credentials %v", err)
+		creds = credentials.NewServerTLSFromCert(nil)
+	}
+
+	return creds
+}
+
+// initMutualTLSForServer returns TLS credentials verifying clients' certificates against CA in caFile
+func initMutualTLSForServer(certFile, keyFile, caFile string) (credentials.TransportAuthenticator, error) {
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("supervisor/node: admin service needs cert, key and client ca files")
+	}
+
+	creds, _, err := mtls.Load(certFile, keyFile, caFile)
+	return creds, err
+}
+
+// connect with idprovider, block until connected if block is true
+func dialIDProvider(cfg *Config, block bool) (*grpc.ClientConn, error) {
+	if cfg.IDProviderTLS {
+		return clientconn.NewClientConnectionWithAddress(cfg.IDProviderAddress, block, true, clientconn.InitTLSForClient(cfg.IDProviderHostOverride, cfg.IDProviderCertFile))
+	}
+
+	return clientconn.NewClientConnectionWithAddress(cfg.IDProviderAddress, block, false, nil)
+}
@@ -0,0 +1,418 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package node
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/audit"
+	"github.com/conseweb/supervisor/auth"
+	"github.com/conseweb/supervisor/challenge"
+	"github.com/conseweb/supervisor/mtls/mtlstest"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type SupervisorTest struct {
+	dir string
+	// issues certificates of peers
+	ca *testCA
+}
+
+var _ = check.Suite(&SupervisorTest{})
+
+func (t *SupervisorTest) SetUpTest(c *check.C) {
+	t.dir = filepath.Join(os.TempDir(), "testSupervisor")
+	os.RemoveAll(t.dir)
+	t.ca = nil
+}
+
+func (t *SupervisorTest) TearDownTest(c *check.C) {
+	os.RemoveAll(t.dir)
+}
+
+func (t *SupervisorTest) newConfig(c *check.C, name string) *Config {
+	blocks, err := challenge.NewFileBlockSource(filepath.Join(t.dir, name, "blocks"))
+	c.Assert(err, check.IsNil)
+
+	return &Config{
+		Address:      "127.0.0.1:0",
+		StoreBackend: default_storage_backend,
+		DBPath:       filepath.Join(t.dir, name, "account"),
+		Account: &account.Config{
+			CheckWorkers: 8,
+			PingInterval: time.Second * 900,
+			LostCount:    2,
+		},
+		Challenge: &challenge.Config{
+			HashAlgo: pb.HashAlgo_SHA256,
+			Delay:    time.Second * 10,
+		},
+		BlockSource: blocks,
+	}
+}
+
+// two supervisors in one process, each with its own storage, caches and server
+func (t *SupervisorTest) TestTwoSupervisors(c *check.C) {
+	svs := []*Supervisor{}
+	for i := 0; i < 2; i++ {
+		sv, err := NewSupervisor(t.newConfig(c, fmt.Sprintf("sv%d", i)))
+		c.Assert(err, check.IsNil)
+		c.Assert(sv.Start(), check.IsNil)
+		defer sv.Stop()
+
+		svs = append(svs, sv)
+	}
+	c.Check(svs[0].Addr().String(), check.Not(check.Equals), svs[1].Addr().String())
+	c.Check(svs[0].Challenger().FarmerChallengeReqCache(), check.Not(check.Equals), svs[1].Challenger().FarmerChallengeReqCache())
+
+	for _, sv := range svs {
+		conn, err := grpc.Dial(sv.Addr().String(), grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Second*3))
+		c.Assert(err, check.IsNil)
+
+		rsp, err := pb.NewFarmerPublicClient(conn).FarmerOnLine(context.Background(), &pb.FarmerOnLineReq{
+			FarmerID: "TestTwoSupervisors",
+		})
+		conn.Close()
+		c.Assert(err, check.IsNil)
+		c.Check(rsp.GetError().OK(), check.Equals, true)
+		c.Check(rsp.Account.State, check.Equals, pb.FarmerState_ONLINE)
+	}
+}
+
+func (t *SupervisorTest) TestStartTwice(c *check.C) {
+	sv, err := NewSupervisor(t.newConfig(c, "sv"))
+	c.Assert(err, check.IsNil)
+	defer sv.Stop()
+
+	c.Assert(sv.Start(), check.IsNil)
+	c.Check(sv.Start(), check.NotNil)
+}
+
+// fakeIDPA knows one farmer device bound to a farmer
+type fakeIDPA struct {
+	farmerId string
+	deviceId string
+}
+
+func (idpa *fakeIDPA) VerifyDevice(ctx context.Context, req *pb.VerifyDeviceReq) (*pb.VerifyDeviceRsp, error) {
+	if req.UserID != idpa.farmerId || req.DeviceID != idpa.deviceId || req.For != pb.DeviceFor_FARMER {
+		return &pb.VerifyDeviceRsp{Error: pb.NewError(pb.ErrorType_INVALID_DEVICE, "no such device bound to user")}, nil
+	}
+	return &pb.VerifyDeviceRsp{Error: pb.ResponseOK()}, nil
+}
+
+func (t *SupervisorTest) TestAuthenticatedFarmer(c *check.C) {
+	farmerId := "TestAuthenticatedFarmer"
+	deviceId := "TestAuthenticatedFarmerDevice"
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	idpServer := grpc.NewServer()
+	pb.RegisterIDPAServer(idpServer, &fakeIDPA{farmerId: farmerId, deviceId: deviceId})
+	go idpServer.Serve(lis)
+	defer idpServer.Stop()
+
+	cfg := t.newConfig(c, "sv")
+	cfg.IDProviderAddress = lis.Addr().String()
+	cfg.Auth = &auth.Config{
+		Enabled:        true,
+		Window:         time.Second * 30,
+		DeviceCacheTTL: time.Minute,
+	}
+	sv, err := NewSupervisor(cfg)
+	c.Assert(err, check.IsNil)
+	c.Assert(sv.Start(), check.IsNil)
+	defer sv.Stop()
+
+	conn, err := grpc.Dial(sv.Addr().String(), grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Second*3))
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	client := pb.NewFarmerPublicClient(conn)
+
+	// anyone else can't put the farmer online
+	req := &pb.FarmerOnLineReq{FarmerID: farmerId}
+	rsp, err := client.FarmerOnLine(context.Background(), req)
+	c.Assert(err, check.IsNil)
+	c.Check(rsp.GetError().ErrorType, check.Equals, pb.ErrorType_INVALID_SIGNATURE)
+
+	c.Assert(auth.SignRequest(req, deviceId, priv), check.IsNil)
+	rsp, err = client.FarmerOnLine(context.Background(), req)
+	c.Assert(err, check.IsNil)
+	c.Check(rsp.GetError().OK(), check.Equals, true)
+
+	// the same signed request sent again
+	rsp, err = client.FarmerOnLine(context.Background(), req)
+	c.Assert(err, check.IsNil)
+	c.Check(rsp.GetError().ErrorType, check.Equals, pb.ErrorType_REPLAYED_REQUEST)
+}
+
+// testCA issues certificates for admin service, its operators, and supervisors talking to their peers
+type testCA struct {
+	*mtlstest.CA
+}
+
+func newTestCA(c *check.C, dir string) *testCA {
+	ca, err := mtlstest.NewCA(dir)
+	c.Assert(err, check.IsNil)
+	return &testCA{ca}
+}
+
+// issue a certificate of cn, written into dir of ca as cn.pem and cn.key
+func (ca *testCA) issue(c *check.C, cn string, usages ...x509.ExtKeyUsage) (certFile, keyFile string) {
+	certFile, keyFile, err := ca.Issue(cn, usages...)
+	c.Assert(err, check.IsNil)
+	return
+}
+
+// dial admin service, with operator's certificate if certFile isn't empty
+func (ca *testCA) dialAdmin(c *check.C, addr net.Addr, certFile, keyFile string) *grpc.ClientConn {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	tlsCfg := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		c.Assert(err, check.IsNil)
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	conn, err := grpc.Dial(addr.String(), grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)))
+	c.Assert(err, check.IsNil)
+	return conn
+}
+
+func (t *SupervisorTest) TestAdmin(c *check.C) {
+	farmerId := "TestAdmin"
+	ca := newTestCA(c, filepath.Join(t.dir, "certs"))
+	cfg := t.newConfig(c, "sv")
+	cfg.AdminEnabled = true
+	cfg.AdminAddress = "127.0.0.1:0"
+	cfg.AdminCertFile, cfg.AdminKeyFile = ca.issue(c, "supervisor", x509.ExtKeyUsageServerAuth)
+	cfg.AdminClientCAFile = ca.File
+	cfg.Audit = &audit.Config{
+		Enabled: true,
+		Dir:     filepath.Join(t.dir, "audit"),
+		MaxSize: 1 << 20,
+	}
+	operatorCert, operatorKey := ca.issue(c, "alice", x509.ExtKeyUsageClientAuth)
+
+	sv, err := NewSupervisor(cfg)
+	c.Assert(err, check.IsNil)
+	c.Assert(sv.Start(), check.IsNil)
+	c.Assert(sv.AdminAddr(), check.NotNil)
+	c.Check(sv.AdminAddr().String(), check.Not(check.Equals), sv.Addr().String())
+
+	// admin service isn't on farmer's listener, and farmer without a certificate isn't served
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	anonymous := ca.dialAdmin(c, sv.AdminAddr(), "", "")
+	_, err = pb.NewSupervisorAdminClient(anonymous).GetFarmer(ctx, &pb.GetFarmerReq{FarmerID: farmerId})
+	c.Check(err, check.NotNil)
+	anonymous.Close()
+
+	conn := ca.dialAdmin(c, sv.AdminAddr(), operatorCert, operatorKey)
+	defer conn.Close()
+	admin := pb.NewSupervisorAdminClient(conn)
+
+	getRsp, err := admin.GetFarmer(context.Background(), &pb.GetFarmerReq{FarmerID: farmerId})
+	c.Assert(err, check.IsNil)
+	c.Check(getRsp.Error.ErrorType, check.Equals, pb.ErrorType_FARMER_NOT_FOUND)
+
+	for _, id := range []string{farmerId, farmerId + "2", "Other"} {
+		handler, err := sv.Controller().NewFarmerHandler(id)
+		c.Assert(err, check.IsNil)
+		c.Assert(handler.OnLine(), check.IsNil)
+	}
+
+	getRsp, err = admin.GetFarmer(context.Background(), &pb.GetFarmerReq{FarmerID: farmerId})
+	c.Assert(err, check.IsNil)
+	c.Check(getRsp.Error.OK(), check.Equals, true)
+	c.Check(getRsp.Account.State, check.Equals, pb.FarmerState_ONLINE)
+	c.Check(getRsp.InService, check.Equals, true)
+
+	listRsp, err := admin.ListFarmers(context.Background(), &pb.ListFarmersReq{Prefix: farmerId, Limit: 1})
+	c.Assert(err, check.IsNil)
+	c.Assert(listRsp.Accounts, check.HasLen, 1)
+	c.Check(listRsp.Accounts[0].FarmerID, check.Equals, farmerId)
+	c.Check(listRsp.Next, check.Equals, farmerId)
+	listRsp, err = admin.ListFarmers(context.Background(), &pb.ListFarmersReq{Prefix: farmerId, After: listRsp.Next})
+	c.Assert(err, check.IsNil)
+	c.Assert(listRsp.Accounts, check.HasLen, 1)
+	c.Check(listRsp.Accounts[0].FarmerID, check.Equals, farmerId+"2")
+	c.Check(listRsp.Next, check.Equals, "")
+
+	rsp, err := admin.AdjustBalance(context.Background(), &pb.AdjustBalanceReq{FarmerID: farmerId, Balance: 1000})
+	c.Assert(err, check.IsNil)
+	c.Check(rsp.Error.ErrorType, check.Equals, pb.ErrorType_INVALID_PARAM)
+	rsp, err = admin.AdjustBalance(context.Background(), &pb.AdjustBalanceReq{FarmerID: farmerId, Balance: 1000, Reason: "compensation"})
+	c.Assert(err, check.IsNil)
+	c.Check(rsp.Error.OK(), check.Equals, true)
+	c.Check(rsp.Account.Balance, check.Equals, uint32(1000))
+
+	rsp, err = admin.SuspendFarmer(context.Background(), &pb.SuspendFarmerReq{FarmerID: farmerId, Duration: int64(time.Hour), Reason: "investigating"})
+	c.Assert(err, check.IsNil)
+	c.Check(rsp.Account.State, check.Equals, pb.FarmerState_SUSPENDED)
+	listRsp, err = admin.ListFarmers(context.Background(), &pb.ListFarmersReq{States: []pb.FarmerState{pb.FarmerState_SUSPENDED}})
+	c.Assert(err, check.IsNil)
+	c.Assert(listRsp.Accounts, check.HasLen, 1)
+	c.Check(listRsp.Accounts[0].FarmerID, check.Equals, farmerId)
+
+	rsp, err = admin.BanFarmer(context.Background(), &pb.AdminFarmerReq{FarmerID: farmerId, Reason: "cheating"})
+	c.Assert(err, check.IsNil)
+	c.Check(rsp.Account.State, check.Equals, pb.FarmerState_BANNED)
+	rsp, err = admin.LiftFarmer(context.Background(), &pb.AdminFarmerReq{FarmerID: farmerId})
+	c.Assert(err, check.IsNil)
+	c.Check(rsp.Account.State, check.Equals, pb.FarmerState_OFFLINE)
+
+	// farmers out of service are looked up in storage, and left out of service
+	getRsp, err = admin.GetFarmer(context.Background(), &pb.GetFarmerReq{FarmerID: farmerId})
+	c.Assert(err, check.IsNil)
+	c.Check(getRsp.Account.State, check.Equals, pb.FarmerState_OFFLINE)
+	c.Check(getRsp.InService, check.Equals, false)
+	listRsp, err = admin.ListFarmers(context.Background(), &pb.ListFarmersReq{States: []pb.FarmerState{pb.FarmerState_OFFLINE}})
+	c.Assert(err, check.IsNil)
+	c.Assert(listRsp.Accounts, check.HasLen, 1)
+	c.Check(listRsp.Accounts[0].FarmerID, check.Equals, farmerId)
+	handlers, _ := sv.Controller().InServiceFarmers(farmerId, "", nil, 10)
+	c.Check(handlers, check.HasLen, 1)
+
+	rsp, err = admin.ClearChallenge(context.Background(), &pb.AdminFarmerReq{FarmerID: "Other"})
+	c.Assert(err, check.IsNil)
+	c.Check(rsp.Error.ErrorType, check.Equals, pb.ErrorType_INVALID_PARAM)
+	rsp, err = admin.ForceOffline(context.Background(), &pb.AdminFarmerReq{FarmerID: "Other"})
+	c.Assert(err, check.IsNil)
+	c.Check(rsp.Account.State, check.Equals, pb.FarmerState_OFFLINE)
+
+	flushRsp, err := admin.FlushCaches(context.Background(), &pb.FlushCachesReq{})
+	c.Assert(err, check.IsNil)
+	c.Check(flushRsp.Flushed, check.DeepEquals, []pb.AdminCache{pb.AdminCache_BLOCKS_HASH_CACHE, pb.AdminCache_BLOCK_DIGEST_CACHE})
+
+	c.Assert(sv.Stop(), check.IsNil)
+
+	// every call is audited, along with who made it
+	chain, err := audit.Verify(cfg.Audit.Dir)
+	c.Assert(err, check.IsNil)
+	c.Check(chain.Records > 13, check.Equals, true)
+	methods := []string{}
+	c.Assert(audit.Walk(cfg.Audit.Dir, func(path string, lineno int, rec *audit.Record) error {
+		if rec.Kind == audit.RecordAdmin {
+			c.Check(rec.Operator, check.Equals, "alice")
+			methods = append(methods, rec.Method)
+		}
+		return nil
+	}), check.IsNil)
+	c.Check(methods, check.DeepEquals, []string{"GetFarmer", "GetFarmer", "ListFarmers", "ListFarmers", "AdjustBalance", "AdjustBalance",
+		"SuspendFarmer", "ListFarmers", "BanFarmer", "LiftFarmer", "GetFarmer", "ListFarmers", "ClearChallenge", "ForceOffline", "FlushCaches"})
+}
+
+func (t *SupervisorTest) TestAdminNeedsCertificates(c *check.C) {
+	cfg := t.newConfig(c, "sv")
+	cfg.AdminEnabled = true
+	_, err := NewSupervisor(cfg)
+	c.Check(err, check.ErrorMatches, ".*admin service needs cert, key and client ca files")
+}
+
+func (t *SupervisorTest) TestControlSocket(c *check.C) {
+	cfg := t.newConfig(c, "sv")
+	cfg.ControlSocket = filepath.Join(t.dir, "sv", "supervisor.sock")
+	cfg.Audit = &audit.Config{
+		Enabled: true,
+		Dir:     filepath.Join(t.dir, "audit"),
+		MaxSize: 1 << 20,
+	}
+
+	sv, err := NewSupervisor(cfg)
+	c.Assert(err, check.IsNil)
+	c.Assert(sv.Start(), check.IsNil)
+	c.Assert(sv.ControlAddr(), check.NotNil)
+	fi, err := os.Stat(cfg.ControlSocket)
+	c.Assert(err, check.IsNil)
+	c.Check(fi.Mode().Perm(), check.Equals, os.FileMode(0600))
+
+	// a second node can't take over a socket in use
+	other := t.newConfig(c, "other")
+	other.ControlSocket = cfg.ControlSocket
+	otherSv, err := NewSupervisor(other)
+	c.Assert(err, check.IsNil)
+	c.Check(otherSv.Start(), check.ErrorMatches, ".*control socket .* is in use")
+	otherSv.Stop()
+
+	conn, err := grpc.Dial(cfg.ControlSocket, grpc.WithInsecure(), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", addr, timeout)
+	}))
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+
+	_, err = sv.Controller().NewFarmerHandler("TestControlSocket")
+	c.Assert(err, check.IsNil)
+	rsp, err := pb.NewSupervisorAdminClient(conn).AdjustBalance(context.Background(), &pb.AdjustBalanceReq{FarmerID: "TestControlSocket", Balance: 10, Reason: "compensation"})
+	c.Assert(err, check.IsNil)
+	c.Check(rsp.Error.OK(), check.Equals, true)
+
+	c.Assert(sv.Stop(), check.IsNil)
+	_, err = os.Stat(cfg.ControlSocket)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	// calls over control socket are audited as the local user
+	operators := []string{}
+	c.Assert(audit.Walk(cfg.Audit.Dir, func(path string, lineno int, rec *audit.Record) error {
+		if rec.Kind == audit.RecordAdmin {
+			operators = append(operators, rec.Operator)
+		}
+		return nil
+	}), check.IsNil)
+	c.Assert(operators, check.HasLen, 1)
+	c.Check(operators[0], check.Matches, "local:.+")
+}
+
+func (t *SupervisorTest) TestConfigCheck(c *check.C) {
+	cfg := t.newConfig(c, "sv")
+	c.Check(cfg.Check(), check.HasLen, 0)
+
+	cfg.Address = "no port"
+	cfg.AdminEnabled = true
+	cfg.AdminAddress = "127.0.0.1:0"
+	cfg.Account.FSM = &account.FSMConfig{
+		Transitions: []account.FSMTransitionConfig{{Event: "release", Src: []string{"NOWHERE"}, Dst: "ONLINE"}},
+	}
+	cfg.Challenge.Policy = "random"
+	errs := cfg.Check()
+	c.Assert(errs, check.HasLen, 4)
+	c.Check(errs[0], check.ErrorMatches, ".*invalid address.*")
+	c.Check(errs[1], check.ErrorMatches, ".*admin service needs cert, key and client ca files")
+	c.Check(errs[3], check.ErrorMatches, ".*unknown challenge policy.*")
+}
@@ -0,0 +1,103 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Config of webhook notifier, notify.webhook section of supervisor.yaml
+type Config struct {
+	// whether or not farmer events are posted
+	Enabled   bool
+	Endpoints []Endpoint
+	// timeout of one post
+	Timeout time.Duration
+	// the n-th retry of an event waits MinBackoff * 2^(n-1), up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// an event is given up after so many failed attempts, 0 means never
+	MaxAttempts int
+	// decoding err, reported by NewNotifier
+	err error
+}
+
+// Endpoint is where farmer events are posted to, payloads are signed by Secret
+type Endpoint struct {
+	URL    string `mapstructure:"url"`
+	Secret string `mapstructure:"secret"`
+	// events posted to the endpoint, all if empty
+	Events []string `mapstructure:"events"`
+}
+
+// ConfigFromViper reads notify.webhook section, missing values fall back to defaults
+func ConfigFromViper() *Config {
+	cfg := &Config{
+		Enabled:     viper.GetBool("notify.webhook.enabled"),
+		Timeout:     getWebhookDuration("notify.webhook.timeout", time.Duration(10)*time.Second),
+		MinBackoff:  getWebhookDuration("notify.webhook.backoff.min", time.Second),
+		MaxBackoff:  getWebhookDuration("notify.webhook.backoff.max", time.Duration(5)*time.Minute),
+		MaxAttempts: viper.GetInt("notify.webhook.maxattempts"),
+	}
+	if err := viper.UnmarshalKey("notify.webhook.endpoints", &cfg.Endpoints); err != nil {
+		cfg.err = fmt.Errorf("supervisor/notify: invalid notify.webhook.endpoints: %v", err)
+	}
+
+	return cfg
+}
+
+// Check reports the first problem of cfg NewNotifier would fail with
+func (cfg *Config) Check() error {
+	_, err := cfg.endpoints()
+	return err
+}
+
+// endpoints of cfg, each checked and configured once
+func (cfg *Config) endpoints() ([]*endpoint, error) {
+	if cfg.err != nil {
+		return nil, cfg.err
+	}
+
+	var endpoints []*endpoint
+	for _, cfgEndpoint := range cfg.Endpoints {
+		ep, err := newEndpoint(cfgEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range endpoints {
+			if bytes.Equal(other.prefix, ep.prefix) {
+				return nil, fmt.Errorf("supervisor/notify: webhook endpoint %s configured twice", ep.URL)
+			}
+		}
+		endpoints = append(endpoints, ep)
+	}
+
+	return endpoints, nil
+}
+
+func getWebhookDuration(key string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(viper.GetString(key)); err == nil && d > 0 {
+		return d
+	}
+
+	viper.Set(key, def.String())
+	return def
+}
@@ -0,0 +1,465 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/op/go-logging"
+)
+
+// events posted, Event field of the payload and of EventHeader
+const (
+	EventOnline          = "online"
+	EventLost            = "lost"
+	EventOffline         = "offline"
+	EventSuspended       = "suspended"
+	EventBanned          = "banned"
+	EventChallengeFailed = "challenge_failed"
+	EventBalanceChanged  = "balance_changed"
+)
+
+const (
+	// "sha256=" followed by hex HMAC-SHA256 of the body by endpoint's secret
+	SignatureHeader = "X-Supervisor-Signature"
+	EventHeader     = "X-Supervisor-Event"
+	// id of the notification, the same on a retry, so that receivers can drop duplicates
+	DeliveryHeader = "X-Supervisor-Delivery"
+
+	signature_prefix = "sha256="
+	hook_name        = "webhook"
+	queue_key_size   = 16
+	// last notification id, kept beside the queues, so that ids stay unique once queues drained
+	seq_key = "seq"
+)
+
+var (
+	logger = logging.MustGetLogger("supervisor")
+
+	allEvents = []string{EventOnline, EventLost, EventOffline, EventSuspended, EventBanned, EventChallengeFailed, EventBalanceChanged}
+
+	ErrNotifierClosed = errors.New("supervisor/notify: notifier closed")
+)
+
+// Notification is the JSON payload posted
+type Notification struct {
+	ID       uint64    `json:"id"`
+	Event    string    `json:"event"`
+	FarmerID string    `json:"farmerId"`
+	Time     time.Time `json:"time"`
+	// transition of farmer's state machine, State is the one farmer reports as
+	Transition string `json:"transition,omitempty"`
+	Src        string `json:"src,omitempty"`
+	Dst        string `json:"dst,omitempty"`
+	State      string `json:"state,omitempty"`
+	// balance change, the entry posted to farmer's journal
+	Entry *pb.BalanceEntry `json:"entry,omitempty"`
+}
+
+// transitions are named after the state farmer reports as, balance changes after their reason,
+// empty for events nobody is notified of
+func eventOf(e *account.HookEvent) string {
+	switch e.Kind {
+	case account.HookTransition:
+		switch e.State {
+		case pb.FarmerState_ONLINE:
+			return EventOnline
+		case pb.FarmerState_LOST:
+			return EventLost
+		case pb.FarmerState_OFFLINE:
+			return EventOffline
+		case pb.FarmerState_SUSPENDED:
+			return EventSuspended
+		case pb.FarmerState_BANNED:
+			return EventBanned
+		}
+	case account.HookBalance:
+		if e.Entry == nil {
+			return ""
+		}
+		if e.Entry.Reason == pb.BalanceReason_CHALLENGE_MISSED {
+			return EventChallengeFailed
+		}
+		return EventBalanceChanged
+	}
+
+	return ""
+}
+
+// Sign returns SignatureHeader's value of body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return signature_prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify tells whether signature is SignatureHeader's value of body, for receivers
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// a notification waiting in an endpoint's queue
+type queued struct {
+	Event    string `json:"event"`
+	Body     []byte `json:"body"`
+	Attempts int    `json:"attempts"`
+}
+
+type endpoint struct {
+	Endpoint
+	// queue keys are prefix followed by notification id
+	prefix []byte
+	events map[string]bool
+	wake   chan struct{}
+}
+
+func (ep *endpoint) wants(event string) bool {
+	return len(ep.events) == 0 || ep.events[event]
+}
+
+func (ep *endpoint) key(id uint64) []byte {
+	key := make([]byte, queue_key_size)
+	copy(key, ep.prefix)
+	binary.BigEndian.PutUint64(key[len(ep.prefix):], id)
+	return key
+}
+
+// Notifier posts farmer events to webhook endpoints,
+// every endpoint has its own queue in storage, worked off in order, a failed post is retried with backoff
+type Notifier struct {
+	cfg       *Config
+	storage   store.Storage
+	client    *http.Client
+	endpoints []*endpoint
+	hooks     *account.Hooks
+	seq       uint64
+	l         *sync.Mutex
+	closed    bool
+	stop      chan struct{}
+	wg        *sync.WaitGroup
+}
+
+// NewNotifier subscribes to hooks, and starts working off queues left by last run,
+// queues of endpoints no longer configured are dropped
+func NewNotifier(cfg *Config, storage store.Storage, hooks *account.Hooks) (*Notifier, error) {
+	endpoints, err := cfg.endpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Notifier{
+		cfg:       cfg,
+		storage:   storage,
+		client:    &http.Client{Timeout: cfg.Timeout},
+		hooks:     hooks,
+		endpoints: endpoints,
+		l:         &sync.Mutex{},
+		stop:      make(chan struct{}),
+		wg:        &sync.WaitGroup{},
+	}
+
+	if err := n.loadQueues(); err != nil {
+		return nil, err
+	}
+	if err := hooks.Subscribe(account.HookSubscription{
+		Name:    hook_name,
+		Filter:  func(e *account.HookEvent) bool { return eventOf(e) != "" },
+		Timeout: cfg.Timeout,
+	}, n.enqueue); err != nil {
+		return nil, err
+	}
+
+	for _, ep := range n.endpoints {
+		n.wg.Add(1)
+		go n.work(ep)
+	}
+
+	return n, nil
+}
+
+func newEndpoint(cfg Endpoint) (*endpoint, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("supervisor/notify: invalid webhook endpoint %q", cfg.URL)
+	}
+
+	ep := &endpoint{
+		Endpoint: cfg,
+		events:   make(map[string]bool),
+		wake:     make(chan struct{}, 1),
+	}
+	for _, event := range cfg.Events {
+		known := false
+		for _, e := range allEvents {
+			known = known || e == event
+		}
+		if !known {
+			return nil, fmt.Errorf("supervisor/notify: webhook endpoint %s has unknown event %q", cfg.URL, event)
+		}
+		ep.events[event] = true
+	}
+
+	hash := sha256.Sum256([]byte(cfg.URL))
+	ep.prefix = hash[:queue_key_size-8]
+	return ep, nil
+}
+
+// ids go on from the last notification, orphan ones are dropped
+func (n *Notifier) loadQueues() error {
+	var orphans [][]byte
+	err := n.storage.IterateCF(store.WebhookColumnFamily, func(key, value []byte) bool {
+		if string(key) == seq_key {
+			if len(value) == 8 && binary.BigEndian.Uint64(value) > n.seq {
+				n.seq = binary.BigEndian.Uint64(value)
+			}
+			return true
+		}
+		if len(key) != queue_key_size {
+			orphans = append(orphans, key)
+			return true
+		}
+		if id := binary.BigEndian.Uint64(key[queue_key_size-8:]); id > n.seq {
+			n.seq = id
+		}
+		for _, ep := range n.endpoints {
+			if bytes.HasPrefix(key, ep.prefix) {
+				return true
+			}
+		}
+		orphans = append(orphans, key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(orphans) > 0 {
+		logger.Warningf("drop %d webhook notifications queued for endpoints no longer configured", len(orphans))
+	}
+	for _, key := range orphans {
+		if err := n.storage.DelCF(store.WebhookColumnFamily, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// the hook, queues the event for every endpoint wants it
+func (n *Notifier) enqueue(e *account.HookEvent) error {
+	event := eventOf(e)
+
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	if n.closed {
+		return ErrNotifierClosed
+	}
+
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, n.seq+1)
+	if err := n.storage.SetCF(store.WebhookColumnFamily, []byte(seq_key), seq); err != nil {
+		return err
+	}
+	n.seq++
+
+	notification := &Notification{
+		ID:       n.seq,
+		Event:    event,
+		FarmerID: e.FarmerID,
+		Time:     e.Time,
+		Entry:    e.Entry,
+	}
+	if e.Kind == account.HookTransition {
+		notification.Transition = e.Event
+		notification.Src = e.Src
+		notification.Dst = e.Dst
+		notification.State = e.State.String()
+	}
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	for _, ep := range n.endpoints {
+		if !ep.wants(event) {
+			continue
+		}
+
+		value, err := json.Marshal(&queued{Event: event, Body: body})
+		if err != nil {
+			return err
+		}
+		if err := n.storage.SetCF(store.WebhookColumnFamily, ep.key(notification.ID), value); err != nil {
+			return err
+		}
+
+		select {
+		case ep.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// first notification in endpoint's queue, nil if empty
+func (n *Notifier) head(ep *endpoint) (key []byte, item *queued, err error) {
+	var value []byte
+	err = n.storage.SeekCF(store.WebhookColumnFamily, ep.prefix, func(k, v []byte) bool {
+		if bytes.HasPrefix(k, ep.prefix) {
+			key, value = k, v
+		}
+		return false
+	})
+	if err != nil || key == nil {
+		return
+	}
+
+	item = &queued{}
+	err = json.Unmarshal(value, item)
+	return
+}
+
+func (n *Notifier) work(ep *endpoint) {
+	defer n.wg.Done()
+
+	for {
+		key, item, err := n.head(ep)
+		if err != nil {
+			logger.Errorf("load webhook %s queue err: %v", ep.URL, err)
+			if !n.wait(n.cfg.MinBackoff) {
+				return
+			}
+			continue
+		}
+		if item == nil {
+			select {
+			case <-ep.wake:
+				continue
+			case <-n.stop:
+				return
+			}
+		}
+
+		id := binary.BigEndian.Uint64(key[queue_key_size-8:])
+		if err = n.post(ep, id, item); err == nil {
+			n.storage.DelCF(store.WebhookColumnFamily, key)
+			continue
+		}
+
+		item.Attempts++
+		if n.cfg.MaxAttempts > 0 && item.Attempts >= n.cfg.MaxAttempts {
+			logger.Errorf("give up webhook %s notification %d after %d attempts, last err: %v", ep.URL, id, item.Attempts, err)
+			n.storage.DelCF(store.WebhookColumnFamily, key)
+			continue
+		}
+
+		backoff := n.backoff(item.Attempts)
+		logger.Warningf("post webhook %s notification %d err: %v, retry in %v", ep.URL, id, err, backoff)
+		if value, err := json.Marshal(item); err == nil {
+			n.storage.SetCF(store.WebhookColumnFamily, key, value)
+		}
+		if !n.wait(backoff) {
+			return
+		}
+	}
+}
+
+// returns false if notifier closed while waiting
+func (n *Notifier) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-n.stop:
+		return false
+	}
+}
+
+func (n *Notifier) backoff(attempts int) time.Duration {
+	backoff := n.cfg.MinBackoff
+	for i := 1; i < attempts && backoff < n.cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > n.cfg.MaxBackoff {
+		backoff = n.cfg.MaxBackoff
+	}
+
+	return backoff
+}
+
+func (n *Notifier) post(ep *endpoint, id uint64, item *queued) error {
+	req, err := http.NewRequest("POST", ep.URL, bytes.NewReader(item.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, item.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatUint(id, 10))
+	req.Header.Set(SignatureHeader, Sign(ep.Secret, item.Body))
+
+	rsp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(rsp.Body, 4096))
+
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("supervisor/notify: %s responds %s", ep.URL, rsp.Status)
+	}
+
+	return nil
+}
+
+// Close unsubscribes from hooks, stops working off queues, what is left in them is posted on next run,
+// storage is not closed
+func (n *Notifier) Close() error {
+	n.l.Lock()
+	if n.closed {
+		n.l.Unlock()
+		return nil
+	}
+	n.closed = true
+	n.l.Unlock()
+
+	n.hooks.Unsubscribe(hook_name)
+	close(n.stop)
+	n.wg.Wait()
+
+	return nil
+}
@@ -0,0 +1,326 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/account/store"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+const test_secret = "webhook secret"
+
+// receiver is a webhook endpoint, fails the first fails posts
+type receiver struct {
+	l        *sync.Mutex
+	server   *httptest.Server
+	fails    int
+	attempts int
+	received []*Notification
+	// ids of deliveries
+	deliveries []string
+	got        chan struct{}
+}
+
+func newReceiver(c *check.C, fails int) *receiver {
+	r := &receiver{
+		l:     &sync.Mutex{},
+		fails: fails,
+		got:   make(chan struct{}, 100),
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		c.Check(err, check.IsNil)
+		if !Verify(test_secret, body, req.Header.Get(SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		r.l.Lock()
+		defer r.l.Unlock()
+		r.attempts++
+		if r.attempts <= r.fails {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		notification := &Notification{}
+		c.Check(json.Unmarshal(body, notification), check.IsNil)
+		c.Check(req.Header.Get(EventHeader), check.Equals, notification.Event)
+		r.received = append(r.received, notification)
+		r.deliveries = append(r.deliveries, req.Header.Get(DeliveryHeader))
+		r.got <- struct{}{}
+	}))
+
+	return r
+}
+
+// wait until n notifications received
+func (r *receiver) wait(c *check.C, n int) []*Notification {
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.got:
+		case <-time.After(time.Second * 5):
+			c.Fatalf("received %d notifications, want %d", i, n)
+		}
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	return append([]*Notification{}, r.received...)
+}
+
+type TestNotifier struct {
+	dbpath  string
+	storage store.Storage
+	hooks   *account.Hooks
+}
+
+var _ = check.Suite(&TestNotifier{})
+
+func (t *TestNotifier) SetUpTest(c *check.C) {
+	t.dbpath = filepath.Join(os.TempDir(), "testNotifier")
+	os.RemoveAll(t.dbpath)
+
+	var err error
+	t.storage, err = store.NewStore("rocksdb", t.dbpath)
+	c.Assert(err, check.IsNil)
+	t.hooks = account.NewHooks()
+}
+
+func (t *TestNotifier) TearDownTest(c *check.C) {
+	t.hooks.Close()
+	t.storage.Close()
+	os.RemoveAll(t.dbpath)
+}
+
+func newTestConfig(endpoints ...Endpoint) *Config {
+	return &Config{
+		Enabled:    true,
+		Endpoints:  endpoints,
+		Timeout:    time.Second,
+		MinBackoff: time.Millisecond * 10,
+		MaxBackoff: time.Millisecond * 40,
+	}
+}
+
+func transition(farmerId, event, src, dst string, state pb.FarmerState) *account.HookEvent {
+	return &account.HookEvent{Kind: account.HookTransition, FarmerID: farmerId, Time: time.Now(), Event: event, Src: src, Dst: dst, State: state}
+}
+
+func balanceChange(farmerId string, reason pb.BalanceReason, balance uint32) *account.HookEvent {
+	return &account.HookEvent{Kind: account.HookBalance, FarmerID: farmerId, Time: time.Now(), Entry: &pb.BalanceEntry{FarmerID: farmerId, Reason: reason, Balance: balance}}
+}
+
+func (t *TestNotifier) TestDeliver(c *check.C) {
+	r := newReceiver(c, 0)
+	defer r.server.Close()
+
+	n, err := NewNotifier(newTestConfig(Endpoint{URL: r.server.URL, Secret: test_secret}), t.storage, t.hooks)
+	c.Assert(err, check.IsNil)
+	defer n.Close()
+
+	t.hooks.Publish(transition("farmer", "online", "OFFLINE", "ONLINE", pb.FarmerState_ONLINE))
+	t.hooks.Publish(balanceChange("farmer", pb.BalanceReason_CHALLENGE_MISSED, 90))
+	t.hooks.Publish(balanceChange("farmer", pb.BalanceReason_PING_REWARD, 190))
+	t.hooks.Publish(transition("farmer", "lost", "ONLINE", "LOST", pb.FarmerState_LOST))
+
+	received := r.wait(c, 4)
+	c.Check(received[0].Event, check.Equals, EventOnline)
+	c.Check(received[0].Src, check.Equals, "OFFLINE")
+	c.Check(received[0].State, check.Equals, "ONLINE")
+	c.Check(received[1].Event, check.Equals, EventChallengeFailed)
+	c.Check(received[1].Entry.Balance, check.Equals, uint32(90))
+	c.Check(received[2].Event, check.Equals, EventBalanceChanged)
+	c.Check(received[3].Event, check.Equals, EventLost)
+	c.Check(r.deliveries, check.DeepEquals, []string{"1", "2", "3", "4"})
+}
+
+func (t *TestNotifier) TestEventFilter(c *check.C) {
+	all, lost := newReceiver(c, 0), newReceiver(c, 0)
+	defer all.server.Close()
+	defer lost.server.Close()
+
+	n, err := NewNotifier(newTestConfig(
+		Endpoint{URL: all.server.URL, Secret: test_secret},
+		Endpoint{URL: lost.server.URL, Secret: test_secret, Events: []string{EventLost, EventOffline}},
+	), t.storage, t.hooks)
+	c.Assert(err, check.IsNil)
+	defer n.Close()
+
+	t.hooks.Publish(transition("farmer", "online", "OFFLINE", "ONLINE", pb.FarmerState_ONLINE))
+	t.hooks.Publish(transition("farmer", "lost", "ONLINE", "LOST", pb.FarmerState_LOST))
+
+	c.Check(all.wait(c, 2), check.HasLen, 2)
+	received := lost.wait(c, 1)
+	c.Assert(received, check.HasLen, 1)
+	c.Check(received[0].Event, check.Equals, EventLost)
+	c.Check(received[0].ID, check.Equals, uint64(2))
+}
+
+func (t *TestNotifier) TestRetry(c *check.C) {
+	r := newReceiver(c, 3)
+	defer r.server.Close()
+
+	n, err := NewNotifier(newTestConfig(Endpoint{URL: r.server.URL, Secret: test_secret}), t.storage, t.hooks)
+	c.Assert(err, check.IsNil)
+	defer n.Close()
+
+	t.hooks.Publish(transition("farmer", "offline", "LOST", "OFFLINE", pb.FarmerState_OFFLINE))
+	t.hooks.Publish(transition("farmer", "online", "OFFLINE", "ONLINE", pb.FarmerState_ONLINE))
+
+	// order kept across retries
+	received := r.wait(c, 2)
+	c.Check(received[0].Event, check.Equals, EventOffline)
+	c.Check(received[1].Event, check.Equals, EventOnline)
+	c.Check(r.attempts, check.Equals, 5)
+}
+
+func (t *TestNotifier) TestWrongSecret(c *check.C) {
+	r := newReceiver(c, 0)
+	defer r.server.Close()
+
+	cfg := newTestConfig(Endpoint{URL: r.server.URL, Secret: "guessed"})
+	cfg.MaxAttempts = 2
+	n, err := NewNotifier(cfg, t.storage, t.hooks)
+	c.Assert(err, check.IsNil)
+	defer n.Close()
+
+	// given up after max attempts, queue is empty then
+	t.hooks.Publish(transition("farmer", "online", "OFFLINE", "ONLINE", pb.FarmerState_ONLINE))
+	time.Sleep(time.Millisecond * 200)
+	_, item, err := n.head(n.endpoints[0])
+	c.Check(err, check.IsNil)
+	c.Check(item, check.IsNil)
+	c.Check(r.received, check.HasLen, 0)
+}
+
+func (t *TestNotifier) TestSurviveRestart(c *check.C) {
+	r := newReceiver(c, 1000)
+	defer r.server.Close()
+
+	n, err := NewNotifier(newTestConfig(Endpoint{URL: r.server.URL, Secret: test_secret}), t.storage, t.hooks)
+	c.Assert(err, check.IsNil)
+	t.hooks.Publish(transition("farmer", "lost", "ONLINE", "LOST", pb.FarmerState_LOST))
+	t.hooks.Publish(balanceChange("farmer", pb.BalanceReason_CHALLENGE_MISSED, 0))
+	time.Sleep(time.Millisecond * 50)
+	c.Check(n.Close(), check.IsNil)
+
+	// endpoint comes back after supervisor restarted
+	r.l.Lock()
+	r.fails = 0
+	r.l.Unlock()
+	n, err = NewNotifier(newTestConfig(Endpoint{URL: r.server.URL, Secret: test_secret}), t.storage, t.hooks)
+	c.Assert(err, check.IsNil)
+	defer n.Close()
+
+	received := r.wait(c, 2)
+	c.Check(received[0].Event, check.Equals, EventLost)
+	c.Check(received[1].Event, check.Equals, EventChallengeFailed)
+
+	// ids go on after restart
+	t.hooks.Publish(transition("farmer", "offline", "LOST", "OFFLINE", pb.FarmerState_OFFLINE))
+	received = r.wait(c, 1)
+	c.Check(received[2].ID, check.Equals, uint64(3))
+}
+
+func (t *TestNotifier) TestOrphanQueueDropped(c *check.C) {
+	r := newReceiver(c, 1000)
+	defer r.server.Close()
+
+	n, err := NewNotifier(newTestConfig(Endpoint{URL: r.server.URL, Secret: test_secret}), t.storage, t.hooks)
+	c.Assert(err, check.IsNil)
+	t.hooks.Publish(transition("farmer", "lost", "ONLINE", "LOST", pb.FarmerState_LOST))
+	c.Check(n.Close(), check.IsNil)
+
+	n, err = NewNotifier(newTestConfig(), t.storage, t.hooks)
+	c.Assert(err, check.IsNil)
+	defer n.Close()
+
+	count := 0
+	t.storage.IterateCF(store.WebhookColumnFamily, func(key, value []byte) bool {
+		if string(key) != seq_key {
+			count++
+		}
+		return true
+	})
+	c.Check(count, check.Equals, 0)
+}
+
+func (t *TestNotifier) TestIdsUniqueAfterDrained(c *check.C) {
+	r := newReceiver(c, 0)
+	defer r.server.Close()
+
+	n, err := NewNotifier(newTestConfig(Endpoint{URL: r.server.URL, Secret: test_secret}), t.storage, t.hooks)
+	c.Assert(err, check.IsNil)
+	t.hooks.Publish(transition("farmer", "lost", "ONLINE", "LOST", pb.FarmerState_LOST))
+	t.hooks.Publish(transition("farmer", "offline", "LOST", "OFFLINE", pb.FarmerState_OFFLINE))
+	r.wait(c, 2)
+	c.Check(n.Close(), check.IsNil)
+
+	// nothing queued left, ids go on anyway
+	n, err = NewNotifier(newTestConfig(Endpoint{URL: r.server.URL, Secret: test_secret}), t.storage, t.hooks)
+	c.Assert(err, check.IsNil)
+	defer n.Close()
+
+	t.hooks.Publish(transition("farmer", "online", "OFFLINE", "ONLINE", pb.FarmerState_ONLINE))
+	received := r.wait(c, 1)
+	c.Assert(received, check.HasLen, 3)
+	c.Check(received[2].ID, check.Equals, uint64(3))
+	c.Check(r.deliveries[2], check.Not(check.Equals), r.deliveries[0])
+}
+
+func (t *TestNotifier) TestInvalidConfig(c *check.C) {
+	for _, cfg := range []*Config{
+		newTestConfig(Endpoint{URL: "ftp://example.com"}),
+		newTestConfig(Endpoint{URL: "http://example.com", Events: []string{"rebooted"}}),
+		newTestConfig(Endpoint{URL: "http://example.com"}, Endpoint{URL: "http://example.com"}),
+	} {
+		_, err := NewNotifier(cfg, t.storage, t.hooks)
+		c.Check(err, check.NotNil)
+	}
+}
+
+func (t *TestNotifier) TestBackoff(c *check.C) {
+	n := &Notifier{cfg: &Config{MinBackoff: time.Second, MaxBackoff: time.Second * 10}}
+	for attempts, backoff := range []time.Duration{time.Second, time.Second, time.Second * 2, time.Second * 4, time.Second * 8, time.Second * 10, time.Second * 10} {
+		c.Check(n.backoff(attempts), check.Equals, backoff, check.Commentf("attempts %d", attempts))
+	}
+}
+
+func (t *TestNotifier) TestSign(c *check.C) {
+	body := []byte(`{"id":1}`)
+	signature := Sign(test_secret, body)
+	c.Check(Verify(test_secret, body, signature), check.Equals, true)
+	c.Check(Verify("other", body, signature), check.Equals, false)
+	c.Check(Verify(test_secret, []byte(`{"id":2}`), signature), check.Equals, false)
+}
@@ -0,0 +1,111 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	default_slots = 256
+	max_slots     = 1 << 16
+)
+
+// Config of a supervisor in a shard map, shard section of supervisor.yaml
+type Config struct {
+	// whether or not farmers are sharded among supervisors, a single supervisor serves them all if not
+	Enabled bool
+	// id of the supervisor, one of Nodes
+	ID string
+	// where shard service listens, slots handed over by other supervisors
+	Address string
+	// farmer ids are hashed into so many slots, every supervisor must have the same
+	Slots int
+	// every supervisor of the shard map, this one included, id to the address farmers reach it at
+	Nodes map[string]string
+	// id to the address shard service of the supervisor is reached at, the same ids as Nodes
+	Peers map[string]string
+	// mutual tls between supervisors, peers' certificates must be signed by CAFile, and have their ids as common names
+	CertFile string
+	KeyFile  string
+	CAFile   string
+
+	// if set, shard service is served on it instead of Address, handy for tests
+	Listener net.Listener
+}
+
+// ConfigFromViper reads shard section, missing values fall back to defaults
+func ConfigFromViper() *Config {
+	cfg := &Config{
+		Enabled:  viper.GetBool("shard.enabled"),
+		ID:       viper.GetString("shard.id"),
+		Address:  viper.GetString("shard.address"),
+		Slots:    viper.GetInt("shard.slots"),
+		Nodes:    viper.GetStringMapString("shard.nodes"),
+		Peers:    viper.GetStringMapString("shard.peers"),
+		CertFile: viper.GetString("shard.tls.cert.file"),
+		KeyFile:  viper.GetString("shard.tls.key.file"),
+		CAFile:   viper.GetString("shard.tls.ca.file"),
+	}
+	if cfg.Slots <= 0 {
+		cfg.Slots = default_slots
+	}
+
+	return cfg
+}
+
+// Check reports the first problem of cfg a sharder would fail to start with
+func (cfg *Config) Check() error {
+	if cfg.ID == "" {
+		return errors.New("supervisor/shard: no id")
+	}
+	if _, ok := cfg.Nodes[cfg.ID]; !ok {
+		return fmt.Errorf("supervisor/shard: %s is not one of nodes", cfg.ID)
+	}
+	if cfg.Slots <= 0 || cfg.Slots > max_slots {
+		return fmt.Errorf("supervisor/shard: %d slots, must be in [1, %d]", cfg.Slots, max_slots)
+	}
+	if len(cfg.Peers) != len(cfg.Nodes) {
+		return errors.New("supervisor/shard: nodes and peers must have the same supervisors")
+	}
+	for id, addr := range cfg.Nodes {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("supervisor/shard: invalid address %q of node %s: %v", addr, id, err)
+		}
+		peerAddr, ok := cfg.Peers[id]
+		if !ok {
+			return fmt.Errorf("supervisor/shard: node %s is not one of peers", id)
+		}
+		if _, _, err := net.SplitHostPort(peerAddr); err != nil {
+			return fmt.Errorf("supervisor/shard: invalid address %q of peer %s: %v", peerAddr, id, err)
+		}
+	}
+	if cfg.Listener == nil {
+		if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+			return fmt.Errorf("supervisor/shard: invalid address %q: %v", cfg.Address, err)
+		}
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" || cfg.CAFile == "" {
+		return errors.New("supervisor/shard: mutual tls is required, it needs cert, key and ca files")
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package shard
+
+import (
+	"sync"
+
+	pb "github.com/conseweb/common/protos"
+	"golang.org/x/net/context"
+)
+
+// FarmerPublic serves farmers of the slots this supervisor owns, the others get WRONG_SHARD errors
+// with address of the supervisor owning them, farmers of a slot being handed over are asked to try again later
+type FarmerPublic struct {
+	local   pb.FarmerPublicServer
+	sharder *Sharder
+}
+
+// NewFarmerPublic wraps local farmer public service of the supervisor, so that it serves its own farmers only
+func NewFarmerPublic(local pb.FarmerPublicServer, sharder *Sharder) *FarmerPublic {
+	return &FarmerPublic{
+		local:   local,
+		sharder: sharder,
+	}
+}
+
+func (fmp *FarmerPublic) FarmerOnLine(ctx context.Context, req *pb.FarmerOnLineReq) (*pb.FarmerOnLineRsp, error) {
+	release, redirect, err := fmp.sharder.acquire(req.FarmerID)
+	if err != nil {
+		return nil, err
+	}
+	if redirect != nil {
+		return &pb.FarmerOnLineRsp{Error: redirect}, nil
+	}
+	defer release()
+
+	return fmp.local.FarmerOnLine(ctx, req)
+}
+
+func (fmp *FarmerPublic) FarmerPing(ctx context.Context, req *pb.FarmerPingReq) (*pb.FarmerPingRsp, error) {
+	release, redirect, err := fmp.sharder.acquire(req.FarmerID)
+	if err != nil {
+		return nil, err
+	}
+	if redirect != nil {
+		return &pb.FarmerPingRsp{Error: redirect}, nil
+	}
+	defer release()
+
+	return fmp.local.FarmerPing(ctx, req)
+}
+
+func (fmp *FarmerPublic) FarmerConquerChallenge(ctx context.Context, req *pb.FarmerConquerChallengeReq) (*pb.FarmerConquerChallengeRsp, error) {
+	release, redirect, err := fmp.sharder.acquire(req.FarmerID)
+	if err != nil {
+		return nil, err
+	}
+	if redirect != nil {
+		return &pb.FarmerConquerChallengeRsp{Error: redirect}, nil
+	}
+	defer release()
+
+	return fmp.local.FarmerConquerChallenge(ctx, req)
+}
+
+func (fmp *FarmerPublic) FarmerOffLine(ctx context.Context, req *pb.FarmerOffLineReq) (*pb.FarmerOffLineRsp, error) {
+	release, redirect, err := fmp.sharder.acquire(req.FarmerID)
+	if err != nil {
+		return nil, err
+	}
+	if redirect != nil {
+		return &pb.FarmerOffLineRsp{Error: redirect}, nil
+	}
+	defer release()
+
+	return fmp.local.FarmerOffLine(ctx, req)
+}
+
+func (fmp *FarmerPublic) FarmerBalanceHistory(ctx context.Context, req *pb.FarmerBalanceHistoryReq) (*pb.FarmerBalanceHistoryRsp, error) {
+	release, redirect, err := fmp.sharder.acquire(req.FarmerID)
+	if err != nil {
+		return nil, err
+	}
+	if redirect != nil {
+		return &pb.FarmerBalanceHistoryRsp{Error: redirect}, nil
+	}
+	defer release()
+
+	return fmp.local.FarmerBalanceHistory(ctx, req)
+}
+
+// FarmerSession opens farmer's session if this supervisor owns the farmer, its slot isn't handed over until the session
+// is open or refused, handing it over later ends the session, farmer reconnects to be redirected
+func (fmp *FarmerPublic) FarmerSession(stream pb.FarmerPublic_FarmerSessionServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	session := &sessionStream{
+		FarmerPublic_FarmerSessionServer: stream,
+		first:                            req,
+		once:                             &sync.Once{},
+	}
+	// a session opening without online request is refused by local service
+	if req.OnLine != nil {
+		release, redirect, err := fmp.sharder.acquire(req.OnLine.FarmerID)
+		if err != nil {
+			return err
+		}
+		if redirect != nil {
+			return stream.Send(&pb.FarmerSessionRsp{Error: redirect, OnLine: &pb.FarmerOnLineRsp{Error: redirect}})
+		}
+		session.release = release
+		defer session.opened()
+	}
+
+	return fmp.local.FarmerSession(session)
+}
+
+// sessionStream hands the request received already over to local service, and releases farmer's slot
+// once local service replied to it
+type sessionStream struct {
+	pb.FarmerPublic_FarmerSessionServer
+	first   *pb.FarmerSessionReq
+	release func()
+	once    *sync.Once
+}
+
+func (s *sessionStream) Recv() (*pb.FarmerSessionReq, error) {
+	if req := s.first; req != nil {
+		s.first = nil
+		return req, nil
+	}
+	return s.FarmerPublic_FarmerSessionServer.Recv()
+}
+
+func (s *sessionStream) Send(rsp *pb.FarmerSessionRsp) error {
+	s.opened()
+	return s.FarmerPublic_FarmerSessionServer.Send(rsp)
+}
+
+func (s *sessionStream) opened() {
+	s.once.Do(func() {
+		if s.release != nil {
+			s.release()
+		}
+	})
+}
@@ -0,0 +1,143 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package shard
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/conseweb/supervisor/account/store"
+)
+
+const (
+	map_slot_key = "slot/"
+)
+
+// Slot of the farmer, one of slots
+func Slot(farmerId string, slots int) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(farmerId))
+	return h.Sum32() % uint32(slots)
+}
+
+// owner of a slot since epoch, epoch 0 is the initial assignment
+type slotOwner struct {
+	Owner string `json:"owner"`
+	Epoch uint64 `json:"epoch"`
+}
+
+// Map assigns farmer slots to supervisors, slots are split among supervisors in order of id at first,
+// a slot moved is recorded in shard column family along with its epoch, by both supervisors moving it,
+// so that maps of supervisors differ in the slots moved only, a stale one is fixed by following redirects
+type Map struct {
+	l       *sync.RWMutex
+	storage store.Storage
+	owners  []slotOwner
+}
+
+func newMap(cfg *Config, storage store.Storage) (*Map, error) {
+	ids := make([]string, 0, len(cfg.Nodes))
+	for id := range cfg.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	m := &Map{
+		l:       &sync.RWMutex{},
+		storage: storage,
+		owners:  make([]slotOwner, cfg.Slots),
+	}
+	for slot := range m.owners {
+		m.owners[slot].Owner = ids[slot*len(ids)/cfg.Slots]
+	}
+
+	var loadErr error
+	err := storage.SeekCF(store.ShardColumnFamily, []byte(map_slot_key), func(key, value []byte) bool {
+		if len(key) != len(map_slot_key)+4 || string(key[:len(map_slot_key)]) != map_slot_key {
+			return false
+		}
+		slot := binary.BigEndian.Uint32(key[len(map_slot_key):])
+		owner := slotOwner{}
+		if loadErr = json.Unmarshal(value, &owner); loadErr != nil {
+			return false
+		}
+		// a slot beyond the configured ones is of a map with more slots, ignored
+		if int(slot) < len(m.owners) {
+			m.owners[slot] = owner
+		}
+		return true
+	})
+	if err == nil {
+		err = loadErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func slotKey(slot uint32) []byte {
+	key := make([]byte, len(map_slot_key)+4)
+	copy(key, map_slot_key)
+	binary.BigEndian.PutUint32(key[len(map_slot_key):], slot)
+	return key
+}
+
+// Owner of slot, and since which epoch
+func (m *Map) Owner(slot uint32) (string, uint64) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	owner := m.owners[slot]
+	return owner.Owner, owner.Epoch
+}
+
+// Slots owned by id, in order
+func (m *Map) Slots(id string) []uint32 {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	slots := []uint32{}
+	for slot, owner := range m.owners {
+		if owner.Owner == id {
+			slots = append(slots, uint32(slot))
+		}
+	}
+	return slots
+}
+
+// persist the new owner of slot, before the map tells it
+func (m *Map) set(slot uint32, id string, epoch uint64) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	owner := slotOwner{Owner: id, Epoch: epoch}
+	value, err := json.Marshal(&owner)
+	if err != nil {
+		return err
+	}
+	if err := m.storage.SetCF(store.ShardColumnFamily, slotKey(slot), value); err != nil {
+		return err
+	}
+	m.owners[slot] = owner
+
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package shard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/conseweb/supervisor/account/store"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type ShardTest struct {
+	dir string
+}
+
+var _ = check.Suite(&ShardTest{})
+
+func (t *ShardTest) SetUpTest(c *check.C) {
+	t.dir = filepath.Join(os.TempDir(), "testShard")
+	os.RemoveAll(t.dir)
+}
+
+func (t *ShardTest) TearDownTest(c *check.C) {
+	os.RemoveAll(t.dir)
+}
+
+func newTestConfig(id string, slots int) *Config {
+	return &Config{
+		Enabled:  true,
+		ID:       id,
+		Address:  "127.0.0.1:0",
+		Slots:    slots,
+		Nodes:    map[string]string{"sv0": "127.0.0.1:9376", "sv1": "127.0.0.1:9386", "sv2": "127.0.0.1:9396"},
+		Peers:    map[string]string{"sv0": "127.0.0.1:9379", "sv1": "127.0.0.1:9389", "sv2": "127.0.0.1:9399"},
+		CertFile: id + ".pem",
+		KeyFile:  id + ".key",
+		CAFile:   "ca.pem",
+	}
+}
+
+func (t *ShardTest) TestSlot(c *check.C) {
+	counts := make([]int, 16)
+	for i := 0; i < 1600; i++ {
+		slot := Slot(fmt.Sprintf("farmer%d", i), len(counts))
+		c.Assert(slot < uint32(len(counts)), check.Equals, true)
+		c.Check(Slot(fmt.Sprintf("farmer%d", i), len(counts)), check.Equals, slot)
+		counts[slot]++
+	}
+	for slot, count := range counts {
+		c.Check(count > 50, check.Equals, true, check.Commentf("slot %d has %d farmers", slot, count))
+	}
+}
+
+func (t *ShardTest) TestMap(c *check.C) {
+	storage, err := store.NewStore("rocksdb", t.dir)
+	c.Assert(err, check.IsNil)
+
+	m, err := newMap(newTestConfig("sv0", 16), storage)
+	c.Assert(err, check.IsNil)
+	// split in order of id
+	c.Check(m.Slots("sv0"), check.DeepEquals, []uint32{0, 1, 2, 3, 4, 5})
+	c.Check(m.Slots("sv1"), check.DeepEquals, []uint32{6, 7, 8, 9, 10})
+	c.Check(m.Slots("sv2"), check.DeepEquals, []uint32{11, 12, 13, 14, 15})
+	owner, epoch := m.Owner(6)
+	c.Check(owner, check.Equals, "sv1")
+	c.Check(epoch, check.Equals, uint64(0))
+
+	c.Assert(m.set(6, "sv2", 1), check.IsNil)
+	owner, epoch = m.Owner(6)
+	c.Check(owner, check.Equals, "sv2")
+	c.Check(epoch, check.Equals, uint64(1))
+	storage.Close()
+
+	// moves survive restarts
+	storage, err = store.NewStore("rocksdb", t.dir)
+	c.Assert(err, check.IsNil)
+	defer storage.Close()
+	m, err = newMap(newTestConfig("sv0", 16), storage)
+	c.Assert(err, check.IsNil)
+	owner, epoch = m.Owner(6)
+	c.Check(owner, check.Equals, "sv2")
+	c.Check(epoch, check.Equals, uint64(1))
+	c.Check(m.Slots("sv2"), check.DeepEquals, []uint32{6, 11, 12, 13, 14, 15})
+}
+
+func (t *ShardTest) TestConfigCheck(c *check.C) {
+	c.Check(newTestConfig("sv0", 16).Check(), check.IsNil)
+
+	cfg := newTestConfig("sv3", 16)
+	c.Check(cfg.Check(), check.ErrorMatches, ".*not one of nodes")
+
+	cfg = newTestConfig("sv0", max_slots+1)
+	c.Check(cfg.Check(), check.ErrorMatches, ".*slots, must be in.*")
+
+	cfg = newTestConfig("sv0", 16)
+	delete(cfg.Peers, "sv2")
+	c.Check(cfg.Check(), check.ErrorMatches, ".*same supervisors")
+
+	cfg = newTestConfig("sv0", 16)
+	cfg.Nodes["sv1"] = "sv1"
+	c.Check(cfg.Check(), check.ErrorMatches, ".*invalid address.*of node sv1.*")
+
+	cfg = newTestConfig("sv0", 16)
+	cfg.CertFile = ""
+	c.Check(cfg.Check(), check.ErrorMatches, ".*mutual tls is required.*")
+
+	cfg = newTestConfig("sv0", 16)
+	cfg.KeyFile = ""
+	c.Check(cfg.Check(), check.ErrorMatches, ".*mutual tls is required.*")
+}
@@ -0,0 +1,383 @@
+/*
+Copyright Mojing Inc. 2016 All Rights Reserved.
+Written by mint.zhao.chiu@gmail.com. github.com: https://www.github.com/mintzhao
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	pb "github.com/conseweb/common/protos"
+	"github.com/conseweb/supervisor/account"
+	"github.com/conseweb/supervisor/account/store"
+	"github.com/conseweb/supervisor/mtls"
+	"github.com/op/go-logging"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// most records sent in one batch of a slot handed over
+	max_batch_records = 256
+)
+
+var (
+	logger = logging.MustGetLogger("shard")
+
+	ErrSlotMoving = errors.New("supervisor/shard: slot is being handed over")
+)
+
+// Sharder serves farmers of the slots this supervisor owns, redirects the others to their owners,
+// and hands slots over to other supervisors, or takes them over, through shard service
+type Sharder struct {
+	cfg     *Config
+	ctr     *account.FarmerAccountController
+	storage store.Storage
+	smap    *Map
+	peers   map[string]pb.SupervisorShardClient
+	conns   []*grpc.ClientConn
+	creds   credentials.TransportAuthenticator
+
+	server   *grpc.Server
+	listener net.Listener
+
+	l    *sync.Mutex
+	cond *sync.Cond
+	// slots being handed over, their farmers are asked to try again later
+	moving map[uint32]bool
+	// farmer requests being served, by slot, a slot is handed over once they are done
+	serving map[uint32]int
+	// slots being taken over
+	receiving map[uint32]*receiving
+	receiveL  *sync.Mutex
+}
+
+// a slot being taken over, from one supervisor at one epoch
+type receiving struct {
+	from    string
+	epoch   uint64
+	records int
+}
+
+// New loads the shard map from storage the controller works on, and connects peers, nothing is served until Start
+func New(cfg *Config, ctr *account.FarmerAccountController, storage store.Storage) (*Sharder, error) {
+	if err := cfg.Check(); err != nil {
+		return nil, err
+	}
+	smap, err := newMap(cfg, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sharder{
+		cfg:       cfg,
+		ctr:       ctr,
+		storage:   storage,
+		smap:      smap,
+		peers:     make(map[string]pb.SupervisorShardClient),
+		l:         &sync.Mutex{},
+		moving:    make(map[uint32]bool),
+		serving:   make(map[uint32]int),
+		receiving: make(map[uint32]*receiving),
+		receiveL:  &sync.Mutex{},
+	}
+	s.cond = sync.NewCond(s.l)
+
+	serverCreds, clientTLS, err := mtls.Load(cfg.CertFile, cfg.KeyFile, cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	s.creds = serverCreds
+	for id, addr := range cfg.Peers {
+		if id == cfg.ID {
+			continue
+		}
+		// credentials of a dial take server name of the peer into their tls config, so every peer has its own
+		conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(clientTLS.Clone())))
+		if err != nil {
+			s.closeConns()
+			return nil, fmt.Errorf("supervisor/shard: dial peer %s at %s err: %v", id, addr, err)
+		}
+		s.conns = append(s.conns, conn)
+		s.peers[id] = pb.NewSupervisorShardClient(conn)
+	}
+
+	return s, nil
+}
+
+// Map of slots to their owners, as this supervisor knows it
+func (s *Sharder) Map() *Map {
+	return s.smap
+}
+
+// Start serves shard service
+func (s *Sharder) Start() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.server != nil {
+		return errors.New("supervisor/shard: sharder already started")
+	}
+
+	lis := s.cfg.Listener
+	if lis == nil {
+		var err error
+		if lis, err = net.Listen("tcp", s.cfg.Address); err != nil {
+			return err
+		}
+	}
+	s.server = grpc.NewServer(grpc.Creds(s.creds))
+	s.listener = lis
+	pb.RegisterSupervisorShardServer(s.server, s)
+
+	go s.server.Serve(lis)
+	logger.Infof("supervisor %s of shard map listening on %s, owns %d of %d slots", s.cfg.ID, lis.Addr(), len(s.smap.Slots(s.cfg.ID)), s.cfg.Slots)
+
+	return nil
+}
+
+// Stop stops serving and disconnects peers
+func (s *Sharder) Stop() {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.server != nil {
+		s.server.Stop()
+	}
+	s.closeConns()
+}
+
+func (s *Sharder) closeConns() {
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *Sharder) slot(farmerId string) uint32 {
+	return Slot(farmerId, s.cfg.Slots)
+}
+
+// acquire farmer's slot for a request, nil release and a redirect error if another supervisor owns it
+func (s *Sharder) acquire(farmerId string) (release func(), redirect *pb.Error, err error) {
+	slot := s.slot(farmerId)
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.moving[slot] {
+		return nil, nil, grpc.Errorf(codes.Unavailable, "%v, try again later", ErrSlotMoving)
+	}
+	if owner, _ := s.smap.Owner(slot); owner != s.cfg.ID {
+		addr := s.cfg.Nodes[owner]
+		return nil, pb.NewWrongShardError(addr, "farmer(%s) of slot %d is served by supervisor %s at %s", farmerId, slot, owner, addr), nil
+	}
+
+	s.serving[slot]++
+	return func() {
+		s.l.Lock()
+		if s.serving[slot]--; s.serving[slot] == 0 {
+			s.cond.Broadcast()
+		}
+		s.l.Unlock()
+	}, nil, nil
+}
+
+// MoveShard hands farmers of slot over to supervisor to, their requests are asked to try again later meanwhile,
+// records of the farmers are pushed to it, and dropped here once it takes the slot over.
+// a move broken after the last batch may have handed the slot over, moving it again finishes it
+func (s *Sharder) MoveShard(ctx context.Context, slot uint32, to string) (farmers, records int, err error) {
+	peer, ok := s.peers[to]
+	if !ok {
+		return 0, 0, fmt.Errorf("supervisor/shard: %s is not a peer", to)
+	}
+	if int(slot) >= s.cfg.Slots {
+		return 0, 0, fmt.Errorf("supervisor/shard: no slot %d, %d slots in all", slot, s.cfg.Slots)
+	}
+
+	s.l.Lock()
+	if owner, _ := s.smap.Owner(slot); owner != s.cfg.ID {
+		s.l.Unlock()
+		return 0, 0, fmt.Errorf("supervisor/shard: slot %d is owned by %s", slot, owner)
+	}
+	if s.moving[slot] {
+		s.l.Unlock()
+		return 0, 0, ErrSlotMoving
+	}
+	s.moving[slot] = true
+	for s.serving[slot] > 0 {
+		s.cond.Wait()
+	}
+	s.l.Unlock()
+	defer func() {
+		s.l.Lock()
+		delete(s.moving, slot)
+		s.l.Unlock()
+	}()
+
+	inSlot := func(farmerId string) bool {
+		return s.slot(farmerId) == slot
+	}
+	s.ctr.DropHandlers(inSlot)
+
+	// the snapshot sees every account changed before handlers dropped
+	snap, err := s.ctr.Snapshot()
+	if err != nil {
+		s.ctr.RestoreHandlers(inSlot)
+		return 0, 0, err
+	}
+	_, epoch := s.smap.Owner(slot)
+	epoch++
+	sent, farmerIds, err := s.sendSlot(ctx, peer, snap, slot, epoch, inSlot)
+	snap.Release()
+	if err != nil {
+		s.ctr.RestoreHandlers(inSlot)
+		return 0, 0, fmt.Errorf("supervisor/shard: hand slot %d over to %s err: %v", slot, to, err)
+	}
+
+	if err := s.smap.set(slot, to, epoch); err != nil {
+		return 0, 0, err
+	}
+	for _, record := range sent {
+		if err := s.storage.DelCF(record.Cf, record.Key); err != nil {
+			logger.Errorf("delete record of slot %d handed over err: %v", slot, err)
+		}
+	}
+	// a handler put back by a check running while the slot was handed over
+	s.ctr.DropHandlers(inSlot)
+	logger.Infof("slot %d handed over to %s at epoch %d, %d farmers, %d records", slot, to, epoch, len(farmerIds), len(sent))
+
+	return len(farmerIds), len(sent), nil
+}
+
+// push records of farmers in slot to peer in batches, the last one hands the slot over
+func (s *Sharder) sendSlot(ctx context.Context, peer pb.SupervisorShardClient, snap store.Snapshot, slot uint32, epoch uint64, inSlot func(string) bool) ([]*pb.ShardRecord, map[string]bool, error) {
+	var sent, batch []*pb.ShardRecord
+	farmerIds := make(map[string]bool)
+	send := func(done bool) error {
+		rsp, err := peer.ReceiveShard(ctx, &pb.ShardRecordsReq{
+			Slot:    slot,
+			Epoch:   epoch,
+			From:    s.cfg.ID,
+			Records: batch,
+			Done:    done,
+		})
+		if err != nil {
+			return err
+		}
+		if !rsp.Error.OK() {
+			return rsp.Error
+		}
+		sent = append(sent, batch...)
+		batch = nil
+		return nil
+	}
+
+	for _, cf := range account.FarmerColumnFamilies {
+		var sendErr error
+		err := snap.IterateCF(cf, func(key, value []byte) bool {
+			farmerId, ok := account.RecordFarmer(cf, key)
+			if !ok || !inSlot(farmerId) {
+				return true
+			}
+			farmerIds[farmerId] = true
+			batch = append(batch, &pb.ShardRecord{Cf: cf, Key: key, Value: value})
+			if len(batch) == max_batch_records {
+				sendErr = send(false)
+			}
+			return sendErr == nil
+		})
+		if err == nil {
+			err = sendErr
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return sent, farmerIds, send(true)
+}
+
+// ReceiveShard takes records of a slot being handed over, and the slot itself with the last batch,
+// the sender is the peer its certificate tells
+func (s *Sharder) ReceiveShard(ctx context.Context, req *pb.ShardRecordsReq) (*pb.ShardRecordsRsp, error) {
+	rsp := &pb.ShardRecordsRsp{
+		Error: pb.ResponseOK(),
+	}
+	from := mtls.PeerName(ctx)
+	if _, ok := s.peers[from]; !ok {
+		rsp.Error = pb.NewErrorf(pb.ErrorType_INVALID_PARAM, "%q is not a peer", from)
+		return rsp, nil
+	}
+	if req.From != from {
+		rsp.Error = pb.NewErrorf(pb.ErrorType_INVALID_PARAM, "%s sends as %s", from, req.From)
+		return rsp, nil
+	}
+	if int(req.Slot) >= s.cfg.Slots {
+		rsp.Error = pb.NewErrorf(pb.ErrorType_INVALID_PARAM, "no slot %d, %d slots in all", req.Slot, s.cfg.Slots)
+		return rsp, nil
+	}
+
+	s.receiveL.Lock()
+	defer s.receiveL.Unlock()
+
+	owner, epoch := s.smap.Owner(req.Slot)
+	switch {
+	case owner == s.cfg.ID && req.Epoch == epoch:
+		// the sender didn't hear the slot was taken over, records here may have changed since
+		return rsp, nil
+	case owner == s.cfg.ID || req.Epoch <= epoch:
+		rsp.Error = pb.NewErrorf(pb.ErrorType_INVALID_PARAM, "slot %d is owned by %s at epoch %d", req.Slot, owner, epoch)
+		return rsp, nil
+	}
+
+	r := s.receiving[req.Slot]
+	if r == nil || r.from != from || r.epoch != req.Epoch {
+		r = &receiving{from: from, epoch: req.Epoch}
+		s.receiving[req.Slot] = r
+	}
+	for _, record := range req.Records {
+		farmerId, ok := account.RecordFarmer(record.Cf, record.Key)
+		if !ok || s.slot(farmerId) != req.Slot {
+			rsp.Error = pb.NewErrorf(pb.ErrorType_INVALID_PARAM, "record %q of %s isn't of slot %d", record.Key, record.Cf, req.Slot)
+			return rsp, nil
+		}
+		if err := s.storage.SetCF(record.Cf, record.Key, record.Value); err != nil {
+			rsp.Error = pb.NewError(pb.ErrorType_INTERNAL_ERROR, err.Error())
+			return rsp, nil
+		}
+		r.records++
+	}
+	rsp.Records = uint32(r.records)
+	if !req.Done {
+		return rsp, nil
+	}
+
+	if err := s.smap.set(req.Slot, s.cfg.ID, req.Epoch); err != nil {
+		rsp.Error = pb.NewError(pb.ErrorType_INTERNAL_ERROR, err.Error())
+		return rsp, nil
+	}
+	delete(s.receiving, req.Slot)
+	restored := s.ctr.RestoreHandlers(func(farmerId string) bool {
+		return s.slot(farmerId) == req.Slot
+	})
+	logger.Infof("slot %d taken over from %s at epoch %d, %d records, %d handlers restored", req.Slot, from, req.Epoch, r.records, restored)
+
+	return rsp, nil
+}